@@ -2,6 +2,7 @@ package main
 
 import (
 	"crypto/rsa"
+	"crypto/x509"
 	"encoding/pem"
 	"fmt"
 	"github.com/goidp/config"
@@ -29,14 +30,159 @@ func main() {
 	if err != nil {
 		log.Fatalf("failed to parse provided timezone: %s", err.Error())
 	}
-	if err := models.SetupAutomaticDeletion(db, envC.DB.CleanupPeriod, location, envC.DB.MaxEventsNumber); err != nil {
+	if err := models.SetupAutomaticDeletion(db, envC.DB.CleanupPeriod, location, envC.DB.MaxEventsNumber, envC.DB.UserRetentionPeriod); err != nil {
 		log.Fatalf("failed to set-up automatic deletion cronjob for db events: %s", err.Error())
 	}
 	a := controllers.NewApp(db, c)
+	if envC.LDAP.Enabled {
+		a.Backends = append(a.Backends, newLDAPBackend(envC.LDAP, a.Users))
+	}
+	if envC.OIDC.Enabled {
+		a.OIDC = newOIDCBroker(envC.OIDC)
+	}
+	if envC.SAML.Enabled {
+		if err := a.SetupSAML(newSAMLConfig(envC.SAML)); err != nil {
+			log.Fatalf("failed to set-up SAML: %s", err.Error())
+		}
+	}
+	if envC.SMTP.Enabled {
+		a.Mailer = newSMTPMailer(envC.SMTP)
+	}
+	if envC.App.TLSCertFile != "" {
+		err := a.SetupTLS(&controllers.TLSConfig{
+			CertFile:          envC.App.TLSCertFile,
+			KeyFile:           envC.App.TLSKeyFile,
+			ClientCAFile:      envC.App.TLSClientCAFile,
+			RequireClientCert: envC.App.TLSRequireClientCert,
+			ReloadInterval:    envC.App.TLSReloadInterval,
+		})
+		if err != nil {
+			log.Fatalf("failed to set-up TLS: %s", err.Error())
+		}
+	}
 	a.AddDefaultUserAndRoles()
+	// the break-glass account is set up once the default user exists, its username cannot be taken
+	if envC.App.BreakGlassEnabled {
+		err := a.SetupBreakGlass(&controllers.BreakGlassConfig{
+			File:         envC.App.BreakGlassFile,
+			RateInterval: envC.App.BreakGlassRateInterval,
+		})
+		if err != nil {
+			log.Fatalf("failed to set-up break-glass account: %s", err.Error())
+		}
+	}
+	// keys mounted in the legacy keys directory are imported once into the trusted issuers registry
+	a.ImportTrustedKeys(controllers.ReadTrustedKeys(envC.JWT.PublicKeysPath), envC.JWT.PublicKeysRoleCeiling)
+	if err := a.ReloadTrustedIssuers(); err != nil {
+		log.Fatalf("failed to load trusted issuers: %s", err.Error())
+	}
+	if err := a.SetupTrustedIssuersReload(envC.JWT.IssuersReloadInterval); err != nil {
+		log.Fatalf("failed to set-up trusted issuers reload: %s", err.Error())
+	}
 	a.Run()
 }
 
+func newLDAPBackend(lC *config.LDAPConfig, users models.ShadowUserProvisioner) *models.LDAPBackend {
+	bindPassword := lC.BindPassword
+	if bindPassword == "" && lC.BindPasswordFile != "" {
+		data, err := ioutil.ReadFile(lC.BindPasswordFile)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Fatalf("unable to read LDAP bind password file")
+		}
+		bindPassword = strings.Trim(string(data), "\n\t ")
+	}
+	groupRoles, err := models.ParseLDAPGroupRoles(lC.GroupRoles)
+	if err != nil {
+		log.Fatalf("failed to parse LDAP group roles: %s", err.Error())
+	}
+	b := &models.LDAPBackend{
+		URL:                lC.URL,
+		StartTLS:           lC.StartTLS,
+		InsecureSkipVerify: lC.InsecureSkipVerify,
+		Timeout:            lC.Timeout,
+		BindDN:             lC.BindDN,
+		BindPassword:       bindPassword,
+		BaseDN:             lC.BaseDN,
+		UserFilter:         lC.UserFilter,
+		GroupAttribute:     lC.GroupAttribute,
+		GroupRoles:         groupRoles,
+	}
+	if lC.JITProvisioning {
+		b.Users = users
+	}
+	return b
+}
+
+func newSMTPMailer(sC *config.SMTPConfig) *controllers.SMTPMailer {
+	password := sC.Password
+	if password == "" && sC.PasswordFile != "" {
+		data, err := ioutil.ReadFile(sC.PasswordFile)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Fatalf("unable to read SMTP password file")
+		}
+		password = strings.Trim(string(data), "\n\t ")
+	}
+	return &controllers.SMTPMailer{
+		Host:     sC.Host,
+		Port:     sC.Port,
+		Username: sC.Username,
+		Password: password,
+		From:     sC.From,
+	}
+}
+
+func newOIDCBroker(oC *config.OIDCConfig) *controllers.OIDCBroker {
+	clientSecret := oC.ClientSecret
+	if clientSecret == "" && oC.ClientSecretFile != "" {
+		data, err := ioutil.ReadFile(oC.ClientSecretFile)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Fatalf("unable to read OIDC client secret file")
+		}
+		clientSecret = strings.Trim(string(data), "\n\t ")
+	}
+	roleRules, err := controllers.ParseRoleRules(oC.RoleRules)
+	if err != nil {
+		log.Fatalf("failed to parse OIDC role rules: %s", err.Error())
+	}
+	return &controllers.OIDCBroker{
+		Issuer:        oC.Issuer,
+		ClientID:      oC.ClientID,
+		ClientSecret:  clientSecret,
+		RedirectURL:   oC.RedirectURL,
+		Scopes:        oC.Scopes,
+		UsernameClaim: oC.UsernameClaim,
+		RoleRules:     roleRules,
+		Provision:     oC.Provision,
+	}
+}
+
+func newSAMLConfig(sC *config.SAMLConfig) *controllers.SAMLConfig {
+	roleRules, err := controllers.ParseRoleRules(sC.RoleRules)
+	if err != nil {
+		log.Fatalf("failed to parse SAML role rules: %s", err.Error())
+	}
+	c := controllers.SAMLConfig{
+		BaseURL:           sC.BaseURL,
+		ServiceProviders:  controllers.ReadSAMLServiceProviders(sC.ServiceProvidersPath),
+		UsernameAttribute: sC.UsernameAttribute,
+		RoleRules:         roleRules,
+		Provision:         sC.Provision,
+	}
+	if sC.IDPMetadata != "" {
+		c.IDPMetadata, err = controllers.ReadSAMLMetadata(sC.IDPMetadata)
+		if err != nil {
+			log.Fatalf("failed to read SAML identity provider metadata: %s", err.Error())
+		}
+	}
+	return &c
+}
+
 func buildDBConnectionParameters(dbC *config.DBConfig) (string, logger.Interface) {
 	var password string
 	if dbC.Pass == "" {
@@ -71,6 +217,7 @@ func buildDBConnectionParameters(dbC *config.DBConfig) (string, logger.Interface
 func newControllersConfiguration(c *config.EnvConfigurations) *controllers.Config {
 	var verifyKey *rsa.PublicKey
 	var signKey *rsa.PrivateKey
+	var certificate *x509.Certificate
 	var secret string
 
 	// Utility function to read a file from the FS if it exists, returns the passed
@@ -114,6 +261,10 @@ func newControllersConfiguration(c *config.EnvConfigurations) *controllers.Confi
 		if err != nil {
 			log.Fatalf("error when extracting keys: %s", err)
 		}
+		if x509PublicKey {
+			// the certificate is published as is in the SAML metadata
+			certificate, _ = x509.ParseCertificate(pubKeyData.Bytes)
+		}
 	} else {
 		secret = string(readIfFileFunction(c.JWT.Secret))
 	}
@@ -121,7 +272,9 @@ func newControllersConfiguration(c *config.EnvConfigurations) *controllers.Confi
 	if c.JWT.Refresh {
 		renewTokenExpireTime = c.JWT.RefreshExpireTime
 	}
-	pKeys := controllers.ReadPublicKeys(c.JWT.PublicKeysPath)
+	if p := c.JWT.SessionLimitPolicy; !strings.EqualFold(p, "reject") && !strings.EqualFold(p, "evict") {
+		log.Fatalf("invalid session limit policy %s, expected reject or evict", p)
+	}
 	cC := controllers.Config{
 		LogLevel:              c.App.LogLevel,
 		WriteTimeout:          c.App.WriteTimeout,
@@ -132,9 +285,26 @@ func newControllersConfiguration(c *config.EnvConfigurations) *controllers.Confi
 		Secret:                secret,
 		SignKey:               signKey,
 		VerifyKey:             verifyKey,
+		Certificate:           certificate,
 		AccessTokenExpireTime: c.JWT.AccessExpireTime,
 		RenewTokenExpireTime:  renewTokenExpireTime,
-		TrustedPublicKeys:     pKeys,
+		Audience:              c.JWT.Audience,
+		RequireAudience:       c.JWT.RequireAudience,
+		DeviceCodeExpireTime:  c.JWT.DeviceCodeExpireTime,
+		DevicePollInterval:    c.JWT.DevicePollInterval,
+		DPoPProofMaxAge:       c.JWT.DPoPProofMaxAge,
+		SessionLifetime:       c.JWT.SessionLifetime,
+		SessionIdleTimeout:    c.JWT.SessionIdleTimeout,
+		MaxSessions:           c.JWT.MaxSessions,
+		EvictOldestSession:    strings.EqualFold(c.JWT.SessionLimitPolicy, "evict"),
+
+		PersonalAccessTokenMaxLifetime: c.JWT.PATMaxLifetime,
+		ImpersonationExpireTime:        c.JWT.ImpersonationExpireTime,
+		AllowAdminImpersonation:        c.JWT.AllowAdminImpersonation,
+		ElevationMaxDuration:           c.JWT.ElevationMaxDuration,
+		ProfileClaims:                  c.JWT.ProfileClaims,
+		EmailVerificationExpireTime:    c.SMTP.VerificationExpireTime,
+		EmailVerificationURL:           c.SMTP.VerificationURL,
 	}
 	return &cC
 }
@@ -9,9 +9,13 @@ import (
 )
 
 type EnvConfigurations struct {
-	DB  *DBConfig
-	JWT *JWTConfig
-	App *AppConfig
+	DB   *DBConfig
+	JWT  *JWTConfig
+	App  *AppConfig
+	LDAP *LDAPConfig
+	OIDC *OIDCConfig
+	SAML *SAMLConfig
+	SMTP *SMTPConfig
 }
 
 func NewEnvConfigurations() *EnvConfigurations {
@@ -24,6 +28,10 @@ func (eC *EnvConfigurations) LoadEnvConfigurations() {
 	var jC JWTConfig
 	var dbC DBConfig
 	var appC AppConfig
+	var ldapC LDAPConfig
+	var oidcC OIDCConfig
+	var samlC SAMLConfig
+	var smtpC SMTPConfig
 
 	err := envconfig.Process("jwt", &jC)
 	if err != nil {
@@ -42,6 +50,30 @@ func (eC *EnvConfigurations) LoadEnvConfigurations() {
 		log.Fatal(err.Error())
 	}
 	eC.App = &appC
+
+	err = envconfig.Process("ldap", &ldapC)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	eC.LDAP = &ldapC
+
+	err = envconfig.Process("oidc", &oidcC)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	eC.OIDC = &oidcC
+
+	err = envconfig.Process("saml", &samlC)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	eC.SAML = &samlC
+
+	err = envconfig.Process("smtp", &smtpC)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	eC.SMTP = &smtpC
 }
 
 type AppConfig struct {
@@ -51,6 +83,17 @@ type AppConfig struct {
 	ReadTimeout  int    `default:"15" split_words:"true"`
 	IdleTimeout  int    `default:"60" split_words:"true"`
 	LogLevel     string `default:"debug" split_words:"true"`
+	// TLS is terminated by goidp if TLSCertFile is set, client certificates are verified if TLSClientCAFile is set
+	TLSCertFile          string        `default:"" envconfig:"tls_cert_file"`
+	TLSKeyFile           string        `default:"" envconfig:"tls_key_file"`
+	TLSClientCAFile      string        `default:"" envconfig:"tls_client_ca_file"`
+	TLSRequireClientCert bool          `default:"false" envconfig:"tls_require_client_cert"`
+	TLSReloadInterval    time.Duration `default:"1m" envconfig:"tls_reload_interval"`
+	// BreakGlassEnabled enables the emergency administrator account read from BreakGlassFile, which
+	// logs in even when the DB is unreachable
+	BreakGlassEnabled      bool          `default:"false" split_words:"true"`
+	BreakGlassFile         string        `default:"/run/secrets/break_glass" split_words:"true"`
+	BreakGlassRateInterval time.Duration `default:"1m" split_words:"true"`
 }
 
 type DBConfig struct {
@@ -67,6 +110,8 @@ type DBConfig struct {
 	ShowSql         bool   `default:"true" split_words:"true"`
 	CleanupPeriod   string `default:"0 2 * * *" split_words:"true"`
 	MaxEventsNumber int64  `default:"100" split_words:"true"`
+	// UserRetentionPeriod is the period after which the deleted users are purged, never if 0
+	UserRetentionPeriod time.Duration `default:"720h" split_words:"true"`
 }
 
 type JWTConfig struct {
@@ -78,4 +123,80 @@ type JWTConfig struct {
 	UseKey            bool          `default:"True"`
 	Secret            string        `default:""`
 	PublicKeysPath    string        `default:"/run/pubkeys" split_words:"true"`
+	// PublicKeysRoleCeiling lists the highest roles the issuers imported from PublicKeysPath can grant
+	PublicKeysRoleCeiling []string `default:"MONITOR" split_words:"true"`
+	// IssuersReloadInterval is the period after which the trusted issuers registry is reloaded from DB
+	IssuersReloadInterval time.Duration `default:"1m" split_words:"true"`
+	Audience              string        `default:"goidp"`
+	RequireAudience       bool          `default:"false" split_words:"true"`
+	DeviceCodeExpireTime  time.Duration `default:"10m" split_words:"true"`
+	DevicePollInterval    time.Duration `default:"5s" split_words:"true"`
+	DPoPProofMaxAge       time.Duration `default:"1m" envconfig:"DPOP_PROOF_MAX_AGE"`
+	SessionLifetime       time.Duration `default:"0s" split_words:"true"`
+	SessionIdleTimeout    time.Duration `default:"0s" split_words:"true"`
+	// MaxSessions is the list of role:limit pairs, e.g. ADMIN:1,HELPDESK:2
+	MaxSessions        map[string]int `default:"" split_words:"true"`
+	SessionLimitPolicy string         `default:"reject" split_words:"true"`
+	PATMaxLifetime     time.Duration  `default:"8760h" envconfig:"pat_max_lifetime"`
+	// ImpersonationExpireTime is the lifetime of the tokens issued to the administrators impersonating a user
+	ImpersonationExpireTime time.Duration `default:"15m" split_words:"true"`
+	AllowAdminImpersonation bool          `default:"false" split_words:"true"`
+	// ElevationMaxDuration is the maximum window of the just-in-time role elevations
+	ElevationMaxDuration time.Duration `default:"8h" split_words:"true"`
+	// ProfileClaims maps the core profile of the users into the claims of their tokens
+	ProfileClaims bool `default:"false" split_words:"true"`
+}
+
+type LDAPConfig struct {
+	Enabled            bool          `default:"false"`
+	URL                string        `default:"ldap://localhost:389"`
+	StartTLS           bool          `default:"false" split_words:"true"`
+	InsecureSkipVerify bool          `default:"false" split_words:"true"`
+	Timeout            time.Duration `default:"10s"`
+	BindDN             string        `default:"" envconfig:"bind_dn"`
+	BindPassword       string        `default:"" split_words:"true"`
+	BindPasswordFile   string        `default:"" split_words:"true"`
+	BaseDN             string        `default:"" envconfig:"base_dn"`
+	UserFilter         string        `default:"(uid=%s)" split_words:"true"`
+	GroupAttribute     string        `default:"memberOf" split_words:"true"`
+	GroupRoles         string        `default:"" split_words:"true"`
+	JITProvisioning    bool          `default:"true" envconfig:"jit_provisioning"`
+}
+
+type OIDCConfig struct {
+	Enabled          bool   `default:"false"`
+	Issuer           string `default:""`
+	ClientID         string `default:"" envconfig:"client_id"`
+	ClientSecret     string `default:"" split_words:"true"`
+	ClientSecretFile string `default:"" split_words:"true"`
+	RedirectURL      string `default:"" envconfig:"redirect_url"`
+	Scopes           string `default:"openid profile email"`
+	UsernameClaim    string `default:"preferred_username" split_words:"true"`
+	RoleRules        string `default:"" split_words:"true"`
+	Provision        bool   `default:"true"`
+}
+
+type SAMLConfig struct {
+	Enabled              bool   `default:"false"`
+	BaseURL              string `default:"" envconfig:"base_url"`
+	ServiceProvidersPath string `default:"/run/saml/sp" split_words:"true"`
+	IDPMetadata          string `default:"" envconfig:"idp_metadata"`
+	UsernameAttribute    string `default:"uid" split_words:"true"`
+	RoleRules            string `default:"" split_words:"true"`
+	Provision            bool   `default:"true"`
+}
+
+// SMTPConfig configures the SMTP relay delivering the emails to the users, the emails of the users are
+// verified only if enabled
+type SMTPConfig struct {
+	Enabled      bool   `default:"false"`
+	Host         string `default:"localhost"`
+	Port         string `default:"25"`
+	Username     string `default:""`
+	Password     string `default:""`
+	PasswordFile string `default:"" split_words:"true"`
+	From         string `default:"idp@localhost"`
+	// VerificationURL is the page the email verification links point to, the goidp endpoint if empty
+	VerificationURL        string        `default:"" envconfig:"verification_url"`
+	VerificationExpireTime time.Duration `default:"24h" split_words:"true"`
 }
@@ -3,6 +3,7 @@ package controllers
 import (
 	"context"
 	"crypto/rsa"
+	"crypto/x509"
 	"fmt"
 	"github.com/goidp/models"
 	"net/http"
@@ -13,6 +14,7 @@ import (
 
 	"gorm.io/gorm"
 
+	"github.com/crewjam/saml"
 	"github.com/gorilla/mux"
 	_ "github.com/joho/godotenv/autoload"
 	log "github.com/sirupsen/logrus"
@@ -37,28 +39,127 @@ type App struct {
 		CreateSuccessfulLoginEvent(username, domain, ip string) error
 		CreateUserEvent(method, username, domain string) error
 		CreateJWTEvent(username, domain string) error
+		CreateTokenExchangeEvent(username, actor, domain string) error
+		CreateSessionTerminatedEvent(username, domain string, count int64) error
+		CreatePersonalAccessTokenEvent(method, username, name string) error
+		CreateServiceAccountEvent(method, name string) error
+		CreateImpersonationEvent(username, actor, reason string) error
+		CreateImpersonatedWriteEvent(username, actor, method, path string) error
+		CreateElevationEvent(elevation *models.Elevation, actor string) error
+		CreateBreakGlassEvent(username, ip string, at time.Time) error
+		CreateUserStatusEvent(username, from, to, actor string) error
+		CreateUserRestoreEvent(username string) error
+		CreateAttributeDefinitionEvent(method, name, actor string) error
+		CreateEmailVerifiedEvent(username, email string) error
 	}
 	Users interface {
 		Create(u *models.User) error
 		ValidateUsername(u string) error
-		UpdateUserByNameOrID(nameOrID, username, password string, roles []string) (*models.User, error)
+		Reserve(username string)
+		ValidateEmail(email string, id uint) error
+		PatchUser(u *models.User, p *models.UserPatch) error
 		UpdateUser(u *models.User) error
+		UpdateUserStatus(u *models.User) error
+		UpdateUserProfile(u *models.User) error
 		GetUserByNameOrID(nameOrID string) (*models.User, error)
+		GetUserByVerifiedEmail(email string) (*models.User, error)
 		GetUsers() ([]*models.User, error)
 		GetUsersID() []uint
+		FindUsers(q *models.UserQuery) ([]*models.User, int64, error)
 		DeleteUser(user *models.User) (err error)
 		DeleteUserByID(id int) error
 		DeleteUserByName(name string) error
 		DeleteUserByNameOrID(nameOrID string) error
 		DeleteAllUsers() error
+		RestoreUserByNameOrID(nameOrID string) (*models.User, error)
 		GetAndValidateUser(username string, password string) (*models.User, bool)
+		ProvisionShadowUser(backend, subject, username string, roles models.RoleList) (*models.User, error)
+		CreateWithoutPassword(u *models.User) error
 		AddDefaultUser()
 	}
 	Roles interface {
 		AddDefaultRoles()
 	}
-	extUsers map[string]models.RoleList
-	config   *Config
+	TrustedIssuers interface {
+		Create(t *models.TrustedIssuer) error
+		Import(t *models.TrustedIssuer) (bool, error)
+		GetTrustedIssuers() ([]*models.TrustedIssuer, error)
+		GetTrustedIssuer(id string) (*models.TrustedIssuer, error)
+		UpdateTrustedIssuer(t *models.TrustedIssuer) error
+		DeleteTrustedIssuer(t *models.TrustedIssuer) error
+	}
+	ExternalIdentities interface {
+		Record(issuer, subject, username string, roles models.RoleList) (*models.ExternalIdentity, error)
+		GetExternalIdentityByID(id string) (*models.ExternalIdentity, error)
+		GetExternalIdentities() ([]*models.ExternalIdentity, error)
+		TouchExternalIdentity(e *models.ExternalIdentity) error
+		DeleteExternalIdentity(e *models.ExternalIdentity) error
+	}
+	Sessions interface {
+		Create(s *models.Session) error
+		CreateWithinLimit(s *models.Session, admit func([]*models.Session) ([]*models.Session, error)) (int64, error)
+		GetSession(sid string) (*models.Session, error)
+		GetUserSessions(o models.SessionOwner) ([]*models.Session, error)
+		TouchSession(s *models.Session) error
+		DeleteSession(s *models.Session) error
+		DeleteUserSessions(o models.SessionOwner) (int64, error)
+	}
+	PersonalAccessTokens interface {
+		Create(p *models.PersonalAccessToken) error
+		GetPersonalAccessToken(token string) (*models.PersonalAccessToken, error)
+		GetUserPersonalAccessToken(username, id string) (*models.PersonalAccessToken, error)
+		GetUserPersonalAccessTokens(username string) ([]*models.PersonalAccessToken, error)
+		TouchPersonalAccessToken(p *models.PersonalAccessToken) error
+		DeletePersonalAccessToken(p *models.PersonalAccessToken) error
+	}
+	ServiceAccounts interface {
+		Create(s *models.ServiceAccount) error
+		GetServiceAccounts() ([]*models.ServiceAccount, error)
+		GetServiceAccount(nameOrID string) (*models.ServiceAccount, error)
+		GetServiceAccountByName(name string) (*models.ServiceAccount, error)
+		UpdateServiceAccount(s *models.ServiceAccount) error
+		DeleteServiceAccount(s *models.ServiceAccount) error
+	}
+	Elevations interface {
+		Create(e *models.Elevation) error
+		GetElevation(id string) (*models.Elevation, error)
+		GetElevations(username string) ([]*models.Elevation, error)
+		GetAllElevations() ([]*models.Elevation, error)
+		GetActiveElevations(username string) ([]*models.Elevation, error)
+		DecideElevation(e *models.Elevation) error
+	}
+	Attributes interface {
+		Create(d *models.AttributeDefinition) error
+		GetAttributeDefinitions() ([]*models.AttributeDefinition, error)
+		GetAttributeDefinition(nameOrID string) (*models.AttributeDefinition, error)
+		UpdateAttributeDefinition(d *models.AttributeDefinition) error
+		DeleteAttributeDefinition(d *models.AttributeDefinition) error
+	}
+	// Nonces record the single use credentials, the DPoP proofs and the client assertions, received
+	// by any replica
+	Nonces interface {
+		Use(jti string, expire time.Time) (bool, error)
+	}
+	DeviceAuthorizations interface {
+		Create(d *models.DeviceAuthorization) error
+		GetDeviceAuthorizationByUserCode(userCode string) (*models.DeviceAuthorization, error)
+		GetDeviceAuthorizationByDeviceCode(deviceCode string) (*models.DeviceAuthorization, error)
+		UpdateDeviceAuthorization(d *models.DeviceAuthorization) error
+		DeleteDeviceAuthorization(d *models.DeviceAuthorization) error
+	}
+	// Backends are the external authentication backends checked, in order, when the
+	// credentials do not match any local user
+	Backends models.AuthBackendChain
+	// OIDC is the upstream OpenID Connect provider the login can be delegated to
+	OIDC *OIDCBroker
+	// Mailer delivers the emails to the users, the emails are not verified if nil
+	Mailer  Mailer
+	issuers *issuerRegistry
+	samlIdP *saml.IdentityProvider
+	samlSP  *samlServiceProvider
+	// breakGlass is the emergency account, if enabled
+	breakGlass *breakGlass
+	config     *Config
 }
 
 type Config struct {
@@ -71,9 +172,45 @@ type Config struct {
 	Secret                string
 	SignKey               *rsa.PrivateKey
 	VerifyKey             *rsa.PublicKey
+	Certificate           *x509.Certificate
 	AccessTokenExpireTime time.Duration
 	RenewTokenExpireTime  time.Duration
-	TrustedPublicKeys     []*rsa.PublicKey
+	// Audience identifies goidp in the aud claim, the tokens meant for other services are rejected
+	Audience string
+	// RequireAudience rejects the tokens without aud claim
+	RequireAudience bool
+	// DeviceCodeExpireTime and DevicePollInterval configure the device authorization grant
+	DeviceCodeExpireTime time.Duration
+	DevicePollInterval   time.Duration
+	// DPoPProofMaxAge is the maximum age of the DPoP proofs, the proofs are remembered as long to detect replays
+	DPoPProofMaxAge time.Duration
+	// SessionLifetime is the absolute lifetime of the sessions, the renew token lifetime if 0
+	SessionLifetime time.Duration
+	// SessionIdleTimeout terminates the sessions not renewed for longer, the sessions never expire for
+	// inactivity if 0
+	SessionIdleTimeout time.Duration
+	// MaxSessions is the maximum number of concurrent sessions of the users by role, the lowest limit of
+	// the user roles applies and the roles without limit allow any number of sessions
+	MaxSessions map[string]int
+	// EvictOldestSession terminates the oldest sessions of the users who reached their limit, instead of
+	// rejecting the new login
+	EvictOldestSession bool
+	// PersonalAccessTokenMaxLifetime is the maximum lifetime of the personal access tokens
+	PersonalAccessTokenMaxLifetime time.Duration
+	// ImpersonationExpireTime is the lifetime of the impersonation tokens, which are never renewed
+	ImpersonationExpireTime time.Duration
+	// AllowAdminImpersonation lets the administrators impersonate the other administrators
+	AllowAdminImpersonation bool
+	// ElevationMaxDuration is the maximum window of the elevations requested by the users
+	ElevationMaxDuration time.Duration
+	// EmailVerificationExpireTime is the lifetime of the links verifying the emails of the users
+	EmailVerificationExpireTime time.Duration
+	// EmailVerificationURL is the page the verification links point to, the token is added as token
+	// parameter; the links point to the verification endpoint if empty
+	EmailVerificationURL string
+	// ProfileClaims maps the core profile of the users into the name, email, phone_number, locale and team
+	// claims of their tokens, the custom attributes are mapped by their definitions
+	ProfileClaims bool
 }
 
 func (a *App) setRouters() {
@@ -83,25 +220,109 @@ func (a *App) setRouters() {
 	baseURL := fmt.Sprintf("/%s", ApiVersion)
 	base := a.router.PathPrefix(baseURL).Subrouter()
 	base.HandleFunc("/session", a.SessionHandler).Methods(http.MethodPost, http.MethodDelete)
+	impersonationRouter := base.PathPrefix("/session/impersonate").Subrouter()
+	impersonationRouter.Use(func(next http.Handler) http.Handler {
+		return a.adminMiddleware(next, "session")
+	})
+	impersonationRouter.HandleFunc("", a.ImpersonationHandler).Methods(http.MethodPost)
+	base.HandleFunc("/email/verify", a.VerifyEmailHandler).Methods(http.MethodGet, http.MethodPost)
 	base.HandleFunc("/renew", a.RenewTokenHandler).Methods(http.MethodPost)
+	base.HandleFunc("/token", a.TokenHandler).Methods(http.MethodPost)
+	base.HandleFunc("/device/code", a.DeviceAuthorizationHandler).Methods(http.MethodPost)
+	base.HandleFunc("/device", a.DeviceVerificationHandler).Methods(http.MethodGet, http.MethodPost)
+	base.HandleFunc("/oidc/login", a.OIDCLoginHandler).Methods(http.MethodGet)
+	base.HandleFunc("/oidc/callback", a.OIDCCallbackHandler).Methods(http.MethodGet)
+	base.HandleFunc("/saml/idp/metadata", a.SAMLIdPMetadataHandler).Methods(http.MethodGet)
+	base.HandleFunc("/saml/idp/sso", a.SAMLIdPSSOHandler).Methods(http.MethodGet, http.MethodPost)
+	base.HandleFunc("/saml/sp/metadata", a.SAMLSPMetadataHandler).Methods(http.MethodGet)
+	base.HandleFunc("/saml/sp/login", a.SAMLSPLoginHandler).Methods(http.MethodGet)
+	base.HandleFunc("/saml/sp/acs", a.SAMLSPACSHandler).Methods(http.MethodPost)
+
+	// the personal access tokens are created by their owner, listed and revoked by the administrators as well
+	tokenRouter := base.PathPrefix("/user/{id}/token").Subrouter()
+	tokenRouter.Use(func(next http.Handler) http.Handler {
+		return a.jwtMiddleware(next, "token")
+	})
+	tokenRouter.HandleFunc("", a.PersonalAccessTokensHandler).Methods(http.MethodGet, http.MethodPost)
+	tokenRouter.HandleFunc("/{tid}", a.PersonalAccessTokenHandler).Methods(http.MethodDelete)
+
+	// the verification of the email is requested by the user as well as by the administrators
+	emailRouter := base.PathPrefix("/user/{id}/email").Subrouter()
+	emailRouter.Use(func(next http.Handler) http.Handler {
+		return a.jwtMiddleware(next, "email")
+	})
+	emailRouter.HandleFunc("/verification", a.EmailVerificationHandler).Methods(http.MethodPost)
+
 	usersRouter := base.PathPrefix("/user").Subrouter()
 
 	usersRouter.Use(func(next http.Handler) http.Handler {
-		return a.jwtMiddleware(next)
+		return a.jwtMiddleware(next, "user")
 	})
 
 	usersRouter.HandleFunc("", a.UsersHandler).Methods(http.MethodGet, http.MethodPost)
 	usersRouter.HandleFunc("/{id}", a.UserHandler).Methods(http.MethodDelete, http.MethodPatch, http.MethodGet)
+	usersRouter.HandleFunc("/{id}/restore", a.RestoreUserHandler).Methods(http.MethodPost)
+	usersRouter.HandleFunc("/{id}/session", a.UserSessionsHandler).Methods(http.MethodGet, http.MethodDelete)
+	usersRouter.HandleFunc("/{id}/session/{sid}", a.UserSessionHandler).Methods(http.MethodDelete)
+
+	issuerRouter := base.PathPrefix("/issuer").Subrouter()
+	issuerRouter.Use(func(next http.Handler) http.Handler {
+		return a.adminMiddleware(next, "issuer")
+	})
+	issuerRouter.HandleFunc("", a.TrustedIssuersHandler).Methods(http.MethodGet, http.MethodPost)
+	issuerRouter.HandleFunc("/reload", a.ReloadTrustedIssuersHandler).Methods(http.MethodPost)
+	issuerRouter.HandleFunc("/{id}", a.TrustedIssuerHandler).Methods(http.MethodGet, http.MethodPatch, http.MethodDelete)
+
+	serviceAccountRouter := base.PathPrefix("/serviceaccount").Subrouter()
+	serviceAccountRouter.Use(func(next http.Handler) http.Handler {
+		return a.adminMiddleware(next, "serviceaccount")
+	})
+	serviceAccountRouter.HandleFunc("", a.ServiceAccountsHandler).Methods(http.MethodGet, http.MethodPost)
+	serviceAccountRouter.HandleFunc("/{id}", a.ServiceAccountHandler).Methods(http.MethodGet, http.MethodPatch, http.MethodDelete)
+
+	attributeRouter := base.PathPrefix("/attribute").Subrouter()
+	attributeRouter.Use(func(next http.Handler) http.Handler {
+		return a.adminMiddleware(next, "attribute")
+	})
+	attributeRouter.HandleFunc("", a.AttributeDefinitionsHandler).Methods(http.MethodGet, http.MethodPost)
+	attributeRouter.HandleFunc("/{id}", a.AttributeDefinitionHandler).Methods(http.MethodGet, http.MethodPatch, http.MethodDelete)
+
+	// the elevations are requested by the users and decided by the administrators
+	elevationRouter := base.PathPrefix("/elevation").Subrouter()
+	elevationRouter.Use(func(next http.Handler) http.Handler {
+		return a.jwtMiddleware(next, "elevation")
+	})
+	elevationRouter.HandleFunc("", a.ElevationsHandler).Methods(http.MethodGet, http.MethodPost)
+	elevationRouter.HandleFunc("/{id}", a.ElevationHandler).Methods(http.MethodGet, http.MethodPatch)
+
+	identityRouter := base.PathPrefix("/identity").Subrouter()
+	identityRouter.Use(func(next http.Handler) http.Handler {
+		return a.adminMiddleware(next, "identity")
+	})
+	identityRouter.HandleFunc("", a.ExternalIdentitiesHandler).Methods(http.MethodGet)
+	identityRouter.HandleFunc("/{id}", a.ExternalIdentityHandler).Methods(http.MethodGet, http.MethodDelete)
+	identityRouter.HandleFunc("/{id}/session", a.ExternalIdentitySessionsHandler).Methods(http.MethodGet, http.MethodDelete)
+	identityRouter.HandleFunc("/{id}/session/{sid}", a.ExternalIdentitySessionHandler).Methods(http.MethodDelete)
 
 	eventRouter := base.PathPrefix("/event").Subrouter()
 	eventRouter.Use(func(next http.Handler) http.Handler {
-		return a.jwtMiddleware(next)
+		return a.jwtMiddleware(next, "event")
 	})
 	eventRouter.HandleFunc("", a.EventsHandler).Methods(http.MethodGet)
 
+	scimRouter := a.router.PathPrefix(scimBasePath).Subrouter()
+	scimRouter.Use(func(next http.Handler) http.Handler {
+		return a.scimMiddleware(next)
+	})
+	scimRouter.HandleFunc("/ServiceProviderConfig", a.SCIMServiceProviderConfigHandler).Methods(http.MethodGet)
+	scimRouter.HandleFunc("/Users", a.SCIMUsersHandler).Methods(http.MethodGet, http.MethodPost)
+	scimRouter.HandleFunc("/Users/{id}", a.SCIMUserHandler).Methods(http.MethodGet, http.MethodPut, http.MethodPatch, http.MethodDelete)
+	scimRouter.HandleFunc("/Groups", a.SCIMGroupsHandler).Methods(http.MethodGet)
+	scimRouter.HandleFunc("/Groups/{id}", a.SCIMGroupHandler).Methods(http.MethodGet, http.MethodPut, http.MethodPatch)
+
 	systemRouter := base.PathPrefix("/system").Subrouter()
 	systemRouter.Use(func(next http.Handler) http.Handler {
-		return a.jwtMiddleware(next)
+		return a.jwtMiddleware(next, "system")
 	})
 	systemRouter.HandleFunc("", a.SystemHandler).Methods(http.MethodGet)
 }
@@ -137,7 +358,16 @@ func NewApp(db *gorm.DB, c *Config) *App {
 	a.Roles = &models.RoleRepo{DB: db}
 	a.Users = &models.UserRepo{DB: db}
 	a.Events = &models.EventRepo{DB: db}
-	a.extUsers = make(map[string]models.RoleList)
+	a.TrustedIssuers = &models.TrustedIssuerRepo{DB: db}
+	a.ExternalIdentities = &models.ExternalIdentityRepo{DB: db}
+	a.DeviceAuthorizations = &models.DeviceAuthorizationRepo{DB: db}
+	a.Sessions = &models.SessionRepo{DB: db}
+	a.PersonalAccessTokens = &models.PersonalAccessTokenRepo{DB: db}
+	a.ServiceAccounts = &models.ServiceAccountRepo{DB: db}
+	a.Elevations = &models.ElevationRepo{DB: db}
+	a.Attributes = &models.AttributeRepo{DB: db}
+	a.Nonces = &models.NonceRepo{DB: db}
+	a.issuers = newIssuerRegistry()
 	return &a
 }
 
@@ -154,7 +384,13 @@ func (a *App) Run() {
 	// Handle server shutdown gracefully
 	// Run our server in a goroutine so that it doesn't block.
 	go func() {
-		err := a.server.ListenAndServe()
+		var err error
+		if a.server.TLSConfig != nil {
+			// the certificate is provided by the TLS configuration
+			err = a.server.ListenAndServeTLS("", "")
+		} else {
+			err = a.server.ListenAndServe()
+		}
 		if err != nil {
 			log.WithFields(log.Fields{
 				"host":  a.server.Addr,
@@ -0,0 +1,261 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/goidp/models"
+	"net/http"
+	"strconv"
+
+	"github.com/google/jsonapi"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// AttributeResource is the jsonapi representation of a custom attribute definition
+type AttributeResource struct {
+	ID           string   `jsonapi:"primary,attribute,omitempty"`
+	Name         string   `jsonapi:"attr,name"`
+	Description  string   `jsonapi:"attr,description,omitempty"`
+	Type         string   `jsonapi:"attr,type,omitempty"`
+	Pattern      string   `jsonapi:"attr,pattern,omitempty"`
+	Values       []string `jsonapi:"attr,values,omitempty"`
+	UserEditable *bool    `jsonapi:"attr,user_editable,omitempty"`
+	InToken      *bool    `jsonapi:"attr,in_token,omitempty"`
+}
+
+func newAttributeResource(d *models.AttributeDefinition) *AttributeResource {
+	userEditable, inToken := d.UserEditable, d.InToken
+	return &AttributeResource{
+		ID:           strconv.Itoa(int(d.ID)),
+		Name:         d.Name,
+		Description:  d.Description,
+		Type:         d.Type,
+		Pattern:      d.Pattern,
+		Values:       d.Values,
+		UserEditable: &userEditable,
+		InToken:      &inToken,
+	}
+}
+
+// apply copies the provided attributes into the attribute definition, which is validated when stored
+func (aR *AttributeResource) apply(d *models.AttributeDefinition) {
+	if aR.Name != "" {
+		d.Name = aR.Name
+	}
+	if aR.Description != "" {
+		d.Description = aR.Description
+	}
+	if aR.Type != "" {
+		d.Type = aR.Type
+	}
+	if aR.Pattern != "" {
+		d.Pattern = aR.Pattern
+	}
+	if aR.Values != nil {
+		d.Values = aR.Values
+	}
+	if aR.UserEditable != nil {
+		d.UserEditable = *aR.UserEditable
+	}
+	if aR.InToken != nil {
+		d.InToken = *aR.InToken
+	}
+}
+
+// requestSubject returns the subject of the token of the request, empty if the token is not valid
+func (a *App) requestSubject(r *http.Request) string {
+	claims, err := a.getRequestClaims(parseAuthHeader(r))
+	if err != nil {
+		return ""
+	}
+	return claims.Subject
+}
+
+// AttributeDefinitionsHandler lists (GET) the custom attribute definitions or adds (POST) a new one
+func (a *App) AttributeDefinitionsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		list, err := a.Attributes.GetAttributeDefinitions()
+		if err != nil {
+			jsonapiError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		resources := make([]*AttributeResource, 0)
+		for _, d := range list {
+			resources = append(resources, newAttributeResource(d))
+		}
+		jsonapiSuccess(w, resources, http.StatusOK)
+	case http.MethodPost:
+		var requestBody AttributeResource
+		if err := jsonapi.UnmarshalPayload(r.Body, &requestBody); err != nil {
+			jsonapiError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		var d models.AttributeDefinition
+		requestBody.apply(&d)
+		switch err := a.Attributes.Create(&d).(type) {
+		case *models.UserError:
+			jsonapiError(w, http.StatusBadRequest, err.Error())
+			return
+		case *models.DBError:
+			jsonapiError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err := a.Events.CreateAttributeDefinitionEvent(r.Method, d.Name, a.requestSubject(r)); err != nil {
+			log.WithError(err).Warnf("failed to store attribute event")
+		}
+		jsonapiSuccess(w, newAttributeResource(&d), http.StatusCreated)
+	}
+}
+
+// AttributeDefinitionHandler reads (GET), updates (PATCH) or removes (DELETE) a custom attribute definition
+func (a *App) AttributeDefinitionHandler(w http.ResponseWriter, r *http.Request) {
+	d, err := a.Attributes.GetAttributeDefinition(mux.Vars(r)["id"])
+	switch err.(type) {
+	case *models.NotFoundError:
+		jsonapiError(w, http.StatusNotFound, err.Error())
+		return
+	case *models.DBError:
+		jsonapiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		jsonapiSuccess(w, newAttributeResource(d), http.StatusOK)
+		return
+	case http.MethodPatch:
+		var requestBody AttributeResource
+		if err = jsonapi.UnmarshalPayload(r.Body, &requestBody); err != nil {
+			jsonapiError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		// the name is the key of the values stored in the user profiles, it cannot change
+		if requestBody.Name != "" && requestBody.Name != d.Name {
+			jsonapiError(w, http.StatusBadRequest, "invalid attribute: name cannot be changed")
+			return
+		}
+		requestBody.apply(d)
+		err = a.Attributes.UpdateAttributeDefinition(d)
+	case http.MethodDelete:
+		err = a.Attributes.DeleteAttributeDefinition(d)
+	}
+	switch err.(type) {
+	case *models.NotFoundError:
+		jsonapiError(w, http.StatusNotFound, err.Error())
+		return
+	case *models.UserError:
+		jsonapiError(w, http.StatusBadRequest, err.Error())
+		return
+	case *models.DBError:
+		jsonapiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err = a.Events.CreateAttributeDefinitionEvent(r.Method, d.Name, a.requestSubject(r)); err != nil {
+		log.WithError(err).Warnf("failed to store attribute event")
+	}
+	if r.Method == http.MethodDelete {
+		jsonapiNoContentSuccess(w)
+		return
+	}
+	jsonapiSuccess(w, newAttributeResource(d), http.StatusOK)
+}
+
+// applyProfile copies the requested profile fields and custom attributes into the user, it reports whether
+// the profile changed or writes the error response. The users edit their display name, phone, locale and
+// the custom attributes marked as user editable, the administrators edit any field; a null attribute is
+// removed from the profile.
+func (a *App) applyProfile(w http.ResponseWriter, u *models.User, requestBody *UserRequest, admin bool) (bool, bool) {
+	if !admin && (requestBody.Email != nil || requestBody.Team != nil) {
+		jsonapiError(w, http.StatusForbidden, "email and team are changed by administrators only")
+		return false, false
+	}
+	changed := false
+	if requestBody.Email != nil && *requestBody.Email != u.Email {
+		// the new email is verified again
+		u.EmailVerified = false
+	}
+	for field, value := range map[*string]*string{
+		&u.DisplayName: requestBody.DisplayName,
+		&u.Email:       requestBody.Email,
+		&u.Phone:       requestBody.Phone,
+		&u.Locale:      requestBody.Locale,
+		&u.Team:        requestBody.Team,
+	} {
+		if value != nil {
+			*field = *value
+			changed = true
+		}
+	}
+	if err := u.ValidateProfile(); err != nil {
+		jsonapiError(w, http.StatusBadRequest, err.Error())
+		return false, false
+	}
+	if len(requestBody.Attributes) == 0 {
+		return changed, true
+	}
+	definitions, err := a.Attributes.GetAttributeDefinitions()
+	if err != nil {
+		jsonapiError(w, http.StatusInternalServerError, err.Error())
+		return false, false
+	}
+	byName := make(map[string]*models.AttributeDefinition)
+	for _, d := range definitions {
+		byName[d.Name] = d
+	}
+	if u.Attributes == nil {
+		u.Attributes = make(map[string]interface{})
+	}
+	for name, value := range requestBody.Attributes {
+		d, ok := byName[name]
+		// the administrators remove the values of the deleted definitions as well
+		if !ok && !(admin && value == nil) {
+			jsonapiError(w, http.StatusBadRequest, fmt.Sprintf("unknown attribute %s", name))
+			return false, false
+		}
+		if ok && !admin && !d.UserEditable {
+			jsonapiError(w, http.StatusForbidden, fmt.Sprintf("attribute %s is changed by administrators only", name))
+			return false, false
+		}
+		if value == nil {
+			delete(u.Attributes, name)
+			continue
+		}
+		if err = d.ValidateValue(value); err != nil {
+			jsonapiError(w, http.StatusBadRequest, err.Error())
+			return false, false
+		}
+		u.Attributes[name] = value
+	}
+	return true, true
+}
+
+// addProfileClaims maps the profile of the user into the claims of its access token: the core profile
+// if enabled, and the custom attributes whose definitions are marked as in token
+func (a *App) addProfileClaims(claims *customClaims, user *models.User) {
+	if a.config.ProfileClaims {
+		claims.Name = user.DisplayName
+		claims.Email = user.Email
+		claims.PhoneNumber = user.Phone
+		claims.Locale = user.Locale
+		claims.Team = user.Team
+	}
+	if len(user.Attributes) == 0 {
+		return
+	}
+	definitions, err := a.Attributes.GetAttributeDefinitions()
+	if err != nil {
+		log.WithError(err).Warnf("failed to load the attribute definitions")
+		return
+	}
+	for _, d := range definitions {
+		value, ok := user.Attributes[d.Name]
+		if !ok || !d.InToken {
+			continue
+		}
+		if claims.Attrs == nil {
+			claims.Attrs = make(map[string]interface{})
+		}
+		claims.Attrs[d.Name] = value
+	}
+}
@@ -0,0 +1,218 @@
+package controllers
+
+import (
+	"bytes"
+	"github.com/goidp/models"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+)
+
+var attributeColumns = []string{"id", "name", "type", "pattern", "values", "user_editable", "in_token"}
+
+func expectAttributeDefinitions(s *Suite) {
+	s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "attribute_definitions" WHERE "attribute_definitions"."deleted_at" IS NULL ORDER BY id`)).
+		WillReturnRows(sqlmock.NewRows(attributeColumns).
+			AddRow(1, "cost_center", models.AttributeString, `^[0-9]{4}$`, nil, false, true).
+			AddRow(2, "pronouns", models.AttributeEnum, "", `["she/her","he/him","they/them"]`, true, false))
+}
+
+func TestAttributeDefinitionsHandler(t *testing.T) {
+	s, err := SetupSuite()
+	if err != nil {
+		t.Fatalf("error setting up test suite: %s", err.Error())
+	}
+	a := NewApp(s.DB, &Config{})
+
+	tt := []struct {
+		name    string
+		body    string
+		count   int
+		created bool
+		status  int
+	}{
+		{
+			name:    "string attribute with pattern",
+			body:    `{"data":{"type":"attribute","attributes":{"name":"cost_center","type":"string","pattern":"^[0-9]{4}$","in_token":true}}}`,
+			created: true,
+			status:  http.StatusCreated,
+		},
+		{
+			name:   "attribute already defined",
+			body:   `{"data":{"type":"attribute","attributes":{"name":"cost_center","type":"string"}}}`,
+			count:  1,
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "invalid type",
+			body:   `{"data":{"type":"attribute","attributes":{"name":"badge","type":"date"}}}`,
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "enum without values",
+			body:   `{"data":{"type":"attribute","attributes":{"name":"pronouns","type":"enum"}}}`,
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "name of a profile field",
+			body:   `{"data":{"type":"attribute","attributes":{"name":"email","type":"string"}}}`,
+			status: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.count > 0 || tc.created {
+				s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT count(*) FROM "attribute_definitions" WHERE name = $1`)).
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(tc.count))
+			}
+			if tc.created {
+				s.mock.ExpectBegin()
+				s.mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "attribute_definitions"`)).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+				s.mock.ExpectCommit()
+				expectEvent(s)
+			}
+
+			req, _ := http.NewRequest(http.MethodPost, "/v1.0/attribute", bytes.NewBufferString(tc.body))
+			rec := httptest.NewRecorder()
+			a.AttributeDefinitionsHandler(rec, req)
+
+			if err := s.mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+			if rec.Code != tc.status {
+				t.Errorf("expected status %d; got %d: %s", tc.status, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestPatchUserProfileHandler(t *testing.T) {
+	s, err := SetupSuite()
+	if err != nil {
+		t.Fatalf("error setting up test suite: %s", err.Error())
+	}
+	a := NewApp(s.DB, &Config{})
+	a.config.SignKey, _ = ReadPrivateKey(PKCS1_Private_Key)
+	a.config.VerifyKey = &a.config.SignKey.PublicKey
+	token := func(username string, role models.UserRole) string {
+		rL, _ := models.NewRoleList([]string{role.String()})
+		t, _ := generateToken(newCustomClaims(&models.User{Username: username, Roles: rL}, models.InternalDomain, time.Minute, nil, ""), "", a.config.SignKey)
+		return t
+	}
+
+	tt := []struct {
+		name        string
+		token       string
+		attributes  string
+		definitions bool
+		code        int
+	}{
+		{
+			name:       "email changed by the user",
+			token:      token("jdoe", models.MonitorRole),
+			attributes: `"email":"jdoe@example.com"`,
+			code:       http.StatusForbidden,
+		},
+		{
+			name:       "phone not in E.164 format",
+			token:      token("jdoe", models.MonitorRole),
+			attributes: `"phone":"555-0100"`,
+			code:       http.StatusBadRequest,
+		},
+		{
+			name:       "invalid email",
+			token:      token("admin", models.AdminRole),
+			attributes: `"email":"jdoe"`,
+			code:       http.StatusBadRequest,
+		},
+		{
+			name:        "attribute changed by administrators only",
+			token:       token("jdoe", models.MonitorRole),
+			attributes:  `"attributes":{"cost_center":"1234"}`,
+			definitions: true,
+			code:        http.StatusForbidden,
+		},
+		{
+			name:        "unknown attribute",
+			token:       token("admin", models.AdminRole),
+			attributes:  `"attributes":{"badge":"1234"}`,
+			definitions: true,
+			code:        http.StatusBadRequest,
+		},
+		{
+			name:        "value not matching the pattern",
+			token:       token("admin", models.AdminRole),
+			attributes:  `"attributes":{"cost_center":"12ab"}`,
+			definitions: true,
+			code:        http.StatusBadRequest,
+		},
+		{
+			name:        "value not in the enum",
+			token:       token("jdoe", models.MonitorRole),
+			attributes:  `"attributes":{"pronouns":"any"}`,
+			definitions: true,
+			code:        http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			s.mock.ExpectQuery(regexp.QuoteMeta(
+				`SELECT * FROM "users" WHERE "users"."id" = $1 AND "users"."deleted_at" IS NULL ORDER BY "users"."id" LIMIT 1`)).
+				WithArgs(int64(123)).WillReturnRows(sqlmock.NewRows([]string{"username", "version"}).AddRow("jdoe", 2))
+			if tc.definitions {
+				expectAttributeDefinitions(s)
+			}
+
+			body := `{"data":{"type":"user","attributes":{` + tc.attributes + `}}}`
+			req, _ := http.NewRequest(http.MethodPatch, "/user/123", bytes.NewBufferString(body))
+			req.Header.Set(headerAuthorization, "Bearer "+tc.token)
+			req = mux.SetURLVars(req, map[string]string{"id": "123"})
+			rec := httptest.NewRecorder()
+			a.UserHandler(rec, req)
+
+			if err := s.mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+			if rec.Code != tc.code {
+				t.Errorf("expected status %d; got %d: %s", tc.code, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestAddProfileClaims(t *testing.T) {
+	s, err := SetupSuite()
+	if err != nil {
+		t.Fatalf("error setting up test suite: %s", err.Error())
+	}
+	a := NewApp(s.DB, &Config{ProfileClaims: true})
+	user := &models.User{
+		Username:    "jdoe",
+		DisplayName: "John Doe",
+		Email:       "jdoe@example.com",
+		Attributes:  map[string]interface{}{"cost_center": "1234", "pronouns": "he/him"},
+	}
+	expectAttributeDefinitions(s)
+
+	claims := newCustomClaims(user, models.InternalDomain, time.Minute, nil, "")
+	a.addProfileClaims(&claims, user)
+
+	if err := s.mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+	if claims.Name != "John Doe" || claims.Email != "jdoe@example.com" {
+		t.Errorf("unexpected profile claims %s %s", claims.Name, claims.Email)
+	}
+	// only the attributes marked as in token are mapped
+	if len(claims.Attrs) != 1 || claims.Attrs["cost_center"] != "1234" {
+		t.Errorf("unexpected attrs claim %v", claims.Attrs)
+	}
+}
@@ -0,0 +1,169 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"github.com/goidp/models"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-co-op/gocron"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// breakGlassFlushInterval is the period after which the pending break-glass events are stored again
+const breakGlassFlushInterval = 30 * time.Second
+
+// BreakGlassConfig configures the emergency account, which logs in as administrator even when the DB
+// is unreachable
+type BreakGlassConfig struct {
+	// File contains the username:hash line of the emergency account, the hash is a bcrypt hash
+	File string
+	// RateInterval is the minimum period between two login attempts with the emergency account
+	RateInterval time.Duration
+}
+
+// breakGlassLogin is a login with the emergency account whose event is not stored yet
+type breakGlassLogin struct {
+	ip string
+	at time.Time
+}
+
+// breakGlass holds the credential of the emergency account, the time of the last login attempt and
+// the logins waiting for the DB to be recorded
+type breakGlass struct {
+	sync.Mutex
+	username    string
+	hash        []byte
+	interval    time.Duration
+	lastAttempt time.Time
+	pending     []breakGlassLogin
+	// flushing serializes the flushes, the DB is not reached while holding the lock of the account
+	flushing sync.Mutex
+}
+
+// readBreakGlassCredential reads the username and the bcrypt hash of the emergency account
+func readBreakGlassCredential(path string) (string, []byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read break-glass file: %s", err.Error())
+	}
+	parts := strings.SplitN(strings.TrimSpace(string(data)), ":", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", nil, errors.New("break-glass file must contain a username:hash line")
+	}
+	hash := []byte(parts[1])
+	if _, err = bcrypt.Cost(hash); err != nil {
+		return "", nil, fmt.Errorf("invalid break-glass hash: %s", err.Error())
+	}
+	return parts[0], hash, nil
+}
+
+// allow reports whether a login attempt is allowed now, otherwise how long to wait for the next one.
+// The attempts are limited globally rather than by client, the account is meant for an operator in an
+// emergency only.
+func (b *breakGlass) allow() (bool, time.Duration) {
+	b.Lock()
+	defer b.Unlock()
+	if wait := b.interval - time.Since(b.lastAttempt); !b.lastAttempt.IsZero() && wait > 0 {
+		return false, wait
+	}
+	b.lastAttempt = time.Now()
+	return true, 0
+}
+
+// record queues the event of a login with the emergency account
+func (b *breakGlass) record(ip string) {
+	b.Lock()
+	defer b.Unlock()
+	b.pending = append(b.pending, breakGlassLogin{ip: ip, at: time.Now()})
+}
+
+// flushBreakGlassEvents stores the events of the logins with the emergency account, the events which
+// cannot be stored are kept for the next flush
+func (a *App) flushBreakGlassEvents() {
+	b := a.breakGlass
+	b.flushing.Lock()
+	defer b.flushing.Unlock()
+	b.Lock()
+	pending := b.pending
+	b.Unlock()
+	stored := 0
+	for _, l := range pending {
+		if err := a.Events.CreateBreakGlassEvent(b.username, l.ip, l.at); err != nil {
+			log.WithError(err).Warnf("failed to store break-glass event, %d pending", len(pending)-stored)
+			break
+		}
+		stored++
+	}
+	b.Lock()
+	b.pending = b.pending[stored:]
+	b.Unlock()
+}
+
+// SetupBreakGlass enables the emergency account read from the break-glass file, the logins are recorded
+// as critical events by the scheduled flushes as soon as the DB is reachable
+// the emergency account is refused if its username is taken by a local user, who would be shadowed
+func (a *App) SetupBreakGlass(c *BreakGlassConfig) error {
+	username, hash, err := readBreakGlassCredential(c.File)
+	if err != nil {
+		return err
+	}
+	if err = a.Users.ValidateUsername(username); err != nil {
+		return fmt.Errorf("invalid break-glass username: %s", err.Error())
+	}
+	// the users created or renamed afterwards would shadow the emergency account or be shadowed by it
+	a.Users.Reserve(username)
+	a.breakGlass = &breakGlass{username: username, hash: hash, interval: c.RateInterval}
+	s := gocron.NewScheduler(time.UTC)
+	if _, err = s.Every(breakGlassFlushInterval).Do(a.flushBreakGlassEvents); err != nil {
+		return err
+	}
+	s.StartAsync()
+	log.Warnf("break-glass account %s enabled", username)
+	return nil
+}
+
+// isBreakGlass reports whether the username is the one of the emergency account, if enabled
+func (a *App) isBreakGlass(username string) bool {
+	return a.breakGlass != nil && username != "" && username == a.breakGlass.username
+}
+
+// breakGlassSession issues an administrator access token to the emergency account without reaching the
+// DB: the token belongs to no session and is not renewable
+func (a *App) breakGlassSession(w http.ResponseWriter, r *http.Request, password string, audience []string, scope, jkt string) {
+	b := a.breakGlass
+	if ok, wait := b.allow(); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		jsonapiError(w, http.StatusTooManyRequests, "too many break-glass attempts")
+		return
+	}
+	ip, _ := getIP(r)
+	if err := bcrypt.CompareHashAndPassword(b.hash, []byte(password)); err != nil {
+		log.WithField("ip", ip).Warnf("failed break-glass login")
+		jsonapiError(w, http.StatusUnauthorized, "user not allowed")
+		return
+	}
+	rL, _ := models.NewRoleList([]string{models.AdminRole.String()})
+	user := &models.User{Username: b.username, Roles: rL}
+	claims := newCustomClaims(user, models.BreakGlassDomain, a.config.AccessTokenExpireTime, audience, scope)
+	claims.Cnf = newConfirmationClaim(jkt)
+	signedToken, err := generateToken(claims, a.config.Secret, a.config.SignKey)
+	if err != nil {
+		jsonapiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	log.WithField("ip", ip).Errorf("break-glass login of %s", b.username)
+	// the event is stored by the next flush, the login does not wait for the DB
+	b.record(ip)
+
+	responseBody := CreateSessionHandlerResponse{AccessToken: signedToken, TokenType: tokenType(jkt)}
+	w.Header().Set(headerAuthorization, fmt.Sprintf("%s %v", responseBody.TokenType, responseBody.AccessToken))
+	jsonapiSuccessMetaOnly(w, &responseBody, http.StatusOK)
+}
@@ -0,0 +1,252 @@
+package controllers
+
+import (
+	"bytes"
+	"errors"
+	"github.com/goidp/models"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestReadBreakGlassCredential(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("s3cr3t"), bcrypt.MinCost)
+	dir, _ := ioutil.TempDir("", "breakglass")
+	defer os.RemoveAll(dir)
+
+	tt := []struct {
+		name    string
+		content string
+		valid   bool
+	}{
+		{
+			name:    "username and hash",
+			content: "emergency:" + string(hash) + "\n",
+			valid:   true,
+		},
+		{
+			name:    "missing username",
+			content: ":" + string(hash),
+		},
+		{
+			name:    "clear text password",
+			content: "emergency:s3cr3t",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(dir, "break_glass")
+			_ = ioutil.WriteFile(path, []byte(tc.content), 0600)
+			username, _, err := readBreakGlassCredential(path)
+			if tc.valid && (err != nil || username != "emergency") {
+				t.Errorf("unexpected username %s or error %v", username, err)
+			}
+			if !tc.valid && err == nil {
+				t.Errorf("invalid break-glass file accepted")
+			}
+		})
+	}
+}
+
+func TestBreakGlassSession(t *testing.T) {
+	s, err := SetupSuite()
+	if err != nil {
+		t.Fatalf("error setting up test suite: %s", err.Error())
+	}
+	a := NewApp(s.DB, &Config{AccessTokenExpireTime: time.Minute, RenewTokenExpireTime: time.Hour})
+	a.config.SignKey, _ = ReadPrivateKey(PKCS1_Private_Key)
+	a.config.VerifyKey = &a.config.SignKey.PublicKey
+	hash, _ := bcrypt.GenerateFromPassword([]byte("s3cr3t"), bcrypt.MinCost)
+	a.breakGlass = &breakGlass{username: "emergency", hash: hash, interval: time.Hour}
+	eventInsert := regexp.QuoteMeta(`INSERT INTO "events"`)
+
+	tt := []struct {
+		name     string
+		password string
+		reset    bool
+		status   int
+	}{
+		{
+			name:     "login",
+			password: "s3cr3t",
+			reset:    true,
+			status:   http.StatusOK,
+		},
+		{
+			name:     "attempt within the rate interval",
+			password: "s3cr3t",
+			status:   http.StatusTooManyRequests,
+		},
+		{
+			name:     "wrong password",
+			password: "secret",
+			reset:    true,
+			status:   http.StatusUnauthorized,
+		},
+		{
+			name:     "second login",
+			password: "s3cr3t",
+			reset:    true,
+			status:   http.StatusOK,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.reset {
+				a.breakGlass.lastAttempt = time.Time{}
+			}
+			// the login does not reach the DB
+			body := `{"data":{"type":"session","attributes":{"username":"emergency","password":"` + tc.password + `"}}}`
+			req, _ := http.NewRequest(http.MethodPost, "/v1.0/session", bytes.NewBufferString(body))
+			rec := httptest.NewRecorder()
+			a.CreateSessionHandler(rec, req)
+
+			if err := s.mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+			if rec.Code != tc.status {
+				t.Fatalf("expected status %d; got %d: %s", tc.status, rec.Code, rec.Body.String())
+			}
+			if tc.status != http.StatusOK {
+				return
+			}
+			if strings.Contains(rec.Body.String(), `"renew_token":"ey`) {
+				t.Errorf("break-glass token must not be renewable")
+			}
+			claims, err := getClaimsFromAccessToken(strings.TrimPrefix(rec.Header().Get(headerAuthorization), "Bearer "), "", a.config.VerifyKey)
+			if err != nil {
+				t.Fatalf("could not decode access token: %s", err)
+			}
+			if !stringInSlice(claims.Roles, models.AdminRole.String()) || claims.Sid != "" {
+				t.Errorf("unexpected roles %v or session %s", claims.Roles, claims.Sid)
+			}
+		})
+	}
+
+	// the events are kept by the scheduled flushes until the DB is reachable
+	s.mock.ExpectBegin()
+	s.mock.ExpectQuery(eventInsert).WillReturnError(errors.New("connection refused"))
+	s.mock.ExpectRollback()
+	a.flushBreakGlassEvents()
+	if len(a.breakGlass.pending) != 2 {
+		t.Errorf("expected 2 pending break-glass events; got %d", len(a.breakGlass.pending))
+	}
+	for i := 0; i < 2; i++ {
+		s.mock.ExpectBegin()
+		s.mock.ExpectQuery(eventInsert).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+		s.mock.ExpectCommit()
+	}
+	a.flushBreakGlassEvents()
+	if err := s.mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+	if len(a.breakGlass.pending) != 0 {
+		t.Errorf("expected no pending break-glass events; got %d", len(a.breakGlass.pending))
+	}
+}
+
+func TestSetupBreakGlass(t *testing.T) {
+	s, err := SetupSuite()
+	if err != nil {
+		t.Fatalf("error setting up test suite: %s", err.Error())
+	}
+	a := NewApp(s.DB, &Config{})
+	hash, _ := bcrypt.GenerateFromPassword([]byte("s3cr3t"), bcrypt.MinCost)
+	dir, _ := ioutil.TempDir("", "breakglass")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "break_glass")
+	_ = ioutil.WriteFile(path, []byte("admin:"+string(hash)), 0600)
+
+	// the emergency account would shadow the local user with the same username
+	s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "users" WHERE username = $1 OR lower(email) = lower($2)`)).
+		WithArgs("admin", "admin").WillReturnRows(sqlmock.NewRows([]string{"id", "username"}).AddRow(1, "admin"))
+	if err = a.SetupBreakGlass(&BreakGlassConfig{File: path, RateInterval: time.Minute}); err == nil {
+		t.Errorf("break-glass username of a local user accepted")
+	}
+	if a.breakGlass != nil {
+		t.Errorf("break-glass account enabled")
+	}
+	if err := s.mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestBreakGlassReservedUsername(t *testing.T) {
+	s, err := SetupSuite()
+	if err != nil {
+		t.Fatalf("error setting up test suite: %s", err.Error())
+	}
+	a := NewApp(s.DB, &Config{})
+	hash, _ := bcrypt.GenerateFromPassword([]byte("s3cr3t"), bcrypt.MinCost)
+	dir, _ := ioutil.TempDir("", "breakglass")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "break_glass")
+	_ = ioutil.WriteFile(path, []byte("breakglass:"+string(hash)), 0600)
+
+	s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "users" WHERE username = $1 OR lower(email) = lower($2)`)).
+		WithArgs("breakglass", "breakglass").WillReturnRows(sqlmock.NewRows(nil))
+	s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT count(*) FROM "service_accounts" WHERE name = $1`)).
+		WithArgs("breakglass").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	if err = a.SetupBreakGlass(&BreakGlassConfig{File: path, RateInterval: time.Minute}); err != nil {
+		t.Fatalf("could not set up the break-glass account: %s", err)
+	}
+
+	// the users created or renamed afterwards cannot take the username of the emergency account
+	t.Run("local user", func(t *testing.T) {
+		body := `{"data":{"type":"user","attributes":{"username":"breakglass","password":"TestUser1*","roles":["MONITOR"]}}}`
+		req, _ := http.NewRequest(http.MethodPost, "/v1.0/user", bytes.NewBufferString(body))
+		rec := httptest.NewRecorder()
+		a.UsersHandler(rec, req)
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "reserved by the break-glass account") {
+			t.Errorf("expected the username to be reserved; got %d: %s", rec.Code, rec.Body.String())
+		}
+	})
+	t.Run("SCIM user", func(t *testing.T) {
+		body := `{"schemas":["urn:ietf:params:scim:schemas:core:2.0:User"],"userName":"breakglass"}`
+		req, _ := http.NewRequest(http.MethodPost, "/scim/v2/Users", bytes.NewBufferString(body))
+		rec := httptest.NewRecorder()
+		a.SCIMCreateUserHandler(rec, req)
+		if rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), "reserved by the break-glass account") {
+			t.Errorf("expected the username to be reserved; got %d: %s", rec.Code, rec.Body.String())
+		}
+	})
+	t.Run("renamed user", func(t *testing.T) {
+		s.mock.ExpectQuery(regexp.QuoteMeta(
+			`SELECT * FROM "users" WHERE "users"."id" = $1 AND "users"."deleted_at" IS NULL ORDER BY "users"."id" LIMIT 1`)).
+			WithArgs(int64(123)).WillReturnRows(sqlmock.NewRows([]string{"id", "username", "version"}).AddRow(123, "jdoe", 1))
+		s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "user_roles" WHERE "user_roles"."user_id" = $1`)).
+			WithArgs(123).WillReturnRows(sqlmock.NewRows([]string{"user_id", "role_id"}))
+		body := `{"data":{"type":"user","attributes":{"username":"breakglass"}}}`
+		req, _ := http.NewRequest(http.MethodPatch, "/v1.0/user/123", bytes.NewBufferString(body))
+		req = mux.SetURLVars(req, map[string]string{"id": "123"})
+		rec := httptest.NewRecorder()
+		a.UserHandler(rec, req)
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "reserved by the break-glass account") {
+			t.Errorf("expected the username to be reserved; got %d: %s", rec.Code, rec.Body.String())
+		}
+	})
+	t.Run("shadow user", func(t *testing.T) {
+		s.mock.ExpectQuery(regexp.QuoteMeta(
+			`SELECT * FROM "users" WHERE (backend = $1 AND subject = $2) AND "users"."deleted_at" IS NULL LIMIT 1`)).
+			WithArgs(models.LDAPDomain, "breakglass").WillReturnRows(sqlmock.NewRows(nil))
+		_, err := a.Users.ProvisionShadowUser(models.LDAPDomain, "breakglass", "breakglass", nil)
+		if err == nil || !strings.Contains(err.Error(), "reserved by the break-glass account") {
+			t.Errorf("expected the username to be reserved; got %v", err)
+		}
+	})
+	if err := s.mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
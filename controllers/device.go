@@ -0,0 +1,390 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"github.com/goidp/models"
+	"html/template"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// userCodeCharset excludes vowels and ambiguous characters, as recommended by RFC 8628
+	userCodeCharset = "BCDFGHJKLMNPQRSTVWXZ"
+	userCodeLength  = 8
+	// slowDownIncrement is added to the polling interval of the devices polling too fast
+	slowDownIncrement = 5 * time.Second
+
+	defaultDeviceCodeExpireTime = 10 * time.Minute
+	defaultDevicePollInterval   = 5 * time.Second
+
+	// deviceSessionCookie keeps the user logged in the verification page between two device requests
+	deviceSessionCookie = "idp_device_session"
+)
+
+// deviceAuthorizationResponse is the RFC 8628 device authorization response
+type deviceAuthorizationResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int64  `json:"expires_in"`
+	Interval                int64  `json:"interval"`
+}
+
+var deviceVerificationForm = template.Must(template.New("device").Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{.AppName}} device login</title></head>
+<body>
+{{if .Message}}<p>{{.Message}}</p>{{else}}
+<form method="post" action="{{.Action}}">
+{{if .Error}}<p>{{.Error}}</p>{{end}}
+<label>Code <input type="text" name="user_code" value="{{.UserCode}}" autofocus></label>
+{{if .Username}}<p>Signed in as {{.Username}}</p>{{else}}
+<label>Username <input type="text" name="username"></label>
+<label>Password <input type="password" name="password"></label>
+{{end}}
+<button type="submit" name="action" value="approve">Approve</button>
+<button type="submit" name="action" value="deny">Deny</button>
+</form>
+{{end}}
+</body>
+</html>`))
+
+func randomString(charset string, length int) (string, error) {
+	var sb strings.Builder
+	for i := 0; i < length; i++ {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(charset))))
+		if err != nil {
+			return "", err
+		}
+		sb.WriteByte(charset[n.Int64()])
+	}
+	return sb.String(), nil
+}
+
+// newUserCode returns a user code in the XXXX-XXXX form
+func newUserCode() (string, error) {
+	code, err := randomString(userCodeCharset, userCodeLength)
+	if err != nil {
+		return "", err
+	}
+	return code[:userCodeLength/2] + "-" + code[userCodeLength/2:], nil
+}
+
+// normalizeUserCode accepts the user code typed in lower case, with or without separators
+func normalizeUserCode(code string) string {
+	code = strings.ToUpper(code)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+	if len(code) != userCodeLength {
+		return code
+	}
+	return code[:userCodeLength/2] + "-" + code[userCodeLength/2:]
+}
+
+func newDeviceCode() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// DeviceAuthorizationHandler starts the RFC 8628 device flow: the device gets a device code to poll
+// the token endpoint with and a user code the user enters in the verification page
+func (a *App) DeviceAuthorizationHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, newOAuthError(http.StatusBadRequest, "invalid_request", "invalid request body: %s", err.Error()))
+		return
+	}
+	deviceCode, err := newDeviceCode()
+	if err != nil {
+		writeOAuthError(w, newOAuthError(http.StatusInternalServerError, "server_error", "%s", err.Error()))
+		return
+	}
+	userCode, err := newUserCode()
+	if err != nil {
+		writeOAuthError(w, newOAuthError(http.StatusInternalServerError, "server_error", "%s", err.Error()))
+		return
+	}
+	expire := a.config.DeviceCodeExpireTime
+	if expire == 0 {
+		expire = defaultDeviceCodeExpireTime
+	}
+	interval := a.config.DevicePollInterval
+	if interval == 0 {
+		interval = defaultDevicePollInterval
+	}
+	d := &models.DeviceAuthorization{
+		DeviceCodeHash: models.HashDeviceCode(deviceCode),
+		UserCode:       userCode,
+		Audience:       r.PostForm["audience"],
+		Scope:          r.PostForm.Get("scope"),
+		ExpiresAt:      time.Now().Add(expire),
+		Interval:       interval,
+		Status:         models.DeviceAuthorizationPending,
+	}
+	if err = a.DeviceAuthorizations.Create(d); err != nil {
+		log.WithError(err).Warnf("failed to store device authorization request")
+		writeOAuthError(w, newOAuthError(http.StatusInternalServerError, "server_error", "internal error, retry later"))
+		return
+	}
+	uri := requestURL(r, fmt.Sprintf("/%s/device", ApiVersion))
+	writeOAuthResponse(w, &deviceAuthorizationResponse{
+		DeviceCode:              deviceCode,
+		UserCode:                userCode,
+		VerificationURI:         uri,
+		VerificationURIComplete: uri + "?user_code=" + userCode,
+		ExpiresIn:               int64(expire.Seconds()),
+		Interval:                int64(interval.Seconds()),
+	}, http.StatusOK)
+}
+
+// DeviceVerificationHandler serves the page where the user logs in and approves (or denies) the
+// request of the device displaying the user code
+func (a *App) DeviceVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		AppName  string
+		Action   string
+		UserCode string
+		Username string
+		Error    string
+		Message  string
+	}{
+		AppName:  AppName,
+		Action:   fmt.Sprintf("/%s/device", ApiVersion),
+		UserCode: r.URL.Query().Get("user_code"),
+	}
+	render := func(status int) {
+		w.Header().Set(headerContentType, "text/html; charset=utf-8")
+		w.WriteHeader(status)
+		if err := deviceVerificationForm.Execute(w, data); err != nil {
+			log.WithError(err).Warnf("failed to write device verification page")
+		}
+	}
+	// the user logged in the page for a previous device approves or denies without credentials
+	claims, user := a.sessionCookieClaims(r, deviceSessionCookie)
+	if claims != nil {
+		data.Username = user.Username
+	}
+	if r.Method != http.MethodPost {
+		render(http.StatusOK)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		data.Error = "invalid request"
+		render(http.StatusBadRequest)
+		return
+	}
+	data.UserCode = normalizeUserCode(r.PostForm.Get("user_code"))
+	d, err := a.DeviceAuthorizations.GetDeviceAuthorizationByUserCode(data.UserCode)
+	switch err.(type) {
+	case *models.DBError:
+		data.Error = "internal error, retry later"
+		render(http.StatusInternalServerError)
+		return
+	case *models.NotFoundError:
+		data.Error = "invalid or expired code"
+		render(http.StatusBadRequest)
+		return
+	}
+	if d.Expired() || d.Status != models.DeviceAuthorizationPending {
+		data.Error = "invalid or expired code"
+		render(http.StatusBadRequest)
+		return
+	}
+
+	ip, _ := getIP(r)
+	var domain string
+	if claims != nil {
+		domain = claims.Azt
+	} else {
+		username := r.PostForm.Get("username")
+		var ok bool
+		user, domain, ok = a.authenticate(username, r.PostForm.Get("password"))
+		if !ok || !user.Active() {
+			if err := a.Events.CreateUnsuccessfulLoginEvent(username, models.InternalDomain, ip); err != nil {
+				log.WithError(err).Warnf("failed to store login attempt")
+			}
+			data.Error = "user not allowed"
+			render(http.StatusUnauthorized)
+			return
+		}
+	}
+
+	if r.PostForm.Get("action") == "deny" {
+		d.Status = models.DeviceAuthorizationDenied
+		data.Message = "The device request has been denied."
+	} else {
+		if domain != models.InternalDomain && user.ID == 0 {
+			if err := a.recordExternalIdentity(user, domain, user.Username); err != nil {
+				data.Error = "internal error, retry later"
+				render(http.StatusInternalServerError)
+				return
+			}
+		}
+		d.Status = models.DeviceAuthorizationApproved
+		d.Username = user.Username
+		d.Domain = domain
+		d.Roles = user.Roles.String()
+		d.Version = user.Version
+		d.UserID = user.ID
+		d.IdentityID = user.IdentityID
+		data.Message = "The device has been approved, you can return to it."
+	}
+	if err = a.DeviceAuthorizations.UpdateDeviceAuthorization(d); err != nil {
+		data.Message = ""
+		data.Error = "internal error, retry later"
+		render(http.StatusInternalServerError)
+		return
+	}
+	if claims == nil {
+		if d.Status == models.DeviceAuthorizationApproved {
+			if err := a.Events.CreateSuccessfulLoginEvent(user.Username, domain, ip); err != nil {
+				log.WithError(err).Warnf("failed to store login attempt")
+			}
+		}
+		a.setDeviceSessionCookie(w, r, user, domain)
+	}
+	render(http.StatusOK)
+}
+
+// setDeviceSessionCookie keeps the local and shadow users logged in the verification page, the external
+// identities enter their credentials for every device
+func (a *App) setDeviceSessionCookie(w http.ResponseWriter, r *http.Request, user *models.User, domain string) {
+	if user.ID == 0 || user.IdentityID != 0 || domain == models.ServiceAccountDomain {
+		return
+	}
+	claims := newCustomClaims(user, domain, a.config.AccessTokenExpireTime, nil, "")
+	signedToken, err := generateToken(claims, a.config.Secret, a.config.SignKey)
+	if err != nil {
+		log.WithError(err).Warnf("failed to sign device session cookie")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     deviceSessionCookie,
+		Value:    signedToken,
+		Path:     fmt.Sprintf("/%s/device", ApiVersion),
+		Expires:  time.Unix(claims.ExpiresAt, 0),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// DeviceTokenHandler answers the device polling the token endpoint: the tokens are issued, once, after
+// the user approval, the device is asked to keep polling, or to slow down, in the meantime
+func (a *App) DeviceTokenHandler(w http.ResponseWriter, r *http.Request) {
+	deviceCode := r.PostForm.Get("device_code")
+	if deviceCode == "" {
+		writeOAuthError(w, newOAuthError(http.StatusBadRequest, "invalid_request", "missing device_code"))
+		return
+	}
+	jkt, err := a.dpopBinding(r)
+	if err != nil {
+		writeOAuthError(w, dpopOAuthError(err))
+		return
+	}
+	d, err := a.DeviceAuthorizations.GetDeviceAuthorizationByDeviceCode(deviceCode)
+	switch err.(type) {
+	case *models.DBError:
+		writeOAuthError(w, newOAuthError(http.StatusInternalServerError, "server_error", "internal error, retry later"))
+		return
+	case *models.NotFoundError:
+		writeOAuthError(w, newOAuthError(http.StatusBadRequest, "invalid_grant", "unknown device code"))
+		return
+	}
+
+	if d.Expired() {
+		if err = a.DeviceAuthorizations.DeleteDeviceAuthorization(d); err != nil {
+			log.WithError(err).Warnf("failed to remove expired device authorization request")
+		}
+		writeOAuthError(w, newOAuthError(http.StatusBadRequest, "expired_token", "the device code has expired"))
+		return
+	}
+
+	switch d.Status {
+	case models.DeviceAuthorizationPending:
+		oErr := newOAuthError(http.StatusBadRequest, "authorization_pending", "the user has not approved the request yet")
+		now := time.Now()
+		if now.Sub(d.LastPolledAt) < d.Interval {
+			d.Interval += slowDownIncrement
+			oErr = newOAuthError(http.StatusBadRequest, "slow_down", "poll every %d seconds", int64(d.Interval.Seconds()))
+		}
+		d.LastPolledAt = now
+		if err = a.DeviceAuthorizations.UpdateDeviceAuthorization(d); err != nil {
+			log.WithError(err).Warnf("failed to update device authorization request")
+		}
+		writeOAuthError(w, oErr)
+		return
+	case models.DeviceAuthorizationDenied:
+		if err = a.DeviceAuthorizations.DeleteDeviceAuthorization(d); err != nil {
+			log.WithError(err).Warnf("failed to remove denied device authorization request")
+		}
+		writeOAuthError(w, newOAuthError(http.StatusBadRequest, "access_denied", "the user has denied the request"))
+		return
+	}
+
+	// the request is removed before issuing the tokens, so that a concurrent poll through another
+	// replica cannot redeem it twice
+	switch err = a.DeviceAuthorizations.DeleteDeviceAuthorization(d); err.(type) {
+	case *models.NotFoundError:
+		writeOAuthError(w, newOAuthError(http.StatusBadRequest, "invalid_grant", "the device code has already been used"))
+		return
+	case *models.DBError:
+		writeOAuthError(w, newOAuthError(http.StatusInternalServerError, "server_error", "internal error, retry later"))
+		return
+	}
+	roles, err := models.NewRoleList(d.Roles)
+	if err != nil {
+		writeOAuthError(w, newOAuthError(http.StatusInternalServerError, "server_error", "%s", err.Error()))
+		return
+	}
+	user := &models.User{Username: d.Username, Roles: roles, Version: d.Version, IdentityID: d.IdentityID}
+	if d.UserID != 0 {
+		// the user may have been disabled, locked or deleted since the approval
+		stored, err := a.Users.GetUserByNameOrID(strconv.Itoa(int(d.UserID)))
+		switch err.(type) {
+		case *models.NotFoundError:
+			writeOAuthError(w, newOAuthError(http.StatusBadRequest, "access_denied", "user revoked"))
+			return
+		case *models.DBError:
+			writeOAuthError(w, newOAuthError(http.StatusInternalServerError, "server_error", "internal error, retry later"))
+			return
+		}
+		if !stored.Active() {
+			writeOAuthError(w, newOAuthError(http.StatusBadRequest, "access_denied", "user %s", stored.State()))
+			return
+		}
+		// the session belongs to the approving user, not to the other users with the same username
+		user.ID = stored.ID
+	}
+	s, err := a.startSession(r, user, d.Domain)
+	if err == errSessionLimit {
+		writeOAuthError(w, newOAuthError(http.StatusBadRequest, "access_denied", "%s", err.Error()))
+		return
+	} else if err != nil {
+		writeOAuthError(w, newOAuthError(http.StatusInternalServerError, "server_error", "internal error, retry later"))
+		return
+	}
+	accessToken, renewToken, err := a.issueTokens(user, d.Domain, a.config.AccessTokenExpireTime, d.Audience, d.Scope, jkt, s.SID)
+	if err != nil {
+		writeOAuthError(w, newOAuthError(http.StatusInternalServerError, "server_error", "%s", err.Error()))
+		return
+	}
+	writeOAuthResponse(w, &tokenResponse{
+		AccessToken:  accessToken,
+		TokenType:    tokenType(jkt),
+		ExpiresIn:    int64(a.config.AccessTokenExpireTime.Seconds()),
+		RefreshToken: renewToken,
+		Scope:        d.Scope,
+	}, http.StatusOK)
+}
@@ -0,0 +1,397 @@
+package controllers
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"github.com/goidp/models"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var deviceAuthorizationColumns = []string{"id", "device_code_hash", "user_code", "audience", "scope", "expires_at", "interval", "last_polled_at", "status", "username", "domain", "roles", "user_id"}
+
+func TestDeviceAuthorizationHandler(t *testing.T) {
+	s, err := SetupSuite()
+	if err != nil {
+		t.Fatalf("error setting up test suite: %s", err.Error())
+	}
+	a := NewApp(s.DB, &Config{})
+
+	s.mock.ExpectBegin()
+	s.mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "device_authorizations"`)).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	s.mock.ExpectCommit()
+
+	form := url.Values{"scope": {"user:read"}, "audience": {"goidp"}}
+	req, _ := http.NewRequest(http.MethodPost, "/v1.0/device/code", strings.NewReader(form.Encode()))
+	req.Header.Set(headerContentType, "application/x-www-form-urlencoded")
+	req.Host = "idp.example.com"
+	rec := httptest.NewRecorder()
+	a.DeviceAuthorizationHandler(rec, req)
+
+	if err := s.mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d; got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	var dR deviceAuthorizationResponse
+	if err := json.NewDecoder(rec.Body).Decode(&dR); err != nil {
+		t.Fatalf("could not decode response: %s", err)
+	}
+	if dR.DeviceCode == "" || !regexp.MustCompile(`^[BCDFGHJKLMNPQRSTVWXZ]{4}-[BCDFGHJKLMNPQRSTVWXZ]{4}$`).MatchString(dR.UserCode) {
+		t.Errorf("unexpected device code %s or user code %s", dR.DeviceCode, dR.UserCode)
+	}
+	if dR.VerificationURI != "http://idp.example.com/v1.0/device" || dR.VerificationURIComplete != dR.VerificationURI+"?user_code="+dR.UserCode {
+		t.Errorf("unexpected verification uri %s", dR.VerificationURIComplete)
+	}
+	if dR.ExpiresIn != 600 || dR.Interval != 5 {
+		t.Errorf("unexpected expiration %d or interval %d", dR.ExpiresIn, dR.Interval)
+	}
+}
+
+func TestDeviceVerificationHandler(t *testing.T) {
+	s, err := SetupSuite()
+	if err != nil {
+		t.Fatalf("error setting up test suite: %s", err.Error())
+	}
+	a := NewApp(s.DB, &Config{Secret: "s3cret", AccessTokenExpireTime: time.Minute})
+	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("admin"), 8)
+	sessionClaims := newCustomClaims(&models.User{Username: "admin", Version: 1}, models.InternalDomain, time.Minute, nil, "")
+	sessionToken, _ := generateToken(sessionClaims, a.config.Secret, nil)
+
+	tt := []struct {
+		name       string
+		action     string
+		password   string
+		codeStatus string
+		expired    bool
+		// session is the status of the user logged in the page by the device session cookie, if any
+		session string
+		status  int
+		message string
+		// cookie is true if the user is kept logged in the page
+		cookie bool
+	}{
+		{
+			name:       "approved",
+			action:     "approve",
+			password:   "admin",
+			codeStatus: "pending",
+			status:     http.StatusOK,
+			message:    "has been approved",
+			cookie:     true,
+		},
+		{
+			name:       "denied",
+			action:     "deny",
+			password:   "admin",
+			codeStatus: "pending",
+			status:     http.StatusOK,
+			message:    "has been denied",
+			cookie:     true,
+		},
+		{
+			name:       "wrong password",
+			action:     "approve",
+			password:   "wrong",
+			codeStatus: "pending",
+			status:     http.StatusUnauthorized,
+			message:    "user not allowed",
+		},
+		{
+			name:       "expired code",
+			action:     "approve",
+			password:   "admin",
+			codeStatus: "pending",
+			expired:    true,
+			status:     http.StatusBadRequest,
+			message:    "invalid or expired code",
+		},
+		{
+			name:       "code already denied",
+			action:     "approve",
+			password:   "admin",
+			codeStatus: "denied",
+			status:     http.StatusBadRequest,
+			message:    "invalid or expired code",
+		},
+		{
+			name:       "approved by the logged in user",
+			action:     "approve",
+			codeStatus: "pending",
+			session:    "active",
+			status:     http.StatusOK,
+			message:    "has been approved",
+		},
+		{
+			name:       "expired code with the logged in user",
+			action:     "approve",
+			codeStatus: "pending",
+			expired:    true,
+			session:    "active",
+			status:     http.StatusBadRequest,
+			message:    "invalid or expired code",
+		},
+		{
+			name:       "logged in user disabled since",
+			action:     "approve",
+			password:   "wrong",
+			codeStatus: "pending",
+			session:    "disabled",
+			status:     http.StatusUnauthorized,
+			message:    "user not allowed",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.session != "" {
+				s.mock.ExpectQuery(regexp.QuoteMeta(
+					`SELECT * FROM "users" WHERE username = $1 AND "users"."deleted_at" IS NULL ORDER BY "users"."id" LIMIT 1`)).
+					WithArgs("admin").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "username", "status", "version"}).
+						AddRow(1, "admin", tc.session, 1))
+				s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "user_roles" WHERE "user_roles"."user_id" = $1`)).
+					WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"user_id", "role_id"}))
+			}
+			expiresAt := time.Now().Add(time.Minute)
+			if tc.expired {
+				expiresAt = time.Now().Add(-time.Minute)
+			}
+			s.mock.ExpectQuery(regexp.QuoteMeta(
+				`SELECT * FROM "device_authorizations" WHERE user_code = $1 AND "device_authorizations"."deleted_at" IS NULL LIMIT 1`)).
+				WithArgs("BCDF-GHJK").
+				WillReturnRows(sqlmock.NewRows(deviceAuthorizationColumns).
+					AddRow(1, "hash", "BCDF-GHJK", `["goidp"]`, "user:read", expiresAt, 5*time.Second, time.Time{}, tc.codeStatus, "", "", "null", 0))
+			if !tc.expired && tc.codeStatus == "pending" {
+				loggedIn := tc.session == "active"
+				if !loggedIn {
+					s.mock.ExpectQuery(regexp.QuoteMeta(
+						`SELECT * FROM "users" WHERE username = $1 AND "users"."deleted_at" IS NULL ORDER BY "users"."id" LIMIT 1`)).
+						WithArgs("admin").
+						WillReturnRows(sqlmock.NewRows([]string{"id", "Username", "Password", "Version"}).
+							AddRow(1, "admin", string(hashedPassword), 1))
+					s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "user_roles" WHERE "user_roles"."user_id" = $1`)).
+						WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"user_id", "role_id"}))
+				}
+				insertArgs := []driver.Value{sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()}
+				if tc.status == http.StatusOK {
+					s.mock.ExpectBegin()
+					s.mock.ExpectExec(regexp.QuoteMeta(`UPDATE "device_authorizations" SET`)).
+						WillReturnResult(sqlmock.NewResult(1, 1))
+					s.mock.ExpectCommit()
+				}
+				// the successful and unsuccessful logins are recorded, the reuse of the page session is not
+				if tc.action == "approve" && !loggedIn {
+					s.mock.ExpectBegin()
+					s.mock.ExpectQuery(regexp.QuoteMeta(
+						`INSERT INTO "events" ("created_at","updated_at","deleted_at","username","activated","description","modified","authn_domain","severity") VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9) RETURNING "id"`)).
+						WithArgs(insertArgs...).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+					s.mock.ExpectCommit()
+				}
+			}
+
+			form := url.Values{
+				"user_code": {"bcdfghjk"},
+				"action":    {tc.action},
+			}
+			if tc.password != "" {
+				form.Set("username", "admin")
+				form.Set("password", tc.password)
+			}
+			req, _ := http.NewRequest(http.MethodPost, "/v1.0/device", strings.NewReader(form.Encode()))
+			req.Header.Set(headerContentType, "application/x-www-form-urlencoded")
+			if tc.session != "" {
+				req.AddCookie(&http.Cookie{Name: deviceSessionCookie, Value: sessionToken})
+			}
+			rec := httptest.NewRecorder()
+			a.DeviceVerificationHandler(rec, req)
+
+			if err := s.mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+			if rec.Code != tc.status {
+				t.Fatalf("expected status %d; got %d: %s", tc.status, rec.Code, rec.Body.String())
+			}
+			if !strings.Contains(rec.Body.String(), tc.message) {
+				t.Errorf("expected page containing %q; got %s", tc.message, rec.Body.String())
+			}
+			cookies := rec.Result().Cookies()
+			if cookie := len(cookies) == 1 && cookies[0].Name == deviceSessionCookie; cookie != tc.cookie {
+				t.Errorf("expected device session cookie %t; got %t", tc.cookie, cookie)
+			}
+		})
+	}
+
+	// the page of the logged in user asks for the code only
+	s.mock.ExpectQuery(regexp.QuoteMeta(
+		`SELECT * FROM "users" WHERE username = $1 AND "users"."deleted_at" IS NULL ORDER BY "users"."id" LIMIT 1`)).
+		WithArgs("admin").
+		WillReturnRows(sqlmock.NewRows([]string{"username", "status", "version"}).AddRow("admin", "active", 1))
+	req, _ := http.NewRequest(http.MethodGet, "/v1.0/device?user_code=BCDF-GHJK", nil)
+	req.AddCookie(&http.Cookie{Name: deviceSessionCookie, Value: sessionToken})
+	rec := httptest.NewRecorder()
+	a.DeviceVerificationHandler(rec, req)
+	if err := s.mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+	if !strings.Contains(rec.Body.String(), "Signed in as admin") || strings.Contains(rec.Body.String(), `name="password"`) {
+		t.Errorf("expected page without credentials; got %s", rec.Body.String())
+	}
+}
+
+func TestDeviceTokenHandler(t *testing.T) {
+	s, err := SetupSuite()
+	if err != nil {
+		t.Fatalf("error setting up test suite: %s", err.Error())
+	}
+	a := NewApp(s.DB, &Config{AccessTokenExpireTime: 5 * time.Minute, RenewTokenExpireTime: 10 * time.Minute})
+	a.config.SignKey, _ = ReadPrivateKey(PKCS1_Private_Key)
+	a.config.VerifyKey = &a.config.SignKey.PublicKey
+
+	tt := []struct {
+		name         string
+		status       string
+		expired      bool
+		lastPolledAt time.Time
+		deleted      int64
+		userStatus   string
+		code         int
+		err          string
+	}{
+		{
+			name:   "authorization pending",
+			status: "pending",
+			code:   http.StatusBadRequest,
+			err:    "authorization_pending",
+		},
+		{
+			name:         "polling too fast",
+			status:       "pending",
+			lastPolledAt: time.Now(),
+			code:         http.StatusBadRequest,
+			err:          "slow_down",
+		},
+		{
+			name:    "expired device code",
+			status:  "pending",
+			expired: true,
+			deleted: 1,
+			code:    http.StatusBadRequest,
+			err:     "expired_token",
+		},
+		{
+			name:    "denied by the user",
+			status:  "denied",
+			deleted: 1,
+			code:    http.StatusBadRequest,
+			err:     "access_denied",
+		},
+		{
+			name:    "already redeemed",
+			status:  "approved",
+			deleted: 0,
+			code:    http.StatusBadRequest,
+			err:     "invalid_grant",
+		},
+		{
+			name:       "approved",
+			status:     "approved",
+			deleted:    1,
+			userStatus: string(models.UserActive),
+			code:       http.StatusOK,
+		},
+		{
+			name:       "user disabled since the approval",
+			status:     "approved",
+			deleted:    1,
+			userStatus: string(models.UserDisabled),
+			code:       http.StatusBadRequest,
+			err:        "access_denied",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			expiresAt := time.Now().Add(time.Minute)
+			if tc.expired {
+				expiresAt = time.Now().Add(-time.Minute)
+			}
+			s.mock.ExpectQuery(regexp.QuoteMeta(
+				`SELECT * FROM "device_authorizations" WHERE device_code_hash = $1 AND "device_authorizations"."deleted_at" IS NULL LIMIT 1`)).
+				WithArgs(models.HashDeviceCode("device-code")).
+				WillReturnRows(sqlmock.NewRows(deviceAuthorizationColumns).
+					AddRow(1, "hash", "BCDF-GHJK", `["goidp"]`, "user:read", expiresAt, 5*time.Second, tc.lastPolledAt, tc.status, "admin", models.InternalDomain, `["ADMIN"]`, 7))
+			s.mock.ExpectBegin()
+			if tc.status == "pending" && !tc.expired {
+				s.mock.ExpectExec(regexp.QuoteMeta(`UPDATE "device_authorizations" SET`)).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+			} else {
+				s.mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "device_authorizations" WHERE "device_authorizations"."id" = $1`)).
+					WithArgs(1).WillReturnResult(sqlmock.NewResult(1, tc.deleted))
+			}
+			s.mock.ExpectCommit()
+			if tc.userStatus != "" {
+				// the state of the user is checked again when the tokens are issued
+				s.mock.ExpectQuery(regexp.QuoteMeta(
+					`SELECT * FROM "users" WHERE "users"."id" = $1 AND "users"."deleted_at" IS NULL ORDER BY "users"."id" LIMIT 1`)).
+					WithArgs(7).WillReturnRows(sqlmock.NewRows([]string{"id", "username", "status"}).AddRow(7, "admin", tc.userStatus))
+				s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "user_roles" WHERE "user_roles"."user_id" = $1`)).
+					WithArgs(7).WillReturnRows(sqlmock.NewRows([]string{"user_id", "role_id"}))
+			}
+			if tc.code == http.StatusOK {
+				s.mock.ExpectBegin()
+				s.mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "sessions"`)).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+				s.mock.ExpectCommit()
+			}
+
+			form := url.Values{"grant_type": {grantTypeDeviceCode}, "device_code": {"device-code"}}
+			req, _ := http.NewRequest(http.MethodPost, "/v1.0/token", strings.NewReader(form.Encode()))
+			req.Header.Set(headerContentType, "application/x-www-form-urlencoded")
+			rec := httptest.NewRecorder()
+			a.TokenHandler(rec, req)
+
+			if err := s.mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+			if rec.Code != tc.code {
+				t.Fatalf("expected status %d; got %d: %s", tc.code, rec.Code, rec.Body.String())
+			}
+			if tc.err != "" {
+				var oErr oauthError
+				if err := json.NewDecoder(rec.Body).Decode(&oErr); err != nil {
+					t.Fatalf("could not decode error: %s", err)
+				}
+				if oErr.Code != tc.err {
+					t.Errorf("expected error %s; got %s", tc.err, oErr.Code)
+				}
+				return
+			}
+
+			var tR tokenResponse
+			if err := json.NewDecoder(rec.Body).Decode(&tR); err != nil {
+				t.Fatalf("could not decode response: %s", err)
+			}
+			claims, err := getClaimsFromAccessToken(tR.AccessToken, "", a.config.VerifyKey)
+			if err != nil {
+				t.Fatalf("could not decode access token: %s", err)
+			}
+			if claims.Subject != "admin" || strings.Join(claims.Roles, " ") != "ADMIN" || claims.Scope != "user:read" {
+				t.Errorf("unexpected subject %s, roles %v or scope %s", claims.Subject, claims.Roles, claims.Scope)
+			}
+			if tR.TokenType != "Bearer" || tR.RefreshToken == "" {
+				t.Errorf("unexpected token type %s or missing refresh token", tR.TokenType)
+			}
+		})
+	}
+}
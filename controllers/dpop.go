@@ -0,0 +1,210 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/goidp/models"
+	"github.com/golang-jwt/jwt"
+)
+
+const (
+	headerDPoP    = "DPoP"
+	dpopProofType = "dpop+jwt"
+	// defaultDPoPProofMaxAge is the maximum distance between the proof iat and the current time
+	defaultDPoPProofMaxAge = 1 * time.Minute
+)
+
+// confirmationClaim is the RFC 7800 cnf claim, it binds the token to the DPoP key of the client
+// or to its client certificate through their thumbprints
+type confirmationClaim struct {
+	JKT string `json:"jkt,omitempty"`
+	X5T string `json:"x5t#S256,omitempty"`
+}
+
+func newConfirmationClaim(jkt string) *confirmationClaim {
+	if jkt == "" {
+		return nil
+	}
+	return &confirmationClaim{JKT: jkt}
+}
+
+// boundKey returns the thumbprint of the key the token is bound to, it is empty for bearer tokens
+func (c *confirmationClaim) boundKey() string {
+	if c == nil {
+		return ""
+	}
+	return c.JKT
+}
+
+// tokenType returns the type of the token issued with the given key thumbprint
+func tokenType(jkt string) string {
+	if jkt == "" {
+		return "Bearer"
+	}
+	return "DPoP"
+}
+
+// dpopClaims are the claims of a RFC 9449 DPoP proof
+type dpopClaims struct {
+	Method string `json:"htm"`
+	URI    string `json:"htu"`
+	// AccessTokenHash is the hash of the access token presented along with the proof
+	AccessTokenHash string `json:"ath,omitempty"`
+	jwt.StandardClaims
+}
+
+// Valid skips the standard time checks, the proof iat is checked against the configured max age
+func (c *dpopClaims) Valid() error {
+	return nil
+}
+
+// requestURL returns the externally reachable address of the resource, without query and fragment
+func requestURL(r *http.Request, path string) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, r.Host, path)
+}
+
+// verifyDPoPProof validates the DPoP proof sent with the request and returns the thumbprint of its key,
+// the proof must cover the access token if any is presented along with it
+func (a *App) verifyDPoPProof(r *http.Request, accessToken string) (string, error) {
+	proofs := r.Header.Values(headerDPoP)
+	if len(proofs) != 1 {
+		return "", errors.New("exactly one DPoP proof is required")
+	}
+	var key jsonWebKey
+	claims := &dpopClaims{}
+	_, err := jwt.ParseWithClaims(proofs[0], claims, func(token *jwt.Token) (interface{}, error) {
+		if typ, _ := token.Header["typ"].(string); typ != dpopProofType {
+			return nil, fmt.Errorf("unexpected proof type %v", token.Header["typ"])
+		}
+		raw, err := json.Marshal(token.Header["jwk"])
+		if err != nil || token.Header["jwk"] == nil {
+			return nil, errors.New("proof without jwk header")
+		}
+		if err = json.Unmarshal(raw, &key); err != nil {
+			return nil, fmt.Errorf("invalid proof jwk: %s", err.Error())
+		}
+		if key.D != "" {
+			return nil, errors.New("proof jwk is a private key")
+		}
+		switch token.Method.(type) {
+		case *jwt.SigningMethodRSA:
+			return key.rsaPublicKey()
+		case *jwt.SigningMethodECDSA:
+			return key.ecdsaPublicKey()
+		}
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if claims.Method != r.Method {
+		return "", fmt.Errorf("proof issued for method %s", claims.Method)
+	}
+	htu := claims.URI
+	if i := strings.IndexAny(htu, "?#"); i >= 0 {
+		htu = htu[:i]
+	}
+	if htu != requestURL(r, r.URL.Path) {
+		return "", fmt.Errorf("proof issued for uri %s", claims.URI)
+	}
+	maxAge := a.config.DPoPProofMaxAge
+	if maxAge == 0 {
+		maxAge = defaultDPoPProofMaxAge
+	}
+	iat := time.Unix(claims.IssuedAt, 0)
+	if d := time.Since(iat); d > maxAge || d < -maxAge {
+		return "", errors.New("proof expired or issued in the future")
+	}
+	if claims.Id == "" {
+		return "", errors.New("proof without jti")
+	}
+	if accessToken != "" {
+		sum := sha256.Sum256([]byte(accessToken))
+		if claims.AccessTokenHash != base64.RawURLEncoding.EncodeToString(sum[:]) {
+			return "", errors.New("proof not issued for the access token")
+		}
+	}
+	fresh, err := a.Nonces.Use("dpop:"+claims.Id, iat.Add(maxAge))
+	if err != nil {
+		return "", err
+	}
+	if !fresh {
+		return "", errors.New("proof already used")
+	}
+	return key.thumbprint()
+}
+
+// dpopBinding returns the thumbprint of the key the tokens issued to the request are bound to,
+// it is empty if the client did not send a DPoP proof
+func (a *App) dpopBinding(r *http.Request) (string, error) {
+	if r.Header.Get(headerDPoP) == "" {
+		return "", nil
+	}
+	return a.verifyDPoPProof(r, "")
+}
+
+// verifyTokenBinding checks that the client presenting a bound token holds the bound key or client
+// certificate, the DPoP bound access tokens must be presented with the DPoP scheme. The tokens without
+// cnf claim are bearer tokens and need no proof.
+func (a *App) verifyTokenBinding(r *http.Request, accessToken string, cnf *confirmationClaim) error {
+	if err := verifyCertificateBinding(r, cnf); err != nil {
+		return err
+	}
+	if cnf.boundKey() == "" {
+		return nil
+	}
+	if accessToken != "" && !strings.HasPrefix(r.Header.Get(headerAuthorization), "DPoP ") {
+		return errors.New("DPoP bound token presented as bearer token")
+	}
+	jkt, err := a.verifyDPoPProof(r, accessToken)
+	if err != nil {
+		return err
+	}
+	if jkt != cnf.JKT {
+		return errors.New("proof key does not match the token binding")
+	}
+	return nil
+}
+
+// dpopOAuthError returns the OAuth error of the invalid or missing DPoP proof
+func dpopOAuthError(err error) *oauthError {
+	if _, ok := err.(*models.DBError); ok {
+		return newOAuthError(http.StatusInternalServerError, "server_error", "internal error, retry later")
+	}
+	return newOAuthError(http.StatusBadRequest, "invalid_dpop_proof", "%s", err.Error())
+}
+
+// writeDPoPError rejects the request with an invalid or missing DPoP proof
+func writeDPoPError(w http.ResponseWriter, err error) {
+	if _, ok := err.(*models.DBError); ok {
+		jsonapiError(w, http.StatusInternalServerError, "internal error, retry later")
+		return
+	}
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`DPoP error="invalid_dpop_proof", error_description=%q`, err.Error()))
+	jsonapiError(w, http.StatusUnauthorized, "invalid DPoP proof")
+}
+
+// writeTokenBindingError rejects the request whose sender does not prove to hold the key or the
+// certificate the token is bound to
+func writeTokenBindingError(w http.ResponseWriter, cnf *confirmationClaim, err error) {
+	if cnf.boundKey() != "" {
+		writeDPoPError(w, err)
+		return
+	}
+	jsonapiError(w, http.StatusUnauthorized, "invalid client certificate")
+}
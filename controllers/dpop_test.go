@@ -0,0 +1,297 @@
+package controllers
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"github.com/goidp/models"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/golang-jwt/jwt"
+	"github.com/google/jsonapi"
+	"github.com/google/uuid"
+)
+
+// dpopKey returns a P-256 key with its public JSON Web Key and thumbprint
+func dpopKey(t *testing.T) (*ecdsa.PrivateKey, *jsonWebKey, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("could not generate key: %s", err)
+	}
+	jwk := &jsonWebKey{
+		Kty: "EC",
+		Crv: "P-256",
+		X:   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		Y:   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+	}
+	jkt, err := jwk.thumbprint()
+	if err != nil {
+		t.Fatalf("could not compute thumbprint: %s", err)
+	}
+	return key, jwk, jkt
+}
+
+func newDPoPProof(t *testing.T, key *ecdsa.PrivateKey, jwk *jsonWebKey, method, uri, accessToken string, iat time.Time) string {
+	claims := jwt.MapClaims{"htm": method, "htu": uri, "jti": uuid.New().String(), "iat": iat.Unix()}
+	if accessToken != "" {
+		sum := sha256.Sum256([]byte(accessToken))
+		claims["ath"] = base64.RawURLEncoding.EncodeToString(sum[:])
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["typ"] = dpopProofType
+	token.Header["jwk"] = map[string]string{"kty": jwk.Kty, "crv": jwk.Crv, "x": jwk.X, "y": jwk.Y}
+	proof, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("could not sign proof: %s", err)
+	}
+	return proof
+}
+
+// expectNonce expects the record of a single use credential, a DPoP proof or a client assertion, which
+// is already used if replayed
+func expectNonce(s *Suite, replayed bool) {
+	rows := int64(1)
+	if replayed {
+		rows = 0
+	}
+	s.mock.ExpectBegin()
+	s.mock.ExpectExec(regexp.QuoteMeta(
+		`INSERT INTO "used_nonces" ("jti","expires_at") VALUES ($1,$2) ON CONFLICT ("jti") DO UPDATE SET "expires_at"="excluded"."expires_at" WHERE "used_nonces"."expires_at" <= $3`)).
+		WillReturnResult(sqlmock.NewResult(0, rows))
+	s.mock.ExpectCommit()
+}
+
+func TestJWTMiddlewareDPoP(t *testing.T) {
+	s, err := SetupSuite()
+	if err != nil {
+		t.Fatalf("error setting up test suite: %s", err.Error())
+	}
+	a := NewApp(s.DB, &Config{})
+	a.config.SignKey, _ = ReadPrivateKey(PKCS1_Private_Key)
+	a.config.VerifyKey = &a.config.SignKey.PublicKey
+	rL, _ := models.NewRoleList([]string{models.AdminRole.String()})
+	admin := &models.User{Username: "admin", Roles: rL}
+
+	key, jwk, jkt := dpopKey(t)
+	otherKey, otherJWK, _ := dpopKey(t)
+	bound := newCustomClaims(admin, models.InternalDomain, time.Minute, nil, "")
+	bound.Cnf = newConfirmationClaim(jkt)
+	boundToken, _ := generateToken(bound, "", a.config.SignKey)
+	bearerToken, _ := generateToken(newCustomClaims(admin, models.InternalDomain, time.Minute, nil, ""), "", a.config.SignKey)
+	uri := "http://idp.example.com/v1.0/user"
+	replayed := newDPoPProof(t, key, jwk, http.MethodGet, uri, boundToken, time.Now())
+
+	tt := []struct {
+		name   string
+		scheme string
+		token  string
+		proof  string
+		// checked is true if the proof reaches the replay check, replayed if it has been used before,
+		// possibly on another replica
+		checked  bool
+		replayed bool
+		// unavailable is true if the used proofs cannot be read
+		unavailable bool
+		status      int
+	}{
+		{
+			name:    "bound token with valid proof",
+			scheme:  "DPoP",
+			token:   boundToken,
+			proof:   replayed,
+			checked: true,
+			status:  http.StatusOK,
+		},
+		{
+			name:     "replayed proof",
+			scheme:   "DPoP",
+			token:    boundToken,
+			proof:    replayed,
+			checked:  true,
+			replayed: true,
+			status:   http.StatusUnauthorized,
+		},
+		{
+			name:        "replay check unavailable",
+			scheme:      "DPoP",
+			token:       boundToken,
+			proof:       newDPoPProof(t, key, jwk, http.MethodGet, uri, boundToken, time.Now()),
+			unavailable: true,
+			status:      http.StatusInternalServerError,
+		},
+		{
+			name:   "bound token without proof",
+			scheme: "DPoP",
+			token:  boundToken,
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:   "bound token presented as bearer token",
+			scheme: "Bearer",
+			token:  boundToken,
+			proof:  newDPoPProof(t, key, jwk, http.MethodGet, uri, boundToken, time.Now()),
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:    "proof of another key",
+			scheme:  "DPoP",
+			token:   boundToken,
+			proof:   newDPoPProof(t, otherKey, otherJWK, http.MethodGet, uri, boundToken, time.Now()),
+			checked: true,
+			status:  http.StatusUnauthorized,
+		},
+		{
+			name:   "proof issued for another method",
+			scheme: "DPoP",
+			token:  boundToken,
+			proof:  newDPoPProof(t, key, jwk, http.MethodDelete, uri, boundToken, time.Now()),
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:   "proof issued for another uri",
+			scheme: "DPoP",
+			token:  boundToken,
+			proof:  newDPoPProof(t, key, jwk, http.MethodGet, "http://idp.example.com/v1.0/event", boundToken, time.Now()),
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:   "stale proof",
+			scheme: "DPoP",
+			token:  boundToken,
+			proof:  newDPoPProof(t, key, jwk, http.MethodGet, uri, boundToken, time.Now().Add(-5*time.Minute)),
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:   "proof without access token hash",
+			scheme: "DPoP",
+			token:  boundToken,
+			proof:  newDPoPProof(t, key, jwk, http.MethodGet, uri, "", time.Now()),
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:   "bearer token",
+			scheme: "Bearer",
+			token:  bearerToken,
+			status: http.StatusOK,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, uri, nil)
+			req.Header.Set(headerAuthorization, tc.scheme+" "+tc.token)
+			if tc.proof != "" {
+				req.Header.Set(headerDPoP, tc.proof)
+			}
+			rec := httptest.NewRecorder()
+			if tc.checked {
+				expectNonce(s, tc.replayed)
+			}
+			if tc.unavailable {
+				s.mock.ExpectBegin()
+				s.mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "used_nonces"`)).WillReturnError(errors.New("connection refused"))
+				s.mock.ExpectRollback()
+			}
+
+			a.jwtMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}), "user").ServeHTTP(rec, req)
+
+			if err := s.mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+			if rec.Code != tc.status {
+				t.Errorf("expected status %d; got %d", tc.status, rec.Code)
+			}
+		})
+	}
+}
+
+func TestRenewTokenHandlerDPoP(t *testing.T) {
+	s, err := SetupSuite()
+	if err != nil {
+		t.Fatalf("error setting up test suite: %s", err.Error())
+	}
+	a := NewApp(s.DB, &Config{AccessTokenExpireTime: time.Minute, RenewTokenExpireTime: time.Minute})
+	a.config.SignKey, _ = ReadPrivateKey(PKCS1_Private_Key)
+	a.config.VerifyKey = &a.config.SignKey.PublicKey
+
+	key, jwk, jkt := dpopKey(t)
+	otherKey, otherJWK, _ := dpopKey(t)
+	_, renewToken, err := a.issueTokens(&models.User{Username: "admin"}, models.InternalDomain, time.Minute, nil, "", jkt, "")
+	if err != nil {
+		t.Fatalf("error generating tokens: %s", err)
+	}
+	uri := "http://idp.example.com/v1.0/renew"
+
+	tt := []struct {
+		name   string
+		proof  string
+		status int
+	}{
+		{
+			name:   "proof of the bound key",
+			proof:  newDPoPProof(t, key, jwk, http.MethodPost, uri, "", time.Now()),
+			status: http.StatusOK,
+		},
+		{
+			name:   "missing proof",
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:   "proof of another key",
+			proof:  newDPoPProof(t, otherKey, otherJWK, http.MethodPost, uri, "", time.Now()),
+			status: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			requestBody := bytes.NewBuffer(nil)
+			if err := jsonapi.MarshalPayload(requestBody, &RenewTokenHandlerRequest{UserID: "admin", RenewToken: renewToken}); err != nil {
+				t.Fatalf("could not marshal request body %v", err)
+			}
+			req, _ := http.NewRequest(http.MethodPost, uri, requestBody)
+			if tc.proof != "" {
+				req.Header.Set(headerDPoP, tc.proof)
+			}
+			rec := httptest.NewRecorder()
+
+			s.mock.ExpectQuery(regexp.QuoteMeta(
+				`SELECT * FROM "users" WHERE username = $1 AND "users"."deleted_at" IS NULL ORDER BY "users"."id" LIMIT 1`)).
+				WithArgs("admin").
+				WillReturnRows(sqlmock.NewRows([]string{"Username", "Version"}).AddRow("admin", 0))
+			if tc.proof != "" {
+				expectNonce(s, false)
+			}
+
+			a.RenewTokenHandler(rec, req)
+
+			if err := s.mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+			if rec.Code != tc.status {
+				t.Fatalf("expected status %d; got %d: %s", tc.status, rec.Code, rec.Body.String())
+			}
+			if tc.status != http.StatusOK {
+				return
+			}
+			claims, err := getClaimsFromAccessToken(parseAuthHeader(&http.Request{Header: rec.Header()}), "", a.config.VerifyKey)
+			if err != nil {
+				t.Fatalf("could not decode renewed token: %s", err)
+			}
+			if claims.Cnf.boundKey() != jkt {
+				t.Errorf("expected renewed token bound to %s; got %+v", jkt, claims.Cnf)
+			}
+		})
+	}
+}
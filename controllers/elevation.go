@@ -0,0 +1,233 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"github.com/goidp/models"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/jsonapi"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// ElevationResource is the jsonapi representation of an elevation request
+type ElevationResource struct {
+	ID            string     `jsonapi:"primary,elevation,omitempty"`
+	Username      string     `jsonapi:"attr,username,omitempty"`
+	Role          string     `jsonapi:"attr,role,omitempty"`
+	Justification string     `jsonapi:"attr,justification,omitempty"`
+	Status        string     `jsonapi:"attr,status,omitempty"`
+	Approver      string     `jsonapi:"attr,approver,omitempty"`
+	StartsAt      *time.Time `jsonapi:"attr,starts_at,iso8601,omitempty"`
+	ExpiresAt     *time.Time `jsonapi:"attr,expires_at,iso8601,omitempty"`
+	CreatedAt     *time.Time `jsonapi:"attr,created_at,iso8601,omitempty"`
+	DecidedAt     *time.Time `jsonapi:"attr,decided_at,iso8601,omitempty"`
+}
+
+func newElevationResource(e *models.Elevation) *ElevationResource {
+	eR := &ElevationResource{
+		ID:            strconv.Itoa(int(e.ID)),
+		Username:      e.Username,
+		Role:          e.Role,
+		Justification: e.Justification,
+		Status:        e.Status,
+		Approver:      e.Approver,
+		StartsAt:      &e.StartsAt,
+		ExpiresAt:     &e.ExpiresAt,
+		CreatedAt:     &e.CreatedAt,
+	}
+	if !e.DecidedAt.IsZero() {
+		eR.DecidedAt = &e.DecidedAt
+	}
+	return eR
+}
+
+// apply validates the elevation requested by the user
+func (eR *ElevationResource) apply(e *models.Elevation, user *models.User, maxDuration time.Duration) error {
+	rL, err := models.NewRoleList([]string{eR.Role})
+	if err != nil {
+		return err
+	}
+	role := models.UserRole(rL[0].ID).String()
+	if stringInSliceCaseInsensitive(user.Roles.String(), role) {
+		return fmt.Errorf("role %s already granted to %s", role, user.Username)
+	}
+	if eR.Justification == "" {
+		return errors.New("justification cannot be empty")
+	}
+	startsAt := time.Now()
+	if eR.StartsAt != nil && eR.StartsAt.After(startsAt) {
+		startsAt = *eR.StartsAt
+	}
+	if eR.ExpiresAt == nil || !eR.ExpiresAt.After(startsAt) {
+		return errors.New("expiration time must follow the start time")
+	}
+	if maxDuration > 0 && eR.ExpiresAt.Sub(startsAt) > maxDuration {
+		return fmt.Errorf("elevation cannot exceed %s", maxDuration)
+	}
+	e.Username = user.Username
+	e.Role = role
+	e.Justification = eR.Justification
+	e.Status = models.ElevationPending
+	e.StartsAt = startsAt
+	e.ExpiresAt = *eR.ExpiresAt
+	return nil
+}
+
+// loadElevations attaches to the local user its active elevations, whose roles are granted by its tokens
+func (a *App) loadElevations(user *models.User) {
+	if user.ID == 0 {
+		// only the local users can be elevated
+		return
+	}
+	elevations, err := a.Elevations.GetActiveElevations(user.Username)
+	if err != nil {
+		log.WithError(err).Warnf("failed to load the elevations of %s", user.Username)
+		return
+	}
+	user.Elevations = elevations
+}
+
+// ElevationsHandler lists (GET) the elevations, the administrators see all of them and the other users
+// their own ones, or requests (POST) an elevation of the user
+func (a *App) ElevationsHandler(w http.ResponseWriter, r *http.Request) {
+	claims, err := a.getRequestClaims(parseAuthHeader(r))
+	if err != nil || claims.Subject == "" {
+		jsonapiError(w, http.StatusUnauthorized, "unauthorized request")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		username := r.URL.Query().Get("username")
+		if !stringInSliceCaseInsensitive(claims.Roles, models.AdminRole.String()) {
+			username = claims.Subject
+		}
+		var elevations []*models.Elevation
+		if username == "" {
+			elevations, err = a.Elevations.GetAllElevations()
+		} else {
+			elevations, err = a.Elevations.GetElevations(username)
+		}
+		if err != nil {
+			jsonapiError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		resources := make([]*ElevationResource, 0)
+		for _, e := range elevations {
+			resources = append(resources, newElevationResource(e))
+		}
+		jsonapiSuccess(w, resources, http.StatusOK)
+	case http.MethodPost:
+		if claims.Act != nil {
+			jsonapiError(w, http.StatusForbidden, "elevations cannot be requested on behalf of another user")
+			return
+		}
+		// the external identities, the service accounts and the subjects of the trusted issuers may be
+		// named like a local user
+		if !claims.localUser(claims.Subject) {
+			jsonapiError(w, http.StatusForbidden, "only local users can request an elevation")
+			return
+		}
+		user, err := a.Users.GetUserByNameOrID(claims.Subject)
+		switch err.(type) {
+		case *models.NotFoundError:
+			jsonapiError(w, http.StatusForbidden, "only local users can request an elevation")
+			return
+		case *models.DBError:
+			jsonapiError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		var requestBody ElevationResource
+		if err = jsonapi.UnmarshalPayload(r.Body, &requestBody); err != nil {
+			jsonapiError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		var e models.Elevation
+		if err = requestBody.apply(&e, user, a.config.ElevationMaxDuration); err != nil {
+			jsonapiError(w, http.StatusBadRequest, fmt.Sprintf("invalid elevation: %s", err.Error()))
+			return
+		}
+		if err = a.Elevations.Create(&e); err != nil {
+			jsonapiError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err = a.Events.CreateElevationEvent(&e, claims.Subject); err != nil {
+			log.WithError(err).Warnf("failed to store elevation event")
+		}
+		jsonapiSuccess(w, newElevationResource(&e), http.StatusCreated)
+	}
+}
+
+// ElevationHandler reads (GET) an elevation or approves or denies (PATCH) a pending elevation request,
+// the requests are decided by an administrator other than the requester
+func (a *App) ElevationHandler(w http.ResponseWriter, r *http.Request) {
+	claims, err := a.getRequestClaims(parseAuthHeader(r))
+	if err != nil || claims.Subject == "" {
+		jsonapiError(w, http.StatusUnauthorized, "unauthorized request")
+		return
+	}
+	e, err := a.Elevations.GetElevation(mux.Vars(r)["id"])
+	switch err.(type) {
+	case *models.NotFoundError:
+		jsonapiError(w, http.StatusNotFound, err.Error())
+		return
+	case *models.DBError:
+		jsonapiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	admin := stringInSliceCaseInsensitive(claims.Roles, models.AdminRole.String())
+	if !admin && e.Username != claims.Subject {
+		jsonapiError(w, http.StatusNotFound, fmt.Sprintf("elevation %d not present in database", e.ID))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		jsonapiSuccess(w, newElevationResource(e), http.StatusOK)
+	case http.MethodPatch:
+		if !admin || claims.Act != nil {
+			jsonapiError(w, http.StatusForbidden, "forbidden request")
+			return
+		}
+		if e.Username == claims.Subject {
+			jsonapiError(w, http.StatusForbidden, "elevations cannot be decided by the requester")
+			return
+		}
+		var requestBody ElevationResource
+		if err = jsonapi.UnmarshalPayload(r.Body, &requestBody); err != nil {
+			jsonapiError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if requestBody.Status != models.ElevationApproved && requestBody.Status != models.ElevationDenied {
+			jsonapiError(w, http.StatusBadRequest, fmt.Sprintf("invalid elevation status %s", requestBody.Status))
+			return
+		}
+		if e.Status != models.ElevationPending {
+			jsonapiError(w, http.StatusConflict, fmt.Sprintf("elevation already %s", e.Status))
+			return
+		}
+		if !time.Now().Before(e.ExpiresAt) {
+			jsonapiError(w, http.StatusConflict, "elevation window has ended")
+			return
+		}
+		e.Status = requestBody.Status
+		e.Approver = claims.Subject
+		e.DecidedAt = time.Now()
+		err = a.Elevations.DecideElevation(e)
+		switch err.(type) {
+		case *models.ConflictError:
+			jsonapiError(w, http.StatusConflict, err.Error())
+			return
+		case *models.DBError:
+			jsonapiError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err = a.Events.CreateElevationEvent(e, claims.Subject); err != nil {
+			log.WithError(err).Warnf("failed to store elevation event")
+		}
+		jsonapiSuccess(w, newElevationResource(e), http.StatusOK)
+	}
+}
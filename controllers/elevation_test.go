@@ -0,0 +1,256 @@
+package controllers
+
+import (
+	"bytes"
+	"github.com/goidp/models"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+)
+
+var elevationColumns = []string{"id", "username", "role", "justification", "status", "approver", "starts_at", "expires_at"}
+
+func TestElevationsHandler(t *testing.T) {
+	s, err := SetupSuite()
+	if err != nil {
+		t.Fatalf("error setting up test suite: %s", err.Error())
+	}
+	a := NewApp(s.DB, &Config{ElevationMaxDuration: 4 * time.Hour})
+	a.config.SignKey, _ = ReadPrivateKey(PKCS1_Private_Key)
+	a.config.VerifyKey = &a.config.SignKey.PublicKey
+	rL, _ := models.NewRoleList([]string{models.MonitorRole.String()})
+	token, _ := generateToken(newCustomClaims(&models.User{Username: "jdoe", Roles: rL}, models.InternalDomain, time.Minute, nil, ""), "", a.config.SignKey)
+	// the principals named like the local user
+	externalToken, _ := generateToken(newCustomClaims(&models.User{Username: "jdoe", Roles: rL}, models.ExternalDomain, time.Minute, nil, ""), "", a.config.SignKey)
+	identityToken, _ := generateToken(newCustomClaims(&models.User{Username: "jdoe", Roles: rL, IdentityID: 3}, models.ExternalDomain, time.Minute, nil, ""), "", a.config.SignKey)
+	serviceAccountToken, _ := generateToken(newCustomClaims(&models.User{Username: "jdoe", Roles: rL}, models.ServiceAccountDomain, time.Minute, nil, ""), "", a.config.SignKey)
+	expiresAt := func(d time.Duration) string {
+		return time.Now().Add(d).UTC().Format(time.RFC3339)
+	}
+
+	tt := []struct {
+		name    string
+		body    string
+		token   string
+		created bool
+		status  int
+	}{
+		{
+			name:    "request an elevation",
+			body:    `{"data":{"type":"elevation","attributes":{"role":"helpdesk","justification":"incident 42","expires_at":"` + expiresAt(time.Hour) + `"}}}`,
+			created: true,
+			status:  http.StatusCreated,
+		},
+		{
+			name:   "role already granted",
+			body:   `{"data":{"type":"elevation","attributes":{"role":"monitor","justification":"incident 42","expires_at":"` + expiresAt(time.Hour) + `"}}}`,
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "missing justification",
+			body:   `{"data":{"type":"elevation","attributes":{"role":"helpdesk","expires_at":"` + expiresAt(time.Hour) + `"}}}`,
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "window beyond the maximum duration",
+			body:   `{"data":{"type":"elevation","attributes":{"role":"admin","justification":"incident 42","expires_at":"` + expiresAt(5*time.Hour) + `"}}}`,
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "window in the past",
+			body:   `{"data":{"type":"elevation","attributes":{"role":"admin","justification":"incident 42","expires_at":"` + expiresAt(-time.Hour) + `"}}}`,
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "requested with the token of a trusted issuer subject",
+			body:   `{"data":{"type":"elevation","attributes":{"role":"helpdesk","justification":"incident 42","expires_at":"` + expiresAt(time.Hour) + `"}}}`,
+			token:  externalToken,
+			status: http.StatusForbidden,
+		},
+		{
+			name:   "requested with the token of an external identity",
+			body:   `{"data":{"type":"elevation","attributes":{"role":"helpdesk","justification":"incident 42","expires_at":"` + expiresAt(time.Hour) + `"}}}`,
+			token:  identityToken,
+			status: http.StatusForbidden,
+		},
+		{
+			name:   "requested with a service account token",
+			body:   `{"data":{"type":"elevation","attributes":{"role":"helpdesk","justification":"incident 42","expires_at":"` + expiresAt(time.Hour) + `"}}}`,
+			token:  serviceAccountToken,
+			status: http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			auth := token
+			if tc.token != "" {
+				auth = tc.token
+			} else {
+				expectTokenOwner(s, "jdoe", models.MonitorRole)
+			}
+			if tc.created {
+				s.mock.ExpectBegin()
+				s.mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "elevations"`)).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+				s.mock.ExpectCommit()
+				expectEvent(s)
+			}
+
+			req, _ := http.NewRequest(http.MethodPost, "/v1.0/elevation", bytes.NewBufferString(tc.body))
+			req.Header.Set(headerAuthorization, "Bearer "+auth)
+			rec := httptest.NewRecorder()
+			a.ElevationsHandler(rec, req)
+
+			if err := s.mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+			if rec.Code != tc.status {
+				t.Fatalf("expected status %d; got %d: %s", tc.status, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestElevationHandler(t *testing.T) {
+	s, err := SetupSuite()
+	if err != nil {
+		t.Fatalf("error setting up test suite: %s", err.Error())
+	}
+	a := NewApp(s.DB, &Config{})
+	a.config.SignKey, _ = ReadPrivateKey(PKCS1_Private_Key)
+	a.config.VerifyKey = &a.config.SignKey.PublicKey
+	rL, _ := models.NewRoleList([]string{models.AdminRole.String()})
+
+	tt := []struct {
+		name      string
+		approver  string
+		requester string
+		status    string
+		current   string
+		updated   bool
+		// concurrent is whether the request is decided or expires meanwhile
+		concurrent bool
+		code       int
+	}{
+		{
+			name:      "approved by another administrator",
+			approver:  "admin",
+			requester: "jdoe",
+			status:    models.ElevationApproved,
+			current:   models.ElevationPending,
+			updated:   true,
+			code:      http.StatusOK,
+		},
+		{
+			name:      "denied by another administrator",
+			approver:  "admin",
+			requester: "jdoe",
+			status:    models.ElevationDenied,
+			current:   models.ElevationPending,
+			updated:   true,
+			code:      http.StatusOK,
+		},
+		{
+			name:      "approved by the requester",
+			approver:  "admin",
+			requester: "admin",
+			status:    models.ElevationApproved,
+			current:   models.ElevationPending,
+			code:      http.StatusForbidden,
+		},
+		{
+			name:       "decided concurrently by another administrator",
+			approver:   "admin",
+			requester:  "jdoe",
+			status:     models.ElevationApproved,
+			current:    models.ElevationPending,
+			updated:    true,
+			concurrent: true,
+			code:       http.StatusConflict,
+		},
+		{
+			name:      "already decided",
+			approver:  "admin",
+			requester: "jdoe",
+			status:    models.ElevationApproved,
+			current:   models.ElevationDenied,
+			code:      http.StatusConflict,
+		},
+		{
+			name:      "invalid status",
+			approver:  "admin",
+			requester: "jdoe",
+			status:    models.ElevationExpired,
+			current:   models.ElevationPending,
+			code:      http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			token, _ := generateToken(newCustomClaims(&models.User{Username: tc.approver, Roles: rL}, models.InternalDomain, time.Minute, nil, ""), "", a.config.SignKey)
+			s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "elevations" WHERE "elevations"."id" = $1`)).
+				WithArgs(3).WillReturnRows(sqlmock.NewRows(elevationColumns).
+				AddRow(3, tc.requester, "HELPDESK", "incident 42", tc.current, "", time.Now(), time.Now().Add(time.Hour)))
+			if tc.updated {
+				// the decision is stored only if the request is still pending
+				affected := int64(1)
+				if tc.concurrent {
+					affected = 0
+				}
+				s.mock.ExpectBegin()
+				s.mock.ExpectExec(regexp.QuoteMeta(
+					`UPDATE "elevations" SET "approver"=$1,"decided_at"=$2,"status"=$3,"updated_at"=$4 WHERE status = $5 AND "elevations"."deleted_at" IS NULL AND "id" = $6`)).
+					WithArgs(tc.approver, sqlmock.AnyArg(), tc.status, sqlmock.AnyArg(), models.ElevationPending, 3).
+					WillReturnResult(sqlmock.NewResult(3, affected))
+				s.mock.ExpectCommit()
+				if !tc.concurrent {
+					expectEvent(s)
+				}
+			}
+
+			body := `{"data":{"type":"elevation","attributes":{"status":"` + tc.status + `"}}}`
+			req, _ := http.NewRequest(http.MethodPatch, "/v1.0/elevation/3", bytes.NewBufferString(body))
+			req.Header.Set(headerAuthorization, "Bearer "+token)
+			req = mux.SetURLVars(req, map[string]string{"id": "3"})
+			rec := httptest.NewRecorder()
+			a.ElevationHandler(rec, req)
+
+			if err := s.mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+			if rec.Code != tc.code {
+				t.Fatalf("expected status %d; got %d: %s", tc.code, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestNewCustomClaimsElevation(t *testing.T) {
+	rL, _ := models.NewRoleList([]string{models.MonitorRole.String()})
+	now := time.Now()
+	user := &models.User{
+		Username: "jdoe",
+		Roles:    rL,
+		Elevations: []*models.Elevation{
+			{Role: "HELPDESK", Status: models.ElevationApproved, StartsAt: now.Add(-time.Minute), ExpiresAt: now.Add(10 * time.Minute)},
+			{Role: "ADMIN", Status: models.ElevationApproved, StartsAt: now.Add(time.Minute), ExpiresAt: now.Add(time.Hour)},
+			{Role: "ADMIN", Status: models.ElevationDenied, StartsAt: now.Add(-time.Minute), ExpiresAt: now.Add(time.Hour)},
+		},
+	}
+
+	claims := newCustomClaims(user, models.InternalDomain, time.Hour, nil, "")
+	if !stringInSlice(claims.Roles, "HELPDESK") || stringInSlice(claims.Roles, "ADMIN") {
+		t.Errorf("unexpected roles %v", claims.Roles)
+	}
+	// the token does not outlive the window of the elevation
+	if claims.ExpiresAt > now.Add(10*time.Minute).Unix() {
+		t.Errorf("token outlives the elevation window")
+	}
+}
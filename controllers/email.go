@@ -0,0 +1,151 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"github.com/goidp/models"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// emailVerificationAudience is the audience of the email verification tokens, which are therefore not
+// accepted as access tokens
+const emailVerificationAudience = "email-verification"
+
+// emailVerificationClaims are the claims of the tokens delivered to the users to verify their email
+type emailVerificationClaims struct {
+	Email string `json:"email"`
+	jwt.StandardClaims
+}
+
+// emailVerificationLink returns the link verifying the email of the user, the link carries a signed token
+// bound to the current email of the user
+func (a *App) emailVerificationLink(r *http.Request, user *models.User) (string, error) {
+	claims := emailVerificationClaims{
+		Email: user.Email,
+		StandardClaims: jwt.StandardClaims{
+			Audience:  emailVerificationAudience,
+			ExpiresAt: time.Now().Add(a.config.EmailVerificationExpireTime).Unix(),
+			IssuedAt:  time.Now().Unix(),
+			Subject:   user.Username,
+			Id:        uuid.New().String(),
+			Issuer:    "idp",
+		},
+	}
+	token, err := generateToken(claims, a.config.Secret, a.config.SignKey)
+	if err != nil {
+		return "", err
+	}
+	link := a.config.EmailVerificationURL
+	if link == "" {
+		link = requestURL(r, fmt.Sprintf("/%s/email/verify", ApiVersion))
+	}
+	separator := "?"
+	if strings.Contains(link, "?") {
+		separator = "&"
+	}
+	return link + separator + "token=" + url.QueryEscape(token), nil
+}
+
+// sendEmailVerification mails to the user the link verifying its email
+func (a *App) sendEmailVerification(r *http.Request, user *models.User) error {
+	if a.Mailer == nil {
+		return errors.New("email verification not configured")
+	}
+	link, err := a.emailVerificationLink(r, user)
+	if err != nil {
+		return err
+	}
+	body := fmt.Sprintf("Hello %s,\n\nplease verify your email address by opening the following link within %s:\n\n%s\n",
+		user.Username, a.config.EmailVerificationExpireTime, link)
+	return a.Mailer.Send(user.Email, "Verify your email address", body)
+}
+
+// requestEmailVerification sends the verification of the new email of the user, if a mailer is configured
+func (a *App) requestEmailVerification(r *http.Request, user *models.User) {
+	if a.Mailer == nil || user.Email == "" || user.EmailVerified {
+		return
+	}
+	if err := a.sendEmailVerification(r, user); err != nil {
+		log.WithError(err).Warnf("failed to send the email verification of %s", user.Username)
+	}
+}
+
+// EmailVerificationHandler sends (POST) again the verification of the email of the user, the users request
+// the verification of their own email only
+func (a *App) EmailVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	if a.Mailer == nil {
+		jsonapiError(w, http.StatusNotFound, "email verification not configured")
+		return
+	}
+	user, err := a.Users.GetUserByNameOrID(mux.Vars(r)["id"])
+	switch err.(type) {
+	case *models.NotFoundError:
+		jsonapiError(w, http.StatusNotFound, err.Error())
+		return
+	case *models.DBError:
+		jsonapiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if user.Email == "" {
+		jsonapiError(w, http.StatusBadRequest, fmt.Sprintf("user %s has no email", user.Username))
+		return
+	}
+	if user.EmailVerified {
+		jsonapiError(w, http.StatusConflict, "email already verified")
+		return
+	}
+	if err = a.sendEmailVerification(r, user); err != nil {
+		log.WithError(err).Warnf("failed to send the email verification of %s", user.Username)
+		jsonapiError(w, http.StatusBadGateway, "failed to send the email verification")
+		return
+	}
+	jsonapiNoContentSuccess(w)
+}
+
+// VerifyEmailHandler verifies the email of the user with the token delivered by email, the token is
+// passed as token parameter of the link (GET) or of the form (POST)
+func (a *App) VerifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	claims := &emailVerificationClaims{}
+	token, err := jwt.ParseWithClaims(r.FormValue("token"), claims, getKeyFunc(a.config.Secret, a.config.VerifyKey))
+	if err != nil || !token.Valid || !claims.VerifyAudience(emailVerificationAudience, true) {
+		jsonapiError(w, http.StatusBadRequest, "invalid verification token")
+		return
+	}
+	user, err := a.Users.GetUserByNameOrID(claims.Subject)
+	switch err.(type) {
+	case *models.NotFoundError:
+		jsonapiError(w, http.StatusBadRequest, "invalid verification token")
+		return
+	case *models.DBError:
+		jsonapiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	// the token verifies the email it has been issued for only
+	if !strings.EqualFold(user.Email, claims.Email) {
+		jsonapiError(w, http.StatusBadRequest, "email changed since the verification was requested")
+		return
+	}
+	if !user.EmailVerified {
+		user.EmailVerified = true
+		switch err := a.Users.UpdateUserProfile(user).(type) {
+		case *models.UserError, *models.ConflictError:
+			jsonapiError(w, http.StatusConflict, err.Error())
+			return
+		case *models.DBError:
+			jsonapiError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err = a.Events.CreateEmailVerifiedEvent(user.Username, user.Email); err != nil {
+			log.WithError(err).Warnf("failed to store user event")
+		}
+	}
+	jsonapiSuccess(w, newUserResponse(user), http.StatusOK)
+}
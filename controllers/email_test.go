@@ -0,0 +1,261 @@
+package controllers
+
+import (
+	"github.com/goidp/models"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// smtpStandIn is a local SMTP server accepting any message, the messages received are queued in messages
+type smtpStandIn struct {
+	net.Listener
+	messages chan string
+}
+
+func newSMTPStandIn(t *testing.T) *smtpStandIn {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start the SMTP stand-in: %s", err)
+	}
+	s := &smtpStandIn{Listener: l, messages: make(chan string, 10)}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+func (s *smtpStandIn) serve(c net.Conn) {
+	defer c.Close()
+	tp := textproto.NewConn(c)
+	_ = tp.PrintfLine("220 localhost ESMTP")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil || line == "" {
+			return
+		}
+		switch strings.ToUpper(strings.Fields(line)[0]) {
+		case "EHLO", "HELO":
+			_ = tp.PrintfLine("250 localhost")
+		case "MAIL", "RCPT", "RSET", "NOOP":
+			_ = tp.PrintfLine("250 OK")
+		case "DATA":
+			_ = tp.PrintfLine("354 end data with <CR><LF>.<CR><LF>")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.messages <- string(data)
+			_ = tp.PrintfLine("250 OK")
+		case "QUIT":
+			_ = tp.PrintfLine("221 bye")
+			return
+		default:
+			_ = tp.PrintfLine("502 command not implemented")
+		}
+	}
+}
+
+// mailer returns a mailer delivering to the stand-in
+func (s *smtpStandIn) mailer() *SMTPMailer {
+	host, port, _ := net.SplitHostPort(s.Addr().String())
+	return &SMTPMailer{Host: host, Port: port, From: "idp@example.com"}
+}
+
+func (s *smtpStandIn) receive(t *testing.T) string {
+	select {
+	case m := <-s.messages:
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no message received by the SMTP stand-in")
+	}
+	return ""
+}
+
+func TestSMTPMailer(t *testing.T) {
+	smtpServer := newSMTPStandIn(t)
+	defer smtpServer.Close()
+	m := smtpServer.mailer()
+
+	if err := m.Send("jdoe@example.com", "Hello", "first line\nsecond line"); err != nil {
+		t.Fatalf("failed to send the email: %s", err)
+	}
+	msg := smtpServer.receive(t)
+	for _, expected := range []string{"From: idp@example.com", "To: jdoe@example.com", "Subject: Hello", "first line\nsecond line"} {
+		if !strings.Contains(msg, expected) {
+			t.Errorf("expected %q in message %q", expected, msg)
+		}
+	}
+	if err := m.Send("jdoe@example.com\r\nBcc: eve@example.com", "Hello", ""); err == nil {
+		t.Errorf("header injection accepted")
+	}
+}
+
+func TestEmailVerification(t *testing.T) {
+	s, err := SetupSuite()
+	if err != nil {
+		t.Fatalf("error setting up test suite: %s", err.Error())
+	}
+	smtpServer := newSMTPStandIn(t)
+	defer smtpServer.Close()
+	a := NewApp(s.DB, &Config{EmailVerificationExpireTime: time.Hour})
+	a.config.SignKey, _ = ReadPrivateKey(PKCS1_Private_Key)
+	a.config.VerifyKey = &a.config.SignKey.PublicKey
+	a.Mailer = smtpServer.mailer()
+	userColumns := []string{"id", "username", "email", "email_verified"}
+	expectUser := func(email string, verified bool) {
+		s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "users" WHERE username = $1`)).
+			WithArgs("jdoe").WillReturnRows(sqlmock.NewRows(userColumns).AddRow(7, "jdoe", email, verified))
+		s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "user_roles" WHERE "user_roles"."user_id" = $1`)).
+			WithArgs(7).WillReturnRows(sqlmock.NewRows([]string{"user_id", "role_id"}))
+	}
+
+	// the verification is requested and delivered by email
+	expectUser("jdoe@example.com", false)
+	req, _ := http.NewRequest(http.MethodPost, "/v1.0/user/jdoe/email/verification", nil)
+	req.Host = "idp.example.com"
+	req = mux.SetURLVars(req, map[string]string{"id": "jdoe"})
+	rec := httptest.NewRecorder()
+	a.EmailVerificationHandler(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d; got %d: %s", http.StatusNoContent, rec.Code, rec.Body.String())
+	}
+	msg := smtpServer.receive(t)
+	link := regexp.MustCompile(`http://idp\.example\.com/v1\.0/email/verify\?token=(\S+)`).FindStringSubmatch(msg)
+	if link == nil {
+		t.Fatalf("no verification link in message %q", msg)
+	}
+	token, _ := url.QueryUnescape(link[1])
+	rL, _ := models.NewRoleList([]string{models.MonitorRole.String()})
+	accessToken, _ := generateToken(newCustomClaims(&models.User{Username: "jdoe", Roles: rL}, models.InternalDomain, time.Minute, nil, ""), "", a.config.SignKey)
+
+	tt := []struct {
+		name     string
+		token    string
+		email    string
+		verified bool
+		updated  bool
+		status   int
+	}{
+		{
+			name:   "access token",
+			token:  accessToken,
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "email changed since the request",
+			token:  token,
+			email:  "john@example.com",
+			status: http.StatusBadRequest,
+		},
+		{
+			name:    "email verified",
+			token:   token,
+			email:   "jdoe@example.com",
+			updated: true,
+			status:  http.StatusOK,
+		},
+		{
+			name:     "email already verified",
+			token:    token,
+			email:    "jdoe@example.com",
+			verified: true,
+			status:   http.StatusOK,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.email != "" {
+				expectUser(tc.email, tc.verified)
+			}
+			if tc.updated {
+				// the email is validated in the transaction storing it
+				s.mock.ExpectBegin()
+				s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "users" WHERE (lower(email) = lower($1) OR username = $2) AND id <> $3`)).
+					WithArgs("jdoe@example.com", "jdoe@example.com", 7).WillReturnRows(sqlmock.NewRows(nil))
+				expectRevision(s, 7, 0, 1)
+				s.mock.ExpectExec(regexp.QuoteMeta(`UPDATE "users" SET`)).WillReturnResult(sqlmock.NewResult(7, 1))
+				s.mock.ExpectCommit()
+				expectEvent(s)
+			}
+
+			req, _ := http.NewRequest(http.MethodGet, "/v1.0/email/verify?token="+url.QueryEscape(tc.token), nil)
+			rec := httptest.NewRecorder()
+			a.VerifyEmailHandler(rec, req)
+
+			if err := s.mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+			if rec.Code != tc.status {
+				t.Fatalf("expected status %d; got %d: %s", tc.status, rec.Code, rec.Body.String())
+			}
+			if tc.status == http.StatusOK && !strings.Contains(rec.Body.String(), `"email_verified":true`) {
+				t.Errorf("email not verified: %s", rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestAuthenticateVerifiedEmail(t *testing.T) {
+	s, err := SetupSuite()
+	if err != nil {
+		t.Fatalf("error setting up test suite: %s", err.Error())
+	}
+	a := NewApp(s.DB, &Config{})
+	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("s3cr3t"), bcrypt.MinCost)
+
+	tt := []struct {
+		name     string
+		verified bool
+	}{
+		{
+			name:     "verified email",
+			verified: true,
+		},
+		{
+			name: "unverified email",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "users" WHERE username = $1`)).
+				WithArgs("jdoe@example.com").WillReturnRows(sqlmock.NewRows(nil))
+			rows := sqlmock.NewRows([]string{"username", "password", "email", "email_verified"})
+			if tc.verified {
+				rows.AddRow("jdoe", string(hashedPassword), "jdoe@example.com", true)
+			}
+			s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "users" WHERE (lower(email) = lower($1) AND email_verified)`)).
+				WithArgs("jdoe@example.com").WillReturnRows(rows)
+
+			user, domain, ok := a.authenticate("jdoe@example.com", "s3cr3t")
+
+			if err := s.mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+			if ok != tc.verified {
+				t.Fatalf("expected authentication %t; got %t", tc.verified, ok)
+			}
+			if ok && (user.Username != "jdoe" || domain != models.InternalDomain) {
+				t.Errorf("unexpected user %s of domain %s", user.Username, domain)
+			}
+		})
+	}
+}
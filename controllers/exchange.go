@@ -0,0 +1,226 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"github.com/goidp/models"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	tokenTypeAccessToken = "urn:ietf:params:oauth:token-type:access_token"
+	tokenTypeJWT         = "urn:ietf:params:oauth:token-type:jwt"
+)
+
+// tokenExchangeResponse is the RFC 8693 successful response
+type tokenExchangeResponse struct {
+	AccessToken     string `json:"access_token"`
+	IssuedTokenType string `json:"issued_token_type"`
+	TokenType       string `json:"token_type"`
+	ExpiresIn       int64  `json:"expires_in"`
+	Scope           string `json:"scope,omitempty"`
+}
+
+// validateToken accepts both the access tokens issued by goidp and the tokens of the trusted issuers
+func (a *App) validateToken(t string) (*customClaims, error) {
+	if t == "" {
+		return nil, errors.New("empty token")
+	}
+	if claims, err := getClaimsFromAccessToken(t, a.config.Secret, a.config.VerifyKey); err == nil {
+		if err = a.verifyGeneration(claims); err != nil {
+			return nil, err
+		}
+		return claims, nil
+	}
+	claims, err := a.issuers.authorize(t)
+	if err != nil {
+		return nil, err
+	}
+	claims.Azt = models.ExternalDomain
+	// the session, the generation and the identity of the tokens of other issuers have no meaning here
+	claims.Sid = ""
+	claims.Ver = 0
+	claims.Eid = 0
+	return claims, nil
+}
+
+// narrowScope splits the requested scope into roles and token scopes, which must be a subset of the
+// subject ones
+// the subject roles and scope are kept as they are if none is requested
+func narrowScope(subject *customClaims, scope string) ([]string, string, error) {
+	var roles, scopes []string
+	for _, s := range strings.Fields(scope) {
+		if _, err := models.NewRoleList([]string{s}); err == nil {
+			if !stringInSliceCaseInsensitive(subject.Roles, s) {
+				return nil, "", fmt.Errorf("role %s not granted to the subject", s)
+			}
+			if !stringInSliceCaseInsensitive(roles, s) {
+				roles = append(roles, strings.ToUpper(s))
+			}
+			continue
+		}
+		if subject.Scope != "" && !stringInSlice(strings.Fields(subject.Scope), s) {
+			return nil, "", fmt.Errorf("scope %s not granted to the subject", s)
+		}
+		if !stringInSlice(scopes, s) {
+			scopes = append(scopes, s)
+		}
+	}
+	if len(roles) == 0 {
+		roles = subject.Roles
+	}
+	if len(scopes) == 0 {
+		return roles, subject.Scope, nil
+	}
+	return roles, strings.Join(scopes, " "), nil
+}
+
+// narrowAudience checks that the requested audience is a subset of the subject one, the subject
+// audience is kept as it is if none is requested
+// a subject token without audience is accepted by any service, so any audience can be requested
+func narrowAudience(subject *customClaims, audience []string) ([]string, error) {
+	if len(audience) == 0 {
+		return subject.Audience, nil
+	}
+	for _, aud := range audience {
+		if len(subject.Audience) > 0 && !stringInSlice(subject.Audience, aud) {
+			return nil, fmt.Errorf("audience %s not granted to the subject", aud)
+		}
+	}
+	return audience, nil
+}
+
+// verifySubjectBinding checks that the holder of the key a subject token is bound to exchanges it, the
+// DPoP proof and the client certificate of the request must match the subject binding
+func verifySubjectBinding(r *http.Request, subject *customClaims, jkt string) error {
+	if subject.Cnf == nil {
+		return nil
+	}
+	if subject.Cnf.JKT != "" && subject.Cnf.JKT != jkt {
+		return errors.New("subject token is bound to another DPoP key")
+	}
+	return verifyCertificateBinding(r, subject.Cnf)
+}
+
+// TokenExchangeHandler implements the RFC 8693 token exchange: a service (the actor) presents a token
+// of the subject and obtains a token to call another service on its behalf, with the same or fewer
+// roles and the same or a narrower audience
+// a subject token bound to a key is exchanged only by the holder of that key
+// the actor is authenticated by the actor_token parameter or, if missing, by the Authorization header
+func (a *App) TokenExchangeHandler(w http.ResponseWriter, r *http.Request) {
+	claims, err := a.exchangeToken(r)
+	if err != nil {
+		var oErr *oauthError
+		if !errors.As(err, &oErr) {
+			oErr = newOAuthError(http.StatusInternalServerError, "server_error", "internal error, retry later")
+		}
+		log.WithError(err).Info("token exchange refused")
+		writeOAuthError(w, oErr)
+		return
+	}
+
+	signedToken, err := generateToken(claims, a.config.Secret, a.config.SignKey)
+	if err != nil {
+		writeOAuthError(w, newOAuthError(http.StatusInternalServerError, "server_error", "%s", err.Error()))
+		return
+	}
+	if err = a.Events.CreateTokenExchangeEvent(claims.Subject, claims.Act.Subject, claims.Azt); err != nil {
+		log.WithError(err).Warnf("failed to store token exchange event")
+	}
+	writeOAuthResponse(w, &tokenExchangeResponse{
+		AccessToken:     signedToken,
+		IssuedTokenType: tokenTypeAccessToken,
+		TokenType:       tokenType(claims.Cnf.boundKey()),
+		ExpiresIn:       claims.ExpiresAt - claims.IssuedAt,
+		Scope:           strings.TrimSpace(strings.Join(claims.Roles, " ") + " " + claims.Scope),
+	}, http.StatusOK)
+}
+
+// exchangeToken validates the exchange request and builds the claims of the delegated token
+func (a *App) exchangeToken(r *http.Request) (*customClaims, error) {
+	form := r.PostForm
+	for _, p := range []string{"subject_token_type", "actor_token_type"} {
+		if tokenType := form.Get(p); tokenType != "" && tokenType != tokenTypeAccessToken && tokenType != tokenTypeJWT {
+			return nil, newOAuthError(http.StatusBadRequest, "invalid_request", "unsupported %s %s", p, tokenType)
+		}
+	}
+	if form.Get("subject_token_type") == "" {
+		return nil, newOAuthError(http.StatusBadRequest, "invalid_request", "missing subject_token_type")
+	}
+	if tokenType := form.Get("requested_token_type"); tokenType != "" && tokenType != tokenTypeAccessToken {
+		return nil, newOAuthError(http.StatusBadRequest, "invalid_request", "unsupported requested_token_type %s", tokenType)
+	}
+	actorToken := form.Get("actor_token")
+	if actorToken == "" {
+		actorToken = parseAuthHeader(r)
+	} else if form.Get("actor_token_type") == "" {
+		return nil, newOAuthError(http.StatusBadRequest, "invalid_request", "missing actor_token_type")
+	}
+	actor, err := a.validateToken(actorToken)
+	if err != nil {
+		return nil, newOAuthError(http.StatusUnauthorized, "invalid_client", "actor token is not valid: %s", err.Error())
+	}
+	// the delegated token is bound to the DPoP key of the actor, which must be the key its own token is bound to
+	jkt, err := a.dpopBinding(r)
+	if err != nil {
+		return nil, dpopOAuthError(err)
+	}
+	if bound := actor.Cnf.boundKey(); bound != "" && bound != jkt {
+		return nil, newOAuthError(http.StatusUnauthorized, "invalid_client", "actor token is bound to another DPoP key")
+	}
+	if err = verifyCertificateBinding(r, actor.Cnf); err != nil {
+		return nil, newOAuthError(http.StatusUnauthorized, "invalid_client", "%s", err.Error())
+	}
+	subject, err := a.validateToken(form.Get("subject_token"))
+	if err != nil {
+		return nil, newOAuthError(http.StatusBadRequest, "invalid_grant", "subject token is not valid: %s", err.Error())
+	}
+	if err = verifySubjectBinding(r, subject, jkt); err != nil {
+		return nil, newOAuthError(http.StatusBadRequest, "invalid_grant", "%s", err.Error())
+	}
+	roles, scope, err := narrowScope(subject, form.Get("scope"))
+	if err != nil {
+		return nil, newOAuthError(http.StatusBadRequest, "invalid_scope", "%s", err.Error())
+	}
+	audience, err := narrowAudience(subject, form["audience"])
+	if err != nil {
+		return nil, newOAuthError(http.StatusBadRequest, "invalid_target", "%s", err.Error())
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(a.config.AccessTokenExpireTime).Unix()
+	if subject.ExpiresAt != 0 && subject.ExpiresAt < expiresAt {
+		// the delegated token never outlives the subject token
+		expiresAt = subject.ExpiresAt
+	}
+	c := &customClaims{
+		Typ:      accessTokenType,
+		Roles:    roles,
+		Azt:      subject.Azt,
+		Audience: audience,
+		Scope:    scope,
+		// the actors which previously exchanged the subject token are kept as nested actors
+		Act: &actorClaim{Subject: actor.Subject, Issuer: actor.Issuer, Act: subject.Act},
+		Cnf: newConfirmationClaim(jkt),
+		// the delegated token is revoked along with the session of the subject and by its changes
+		Sid: subject.Sid,
+		Ver: subject.Ver,
+		Eid: subject.Eid,
+	}
+	if actor.Cnf != nil && actor.Cnf.X5T != "" {
+		// the delegated token is bound to the client certificate of the actor as well
+		c.Cnf = &confirmationClaim{JKT: jkt, X5T: actor.Cnf.X5T}
+	}
+	c.Subject = subject.Subject
+	c.Id = uuid.New().String()
+	c.Issuer = "idp"
+	c.IssuedAt = now.Unix()
+	c.NotBefore = now.Unix()
+	c.ExpiresAt = expiresAt
+	return c, nil
+}
@@ -0,0 +1,259 @@
+package controllers
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"github.com/goidp/models"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestTokenExchangeHandler(t *testing.T) {
+	s, err := SetupSuite()
+	if err != nil {
+		t.Fatalf("error setting up test suite: %s", err.Error())
+	}
+	a := NewApp(s.DB, &Config{AccessTokenExpireTime: 5 * time.Minute})
+	a.config.SignKey, _ = ReadPrivateKey(PKCS1_Private_Key)
+	a.config.VerifyKey = &a.config.SignKey.PublicKey
+
+	rL, _ := models.NewRoleList([]string{models.AdminRole.String(), models.MonitorRole.String()})
+	subjectToken, _ := generateToken(newCustomClaims(&models.User{Username: "jdoe", Roles: rL}, models.InternalDomain, time.Minute, nil, ""), "", a.config.SignKey)
+	serviceRoles, _ := models.NewRoleList([]string{models.MonitorRole.String()})
+	actorToken, _ := generateToken(newCustomClaims(&models.User{Username: "svc-a", Roles: serviceRoles}, models.InternalDomain, time.Minute, nil, ""), "", a.config.SignKey)
+
+	// a token already exchanged by another service, its actor is nested in the new act claim
+	delegated := newCustomClaims(&models.User{Username: "jdoe", Roles: serviceRoles}, models.InternalDomain, time.Minute, nil, "")
+	delegated.Act = &actorClaim{Subject: "svc-z", Issuer: "idp"}
+	delegatedToken, _ := generateToken(delegated, "", a.config.SignKey)
+	audienceToken, _ := generateToken(newCustomClaims(&models.User{Username: "jdoe", Roles: rL}, models.InternalDomain, time.Minute, []string{"svc-b", "svc-c"}, ""), "", a.config.SignKey)
+	// the tokens bound to the keys of the subject client, which the actor does not hold
+	dpopBound := newCustomClaims(&models.User{Username: "jdoe", Roles: rL}, models.InternalDomain, time.Minute, nil, "")
+	dpopBound.Cnf = &confirmationClaim{JKT: "0ZcOCORZNYy-DWpqq30jZyJGHTN0d2HglBV3uiguA4I"}
+	dpopBoundToken, _ := generateToken(dpopBound, "", a.config.SignKey)
+	certBound := newCustomClaims(&models.User{Username: "jdoe", Roles: rL}, models.InternalDomain, time.Minute, nil, "")
+	certBound.Cnf = &confirmationClaim{X5T: "bwcK0esc3ACC3DB2Y5_lESsXE8o9ltc05O89jdN-dg2"}
+	certBoundToken, _ := generateToken(certBound, "", a.config.SignKey)
+
+	tt := []struct {
+		name       string
+		form       url.Values
+		authHeader string
+		status     int
+		err        string
+		roles      []string
+		audience   string
+		nestedAct  string
+	}{
+		{
+			name: "narrowed delegation with actor token",
+			form: url.Values{
+				"grant_type":         {grantTypeTokenExchange},
+				"subject_token":      {subjectToken},
+				"subject_token_type": {tokenTypeAccessToken},
+				"actor_token":        {actorToken},
+				"actor_token_type":   {tokenTypeAccessToken},
+				"audience":           {"svc-b"},
+				"scope":              {"monitor"},
+			},
+			status:   http.StatusOK,
+			roles:    []string{models.MonitorRole.String()},
+			audience: "svc-b",
+		},
+		{
+			name: "actor authenticated by authorization header",
+			form: url.Values{
+				"grant_type":         {grantTypeTokenExchange},
+				"subject_token":      {subjectToken},
+				"subject_token_type": {tokenTypeJWT},
+			},
+			authHeader: "Bearer " + actorToken,
+			status:     http.StatusOK,
+			roles:      []string{models.AdminRole.String(), models.MonitorRole.String()},
+		},
+		{
+			name: "delegation chain",
+			form: url.Values{
+				"grant_type":         {grantTypeTokenExchange},
+				"subject_token":      {delegatedToken},
+				"subject_token_type": {tokenTypeAccessToken},
+			},
+			authHeader: "Bearer " + actorToken,
+			status:     http.StatusOK,
+			roles:      []string{models.MonitorRole.String()},
+			nestedAct:  "svc-z",
+		},
+		{
+			name: "narrowed audience",
+			form: url.Values{
+				"grant_type":         {grantTypeTokenExchange},
+				"subject_token":      {audienceToken},
+				"subject_token_type": {tokenTypeAccessToken},
+				"audience":           {"svc-c"},
+			},
+			authHeader: "Bearer " + actorToken,
+			status:     http.StatusOK,
+			roles:      []string{models.AdminRole.String(), models.MonitorRole.String()},
+			audience:   "svc-c",
+		},
+		{
+			name: "subject audience kept",
+			form: url.Values{
+				"grant_type":         {grantTypeTokenExchange},
+				"subject_token":      {audienceToken},
+				"subject_token_type": {tokenTypeAccessToken},
+			},
+			authHeader: "Bearer " + actorToken,
+			status:     http.StatusOK,
+			roles:      []string{models.AdminRole.String(), models.MonitorRole.String()},
+			audience:   "svc-b svc-c",
+		},
+		{
+			name: "audience not granted to the subject",
+			form: url.Values{
+				"grant_type":         {grantTypeTokenExchange},
+				"subject_token":      {audienceToken},
+				"subject_token_type": {tokenTypeAccessToken},
+				"audience":           {"svc-b", "svc-d"},
+			},
+			authHeader: "Bearer " + actorToken,
+			status:     http.StatusBadRequest,
+			err:        "invalid_target",
+		},
+		{
+			name: "subject token bound to another DPoP key",
+			form: url.Values{
+				"grant_type":         {grantTypeTokenExchange},
+				"subject_token":      {dpopBoundToken},
+				"subject_token_type": {tokenTypeAccessToken},
+			},
+			authHeader: "Bearer " + actorToken,
+			status:     http.StatusBadRequest,
+			err:        "invalid_grant",
+		},
+		{
+			name: "subject token bound to a client certificate",
+			form: url.Values{
+				"grant_type":         {grantTypeTokenExchange},
+				"subject_token":      {certBoundToken},
+				"subject_token_type": {tokenTypeAccessToken},
+			},
+			authHeader: "Bearer " + actorToken,
+			status:     http.StatusBadRequest,
+			err:        "invalid_grant",
+		},
+		{
+			name: "role not held by the subject",
+			form: url.Values{
+				"grant_type":         {grantTypeTokenExchange},
+				"subject_token":      {delegatedToken},
+				"subject_token_type": {tokenTypeAccessToken},
+				"scope":              {"ADMIN"},
+			},
+			authHeader: "Bearer " + actorToken,
+			status:     http.StatusBadRequest,
+			err:        "invalid_scope",
+		},
+		{
+			name: "missing actor",
+			form: url.Values{
+				"grant_type":         {grantTypeTokenExchange},
+				"subject_token":      {subjectToken},
+				"subject_token_type": {tokenTypeAccessToken},
+			},
+			status: http.StatusUnauthorized,
+			err:    "invalid_client",
+		},
+		{
+			name: "invalid subject token",
+			form: url.Values{
+				"grant_type":         {grantTypeTokenExchange},
+				"subject_token":      {"forged"},
+				"subject_token_type": {tokenTypeAccessToken},
+			},
+			authHeader: "Bearer " + actorToken,
+			status:     http.StatusBadRequest,
+			err:        "invalid_grant",
+		},
+		{
+			name: "unsupported grant type",
+			form: url.Values{
+				"grant_type":    {"password"},
+				"subject_token": {subjectToken},
+			},
+			authHeader: "Bearer " + actorToken,
+			status:     http.StatusBadRequest,
+			err:        "unsupported_grant_type",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodPost, "/v1.0/token", strings.NewReader(tc.form.Encode()))
+			req.Header.Set(headerContentType, "application/x-www-form-urlencoded")
+			if tc.authHeader != "" {
+				req.Header.Set(headerAuthorization, tc.authHeader)
+			}
+			rec := httptest.NewRecorder()
+
+			if tc.status == http.StatusOK {
+				insertArgs := []driver.Value{sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()}
+				s.mock.ExpectBegin()
+				s.mock.ExpectQuery(regexp.QuoteMeta(
+					`INSERT INTO "events" ("created_at","updated_at","deleted_at","username","activated","description","modified","authn_domain","severity") VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9) RETURNING "id"`)).
+					WithArgs(insertArgs...).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+				s.mock.ExpectCommit()
+			}
+
+			a.TokenHandler(rec, req)
+
+			if err := s.mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+			if rec.Code != tc.status {
+				t.Fatalf("expected status %d; got %d: %s", tc.status, rec.Code, rec.Body.String())
+			}
+			if tc.err != "" {
+				var oErr oauthError
+				if err := json.NewDecoder(rec.Body).Decode(&oErr); err != nil {
+					t.Fatalf("could not decode error: %s", err)
+				}
+				if oErr.Code != tc.err {
+					t.Errorf("expected error %s; got %s", tc.err, oErr.Code)
+				}
+				return
+			}
+
+			var tR tokenExchangeResponse
+			if err := json.NewDecoder(rec.Body).Decode(&tR); err != nil {
+				t.Fatalf("could not decode response: %s", err)
+			}
+			if tR.IssuedTokenType != tokenTypeAccessToken || tR.ExpiresIn > 60 {
+				t.Errorf("unexpected token type %s or expiration %d", tR.IssuedTokenType, tR.ExpiresIn)
+			}
+			claims, err := getClaimsFromAccessToken(tR.AccessToken, "", a.config.VerifyKey)
+			if err != nil {
+				t.Fatalf("could not decode exchanged token: %s", err)
+			}
+			if claims.Subject != "jdoe" || strings.Join(claims.Audience, " ") != tc.audience {
+				t.Errorf("unexpected subject %s or audience %s", claims.Subject, claims.Audience)
+			}
+			if strings.Join(claims.Roles, " ") != strings.Join(tc.roles, " ") {
+				t.Errorf("expected roles %v; got %v", tc.roles, claims.Roles)
+			}
+			if claims.Act == nil || claims.Act.Subject != "svc-a" {
+				t.Fatalf("expected act claim with subject svc-a; got %+v", claims.Act)
+			}
+			if tc.nestedAct != "" && (claims.Act.Act == nil || claims.Act.Act.Subject != tc.nestedAct) {
+				t.Errorf("expected nested actor %s; got %+v", tc.nestedAct, claims.Act.Act)
+			}
+		})
+	}
+}
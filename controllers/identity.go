@@ -0,0 +1,92 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/goidp/models"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// ExternalIdentityResource is the jsonapi representation of an external identity
+type ExternalIdentityResource struct {
+	ID       string    `jsonapi:"primary,identity"`
+	Username string    `jsonapi:"attr,username"`
+	Issuer   string    `jsonapi:"attr,issuer"`
+	Subject  string    `jsonapi:"attr,subject"`
+	Roles    []string  `jsonapi:"attr,roles"`
+	LastSeen time.Time `jsonapi:"attr,last_seen,iso8601"`
+}
+
+func newExternalIdentityResource(e *models.ExternalIdentity) *ExternalIdentityResource {
+	return &ExternalIdentityResource{
+		ID:       fmt.Sprintf("%d", e.ID),
+		Username: e.Username,
+		Issuer:   e.Issuer,
+		Subject:  e.Subject,
+		Roles:    e.Roles,
+		LastSeen: e.LastSeen,
+	}
+}
+
+// recordExternalIdentity persists the user authenticated by an external issuer or backend
+// without a local copy, so that its renew token is accepted by any replica
+func (a *App) recordExternalIdentity(user *models.User, issuer, subject string) error {
+	e, err := a.ExternalIdentities.Record(issuer, subject, user.Username, user.Roles)
+	if err != nil {
+		log.WithError(err).Warnf("failed to record external identity %s", user.Username)
+		return err
+	}
+	// the tokens of the identity refer to it and carry its generation, as the ones of the local users
+	user.Version = e.Version
+	user.IdentityID = e.ID
+	return nil
+}
+
+// ExternalIdentitiesHandler lists the external identities
+func (a *App) ExternalIdentitiesHandler(w http.ResponseWriter, r *http.Request) {
+	list, err := a.ExternalIdentities.GetExternalIdentities()
+	if err != nil {
+		jsonapiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	resources := make([]*ExternalIdentityResource, 0)
+	for _, e := range list {
+		resources = append(resources, newExternalIdentityResource(e))
+	}
+	jsonapiSuccess(w, resources, http.StatusOK)
+}
+
+// ExternalIdentityHandler reads (GET) or removes (DELETE) an external identity, once removed the
+// identity cannot renew its tokens until the next login
+func (a *App) ExternalIdentityHandler(w http.ResponseWriter, r *http.Request) {
+	e, err := a.ExternalIdentities.GetExternalIdentityByID(mux.Vars(r)["id"])
+	switch err.(type) {
+	case *models.NotFoundError:
+		jsonapiError(w, http.StatusNotFound, err.Error())
+		return
+	case *models.DBError:
+		jsonapiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		jsonapiSuccess(w, newExternalIdentityResource(e), http.StatusOK)
+	case http.MethodDelete:
+		switch err := a.ExternalIdentities.DeleteExternalIdentity(e).(type) {
+		case *models.NotFoundError:
+			jsonapiError(w, http.StatusNotFound, err.Error())
+			return
+		case *models.DBError:
+			jsonapiError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err := a.Events.CreateUserEvent(http.MethodDelete, e.Username, models.ExternalDomain); err != nil {
+			log.WithError(err).Warnf("failed to store user event")
+		}
+		jsonapiNoContentSuccess(w)
+	}
+}
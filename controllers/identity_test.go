@@ -0,0 +1,130 @@
+package controllers
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/jsonapi"
+	"github.com/gorilla/mux"
+)
+
+func TestExternalIdentitiesHandler(t *testing.T) {
+	s, err := SetupSuite()
+	if err != nil {
+		t.Fatalf("error setting up test suite: %s", err.Error())
+	}
+	a := NewApp(s.DB, &Config{})
+
+	lastSeen := time.Now()
+	s.mock.ExpectQuery(regexp.QuoteMeta(
+		`SELECT * FROM "external_identities" WHERE "external_identities"."deleted_at" IS NULL ORDER BY last_seen desc`)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "issuer", "roles", "last_seen"}).
+			AddRow(2, "pipeline", "ci", `["ADMIN"]`, lastSeen).
+			AddRow(1, "jdoe", "LDAP", `["HELPDESK","MONITOR"]`, lastSeen.Add(-time.Hour)))
+
+	req, _ := http.NewRequest(http.MethodGet, "/v1.0/identity", nil)
+	rec := httptest.NewRecorder()
+	a.ExternalIdentitiesHandler(rec, req)
+
+	if err := s.mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d; got %d", http.StatusOK, rec.Code)
+	}
+	var payload jsonapi.ManyPayload
+	if err := json.NewDecoder(rec.Body).Decode(&payload); err != nil {
+		t.Fatalf("could not unmarshal response: %s", err)
+	}
+	if len(payload.Data) != 2 || payload.Data[0].Attributes["username"] != "pipeline" || payload.Data[1].Attributes["issuer"] != "LDAP" {
+		t.Errorf("unexpected identities %v", payload.Data)
+	}
+}
+
+func TestExternalIdentityHandler(t *testing.T) {
+	s, err := SetupSuite()
+	if err != nil {
+		t.Fatalf("error setting up test suite: %s", err.Error())
+	}
+	a := NewApp(s.DB, &Config{})
+
+	tt := []struct {
+		name   string
+		method string
+		id     string
+		found  bool
+		status int
+	}{
+		{
+			name:   "get identity",
+			method: http.MethodGet,
+			id:     "1",
+			found:  true,
+			status: http.StatusOK,
+		},
+		{
+			name:   "get unknown identity",
+			method: http.MethodGet,
+			id:     "2",
+			status: http.StatusNotFound,
+		},
+		{
+			name:   "delete identity",
+			method: http.MethodDelete,
+			id:     "1",
+			found:  true,
+			status: http.StatusNoContent,
+		},
+		{
+			name:   "delete invalid identity id",
+			method: http.MethodDelete,
+			id:     "pipeline",
+			status: http.StatusNotFound,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tc.method, "/v1.0/identity/"+tc.id, nil)
+			req = mux.SetURLVars(req, map[string]string{"id": tc.id})
+			rec := httptest.NewRecorder()
+
+			if tc.id != "pipeline" {
+				rows := sqlmock.NewRows([]string{"id", "username", "issuer", "roles", "last_seen"})
+				if tc.found {
+					rows.AddRow(1, "pipeline", "ci", `["ADMIN"]`, time.Now())
+				}
+				s.mock.ExpectQuery(regexp.QuoteMeta(
+					`SELECT * FROM "external_identities" WHERE "external_identities"."id" = $1 AND "external_identities"."deleted_at" IS NULL LIMIT 1`)).
+					WithArgs(sqlmock.AnyArg()).WillReturnRows(rows)
+			}
+			if tc.method == http.MethodDelete && tc.found {
+				s.mock.ExpectBegin()
+				s.mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "external_identities" WHERE "external_identities"."id" = $1`)).
+					WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+				s.mock.ExpectCommit()
+				insertArgs := []driver.Value{sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()}
+				s.mock.ExpectBegin()
+				s.mock.ExpectQuery(regexp.QuoteMeta(
+					`INSERT INTO "events" ("created_at","updated_at","deleted_at","username","activated","description","modified","authn_domain","severity") VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9) RETURNING "id"`)).
+					WithArgs(insertArgs...).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+				s.mock.ExpectCommit()
+			}
+
+			a.ExternalIdentityHandler(rec, req)
+
+			if err := s.mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+			if rec.Code != tc.status {
+				t.Fatalf("expected status %d; got %d", tc.status, rec.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/goidp/models"
+	"net/http"
+	"time"
+
+	"github.com/google/jsonapi"
+	log "github.com/sirupsen/logrus"
+)
+
+// ImpersonationRequest is the user an administrator asks to impersonate, with the reason recorded in
+// the audit trail
+type ImpersonationRequest struct {
+	ID       string `jsonapi:"primary,impersonation,omitempty"`
+	Username string `jsonapi:"attr,username"`
+	Reason   string `jsonapi:"attr,reason,omitempty"`
+}
+
+// ImpersonationHandler issues to the administrator a short-lived access token of the target user, the
+// act claim names the administrator and the writes made with the token are recorded as events. The
+// token is not renewable, does not outlive the token of the administrator and is revoked by the changes
+// of the target user.
+func (a *App) ImpersonationHandler(w http.ResponseWriter, r *http.Request) {
+	t := parseAuthHeader(r)
+	// a leaked personal access token or an impersonation token must not be enough to impersonate
+	if isPersonalAccessToken(t) {
+		jsonapiError(w, http.StatusForbidden, "impersonation requires an interactive session")
+		return
+	}
+	actor, err := getClaimsFromAccessToken(t, a.config.Secret, a.config.VerifyKey)
+	if err != nil {
+		jsonapiError(w, http.StatusUnauthorized, "unauthorized request")
+		return
+	}
+	if actor.Act != nil {
+		jsonapiError(w, http.StatusForbidden, "tokens issued on behalf of another user cannot impersonate")
+		return
+	}
+
+	var requestBody ImpersonationRequest
+	if err = jsonapi.UnmarshalPayload(r.Body, &requestBody); err != nil {
+		jsonapiError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %s", err.Error()))
+		return
+	}
+	if requestBody.Username == actor.Subject {
+		jsonapiError(w, http.StatusBadRequest, "administrators cannot impersonate themselves")
+		return
+	}
+	user, err := a.Users.GetUserByNameOrID(requestBody.Username)
+	switch err.(type) {
+	case *models.NotFoundError:
+		jsonapiError(w, http.StatusNotFound, err.Error())
+		return
+	case *models.DBError:
+		jsonapiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !a.config.AllowAdminImpersonation && stringInSliceCaseInsensitive(user.Roles.String(), models.AdminRole.String()) {
+		jsonapiError(w, http.StatusForbidden, "administrators cannot be impersonated")
+		return
+	}
+
+	expire := a.config.ImpersonationExpireTime
+	if expire == 0 {
+		expire = a.config.AccessTokenExpireTime
+	}
+	claims := newCustomClaims(user, models.InternalDomain, expire, actor.Audience, "")
+	claims.Act = &actorClaim{Subject: actor.Subject, Issuer: actor.Issuer}
+	// the token is bound to the DPoP key or to the client certificate the token of the administrator is bound to
+	claims.Cnf = actor.Cnf
+	if actor.ExpiresAt != 0 && actor.ExpiresAt < claims.ExpiresAt {
+		// the impersonation never outlives the token of the administrator
+		claims.ExpiresAt = actor.ExpiresAt
+	}
+	signedToken, err := generateToken(claims, a.config.Secret, a.config.SignKey)
+	if err != nil {
+		if err := a.Events.CreateJWTEvent(user.Username, models.InternalDomain); err != nil {
+			log.WithError(err).Warnf("failed to store JWT event")
+		}
+		jsonapiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err = a.Events.CreateImpersonationEvent(user.Username, actor.Subject, requestBody.Reason); err != nil {
+		log.WithError(err).Warnf("failed to store impersonation event")
+	}
+	log.WithFields(log.Fields{
+		"username": user.Username,
+		"actor":    actor.Subject,
+		"expires":  time.Unix(claims.ExpiresAt, 0),
+	}).Info("impersonation started")
+
+	responseBody := CreateSessionHandlerResponse{AccessToken: signedToken, TokenType: tokenType(actor.Cnf.boundKey())}
+	w.Header().Set(headerAuthorization, fmt.Sprintf("%s %v", responseBody.TokenType, responseBody.AccessToken))
+	jsonapiSuccessMetaOnly(w, &responseBody, http.StatusOK)
+}
@@ -0,0 +1,221 @@
+package controllers
+
+import (
+	"bytes"
+	"github.com/goidp/models"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestImpersonationHandler(t *testing.T) {
+	s, err := SetupSuite()
+	if err != nil {
+		t.Fatalf("error setting up test suite: %s", err.Error())
+	}
+	rL, _ := models.NewRoleList([]string{models.AdminRole.String()})
+	admin := &models.User{Username: "admin", Roles: rL}
+	adminToken := func(a *App, cnf *confirmationClaim) string {
+		claims := newCustomClaims(admin, models.InternalDomain, time.Minute, nil, "")
+		claims.Cnf = cnf
+		token, _ := generateToken(claims, "", a.config.SignKey)
+		return token
+	}
+
+	tt := []struct {
+		name       string
+		username   string
+		allowAdmin bool
+		act        bool
+		// cnf is the binding of the token of the administrator, kept by the impersonation token
+		cnf    *confirmationClaim
+		scheme string
+		lookup bool
+		target []models.UserRole
+		found  bool
+		status int
+	}{
+		{
+			name:     "impersonate an operator",
+			username: "jdoe",
+			lookup:   true,
+			found:    true,
+			target:   []models.UserRole{models.MonitorRole},
+			status:   http.StatusOK,
+		},
+		{
+			name:     "impersonate an operator with a DPoP bound token",
+			username: "jdoe",
+			cnf:      &confirmationClaim{JKT: "0ZcOCORZNYy-DWpqq30jZyJGHTN0d2HglBV3uiguA4I"},
+			scheme:   "DPoP",
+			lookup:   true,
+			found:    true,
+			target:   []models.UserRole{models.MonitorRole},
+			status:   http.StatusOK,
+		},
+		{
+			name:     "impersonate an operator with a certificate bound token",
+			username: "jdoe",
+			cnf:      &confirmationClaim{X5T: "bwcK0esc3ACC3DB2Y5_lESsXE8o9ltc05O89jdN-dg2"},
+			scheme:   "Bearer",
+			lookup:   true,
+			found:    true,
+			target:   []models.UserRole{models.MonitorRole},
+			status:   http.StatusOK,
+		},
+		{
+			name:     "impersonate an administrator",
+			username: "root",
+			lookup:   true,
+			found:    true,
+			target:   []models.UserRole{models.AdminRole},
+			status:   http.StatusForbidden,
+		},
+		{
+			name:       "impersonate an administrator explicitly allowed",
+			username:   "root",
+			allowAdmin: true,
+			lookup:     true,
+			found:      true,
+			target:     []models.UserRole{models.AdminRole},
+			status:     http.StatusOK,
+		},
+		{
+			name:     "impersonate oneself",
+			username: "admin",
+			status:   http.StatusBadRequest,
+		},
+		{
+			name:     "unknown user",
+			username: "nobody",
+			lookup:   true,
+			status:   http.StatusNotFound,
+		},
+		{
+			name:     "nested impersonation",
+			username: "jdoe",
+			act:      true,
+			status:   http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			a := NewApp(s.DB, &Config{AccessTokenExpireTime: time.Hour, ImpersonationExpireTime: 10 * time.Minute, AllowAdminImpersonation: tc.allowAdmin})
+			a.config.SignKey, _ = ReadPrivateKey(PKCS1_Private_Key)
+			a.config.VerifyKey = &a.config.SignKey.PublicKey
+			token := adminToken(a, tc.cnf)
+			if tc.act {
+				claims := newCustomClaims(admin, models.InternalDomain, time.Minute, nil, "")
+				claims.Act = &actorClaim{Subject: "root"}
+				token, _ = generateToken(claims, "", a.config.SignKey)
+			}
+
+			if tc.lookup && tc.found {
+				expectTokenOwner(s, tc.username, tc.target...)
+			} else if tc.lookup {
+				s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "users" WHERE username = $1`)).
+					WithArgs(tc.username).WillReturnRows(sqlmock.NewRows([]string{"id", "username"}))
+			}
+			if tc.status == http.StatusOK {
+				expectEvent(s)
+			}
+
+			body := `{"data":{"type":"impersonation","attributes":{"username":"` + tc.username + `","reason":"ticket 42"}}}`
+			req, _ := http.NewRequest(http.MethodPost, "/v1.0/session/impersonate", bytes.NewBufferString(body))
+			req.Header.Set(headerAuthorization, "Bearer "+token)
+			rec := httptest.NewRecorder()
+			a.ImpersonationHandler(rec, req)
+
+			if err := s.mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+			if rec.Code != tc.status {
+				t.Fatalf("expected status %d; got %d: %s", tc.status, rec.Code, rec.Body.String())
+			}
+			if tc.status != http.StatusOK {
+				return
+			}
+			scheme := tc.scheme
+			if scheme == "" {
+				scheme = "Bearer"
+			}
+			if !strings.HasPrefix(rec.Header().Get(headerAuthorization), scheme+" ") {
+				t.Errorf("expected %s token; got %s", scheme, rec.Header().Get(headerAuthorization))
+			}
+			claims, err := getClaimsFromAccessToken(parseAuthHeader(&http.Request{Header: rec.Header()}), "", a.config.VerifyKey)
+			if err != nil {
+				t.Fatalf("could not decode access token: %s", err)
+			}
+			// the impersonation token is bound to the key or certificate of the administrator
+			if !reflect.DeepEqual(claims.Cnf, tc.cnf) {
+				t.Errorf("expected binding %+v; got %+v", tc.cnf, claims.Cnf)
+			}
+			if claims.Subject != tc.username || claims.Act == nil || claims.Act.Subject != "admin" {
+				t.Errorf("unexpected subject %s or actor %+v", claims.Subject, claims.Act)
+			}
+			// the impersonation never outlives the token of the administrator
+			if claims.ExpiresAt > time.Now().Add(time.Minute).Unix() {
+				t.Errorf("impersonation token outlives the administrator token")
+			}
+		})
+	}
+}
+
+func TestJWTMiddlewareImpersonatedWrites(t *testing.T) {
+	s, err := SetupSuite()
+	if err != nil {
+		t.Fatalf("error setting up test suite: %s", err.Error())
+	}
+	a := NewApp(s.DB, &Config{})
+	a.config.SignKey, _ = ReadPrivateKey(PKCS1_Private_Key)
+	a.config.VerifyKey = &a.config.SignKey.PublicKey
+	rL, _ := models.NewRoleList([]string{models.MonitorRole.String()})
+	claims := newCustomClaims(&models.User{Username: "jdoe", Roles: rL}, models.InternalDomain, time.Minute, nil, "")
+	claims.Act = &actorClaim{Subject: "admin", Issuer: "idp"}
+	token, _ := generateToken(claims, "", a.config.SignKey)
+
+	tt := []struct {
+		name    string
+		method  string
+		audited bool
+	}{
+		{
+			name:   "read",
+			method: http.MethodGet,
+		},
+		{
+			name:    "write",
+			method:  http.MethodPatch,
+			audited: true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.audited {
+				expectEvent(s)
+			}
+
+			req, _ := http.NewRequest(tc.method, "/v1.0/user/jdoe", nil)
+			req.Header.Set(headerAuthorization, "Bearer "+token)
+			rec := httptest.NewRecorder()
+			a.jwtMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}), "user").ServeHTTP(rec, req)
+
+			if err := s.mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+			if rec.Code != http.StatusOK {
+				t.Errorf("expected status %d; got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
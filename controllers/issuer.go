@@ -0,0 +1,473 @@
+package controllers
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/goidp/models"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-co-op/gocron"
+	"github.com/golang-jwt/jwt"
+	"github.com/google/jsonapi"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// trustedIssuer is the runtime form of a registry entry, holding the parsed verification keys
+type trustedIssuer struct {
+	*models.TrustedIssuer
+	keys []*rsa.PublicKey
+	jwks *jwksCache
+}
+
+func newTrustedIssuer(t *models.TrustedIssuer) (*trustedIssuer, error) {
+	tI := &trustedIssuer{TrustedIssuer: t}
+	for _, k := range t.PublicKeys {
+		pKey, err := parsePublicKeyPEM([]byte(k))
+		if err != nil {
+			return nil, err
+		}
+		tI.keys = append(tI.keys, pKey)
+	}
+	if t.JWKSURL != "" {
+		tI.jwks = newJWKSCache(t.JWKSURL, nil)
+	}
+	return tI, nil
+}
+
+// parsePublicKeyPEM reads a RSA public key encoded as PKIX, PKCS1 or X509 certificate
+func parsePublicKeyPEM(data []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("public key not in PEM format")
+	}
+	if pKey, err := x509.ParsePKIXPublicKey(block.Bytes); err == nil {
+		if rsaPKey, ok := pKey.(*rsa.PublicKey); ok {
+			return rsaPKey, nil
+		}
+		return nil, fmt.Errorf("expected rsa.PublicKey, found '%T' instead", pKey)
+	}
+	if pKey, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+		return pKey, nil
+	}
+	if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+		if rsaPKey, ok := cert.PublicKey.(*rsa.PublicKey); ok {
+			return rsaPKey, nil
+		}
+	}
+	return nil, errors.New("unsupported public key format")
+}
+
+// keyFuncs returns the candidate key functions, tokens of issuers with static keys
+// are checked against each key in turn
+func (tI *trustedIssuer) keyFuncs() []jwt.Keyfunc {
+	if tI.jwks != nil {
+		return []jwt.Keyfunc{tI.jwks.keyFunc()}
+	}
+	var keyFuncs []jwt.Keyfunc
+	for _, pKey := range tI.keys {
+		keyFuncs = append(keyFuncs, getKeyFunc("", pKey))
+	}
+	return keyFuncs
+}
+
+// verify validates the token signature, expiration, issuer and audience
+func (tI *trustedIssuer) verify(t string) (jwt.MapClaims, error) {
+	err := errors.New("no key configured")
+	for _, keyFunc := range tI.keyFuncs() {
+		var token *jwt.Token
+		token, err = jwt.ParseWithClaims(t, jwt.MapClaims{}, keyFunc)
+		if err != nil || !token.Valid {
+			continue
+		}
+		claims := token.Claims.(jwt.MapClaims)
+		if !claims.VerifyIssuer(tI.Issuer, true) {
+			return nil, errors.New("invalid token issuer")
+		}
+		if len(tI.Audiences) == 0 {
+			return claims, nil
+		}
+		for _, aud := range tI.Audiences {
+			if claims.VerifyAudience(aud, true) {
+				return claims, nil
+			}
+		}
+		return nil, errors.New("invalid token audience")
+	}
+	return nil, err
+}
+
+// mapRoles translates the roles asserted by the issuer into local roles,
+// the roles above the issuer role ceiling are dropped
+func (tI *trustedIssuer) mapRoles(asserted []string) []string {
+	var roles []string
+	for _, a := range asserted {
+		role := a
+		if len(tI.RoleMapping) > 0 {
+			var ok bool
+			if role, ok = tI.RoleMapping[a]; !ok {
+				continue
+			}
+		}
+		role = strings.ToUpper(role)
+		if _, err := models.NewRoleList([]string{role}); err != nil {
+			log.Infof("issuer %s asserted unknown role %s", tI.Issuer, a)
+			continue
+		}
+		if len(tI.RoleCeiling) > 0 && !stringInSliceCaseInsensitive(tI.RoleCeiling, role) {
+			log.Infof("role %s is above the ceiling of issuer %s", role, tI.Issuer)
+			continue
+		}
+		if !stringInSlice(roles, role) {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+// issuerRegistry holds the trusted issuers currently in force, indexed by issuer
+type issuerRegistry struct {
+	mu      sync.RWMutex
+	issuers map[string]*trustedIssuer
+}
+
+func newIssuerRegistry() *issuerRegistry {
+	return &issuerRegistry{issuers: make(map[string]*trustedIssuer)}
+}
+
+// load replaces the registry content, the cached JWKS of unchanged issuers are kept
+// invalid or disabled entries are skipped
+func (reg *issuerRegistry) load(list []*models.TrustedIssuer) {
+	issuers := make(map[string]*trustedIssuer)
+	reg.mu.RLock()
+	for _, t := range list {
+		if t.Disabled {
+			continue
+		}
+		tI, err := newTrustedIssuer(t)
+		if err != nil {
+			log.WithError(err).Warnf("skipping trusted issuer %s", t.Issuer)
+			continue
+		}
+		if old, ok := reg.issuers[t.Issuer]; ok && old.jwks != nil && old.JWKSURL == t.JWKSURL {
+			tI.jwks = old.jwks
+		}
+		issuers[t.Issuer] = tI
+	}
+	reg.mu.RUnlock()
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.issuers = issuers
+}
+
+func (reg *issuerRegistry) lookup(issuer string) (*trustedIssuer, bool) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	tI, ok := reg.issuers[issuer]
+	return tI, ok
+}
+
+// authorize validates a token of a trusted issuer and returns its claims, with the roles
+// mapped to the local ones
+func (reg *issuerRegistry) authorize(t string) (*customClaims, error) {
+	if t == "" {
+		return nil, fmt.Errorf("empty token")
+	}
+	unverified, _, err := new(jwt.Parser).ParseUnverified(t, jwt.MapClaims{})
+	if err != nil {
+		return nil, err
+	}
+	issuer, _ := unverified.Claims.(jwt.MapClaims)["iss"].(string)
+	tI, ok := reg.lookup(issuer)
+	if !ok {
+		return nil, fmt.Errorf("untrusted issuer %s", issuer)
+	}
+	claims, err := tI.verify(t)
+	if err != nil {
+		return nil, err
+	}
+
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return nil, errors.New("token without subject")
+	}
+	var asserted []string
+	switch roles := claims["roles"].(type) {
+	case []interface{}:
+		for _, r := range roles {
+			if s, ok := r.(string); ok {
+				asserted = append(asserted, s)
+			}
+		}
+	case string:
+		asserted = strings.Fields(roles)
+	}
+	roles := tI.mapRoles(asserted)
+	if len(roles) == 0 {
+		return nil, fmt.Errorf("issuer %s grants no role to %s", issuer, subject)
+	}
+	c := &customClaims{Roles: roles}
+	c.Subject = subject
+	c.Issuer = issuer
+	log.WithFields(log.Fields{
+		"subject":   subject,
+		"issuer":    issuer,
+		"role_list": roles,
+	}).Info("m2m token authorized")
+	return c, nil
+}
+
+// ReloadTrustedIssuers refreshes the registry with the trusted issuers stored in DB
+func (a *App) ReloadTrustedIssuers() error {
+	list, err := a.TrustedIssuers.GetTrustedIssuers()
+	if err != nil {
+		return err
+	}
+	a.issuers.load(list)
+	return nil
+}
+
+// SetupTrustedIssuersReload periodically reloads the registry, so that the changes
+// made through any replica are eventually applied by all of them
+func (a *App) SetupTrustedIssuersReload(interval time.Duration) error {
+	s := gocron.NewScheduler(time.UTC)
+	_, err := s.Every(interval).Do(func() {
+		if err := a.ReloadTrustedIssuers(); err != nil {
+			log.WithError(err).Errorf("failed to reload trusted issuers")
+		}
+	})
+	if err != nil {
+		return err
+	}
+	s.StartAsync()
+	return nil
+}
+
+// ReadTrustedKeys reads the PEM public keys in the given directory, the keys are indexed by
+// file name without extension, which is the issuer the key is imported for
+func ReadTrustedKeys(path string) map[string]string {
+	keys := make(map[string]string)
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		log.WithError(err).Warnf("failed to read keys dir")
+		return keys
+	}
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		pubKeyPath := filepath.Join(path, file.Name())
+		data, err := ioutil.ReadFile(pubKeyPath)
+		if err != nil {
+			log.WithError(err).Warnf("failed to read key data from file %s", pubKeyPath)
+			continue
+		}
+		if _, err = parsePublicKeyPEM(data); err != nil {
+			log.WithError(err).Warnf("invalid key %s", pubKeyPath)
+			continue
+		}
+		keys[strings.TrimSuffix(file.Name(), filepath.Ext(file.Name()))] = string(data)
+	}
+	return keys
+}
+
+// ImportTrustedKeys adds to the registry the issuers of the given keys, each key is imported once and
+// its issuer cannot grant roles above the given ceiling
+func (a *App) ImportTrustedKeys(keys map[string]string, ceiling []string) {
+	for issuer, key := range keys {
+		// the asserted roles are used as they are, up to the ceiling
+		t := &models.TrustedIssuer{
+			Issuer:      issuer,
+			PublicKeys:  []string{key},
+			RoleMapping: map[string]string{},
+			RoleCeiling: ceiling,
+		}
+		imported, err := a.TrustedIssuers.Import(t)
+		if err != nil {
+			log.WithError(err).Warnf("failed to import key of issuer %s", issuer)
+			continue
+		}
+		if imported {
+			log.Infof("imported key of issuer %s into the trusted issuers registry", issuer)
+		}
+	}
+}
+
+// TrustedIssuerResource is the jsonapi representation of a trusted issuer
+// the role mapping is a list of "external=LOCAL" entries
+type TrustedIssuerResource struct {
+	ID          string   `jsonapi:"primary,issuer,omitempty"`
+	Issuer      string   `jsonapi:"attr,issuer"`
+	JWKSURL     string   `jsonapi:"attr,jwks_url,omitempty"`
+	PublicKeys  []string `jsonapi:"attr,public_keys,omitempty"`
+	Audiences   []string `jsonapi:"attr,audiences,omitempty"`
+	RoleMapping []string `jsonapi:"attr,role_mapping,omitempty"`
+	RoleCeiling []string `jsonapi:"attr,role_ceiling,omitempty"`
+	Disabled    *bool    `jsonapi:"attr,disabled,omitempty"`
+}
+
+func newTrustedIssuerResource(t *models.TrustedIssuer) *TrustedIssuerResource {
+	disabled := t.Disabled
+	tR := &TrustedIssuerResource{
+		ID:          fmt.Sprintf("%d", t.ID),
+		Issuer:      t.Issuer,
+		JWKSURL:     t.JWKSURL,
+		PublicKeys:  t.PublicKeys,
+		Audiences:   t.Audiences,
+		RoleCeiling: t.RoleCeiling,
+		Disabled:    &disabled,
+	}
+	for external, local := range t.RoleMapping {
+		tR.RoleMapping = append(tR.RoleMapping, external+"="+local)
+	}
+	return tR
+}
+
+// apply copies the provided attributes into the trusted issuer
+func (tR *TrustedIssuerResource) apply(t *models.TrustedIssuer) error {
+	if tR.Issuer != "" {
+		t.Issuer = tR.Issuer
+	}
+	if tR.JWKSURL != "" {
+		t.JWKSURL = tR.JWKSURL
+		t.PublicKeys = nil
+	}
+	if len(tR.PublicKeys) > 0 {
+		t.PublicKeys = tR.PublicKeys
+		t.JWKSURL = ""
+	}
+	if tR.Audiences != nil {
+		t.Audiences = tR.Audiences
+	}
+	if tR.RoleMapping != nil {
+		t.RoleMapping = make(map[string]string)
+		for _, m := range tR.RoleMapping {
+			i := strings.LastIndex(m, "=")
+			if i <= 0 || i == len(m)-1 {
+				return fmt.Errorf("invalid role mapping %s", m)
+			}
+			t.RoleMapping[m[:i]] = strings.ToUpper(m[i+1:])
+		}
+	}
+	if tR.RoleCeiling != nil {
+		t.RoleCeiling = tR.RoleCeiling
+	}
+	if tR.Disabled != nil {
+		t.Disabled = *tR.Disabled
+	}
+	// make sure the keys are usable before storing them
+	_, err := newTrustedIssuer(t)
+	return err
+}
+
+// TrustedIssuersHandler lists (GET) or registers (POST) the trusted issuers
+func (a *App) TrustedIssuersHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		list, err := a.TrustedIssuers.GetTrustedIssuers()
+		if err != nil {
+			jsonapiError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		resources := make([]*TrustedIssuerResource, 0)
+		for _, t := range list {
+			resources = append(resources, newTrustedIssuerResource(t))
+		}
+		jsonapiSuccess(w, resources, http.StatusOK)
+	case http.MethodPost:
+		var requestBody TrustedIssuerResource
+		if err := jsonapi.UnmarshalPayload(r.Body, &requestBody); err != nil {
+			jsonapiError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		var t models.TrustedIssuer
+		if err := requestBody.apply(&t); err != nil {
+			jsonapiError(w, http.StatusBadRequest, fmt.Sprintf("invalid trusted issuer: %s", err.Error()))
+			return
+		}
+		switch err := a.TrustedIssuers.Create(&t).(type) {
+		case *models.UserError:
+			jsonapiError(w, http.StatusBadRequest, err.Error())
+			return
+		case *models.DBError:
+			jsonapiError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		a.reloadTrustedIssuers()
+		jsonapiSuccess(w, newTrustedIssuerResource(&t), http.StatusCreated)
+	}
+}
+
+// TrustedIssuerHandler reads (GET), updates (PATCH) or removes (DELETE) a trusted issuer
+func (a *App) TrustedIssuerHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	t, err := a.TrustedIssuers.GetTrustedIssuer(id)
+	switch err.(type) {
+	case *models.NotFoundError:
+		jsonapiError(w, http.StatusNotFound, err.Error())
+		return
+	case *models.DBError:
+		jsonapiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		jsonapiSuccess(w, newTrustedIssuerResource(t), http.StatusOK)
+		return
+	case http.MethodPatch:
+		var requestBody TrustedIssuerResource
+		if err = jsonapi.UnmarshalPayload(r.Body, &requestBody); err != nil {
+			jsonapiError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err = requestBody.apply(t); err != nil {
+			jsonapiError(w, http.StatusBadRequest, fmt.Sprintf("invalid trusted issuer: %s", err.Error()))
+			return
+		}
+		err = a.TrustedIssuers.UpdateTrustedIssuer(t)
+	case http.MethodDelete:
+		err = a.TrustedIssuers.DeleteTrustedIssuer(t)
+	}
+	switch err.(type) {
+	case *models.NotFoundError:
+		jsonapiError(w, http.StatusNotFound, err.Error())
+		return
+	case *models.UserError:
+		jsonapiError(w, http.StatusBadRequest, err.Error())
+		return
+	case *models.DBError:
+		jsonapiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	a.reloadTrustedIssuers()
+	if r.Method == http.MethodDelete {
+		jsonapiNoContentSuccess(w)
+		return
+	}
+	jsonapiSuccess(w, newTrustedIssuerResource(t), http.StatusOK)
+}
+
+// ReloadTrustedIssuersHandler applies the trusted issuers stored in DB without waiting for the periodic reload
+func (a *App) ReloadTrustedIssuersHandler(w http.ResponseWriter, r *http.Request) {
+	if err := a.ReloadTrustedIssuers(); err != nil {
+		jsonapiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	jsonapiNoContentSuccess(w)
+}
+
+func (a *App) reloadTrustedIssuers() {
+	if err := a.ReloadTrustedIssuers(); err != nil {
+		log.WithError(err).Warnf("failed to reload trusted issuers")
+	}
+}
@@ -0,0 +1,247 @@
+package controllers
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"github.com/goidp/models"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/golang-jwt/jwt"
+	"github.com/google/jsonapi"
+)
+
+func TestIssuerRegistryAuthorize(t *testing.T) {
+	signKey, err := ReadPrivateKey(PKCS1_Private_Key)
+	if err != nil {
+		t.Fatalf("could not read issuer key: %s", err)
+	}
+	reg := newIssuerRegistry()
+	reg.load([]*models.TrustedIssuer{
+		{
+			Issuer:     "ci",
+			PublicKeys: []string{PKIX_Public_Key},
+		},
+		{
+			Issuer:      "partner",
+			PublicKeys:  []string{X509_Certificate},
+			Audiences:   []string{"goidp"},
+			RoleMapping: map[string]string{"reader": "MONITOR", "owner": "ADMIN"},
+			RoleCeiling: []string{"MONITOR"},
+		},
+		{
+			Issuer:     "retired",
+			PublicKeys: []string{PKIX_Public_Key},
+			Disabled:   true,
+		},
+	})
+
+	tt := []struct {
+		name   string
+		claims jwt.MapClaims
+		valid  bool
+		roles  []string
+	}{
+		{
+			name:   "static key issuer",
+			claims: jwt.MapClaims{"iss": "ci", "sub": "pipeline", "roles": []string{"admin", "monitor"}},
+			valid:  true,
+			roles:  []string{models.AdminRole.String(), models.MonitorRole.String()},
+		},
+		{
+			name:   "role mapping and ceiling",
+			claims: jwt.MapClaims{"iss": "partner", "sub": "sync", "aud": "goidp", "roles": []string{"owner", "reader", "guest"}},
+			valid:  true,
+			roles:  []string{models.MonitorRole.String()},
+		},
+		{
+			name:   "audience not accepted",
+			claims: jwt.MapClaims{"iss": "partner", "sub": "sync", "aud": "another", "roles": []string{"reader"}},
+		},
+		{
+			name:   "role above ceiling only",
+			claims: jwt.MapClaims{"iss": "partner", "sub": "sync", "aud": "goidp", "roles": []string{"owner"}},
+		},
+		{
+			name:   "unknown issuer",
+			claims: jwt.MapClaims{"iss": "unknown", "sub": "pipeline", "roles": []string{"admin"}},
+		},
+		{
+			name:   "disabled issuer",
+			claims: jwt.MapClaims{"iss": "retired", "sub": "pipeline", "roles": []string{"admin"}},
+		},
+		{
+			name:   "missing subject",
+			claims: jwt.MapClaims{"iss": "ci", "roles": []string{"admin"}},
+		},
+		{
+			name:   "expired token",
+			claims: jwt.MapClaims{"iss": "ci", "sub": "pipeline", "roles": []string{"admin"}, "exp": time.Now().Add(-time.Minute).Unix()},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			token, err := jwt.NewWithClaims(jwt.SigningMethodRS256, tc.claims).SignedString(signKey)
+			if err != nil {
+				t.Fatalf("could not sign token: %s", err)
+			}
+			claims, err := reg.authorize(token)
+			if !tc.valid {
+				if err == nil {
+					t.Fatalf("expected token to be rejected")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected token to be authorized; got %s", err)
+			}
+			if claims.Subject != tc.claims["sub"] || claims.Issuer != tc.claims["iss"] {
+				t.Errorf("unexpected subject %s or issuer %s", claims.Subject, claims.Issuer)
+			}
+			if len(claims.Roles) != len(tc.roles) {
+				t.Fatalf("expected roles %v; got %v", tc.roles, claims.Roles)
+			}
+			for i := range tc.roles {
+				if claims.Roles[i] != tc.roles[i] {
+					t.Errorf("expected roles %v; got %v", tc.roles, claims.Roles)
+				}
+			}
+		})
+	}
+}
+
+func TestCreateSessionHandlerTrustedIssuer(t *testing.T) {
+	s, err := SetupSuite()
+	if err != nil {
+		t.Fatalf("error setting up test suite: %s", err.Error())
+	}
+	a := NewApp(s.DB, &Config{})
+	a.config.SignKey, _ = ReadPrivateKey(PKCS1_Private_Key)
+	a.config.VerifyKey = &a.config.SignKey.PublicKey
+
+	publicKeys, _ := json.Marshal([]string{PKIX_Public_Key})
+	s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "trusted_issuers" WHERE "trusted_issuers"."deleted_at" IS NULL ORDER BY id`)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "issuer", "public_keys", "role_mapping"}).
+			AddRow(1, "ci", publicKeys, `{"deployer":"ADMIN"}`))
+	if err := a.ReloadTrustedIssuers(); err != nil {
+		t.Fatalf("could not load trusted issuers: %s", err)
+	}
+
+	token, _ := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":   "ci",
+		"sub":   "pipeline",
+		"roles": []string{"deployer"},
+	}).SignedString(a.config.SignKey)
+
+	var body bytes.Buffer
+	_ = jsonapi.MarshalOnePayloadEmbedded(&body, &CreateSessionHandlerRequest{AccessToken: token})
+	req, _ := http.NewRequest(http.MethodPost, "/v1.0/session", &body)
+	rec := httptest.NewRecorder()
+
+	s.mock.ExpectBegin()
+	s.mock.ExpectQuery(regexp.QuoteMeta(
+		`INSERT INTO "external_identities" ("created_at","updated_at","deleted_at","username","issuer","subject","roles","last_seen","version") VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9) ON CONFLICT ("issuer","subject") DO UPDATE SET "updated_at"="excluded"."updated_at","username"="excluded"."username","roles"="excluded"."roles","last_seen"="excluded"."last_seen","version"=CASE WHEN "external_identities"."roles" = "excluded"."roles" AND "external_identities"."username" = "excluded"."username" THEN "external_identities"."version" ELSE "external_identities"."version" + 1 END RETURNING "id","version"`)).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), nil, "pipeline", "ci", "pipeline", `["ADMIN"]`, sqlmock.AnyArg(), 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "version"}).AddRow(1, 1))
+	s.mock.ExpectCommit()
+
+	insertArgs := []driver.Value{sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()}
+	s.mock.ExpectBegin()
+	s.mock.ExpectQuery(regexp.QuoteMeta(
+		`INSERT INTO "events" ("created_at","updated_at","deleted_at","username","activated","description","modified","authn_domain","severity") VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9) RETURNING "id"`)).
+		WithArgs(insertArgs...).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	s.mock.ExpectCommit()
+	s.mock.ExpectBegin()
+	s.mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "sessions"`)).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	s.mock.ExpectCommit()
+
+	a.CreateSessionHandler(rec, req)
+
+	if err := s.mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d; got %d", http.StatusOK, rec.Code)
+	}
+	claims, err := getClaimsFromAccessToken(rec.Header().Get(headerAuthorization)[len("Bearer "):], "", a.config.VerifyKey)
+	if err != nil {
+		t.Fatalf("could not decode access token: %s", err)
+	}
+	if claims.Subject != "pipeline" || claims.Azt != models.ExternalDomain {
+		t.Errorf("unexpected subject %s or domain %s", claims.Subject, claims.Azt)
+	}
+	if len(claims.Roles) != 1 || claims.Roles[0] != models.AdminRole.String() {
+		t.Errorf("expected roles [%s]; got %v", models.AdminRole, claims.Roles)
+	}
+}
+
+func TestImportTrustedKeys(t *testing.T) {
+	s, err := SetupSuite()
+	if err != nil {
+		t.Fatalf("error setting up test suite: %s", err.Error())
+	}
+	a := NewApp(s.DB, &Config{})
+
+	tt := []struct {
+		name string
+		// imported is whether the key file has been imported before
+		imported   bool
+		registered bool
+		created    bool
+	}{
+		{
+			name:    "new key",
+			created: true,
+		},
+		{
+			name:     "key imported before, issuer deleted since",
+			imported: true,
+		},
+		{
+			name:       "issuer registered through the API",
+			registered: true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			s.mock.ExpectBegin()
+			iQ := s.mock.ExpectQuery(regexp.QuoteMeta(
+				`INSERT INTO "trusted_key_imports" ("created_at","updated_at","deleted_at","issuer") VALUES ($1,$2,$3,$4) ON CONFLICT DO NOTHING RETURNING "id"`)).
+				WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), nil, "ci")
+			if tc.imported {
+				iQ.WillReturnRows(sqlmock.NewRows([]string{"id"}))
+			} else {
+				iQ.WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+				count := 0
+				if tc.registered {
+					count = 1
+				}
+				s.mock.ExpectQuery(regexp.QuoteMeta(
+					`SELECT count(*) FROM "trusted_issuers" WHERE issuer = $1 AND "trusted_issuers"."deleted_at" IS NULL`)).
+					WithArgs("ci").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(count))
+			}
+			if tc.created {
+				// the imported issuer cannot grant roles above the ceiling
+				s.mock.ExpectQuery(regexp.QuoteMeta(
+					`INSERT INTO "trusted_issuers" ("created_at","updated_at","deleted_at","issuer","jwks_url","public_keys","audiences","role_mapping","role_ceiling","disabled") VALUES ($1,$2,$3,$4,$5,$6,(NULL),$7,$8,$9) RETURNING "id"`)).
+					WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), nil, "ci", "", sqlmock.AnyArg(), `{}`, `["MONITOR"]`, false).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+			}
+			s.mock.ExpectCommit()
+
+			a.ImportTrustedKeys(map[string]string{"ci": PKIX_Public_Key}, []string{models.MonitorRole.String()})
+
+			if err := s.mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,217 @@
+package controllers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// jwksRefreshInterval is the maximum age of the cached keys
+	jwksRefreshInterval = 1 * time.Hour
+	// jwksMinRefreshInterval avoids hammering the issuer when tokens with unknown key ids are received
+	jwksMinRefreshInterval = 30 * time.Second
+)
+
+// jsonWebKey is a RSA or EC JSON Web Key as defined in RFC 7517
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	// D is the private part of the key, public keys must not carry it
+	D string `json:"d"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+// rsaPublicKey decodes the modulus and exponent of the JSON Web Key
+func (k *jsonWebKey) rsaPublicKey() (*rsa.PublicKey, error) {
+	if k.Kty != "RSA" {
+		return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+	}
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key modulus: %s", err.Error())
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key exponent: %s", err.Error())
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(new(big.Int).SetBytes(e).Int64()),
+	}, nil
+}
+
+// ecdsaPublicKey decodes the curve coordinates of the JSON Web Key, only P-256 is supported
+func (k *jsonWebKey) ecdsaPublicKey() (*ecdsa.PublicKey, error) {
+	if k.Kty != "EC" || k.Crv != "P-256" {
+		return nil, fmt.Errorf("unsupported key type %s %s", k.Kty, k.Crv)
+	}
+	x, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key x coordinate: %s", err.Error())
+	}
+	y, err := base64.RawURLEncoding.DecodeString(k.Y)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key y coordinate: %s", err.Error())
+	}
+	pKey := &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(x),
+		Y:     new(big.Int).SetBytes(y),
+	}
+	if !pKey.Curve.IsOnCurve(pKey.X, pKey.Y) {
+		return nil, errors.New("invalid key, point not on curve")
+	}
+	return pKey, nil
+}
+
+// thumbprint returns the RFC 7638 SHA-256 thumbprint of the JSON Web Key, computed over its
+// required members in lexicographic order
+func (k *jsonWebKey) thumbprint() (string, error) {
+	var members string
+	switch k.Kty {
+	case "RSA":
+		members = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, k.E, k.N)
+	case "EC":
+		members = fmt.Sprintf(`{"crv":%q,"kty":"EC","x":%q,"y":%q}`, k.Crv, k.X, k.Y)
+	default:
+		return "", fmt.Errorf("unsupported key type %s", k.Kty)
+	}
+	sum := sha256.Sum256([]byte(members))
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// jwksCache fetches and caches the RSA keys published by an issuer at its JWKS URL
+// keys are refreshed periodically and whenever a token signed with an unknown key id is received
+type jwksCache struct {
+	url     string
+	client  *http.Client
+	mu      sync.RWMutex
+	keys    map[string]*rsa.PublicKey
+	fetched time.Time
+}
+
+func newJWKSCache(url string, client *http.Client) *jwksCache {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &jwksCache{
+		url:    url,
+		client: client,
+	}
+}
+
+// refresh downloads the key set from the JWKS URL
+func (c *jwksCache) refresh() error {
+	res, err := c.client.Get(c.url)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d fetching %s", res.StatusCode, c.url)
+	}
+	var set jsonWebKeySet
+	if err = json.NewDecoder(res.Body).Decode(&set); err != nil {
+		return err
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pKey, err := k.rsaPublicKey()
+		if err != nil {
+			log.WithError(err).Infof("skipping key %s of %s", k.Kid, c.url)
+			continue
+		}
+		keys[k.Kid] = pKey
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.keys = keys
+	c.fetched = time.Now()
+	return nil
+}
+
+// key returns the public key with the given key id, if the token does not carry
+// a key id the key set must contain exactly one key
+func (c *jwksCache) key(kid string) (*rsa.PublicKey, error) {
+	c.mu.RLock()
+	pKey, found := c.lookup(kid)
+	age := time.Since(c.fetched)
+	c.mu.RUnlock()
+	if found && age < jwksRefreshInterval {
+		return pKey, nil
+	}
+	if !found && age < jwksMinRefreshInterval {
+		return nil, fmt.Errorf("unknown key id %s", kid)
+	}
+
+	if err := c.refresh(); err != nil {
+		if found {
+			// keep using the cached key if the issuer is temporarily unreachable
+			log.WithError(err).Warnf("failed to refresh %s", c.url)
+			return pKey, nil
+		}
+		return nil, err
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if pKey, found = c.lookup(kid); !found {
+		return nil, fmt.Errorf("unknown key id %s", kid)
+	}
+	return pKey, nil
+}
+
+func (c *jwksCache) lookup(kid string) (*rsa.PublicKey, bool) {
+	if kid == "" {
+		if len(c.keys) != 1 {
+			return nil, false
+		}
+		for _, pKey := range c.keys {
+			return pKey, true
+		}
+	}
+	pKey, ok := c.keys[kid]
+	return pKey, ok
+}
+
+// keyFunc returns the jwt.Keyfunc selecting the verification key through the token kid header
+func (c *jwksCache) keyFunc() jwt.Keyfunc {
+	return func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		kid, _ := token.Header["kid"].(string)
+		pKey, err := c.key(kid)
+		if err != nil {
+			return nil, errors.New("no key found to verify token: " + err.Error())
+		}
+		return pKey, nil
+	}
+}
@@ -2,10 +2,12 @@ package controllers
 
 import (
 	"crypto/rsa"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/goidp/models"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -16,17 +18,202 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+const (
+	// accessTokenType and renewTokenType are the typ claims of the access and renew tokens, the other tokens
+	// signed by goidp, e.g. the state of the upstream logins, are never accepted in their place
+	accessTokenType = "access"
+	renewTokenType  = "renew"
+)
+
 type customClaims struct {
+	// Typ is accessTokenType for the access tokens
+	Typ   string   `json:"typ"`
 	Roles []string `json:"roles"`
 	Azt   string   `json:"azt"`
+	// Audience lists the services the token is meant for, the token is accepted by any service if empty
+	Audience audienceClaim `json:"aud,omitempty"`
+	// Scope is the space separated list of operations the token is restricted to, no restriction applies if empty
+	Scope string `json:"scope,omitempty"`
+	// Act identifies the service the token has been issued to on behalf of the subject
+	Act *actorClaim `json:"act,omitempty"`
+	// Cnf binds the token to the DPoP key of the client, the token is a bearer token if empty
+	Cnf *confirmationClaim `json:"cnf,omitempty"`
+	// Sid is the session the token has been issued for, the token is rejected once the session is terminated
+	Sid string `json:"sid,omitempty"`
+	// Ver is the generation of the subject at issuance, the token is rejected once the subject is deleted
+	// or its roles or password change
+	Ver int `json:"ver,omitempty"`
+	// Eid is the external identity of the subject, 0 for the local users and the service accounts
+	Eid uint `json:"eid,omitempty"`
+	// Name, Email, PhoneNumber, Locale and Team are the core profile of the subject, if mapped
+	Name        string `json:"name,omitempty"`
+	Email       string `json:"email,omitempty"`
+	PhoneNumber string `json:"phone_number,omitempty"`
+	Locale      string `json:"locale,omitempty"`
+	Team        string `json:"team,omitempty"`
+	// Attrs are the custom attributes of the subject marked as in token
+	Attrs map[string]interface{} `json:"attrs,omitempty"`
+	jwt.StandardClaims
+}
+
+// localUser returns true if the token has been issued by goidp to the local user username: the external
+// identities, the service accounts and the subjects of the trusted issuers may have the same name
+func (c *customClaims) localUser(username string) bool {
+	return c.Subject == username && c.Azt == models.InternalDomain && c.Eid == 0
+}
+
+// renewClaims are the renew token claims, the audience, scope, DPoP binding, session and generation are
+// preserved by the renewed access tokens
+type renewClaims struct {
+	// Typ is renewTokenType for the renew tokens
+	Typ      string             `json:"typ"`
+	Audience audienceClaim      `json:"aud,omitempty"`
+	Scope    string             `json:"scope,omitempty"`
+	Cnf      *confirmationClaim `json:"cnf,omitempty"`
+	Sid      string             `json:"sid,omitempty"`
+	Ver      int                `json:"ver,omitempty"`
+	Eid      uint               `json:"eid,omitempty"`
 	jwt.StandardClaims
 }
 
-func (a *App) jwtMiddleware(next http.Handler) http.Handler {
+// audienceClaim is the aud claim, which can be either a single string or a list of strings
+type audienceClaim []string
+
+func (aud *audienceClaim) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*aud = audienceClaim{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*aud = list
+	return nil
+}
+
+// actorClaim is the RFC 8693 act claim, the previous actors of a delegation chain are nested
+type actorClaim struct {
+	Subject string      `json:"sub"`
+	Issuer  string      `json:"iss,omitempty"`
+	Act     *actorClaim `json:"act,omitempty"`
+}
+
+// requiredScope returns the scope needed to perform the request on the resource
+func requiredScope(resource, method string) string {
+	if method == http.MethodGet || method == http.MethodHead {
+		return resource + ":read"
+	}
+	return resource + ":write"
+}
+
+// verifyAccess checks that the token is meant for goidp and that its scope, if any, allows the request
+// on the resource
+func (a *App) verifyAccess(claims *customClaims, resource, method string) error {
+	if len(claims.Audience) == 0 {
+		if a.config.RequireAudience {
+			return errors.New("token without audience")
+		}
+	} else if !stringInSlice(claims.Audience, a.config.Audience) {
+		return fmt.Errorf("token not meant for audience %s", a.config.Audience)
+	}
+	if claims.Scope == "" {
+		return nil
+	}
+	if scope := requiredScope(resource, method); !stringInSlice(strings.Fields(claims.Scope), scope) {
+		return fmt.Errorf("token scope does not include %s", scope)
+	}
+	return nil
+}
+
+// errTokenRevoked is returned for the tokens issued before the last change of their subject
+var errTokenRevoked = errors.New("token revoked")
+
+// subjectGeneration returns the current generation of the service account, for the tokens of the service
+// accounts, of the external identity, for the tokens referring to one, otherwise of the local user
+func (a *App) subjectGeneration(username, domain string, eid uint) (int, error) {
+	if domain == models.ServiceAccountDomain {
+		s, err := a.ServiceAccounts.GetServiceAccount(username)
+		if err != nil {
+			return 0, err
+		}
+		return s.Version, nil
+	}
+	if eid != 0 {
+		identity, err := a.ExternalIdentities.GetExternalIdentityByID(strconv.Itoa(int(eid)))
+		if err != nil {
+			return 0, err
+		}
+		if identity.Username != username {
+			return 0, errTokenRevoked
+		}
+		return identity.Version, nil
+	}
+	user, err := a.Users.GetUserByNameOrID(username)
+	if err != nil {
+		return 0, err
+	}
+	return user.Version, nil
+}
+
+// auditActor records the write requests made with a token issued to an actor on behalf of its subject,
+// such as the impersonation tokens of the administrators
+func (a *App) auditActor(r *http.Request, claims *customClaims) {
+	if claims.Act == nil || r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return
+	}
+	if err := a.Events.CreateImpersonatedWriteEvent(claims.Subject, claims.Act.Subject, r.Method, r.URL.Path); err != nil {
+		log.WithError(err).Warnf("failed to store impersonated write event")
+	}
+}
+
+// verifyGeneration checks that the subject of the token still exists and has not changed since the
+// token has been issued, the tokens without generation are accepted
+func (a *App) verifyGeneration(claims *customClaims) error {
+	if claims.Ver == 0 {
+		return nil
+	}
+	version, err := a.subjectGeneration(claims.Subject, claims.Azt, claims.Eid)
+	if err != nil {
+		return err
+	}
+	if version != claims.Ver {
+		return errTokenRevoked
+	}
+	return nil
+}
+
+// verifySubject writes the error response if the token has been revoked by a change of its subject
+func (a *App) verifySubject(w http.ResponseWriter, claims *customClaims) bool {
+	switch err := a.verifyGeneration(claims).(type) {
+	case nil:
+		return true
+	case *models.DBError:
+		jsonapiError(w, http.StatusInternalServerError, "internal error, retry later")
+	default:
+		log.WithError(err).Infof("revoked token of %s", claims.Subject)
+		jsonapiError(w, http.StatusUnauthorized, "token revoked")
+	}
+	return false
+}
+
+// getRequestClaims returns the claims of the access token or of the personal access token of the request
+func (a *App) getRequestClaims(t string) (*customClaims, error) {
+	if isPersonalAccessToken(t) {
+		return a.personalAccessTokenClaims(t)
+	}
+	return getClaimsFromAccessToken(t, a.config.Secret, a.config.VerifyKey)
+}
+
+func (a *App) jwtMiddleware(next http.Handler, resource string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		t := parseAuthHeader(r)
-		claims, err := getClaimsFromAccessToken(t, a.config.Secret, a.config.VerifyKey)
-		if err != nil {
+		claims, err := a.getRequestClaims(t)
+		if _, ok := err.(*models.DBError); ok {
+			jsonapiError(w, http.StatusInternalServerError, "internal error, retry later")
+			return
+		} else if err != nil {
 			log.WithFields(log.Fields{
 				"claims": claims,
 				"error":  err,
@@ -34,25 +221,94 @@ func (a *App) jwtMiddleware(next http.Handler) http.Handler {
 			jsonapiError(w, http.StatusUnauthorized, "unauthorized request")
 			return
 		} else {
+			if err = a.verifyTokenBinding(r, t, claims.Cnf); err != nil {
+				log.WithError(err).Info("invalid token binding")
+				writeTokenBindingError(w, claims.Cnf, err)
+				return
+			}
+			if !a.verifySession(w, claims) || !a.verifySubject(w, claims) {
+				return
+			}
+			if err = a.verifyAccess(claims, resource, r.Method); err != nil {
+				log.WithError(err).Info("forbidden request")
+				jsonapiError(w, http.StatusForbidden, "forbidden request")
+				return
+			}
 			if !stringInSliceCaseInsensitive(claims.Roles, models.AdminRole.String()) {
+				params := mux.Vars(r)
+				id, ok := params["id"]
+				// non-admin users manage their own personal access tokens and email verification only
+				if resource == "token" || resource == "email" {
+					if !ok || !claims.localUser(id) {
+						jsonapiError(w, http.StatusForbidden, "forbidden request")
+						return
+					}
+					a.auditActor(r, claims)
+					next.ServeHTTP(w, r)
+					return
+				}
+				// non-admin users request elevations but cannot decide them
+				if resource == "elevation" {
+					if r.Method == http.MethodPatch {
+						jsonapiError(w, http.StatusForbidden, "forbidden request")
+						return
+					}
+					a.auditActor(r, claims)
+					next.ServeHTTP(w, r)
+					return
+				}
 				// non-admin users cannot POST/DELETE
 				if r.Method == http.MethodPost || r.Method == http.MethodDelete {
 					jsonapiError(w, http.StatusForbidden, "forbidden request")
 					return
 				}
-				params := mux.Vars(r)
-				id, ok := params["id"]
 				// non-admin users can only PATCH themselves
 				if ok && r.Method == http.MethodPatch && id != claims.Subject {
 					jsonapiError(w, http.StatusForbidden, "forbidden request")
 					return
 				}
 			}
+			a.auditActor(r, claims)
 			next.ServeHTTP(w, r)
 		}
 	})
 }
 
+// adminMiddleware restricts the routes to the administrators
+func (a *App) adminMiddleware(next http.Handler, resource string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t := parseAuthHeader(r)
+		claims, err := a.getRequestClaims(t)
+		if _, ok := err.(*models.DBError); ok {
+			jsonapiError(w, http.StatusInternalServerError, "internal error, retry later")
+			return
+		} else if err != nil {
+			log.WithError(err).Info("unauthorized request")
+			jsonapiError(w, http.StatusUnauthorized, "unauthorized request")
+			return
+		}
+		if err = a.verifyTokenBinding(r, t, claims.Cnf); err != nil {
+			log.WithError(err).Info("invalid token binding")
+			writeTokenBindingError(w, claims.Cnf, err)
+			return
+		}
+		if !a.verifySession(w, claims) || !a.verifySubject(w, claims) {
+			return
+		}
+		if err = a.verifyAccess(claims, resource, r.Method); err != nil {
+			log.WithError(err).Info("forbidden request")
+			jsonapiError(w, http.StatusForbidden, "forbidden request")
+			return
+		}
+		if !stringInSliceCaseInsensitive(claims.Roles, models.AdminRole.String()) {
+			jsonapiError(w, http.StatusForbidden, "forbidden request")
+			return
+		}
+		a.auditActor(r, claims)
+		next.ServeHTTP(w, r)
+	})
+}
+
 func newStandardClaims(user *models.User, issuer string, expire time.Duration) jwt.StandardClaims {
 	return jwt.StandardClaims{
 		ExpiresAt: time.Now().Add(expire).Unix(),
@@ -64,23 +320,50 @@ func newStandardClaims(user *models.User, issuer string, expire time.Duration) j
 	}
 }
 
-func newCustomClaims(user *models.User, domain string, expire time.Duration) customClaims {
+func newRenewClaims(user *models.User, issuer string, expire time.Duration, audience []string, scope string) renewClaims {
+	return renewClaims{
+		Typ:            renewTokenType,
+		Audience:       audience,
+		Scope:          scope,
+		Ver:            user.Version,
+		Eid:            user.IdentityID,
+		StandardClaims: newStandardClaims(user, issuer, expire),
+	}
+}
+
+func newCustomClaims(user *models.User, domain string, expire time.Duration, audience []string, scope string) customClaims {
 	var roles []string
 	for _, r := range user.Roles {
 		roles = append(roles, r.Name)
 	}
+	expiresAt := time.Now().Add(expire)
+	// the roles of the active elevations are granted until the end of their window at the latest
+	for _, e := range user.Elevations {
+		if !e.Active() || stringInSliceCaseInsensitive(roles, e.Role) {
+			continue
+		}
+		roles = append(roles, e.Role)
+		if e.ExpiresAt.Before(expiresAt) {
+			expiresAt = e.ExpiresAt
+		}
+	}
 
 	return customClaims{
 		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: time.Now().Add(expire).Unix(),
+			ExpiresAt: expiresAt.Unix(),
 			IssuedAt:  time.Now().Unix(),
 			Subject:   user.Username,
 			Id:        uuid.New().String(),
 			Issuer:    "idp",
 			NotBefore: time.Now().Unix(),
 		},
-		Roles: roles,
-		Azt:   domain,
+		Typ:      accessTokenType,
+		Roles:    roles,
+		Azt:      domain,
+		Audience: audience,
+		Scope:    scope,
+		Ver:      user.Version,
+		Eid:      user.IdentityID,
 	}
 }
 
@@ -120,11 +403,11 @@ func getKeyFunc(secret string, verifyKey *rsa.PublicKey) jwt.Keyfunc {
 	return keyFunc
 }
 
-func getClaimsFromRenewToken(t string, secret string, verifyKey *rsa.PublicKey) (*jwt.StandardClaims, error) {
+func getClaimsFromRenewToken(t string, secret string, verifyKey *rsa.PublicKey) (*renewClaims, error) {
 	keyFunc := getKeyFunc(secret, verifyKey)
 	token, err := jwt.ParseWithClaims(
 		t,
-		&jwt.StandardClaims{},
+		&renewClaims{},
 		keyFunc,
 	)
 	if err != nil {
@@ -136,50 +419,19 @@ func getClaimsFromRenewToken(t string, secret string, verifyKey *rsa.PublicKey)
 	if !token.Valid {
 		return nil, errors.New("invalid token")
 	}
-	c, ok := token.Claims.(*jwt.StandardClaims)
+	c, ok := token.Claims.(*renewClaims)
 	if !ok {
 		return nil, errors.New("error decoding claims")
 	}
-	log.WithFields(log.Fields{
-		"expire_time": c.ExpiresAt,
-		"issued_at":   c.IssuedAt,
-		"subject":     c.Subject,
-		"issuer":      c.Issuer,
-	}).Info("jwt token claims")
-	return c, nil
-}
-
-func getClaimsFromM2MToken(t string, verifyKey *rsa.PublicKey) (*customClaims, error) {
-	token, err := jwt.ParseWithClaims(
-		t,
-		&customClaims{},
-		func(jwtToken *jwt.Token) (interface{}, error) {
-			if _, ok := jwtToken.Method.(*jwt.SigningMethodRSA); !ok {
-				return nil, fmt.Errorf("error jwt method not allowed")
-			}
-			return verifyKey, nil
-		})
-	if err != nil {
-		return nil, err
-	}
-	log.WithFields(log.Fields{
-		"token": token,
-	}).Debug("jwt token")
-	if !token.Valid {
-		return nil, errors.New("invalid token")
-	}
-	c, ok := token.Claims.(*customClaims)
-	if !ok {
-		return nil, errors.New("error decoding claims")
+	if c.Typ != renewTokenType || c.Subject == "" {
+		return nil, errors.New("not a renew token")
 	}
 	log.WithFields(log.Fields{
 		"expire_time": c.ExpiresAt,
 		"issued_at":   c.IssuedAt,
 		"subject":     c.Subject,
 		"issuer":      c.Issuer,
-		"role_list":   c.Roles,
 	}).Info("jwt token claims")
-
 	return c, nil
 }
 
@@ -203,6 +455,9 @@ func getClaimsFromAccessToken(t string, secret string, verifyKey *rsa.PublicKey)
 	if !ok {
 		return nil, errors.New("error decoding claims")
 	}
+	if c.Typ != accessTokenType || c.Subject == "" {
+		return nil, errors.New("not an access token")
+	}
 	log.WithFields(log.Fields{
 		"expire_time": c.ExpiresAt,
 		"issued_at":   c.IssuedAt,
@@ -216,6 +471,10 @@ func getClaimsFromAccessToken(t string, secret string, verifyKey *rsa.PublicKey)
 
 func parseAuthHeader(r *http.Request) string {
 	t := r.Header.Get(headerAuthorization)
+	if strings.HasPrefix(t, "DPoP ") {
+		// DPoP bound tokens are presented with the DPoP scheme
+		return strings.TrimSpace(strings.TrimPrefix(t, "DPoP "))
+	}
 	sT := strings.SplitAfter(t, "Bearer")
 	var rawT string
 	switch len(sT) {
@@ -227,23 +486,3 @@ func parseAuthHeader(r *http.Request) string {
 	}
 	return strings.TrimSpace(rawT)
 }
-
-func authorizeM2MRequest(t string, pubKeys []*rsa.PublicKey) (*customClaims, error) {
-	if pubKeys == nil {
-		return nil, fmt.Errorf("no trusted public keys configured")
-	}
-	if t == "" {
-		return nil, fmt.Errorf("empty token")
-	}
-
-	for _, pKey := range pubKeys {
-		c, err := getClaimsFromM2MToken(t, pKey)
-		if err != nil {
-			log.WithError(err).Info("unable to extract claims from token")
-			continue
-		}
-		return c, nil
-	}
-
-	return nil, fmt.Errorf("no issuer found")
-}
@@ -0,0 +1,346 @@
+package controllers
+
+import (
+	"github.com/goidp/models"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/golang-jwt/jwt"
+	"github.com/gorilla/mux"
+)
+
+func TestJWTMiddlewareAudienceAndScope(t *testing.T) {
+	s, err := SetupSuite()
+	if err != nil {
+		t.Fatalf("error setting up test suite: %s", err.Error())
+	}
+	a := NewApp(s.DB, &Config{Audience: "goidp"})
+	a.config.SignKey, _ = ReadPrivateKey(PKCS1_Private_Key)
+	a.config.VerifyKey = &a.config.SignKey.PublicKey
+	rL, _ := models.NewRoleList([]string{models.AdminRole.String()})
+	admin := &models.User{Username: "admin", Roles: rL}
+
+	tt := []struct {
+		name            string
+		method          string
+		audience        []string
+		scope           string
+		requireAudience bool
+		status          int
+	}{
+		{
+			name:   "unrestricted token",
+			method: http.MethodGet,
+			status: http.StatusOK,
+		},
+		{
+			name:     "token meant for goidp",
+			method:   http.MethodPost,
+			audience: []string{"svc-b", "goidp"},
+			status:   http.StatusOK,
+		},
+		{
+			name:     "token meant for another service",
+			method:   http.MethodGet,
+			audience: []string{"svc-b"},
+			status:   http.StatusForbidden,
+		},
+		{
+			name:            "token without audience when required",
+			method:          http.MethodGet,
+			requireAudience: true,
+			status:          http.StatusForbidden,
+		},
+		{
+			name:   "read scope on read request",
+			method: http.MethodGet,
+			scope:  "event:read user:read",
+			status: http.StatusOK,
+		},
+		{
+			name:   "read scope on write request",
+			method: http.MethodDelete,
+			scope:  "user:read",
+			status: http.StatusForbidden,
+		},
+		{
+			name:   "scope of another resource",
+			method: http.MethodGet,
+			scope:  "event:read",
+			status: http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			a.config.RequireAudience = tc.requireAudience
+			token, _ := generateToken(newCustomClaims(admin, models.InternalDomain, time.Minute, tc.audience, tc.scope), "", a.config.SignKey)
+			req, _ := http.NewRequest(tc.method, "/v1.0/user", nil)
+			req.Header.Set(headerAuthorization, "Bearer "+token)
+			rec := httptest.NewRecorder()
+
+			a.jwtMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}), "user").ServeHTTP(rec, req)
+
+			if rec.Code != tc.status {
+				t.Errorf("expected status %d; got %d", tc.status, rec.Code)
+			}
+		})
+	}
+}
+
+func TestAudienceAndScopeClaims(t *testing.T) {
+	signKey, _ := ReadPrivateKey(PKCS1_Private_Key)
+	user := &models.User{Username: "jdoe"}
+
+	// the renew token carries the audience and scope of the session
+	renewToken, _ := generateToken(newRenewClaims(user, models.InternalDomain, time.Minute, []string{"svc-b"}, "user:read"), "", signKey)
+	rC, err := getClaimsFromRenewToken(renewToken, "", &signKey.PublicKey)
+	if err != nil {
+		t.Fatalf("could not decode renew token: %s", err)
+	}
+	if len(rC.Audience) != 1 || rC.Audience[0] != "svc-b" || rC.Scope != "user:read" {
+		t.Errorf("unexpected audience %v or scope %s", rC.Audience, rC.Scope)
+	}
+
+	// the audience can be a single string
+	token, _ := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"typ": accessTokenType, "sub": "jdoe", "aud": "goidp"}).SignedString(signKey)
+	c, err := getClaimsFromAccessToken(token, "", &signKey.PublicKey)
+	if err != nil {
+		t.Fatalf("could not decode access token: %s", err)
+	}
+	if len(c.Audience) != 1 || c.Audience[0] != "goidp" {
+		t.Errorf("unexpected audience %v", c.Audience)
+	}
+}
+
+func TestJWTMiddlewareGeneration(t *testing.T) {
+	s, err := SetupSuite()
+	if err != nil {
+		t.Fatalf("error setting up test suite: %s", err.Error())
+	}
+	a := NewApp(s.DB, &Config{})
+	a.config.SignKey, _ = ReadPrivateKey(PKCS1_Private_Key)
+	a.config.VerifyKey = &a.config.SignKey.PublicKey
+	rL, _ := models.NewRoleList([]string{models.AdminRole.String()})
+
+	tt := []struct {
+		name             string
+		identityID       uint
+		userVersion      int
+		identityVersion  int
+		identityUsername string
+		status           int
+	}{
+		{
+			name:        "unchanged user",
+			userVersion: 2,
+			status:      http.StatusOK,
+		},
+		{
+			name:        "user changed after issuance",
+			userVersion: 3,
+			status:      http.StatusUnauthorized,
+		},
+		{
+			name:             "unchanged external identity",
+			identityID:       1,
+			identityVersion:  2,
+			identityUsername: "jdoe",
+			status:           http.StatusOK,
+		},
+		{
+			name:             "external identity with new roles",
+			identityID:       1,
+			identityVersion:  3,
+			identityUsername: "jdoe",
+			status:           http.StatusUnauthorized,
+		},
+		{
+			name:             "external identity renamed",
+			identityID:       1,
+			identityVersion:  2,
+			identityUsername: "john",
+			status:           http.StatusUnauthorized,
+		},
+		{
+			name:       "deleted external identity",
+			identityID: 1,
+			status:     http.StatusUnauthorized,
+		},
+		{
+			name:   "deleted user",
+			status: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			user := &models.User{Username: "jdoe", Roles: rL, Version: 2, IdentityID: tc.identityID}
+			token, _ := generateToken(newCustomClaims(user, models.InternalDomain, time.Minute, nil, ""), "", a.config.SignKey)
+			if tc.identityID != 0 {
+				// the tokens of the external identities refer to them, not to the local user with the same username
+				iQ := s.mock.ExpectQuery(regexp.QuoteMeta(
+					`SELECT * FROM "external_identities" WHERE "external_identities"."id" = $1 AND "external_identities"."deleted_at" IS NULL LIMIT 1`)).
+					WithArgs(1)
+				if tc.identityVersion != 0 {
+					iQ.WillReturnRows(sqlmock.NewRows([]string{"id", "username", "version"}).AddRow(1, tc.identityUsername, tc.identityVersion))
+				} else {
+					iQ.WillReturnRows(sqlmock.NewRows(nil))
+				}
+			} else {
+				uQ := s.mock.ExpectQuery(regexp.QuoteMeta(
+					`SELECT * FROM "users" WHERE username = $1 AND "users"."deleted_at" IS NULL ORDER BY "users"."id" LIMIT 1`)).
+					WithArgs("jdoe")
+				if tc.userVersion != 0 {
+					uQ.WillReturnRows(sqlmock.NewRows([]string{"Username", "Version"}).AddRow("jdoe", tc.userVersion))
+				} else {
+					uQ.WillReturnRows(sqlmock.NewRows(nil))
+				}
+			}
+
+			req, _ := http.NewRequest(http.MethodGet, "/v1.0/user", nil)
+			req.Header.Set(headerAuthorization, "Bearer "+token)
+			rec := httptest.NewRecorder()
+			a.jwtMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}), "user").ServeHTTP(rec, req)
+
+			if err := s.mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+			if rec.Code != tc.status {
+				t.Errorf("expected status %d; got %d", tc.status, rec.Code)
+			}
+		})
+	}
+}
+
+func TestTokenTypes(t *testing.T) {
+	signKey, _ := ReadPrivateKey(PKCS1_Private_Key)
+	user := &models.User{Username: "jdoe"}
+	accessToken, _ := generateToken(newCustomClaims(user, models.InternalDomain, time.Minute, nil, ""), "", signKey)
+	renewToken, _ := generateToken(newRenewClaims(user, models.InternalDomain, time.Minute, nil, ""), "", signKey)
+	stateToken, _ := generateToken(oidcStateClaims{
+		Typ:            oidcStateTokenType,
+		StandardClaims: jwt.StandardClaims{ExpiresAt: time.Now().Add(time.Minute).Unix(), Issuer: oidcStateIssuer},
+	}, "", signKey)
+	relayState, _ := generateToken(samlStateClaims{
+		Typ:            samlStateType,
+		StandardClaims: jwt.StandardClaims{ExpiresAt: time.Now().Add(time.Minute).Unix(), Issuer: samlStateIssuer},
+	}, "", signKey)
+	anonymousToken, _ := generateToken(newCustomClaims(&models.User{}, models.InternalDomain, time.Minute, nil, ""), "", signKey)
+
+	tt := []struct {
+		name   string
+		token  string
+		access bool
+		renew  bool
+	}{
+		{
+			name:   "access token",
+			token:  accessToken,
+			access: true,
+		},
+		{
+			name:  "renew token",
+			token: renewToken,
+			renew: true,
+		},
+		{
+			name:  "oidc state",
+			token: stateToken,
+		},
+		{
+			name:  "saml relay state",
+			token: relayState,
+		},
+		{
+			name:  "access token without subject",
+			token: anonymousToken,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := getClaimsFromAccessToken(tc.token, "", &signKey.PublicKey); (err == nil) != tc.access {
+				t.Errorf("expected access token %t; got error %v", tc.access, err)
+			}
+			if _, err := getClaimsFromRenewToken(tc.token, "", &signKey.PublicKey); (err == nil) != tc.renew {
+				t.Errorf("expected renew token %t; got error %v", tc.renew, err)
+			}
+		})
+	}
+}
+
+func TestJWTMiddlewareOwnResources(t *testing.T) {
+	s, err := SetupSuite()
+	if err != nil {
+		t.Fatalf("error setting up test suite: %s", err.Error())
+	}
+	a := NewApp(s.DB, &Config{})
+	a.config.SignKey, _ = ReadPrivateKey(PKCS1_Private_Key)
+	a.config.VerifyKey = &a.config.SignKey.PublicKey
+	rL, _ := models.NewRoleList([]string{models.MonitorRole.String()})
+
+	tt := []struct {
+		name   string
+		domain string
+		eid    uint
+		act    *actorClaim
+		status int
+	}{
+		{
+			name:   "local user",
+			domain: models.InternalDomain,
+			status: http.StatusOK,
+		},
+		{
+			name:   "subject of a trusted issuer",
+			domain: models.ExternalDomain,
+			status: http.StatusForbidden,
+		},
+		{
+			name:   "exchanged token of a trusted issuer subject",
+			domain: models.ExternalDomain,
+			act:    &actorClaim{Subject: "svc-a"},
+			status: http.StatusForbidden,
+		},
+		{
+			name:   "external identity",
+			domain: models.ExternalDomain,
+			eid:    3,
+			status: http.StatusForbidden,
+		},
+		{
+			name:   "service account",
+			domain: models.ServiceAccountDomain,
+			status: http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			claims := newCustomClaims(&models.User{Username: "jdoe", Roles: rL, IdentityID: tc.eid}, tc.domain, time.Minute, nil, "")
+			claims.Act = tc.act
+			token, _ := generateToken(claims, "", a.config.SignKey)
+			req, _ := http.NewRequest(http.MethodGet, "/v1.0/user/jdoe/token", nil)
+			req.Header.Set(headerAuthorization, "Bearer "+token)
+			req = mux.SetURLVars(req, map[string]string{"id": "jdoe"})
+			rec := httptest.NewRecorder()
+
+			a.jwtMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}), "token").ServeHTTP(rec, req)
+
+			if rec.Code != tc.status {
+				t.Errorf("expected status %d; got %d: %s", tc.status, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,489 @@
+package controllers
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"github.com/goidp/models"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/google/jsonapi"
+)
+
+// ldapEntry is a user entry served by the ldap stand-in server
+type ldapEntry struct {
+	dn       string
+	uid      string
+	password string
+	memberOf []string
+}
+
+// ldapStandIn is a minimal in-process LDAP server, it only understands simple bind,
+// search by (uid=<username>) and unbind requests
+type ldapStandIn struct {
+	listener     net.Listener
+	bindDN       string
+	bindPassword string
+	entries      []ldapEntry
+}
+
+func newLDAPStandIn(t *testing.T, entries []ldapEntry) *ldapStandIn {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not start ldap stand-in: %s", err)
+	}
+	s := &ldapStandIn{
+		listener:     l,
+		bindDN:       "cn=idp,dc=example,dc=org",
+		bindPassword: "idp-secret",
+		entries:      entries,
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *ldapStandIn) URL() string {
+	return "ldap://" + s.listener.Addr().String()
+}
+
+func (s *ldapStandIn) Close() {
+	_ = s.listener.Close()
+}
+
+func (s *ldapStandIn) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		messageID := packet.Children[0].Value
+		op := packet.Children[1]
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn := op.Children[1].Data.String()
+			password := op.Children[2].Data.String()
+			code := uint16(ldap.LDAPResultInvalidCredentials)
+			if dn == s.bindDN && password == s.bindPassword {
+				code = ldap.LDAPResultSuccess
+			}
+			for _, e := range s.entries {
+				if dn == e.dn && password == e.password {
+					code = ldap.LDAPResultSuccess
+				}
+			}
+			s.write(conn, messageID, ldapResult(ldap.ApplicationBindResponse, code))
+		case ldap.ApplicationSearchRequest:
+			filter, _ := ldap.DecompileFilter(op.Children[6])
+			for _, e := range s.entries {
+				if !strings.EqualFold(filter, "(uid="+e.uid+")") {
+					continue
+				}
+				entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "entry")
+				entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.dn, "dn"))
+				attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attributes")
+				attribute := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attribute")
+				attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "memberOf", "type"))
+				values := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "values")
+				for _, g := range e.memberOf {
+					values.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, g, "value"))
+				}
+				attribute.AppendChild(values)
+				attributes.AppendChild(attribute)
+				entry.AppendChild(attributes)
+				s.write(conn, messageID, entry)
+			}
+			s.write(conn, messageID, ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess))
+		default:
+			return
+		}
+	}
+}
+
+func (s *ldapStandIn) write(conn net.Conn, messageID interface{}, op *ber.Packet) {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "message")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "id"))
+	packet.AppendChild(op)
+	_, _ = conn.Write(packet.Bytes())
+}
+
+func ldapResult(tag ber.Tag, code uint16) *ber.Packet {
+	res := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "result")
+	res.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, uint64(code), "code"))
+	res.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"))
+	res.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "message"))
+	return res
+}
+
+func TestCreateSessionHandlerLDAP(t *testing.T) {
+	s, err := SetupSuite()
+	if err != nil {
+		t.Fatalf("error setting up test suite: %s", err.Error())
+	}
+
+	srv := newLDAPStandIn(t, []ldapEntry{
+		{
+			dn:       "uid=jdoe,ou=people,dc=example,dc=org",
+			uid:      "jdoe",
+			password: "Directory1*",
+			memberOf: []string{"cn=operators,ou=groups,dc=example,dc=org", "cn=staff,ou=groups,dc=example,dc=org"},
+		},
+		{
+			dn:       "uid=guest,ou=people,dc=example,dc=org",
+			uid:      "guest",
+			password: "Directory1*",
+			memberOf: []string{"cn=staff,ou=groups,dc=example,dc=org"},
+		},
+	})
+	defer srv.Close()
+
+	groupRoles, err := models.ParseLDAPGroupRoles("cn=operators,ou=groups,dc=example,dc=org=HELPDESK;cn=admins,ou=groups,dc=example,dc=org=ADMIN")
+	if err != nil {
+		t.Fatalf("could not parse group roles: %s", err)
+	}
+
+	a := NewApp(s.DB, &Config{})
+	a.config.SignKey, _ = ReadPrivateKey(PKCS1_Private_Key)
+	a.Backends = models.AuthBackendChain{
+		&models.LDAPBackend{
+			URL:          srv.URL(),
+			Timeout:      5 * time.Second,
+			BindDN:       srv.bindDN,
+			BindPassword: srv.bindPassword,
+			BaseDN:       "dc=example,dc=org",
+			UserFilter:   "(uid=%s)",
+			GroupRoles:   groupRoles,
+		},
+	}
+
+	tt := []struct {
+		name     string
+		username string
+		password string
+		status   int
+	}{
+		{
+			name:     "directory user with mapped group",
+			username: "jdoe",
+			password: "Directory1*",
+			status:   http.StatusOK,
+		},
+		{
+			name:     "directory user with wrong password",
+			username: "jdoe",
+			password: "wrong",
+			status:   http.StatusUnauthorized,
+		},
+		{
+			name:     "directory user without mapped group",
+			username: "guest",
+			password: "Directory1*",
+			status:   http.StatusUnauthorized,
+		},
+		{
+			name:     "unknown user",
+			username: "nobody",
+			password: "Directory1*",
+			status:   http.StatusUnauthorized,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			requestBody := bytes.NewBuffer(nil)
+			if err := jsonapi.MarshalPayload(requestBody, &CreateSessionHandlerRequest{
+				Username: tc.username,
+				Password: tc.password,
+			}); err != nil {
+				t.Fatalf("could not marshal request body %v", err)
+			}
+			req, err := http.NewRequest("POST", "/session", requestBody)
+			if err != nil {
+				t.Fatalf("could not create request: %v", err)
+			}
+			rec := httptest.NewRecorder()
+
+			s.mock.ExpectQuery(regexp.QuoteMeta(
+				`SELECT * FROM "users" WHERE username = $1 AND "users"."deleted_at" IS NULL ORDER BY "users"."id" LIMIT 1`)).
+				WithArgs(tc.username).
+				WillReturnRows(sqlmock.NewRows(nil))
+
+			if tc.status == http.StatusOK {
+				// no JIT provisioning, the directory user is recorded as external identity
+				s.mock.ExpectBegin()
+				s.mock.ExpectQuery(regexp.QuoteMeta(
+					`INSERT INTO "external_identities" ("created_at","updated_at","deleted_at","username","issuer","subject","roles","last_seen","version") VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9) ON CONFLICT ("issuer","subject") DO UPDATE SET "updated_at"="excluded"."updated_at","username"="excluded"."username","roles"="excluded"."roles","last_seen"="excluded"."last_seen","version"=CASE WHEN "external_identities"."roles" = "excluded"."roles" AND "external_identities"."username" = "excluded"."username" THEN "external_identities"."version" ELSE "external_identities"."version" + 1 END RETURNING "id","version"`)).
+					WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), nil, tc.username, models.LDAPDomain, tc.username, `["HELPDESK"]`, sqlmock.AnyArg(), 1).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "version"}).AddRow(1, 1))
+				s.mock.ExpectCommit()
+			}
+
+			insertArgs := []driver.Value{sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()}
+			s.mock.ExpectBegin()
+			s.mock.ExpectQuery(regexp.QuoteMeta(
+				`INSERT INTO "events" ("created_at","updated_at","deleted_at","username","activated","description","modified","authn_domain","severity") VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9) RETURNING "id"`)).
+				WithArgs(insertArgs...).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+			s.mock.ExpectCommit()
+			if tc.status == http.StatusOK {
+				s.mock.ExpectBegin()
+				s.mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "sessions"`)).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+				s.mock.ExpectCommit()
+			}
+
+			a.SessionHandler(rec, req)
+
+			if err := s.mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+			res := rec.Result()
+			defer res.Body.Close()
+			if res.StatusCode != tc.status {
+				t.Fatalf("expected status %d; got %d", tc.status, res.StatusCode)
+			}
+			if tc.status != http.StatusOK {
+				return
+			}
+			claims, err := getClaimsFromAccessToken(rec.Header().Get(headerAuthorization)[len("Bearer "):], "", &a.config.SignKey.PublicKey)
+			if err != nil {
+				t.Fatalf("could not decode access token: %s", err)
+			}
+			if claims.Azt != models.LDAPDomain {
+				t.Errorf("expected domain %s; got %s", models.LDAPDomain, claims.Azt)
+			}
+			if len(claims.Roles) != 1 || claims.Roles[0] != models.HelpdeskRole.String() {
+				t.Errorf("expected roles [%s]; got %v", models.HelpdeskRole.String(), claims.Roles)
+			}
+		})
+	}
+}
+
+func TestLDAPShadowUserLinking(t *testing.T) {
+	s, err := SetupSuite()
+	if err != nil {
+		t.Fatalf("error setting up test suite: %s", err.Error())
+	}
+	srv := newLDAPStandIn(t, []ldapEntry{
+		{
+			dn:       "uid=admin,ou=people,dc=example,dc=org",
+			uid:      "admin",
+			password: "Directory1*",
+			memberOf: []string{"cn=admins,ou=groups,dc=example,dc=org"},
+		},
+		{
+			dn:       "uid=1,ou=people,dc=example,dc=org",
+			uid:      "1",
+			password: "Directory1*",
+			memberOf: []string{"cn=admins,ou=groups,dc=example,dc=org"},
+		},
+	})
+	defer srv.Close()
+	groupRoles, _ := models.ParseLDAPGroupRoles("cn=admins,ou=groups,dc=example,dc=org=ADMIN")
+	a := NewApp(s.DB, &Config{})
+	a.Backends = models.AuthBackendChain{
+		&models.LDAPBackend{
+			URL:          srv.URL(),
+			Timeout:      5 * time.Second,
+			BindDN:       srv.bindDN,
+			BindPassword: srv.bindPassword,
+			BaseDN:       "dc=example,dc=org",
+			UserFilter:   "(uid=%s)",
+			GroupRoles:   groupRoles,
+			Users:        &models.UserRepo{DB: s.DB},
+		},
+	}
+
+	tt := []struct {
+		name     string
+		username string
+		query    string
+	}{
+		{
+			name:     "directory user named like a local user",
+			username: "admin",
+			query:    `SELECT * FROM "users" WHERE username = $1 AND "users"."deleted_at" IS NULL ORDER BY "users"."id" LIMIT 1`,
+		},
+		{
+			name:     "directory user named like a user ID",
+			username: "1",
+			query:    `SELECT * FROM "users" WHERE "users"."id" = $1 AND "users"."deleted_at" IS NULL ORDER BY "users"."id" LIMIT 1`,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			// the local user does not accept the directory password
+			s.mock.ExpectQuery(regexp.QuoteMeta(tc.query)).WillReturnRows(sqlmock.NewRows(nil))
+			// the directory user is linked to the shadow user of its own account only
+			s.mock.ExpectQuery(regexp.QuoteMeta(
+				`SELECT * FROM "users" WHERE (backend = $1 AND subject = $2) AND "users"."deleted_at" IS NULL LIMIT 1`)).
+				WithArgs(models.LDAPDomain, tc.username).WillReturnRows(sqlmock.NewRows(nil))
+			s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "users" WHERE username = $1 OR lower(email) = lower($2)`)).
+				WithArgs(tc.username, tc.username).WillReturnRows(sqlmock.NewRows([]string{"id", "username"}).AddRow(1, "admin"))
+			expectEvent(s)
+
+			requestBody := bytes.NewBuffer(nil)
+			_ = jsonapi.MarshalPayload(requestBody, &CreateSessionHandlerRequest{Username: tc.username, Password: "Directory1*"})
+			req, _ := http.NewRequest(http.MethodPost, "/session", requestBody)
+			rec := httptest.NewRecorder()
+			a.SessionHandler(rec, req)
+
+			if err := s.mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+			if rec.Code != http.StatusUnauthorized {
+				t.Errorf("expected status %d; got %d: %s", http.StatusUnauthorized, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestLDAPDisabledShadowUser(t *testing.T) {
+	s, err := SetupSuite()
+	if err != nil {
+		t.Fatalf("error setting up test suite: %s", err.Error())
+	}
+	srv := newLDAPStandIn(t, []ldapEntry{
+		{
+			dn:       "uid=jdoe,ou=people,dc=example,dc=org",
+			uid:      "jdoe",
+			password: "Directory1*",
+			memberOf: []string{"cn=ops,ou=groups,dc=example,dc=org"},
+		},
+	})
+	defer srv.Close()
+	groupRoles, _ := models.ParseLDAPGroupRoles("cn=ops,ou=groups,dc=example,dc=org=MONITOR")
+	a := NewApp(s.DB, &Config{AccessTokenExpireTime: time.Minute})
+	a.Backends = models.AuthBackendChain{
+		&models.LDAPBackend{
+			URL:          srv.URL(),
+			Timeout:      5 * time.Second,
+			BindDN:       srv.bindDN,
+			BindPassword: srv.bindPassword,
+			BaseDN:       "dc=example,dc=org",
+			UserFilter:   "(uid=%s)",
+			GroupRoles:   groupRoles,
+			Users:        &models.UserRepo{DB: s.DB},
+		},
+	}
+
+	s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "users" WHERE username = $1 AND "users"."deleted_at" IS NULL ORDER BY "users"."id" LIMIT 1`)).
+		WithArgs("jdoe").WillReturnRows(sqlmock.NewRows(nil))
+	// the shadow user is refreshed but, disabled by an administrator, it does not get a session
+	s.mock.ExpectQuery(regexp.QuoteMeta(
+		`SELECT * FROM "users" WHERE (backend = $1 AND subject = $2) AND "users"."deleted_at" IS NULL LIMIT 1`)).
+		WithArgs(models.LDAPDomain, "jdoe").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "status", "backend", "subject"}).
+			AddRow(9, "jdoe", string(models.UserDisabled), models.LDAPDomain, "jdoe"))
+	s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "user_roles" WHERE "user_roles"."user_id" = $1`)).
+		WithArgs(9).WillReturnRows(sqlmock.NewRows([]string{"user_id", "role_id"}))
+	s.mock.ExpectBegin()
+	expectRevision(s, 9, 0, 1)
+	s.mock.ExpectExec(regexp.QuoteMeta(`UPDATE "users" SET`)).WillReturnResult(sqlmock.NewResult(0, 1))
+	s.mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "roles"`)).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	s.mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "user_roles"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	s.mock.ExpectExec(regexp.QuoteMeta(`UPDATE "users" SET "updated_at"=$1`)).WillReturnResult(sqlmock.NewResult(0, 1))
+	s.mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "roles"`)).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	s.mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "user_roles"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	s.mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "user_roles" WHERE "user_roles"."user_id" = $1 AND "user_roles"."role_id" <> $2`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	s.mock.ExpectCommit()
+	expectEvent(s)
+
+	requestBody := bytes.NewBuffer(nil)
+	_ = jsonapi.MarshalPayload(requestBody, &CreateSessionHandlerRequest{Username: "jdoe", Password: "Directory1*"})
+	req, _ := http.NewRequest(http.MethodPost, "/session", requestBody)
+	rec := httptest.NewRecorder()
+	a.SessionHandler(rec, req)
+
+	if err := s.mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+	if rec.Code != http.StatusUnauthorized || !strings.Contains(rec.Body.String(), "user disabled") {
+		t.Errorf("expected status %d; got %d: %s", http.StatusUnauthorized, rec.Code, rec.Body.String())
+	}
+}
+
+func TestLDAPShadowUserRoles(t *testing.T) {
+	s, err := SetupSuite()
+	if err != nil {
+		t.Fatalf("error setting up test suite: %s", err.Error())
+	}
+	users := &models.UserRepo{DB: s.DB}
+	monitor, _ := models.NewRoleList([]string{models.MonitorRole.String()})
+
+	tt := []struct {
+		name string
+		// stored is the role of the shadow user before the login
+		stored models.UserRole
+		// version is the version of the shadow user once refreshed
+		version int
+	}{
+		{
+			name:    "groups unchanged",
+			stored:  models.MonitorRole,
+			version: 3,
+		},
+		{
+			// the tokens issued with the administrator role are revoked
+			name:    "groups changed",
+			stored:  models.AdminRole,
+			version: 4,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			s.mock.ExpectQuery(regexp.QuoteMeta(
+				`SELECT * FROM "users" WHERE (backend = $1 AND subject = $2) AND "users"."deleted_at" IS NULL LIMIT 1`)).
+				WithArgs(models.LDAPDomain, "jdoe").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "username", "version", "backend", "subject"}).
+					AddRow(9, "jdoe", 3, models.LDAPDomain, "jdoe"))
+			s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "user_roles" WHERE "user_roles"."user_id" = $1`)).
+				WithArgs(9).WillReturnRows(sqlmock.NewRows([]string{"user_id", "role_id"}).AddRow(9, int(tc.stored)))
+			s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "roles" WHERE "roles"."id" = $1 AND "roles"."deleted_at" IS NULL`)).
+				WithArgs(int(tc.stored)).WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow(int(tc.stored), tc.stored.String()))
+			s.mock.ExpectBegin()
+			expectRevision(s, 9, 0, 1)
+			s.mock.ExpectExec(regexp.QuoteMeta(
+				`UPDATE "users" SET "updated_at"=$1,"username"=$2,"version"=$3,"revision"=$4,"backend"=$5,"subject"=$6 WHERE "users"."deleted_at" IS NULL AND "id" = $7`)).
+				WithArgs(sqlmock.AnyArg(), "jdoe", tc.version, 1, models.LDAPDomain, "jdoe", 9).WillReturnResult(sqlmock.NewResult(0, 1))
+			s.mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "roles"`)).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+			s.mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "user_roles"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+			s.mock.ExpectExec(regexp.QuoteMeta(`UPDATE "users" SET "updated_at"=$1`)).WillReturnResult(sqlmock.NewResult(0, 1))
+			s.mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "roles"`)).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+			s.mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "user_roles"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+			s.mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "user_roles" WHERE "user_roles"."user_id" = $1 AND "user_roles"."role_id" <> $2`)).
+				WillReturnResult(sqlmock.NewResult(0, 0))
+			s.mock.ExpectCommit()
+
+			u, err := users.ProvisionShadowUser(models.LDAPDomain, "jdoe", "jdoe", monitor)
+
+			if err := s.mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+			if err != nil {
+				t.Fatalf("could not refresh the shadow user: %s", err)
+			}
+			if u.Version != tc.version {
+				t.Errorf("expected version %d; got %d", tc.version, u.Version)
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Mailer delivers the emails sent to the users, e.g. the email verification links
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// SMTPMailer delivers the emails through an SMTP relay, the relay is authenticated with PLAIN if
+// Username is set, which requires TLS unless the relay is on localhost
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	// From is the sender address of the emails
+	From string
+}
+
+// Send delivers a plain text email to the given address
+func (m *SMTPMailer) Send(to, subject, body string) error {
+	// the headers are built from the addresses, which must not inject other headers
+	if strings.ContainsAny(to, "\r\n") || strings.ContainsAny(subject, "\r\n") {
+		return errors.New("invalid email header")
+	}
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n",
+		m.From, to, subject, time.Now().Format(time.RFC1123Z), strings.ReplaceAll(body, "\n", "\r\n"))
+	return smtp.SendMail(net.JoinHostPort(m.Host, m.Port), auth, m.From, []string{to}, []byte(msg))
+}
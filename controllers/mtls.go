@@ -0,0 +1,86 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const grantTypeClientCredentials = "client_credentials"
+
+// clientCertificate returns the client certificate of the request verified against the client CAs, if any
+func clientCertificate(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// certificateThumbprint returns the RFC 8705 x5t#S256 thumbprint of the certificate
+func certificateThumbprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// verifyCertificateBinding checks that a certificate bound token is presented over a connection
+// authenticated with the same client certificate
+func verifyCertificateBinding(r *http.Request, cnf *confirmationClaim) error {
+	if cnf == nil || cnf.X5T == "" {
+		return nil
+	}
+	cert := clientCertificate(r)
+	if cert == nil {
+		return errors.New("certificate bound token presented without client certificate")
+	}
+	if certificateThumbprint(cert) != cnf.X5T {
+		return errors.New("client certificate does not match the token binding")
+	}
+	return nil
+}
+
+// ClientCredentialsHandler issues access tokens to the service accounts. The accounts authenticated with
+// one of their registered client certificates (RFC 8705 tls_client_auth) are identified by the certificate
+// common name and get tokens bound to the certificate, the accounts can also authenticate with their secret
+// or with a client assertion signed with one of their keys.
+func (a *App) ClientCredentialsHandler(w http.ResponseWriter, r *http.Request) {
+	ip, _ := getIP(r)
+	user, domain, oErr := a.authenticateClient(r, ip)
+	if oErr != nil {
+		writeOAuthError(w, oErr)
+		return
+	}
+	username := user.Username
+	jkt, err := a.dpopBinding(r)
+	if err != nil {
+		writeOAuthError(w, dpopOAuthError(err))
+		return
+	}
+
+	claims := newCustomClaims(user, domain, a.config.AccessTokenExpireTime, r.PostForm["audience"], r.PostForm.Get("scope"))
+	claims.Cnf = newConfirmationClaim(jkt)
+	if cert := clientCertificate(r); cert != nil {
+		claims.Cnf = &confirmationClaim{JKT: jkt, X5T: certificateThumbprint(cert)}
+	}
+	signedToken, err := generateToken(claims, a.config.Secret, a.config.SignKey)
+	if err != nil {
+		if err := a.Events.CreateJWTEvent(username, domain); err != nil {
+			log.WithError(err).Warnf("failed to store JWT event")
+		}
+		writeOAuthError(w, newOAuthError(http.StatusInternalServerError, "server_error", "%s", err.Error()))
+		return
+	}
+	if err = a.Events.CreateSuccessfulLoginEvent(username, domain, ip); err != nil {
+		log.WithError(err).Warnf("failed to store login attempt")
+	}
+	// no renew token is issued, the client authenticates again when the access token expires
+	writeOAuthResponse(w, &tokenResponse{
+		AccessToken: signedToken,
+		TokenType:   tokenType(jkt),
+		ExpiresIn:   int64(a.config.AccessTokenExpireTime.Seconds()),
+		Scope:       claims.Scope,
+	}, http.StatusOK)
+}
@@ -0,0 +1,291 @@
+package controllers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/goidp/models"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestCertificate returns a self-signed certificate for the given common name with its PEM encoding
+func newTestCertificate(t *testing.T, cn string) (*x509.Certificate, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("could not generate key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		DNSNames:              []string{cn},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("could not create certificate: %s", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	return cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func withClientCertificate(r *http.Request, cert *x509.Certificate) *http.Request {
+	r.TLS = &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{cert},
+		VerifiedChains:   [][]*x509.Certificate{{cert}},
+	}
+	return r
+}
+
+func TestClientCredentialsHandler(t *testing.T) {
+	s, err := SetupSuite()
+	if err != nil {
+		t.Fatalf("error setting up test suite: %s", err.Error())
+	}
+	a := NewApp(s.DB, &Config{AccessTokenExpireTime: 5 * time.Minute})
+	a.config.SignKey, _ = ReadPrivateKey(PKCS1_Private_Key)
+	a.config.VerifyKey = &a.config.SignKey.PublicKey
+	clientCert, _, _ := newTestCertificate(t, "svc-a")
+	otherCert, _, _ := newTestCertificate(t, "svc-a")
+	adminCert, _, _ := newTestCertificate(t, "admin")
+	idCert, _, _ := newTestCertificate(t, "1")
+	account := &models.ServiceAccount{Name: "svc-a", Roles: []string{models.MonitorRole.String()}, CertificateThumbprints: []string{certificateThumbprint(clientCert)}}
+
+	tt := []struct {
+		name     string
+		cert     *x509.Certificate
+		clientID string
+		account  *models.ServiceAccount
+		status   int
+		err      string
+	}{
+		{
+			name:    "registered client certificate",
+			cert:    clientCert,
+			account: account,
+			status:  http.StatusOK,
+		},
+		{
+			name:   "missing client certificate",
+			status: http.StatusUnauthorized,
+			err:    "invalid_client",
+		},
+		{
+			name:     "certificate of another client",
+			cert:     clientCert,
+			clientID: "svc-b",
+			status:   http.StatusUnauthorized,
+			err:      "invalid_client",
+		},
+		{
+			name:    "unregistered certificate with the client name",
+			cert:    otherCert,
+			account: account,
+			status:  http.StatusUnauthorized,
+			err:     "invalid_client",
+		},
+		{
+			name:   "unknown client",
+			cert:   clientCert,
+			status: http.StatusUnauthorized,
+			err:    "invalid_client",
+		},
+		{
+			name:   "certificate named after a local user",
+			cert:   adminCert,
+			status: http.StatusUnauthorized,
+			err:    "invalid_client",
+		},
+		{
+			name:   "certificate named after an id",
+			cert:   idCert,
+			status: http.StatusUnauthorized,
+			err:    "invalid_client",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			form := url.Values{"grant_type": {grantTypeClientCredentials}, "scope": {"user:read"}}
+			if tc.clientID != "" {
+				form.Set("client_id", tc.clientID)
+			}
+			req, _ := http.NewRequest(http.MethodPost, "/v1.0/token", strings.NewReader(form.Encode()))
+			req.Header.Set(headerContentType, "application/x-www-form-urlencoded")
+			if tc.cert != nil {
+				req = withClientCertificate(req, tc.cert)
+			}
+			rec := httptest.NewRecorder()
+
+			if tc.cert != nil && tc.clientID == "" {
+				// only the service accounts are looked up, by name, the local users never
+				expectServiceAccount(s, tc.cert.Subject.CommonName, tc.account)
+				expectEvent(s)
+			}
+
+			a.TokenHandler(rec, req)
+
+			if err := s.mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+			if rec.Code != tc.status {
+				t.Fatalf("expected status %d; got %d: %s", tc.status, rec.Code, rec.Body.String())
+			}
+			if tc.err != "" {
+				var oErr oauthError
+				if err := json.NewDecoder(rec.Body).Decode(&oErr); err != nil {
+					t.Fatalf("could not decode error: %s", err)
+				}
+				if oErr.Code != tc.err {
+					t.Errorf("expected error %s; got %s", tc.err, oErr.Code)
+				}
+				return
+			}
+
+			var tR tokenResponse
+			if err := json.NewDecoder(rec.Body).Decode(&tR); err != nil {
+				t.Fatalf("could not decode response: %s", err)
+			}
+			if tR.RefreshToken != "" || tR.Scope != "user:read" {
+				t.Errorf("unexpected refresh token or scope %s", tR.Scope)
+			}
+			claims, err := getClaimsFromAccessToken(tR.AccessToken, "", a.config.VerifyKey)
+			if err != nil {
+				t.Fatalf("could not decode access token: %s", err)
+			}
+			if claims.Subject != "svc-a" || claims.Cnf == nil || claims.Cnf.X5T != certificateThumbprint(clientCert) {
+				t.Errorf("unexpected subject %s or binding %+v", claims.Subject, claims.Cnf)
+			}
+		})
+	}
+}
+
+func TestJWTMiddlewareCertificateBinding(t *testing.T) {
+	s, err := SetupSuite()
+	if err != nil {
+		t.Fatalf("error setting up test suite: %s", err.Error())
+	}
+	a := NewApp(s.DB, &Config{})
+	a.config.SignKey, _ = ReadPrivateKey(PKCS1_Private_Key)
+	a.config.VerifyKey = &a.config.SignKey.PublicKey
+	rL, _ := models.NewRoleList([]string{models.MonitorRole.String()})
+	clientCert, _, _ := newTestCertificate(t, "svc-a")
+	otherCert, _, _ := newTestCertificate(t, "svc-a")
+
+	claims := newCustomClaims(&models.User{Username: "svc-a", Roles: rL}, models.InternalDomain, time.Minute, nil, "")
+	claims.Cnf = &confirmationClaim{X5T: certificateThumbprint(clientCert)}
+	token, _ := generateToken(claims, "", a.config.SignKey)
+
+	tt := []struct {
+		name   string
+		cert   *x509.Certificate
+		status int
+	}{
+		{
+			name:   "bound client certificate",
+			cert:   clientCert,
+			status: http.StatusOK,
+		},
+		{
+			name:   "another client certificate",
+			cert:   otherCert,
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:   "no client certificate",
+			status: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, "/v1.0/user", nil)
+			req.Header.Set(headerAuthorization, "Bearer "+token)
+			if tc.cert != nil {
+				req = withClientCertificate(req, tc.cert)
+			}
+			rec := httptest.NewRecorder()
+
+			a.jwtMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}), "user").ServeHTTP(rec, req)
+
+			if rec.Code != tc.status {
+				t.Errorf("expected status %d; got %d", tc.status, rec.Code)
+			}
+		})
+	}
+}
+
+func TestTLSReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile, caFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), filepath.Join(dir, "ca.crt")
+	writeFiles := func(cn string) *x509.Certificate {
+		cert, certPEM, keyPEM := newTestCertificate(t, cn)
+		_ = ioutil.WriteFile(certFile, certPEM, 0600)
+		_ = ioutil.WriteFile(keyFile, keyPEM, 0600)
+		_ = ioutil.WriteFile(caFile, certPEM, 0600)
+		return cert
+	}
+
+	first := writeFiles("idp-1")
+	tR, err := newTLSReloader(&TLSConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile, RequireClientCert: true})
+	if err != nil {
+		t.Fatalf("could not load certificates: %s", err)
+	}
+	c, _ := tR.tlsConfig().GetConfigForClient(nil)
+	if string(c.Certificates[0].Certificate[0]) != string(first.Raw) {
+		t.Errorf("expected the initial certificate")
+	}
+	if c.ClientAuth != tls.RequireAndVerifyClientCert || c.ClientCAs == nil {
+		t.Errorf("expected client certificates to be required")
+	}
+	if !reflect.DeepEqual(c.NextProtos, []string{"h2", "http/1.1"}) || c.MinVersion != tls.VersionTLS12 {
+		t.Errorf("expected the base configuration to be kept; got protocols %v", c.NextProtos)
+	}
+
+	// the renewed certificate is picked up by the next handshakes
+	second := writeFiles("idp-2")
+	if err := tR.reload(); err != nil {
+		t.Fatalf("could not reload certificates: %s", err)
+	}
+	c, _ = tR.tlsConfig().GetConfigForClient(nil)
+	if string(c.Certificates[0].Certificate[0]) != string(second.Raw) {
+		t.Errorf("expected the renewed certificate")
+	}
+
+	// a broken file does not replace the certificate in force
+	_ = ioutil.WriteFile(keyFile, []byte("broken"), 0600)
+	if err := tR.reload(); err == nil {
+		t.Errorf("expected reload failure")
+	}
+	c, _ = tR.tlsConfig().GetConfigForClient(nil)
+	if string(c.Certificates[0].Certificate[0]) != string(second.Raw) {
+		t.Errorf("expected the renewed certificate to be kept")
+	}
+}
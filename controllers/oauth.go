@@ -0,0 +1,69 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	grantTypeTokenExchange = "urn:ietf:params:oauth:grant-type:token-exchange"
+	grantTypeDeviceCode    = "urn:ietf:params:oauth:grant-type:device_code"
+)
+
+// oauthError is the RFC 6749 error response, used by the token endpoint instead of the jsonapi errors
+type oauthError struct {
+	status      int
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+// tokenResponse is the RFC 6749 successful response of the token endpoint
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+}
+
+func newOAuthError(status int, code, format string, args ...interface{}) *oauthError {
+	return &oauthError{status: status, Code: code, Description: fmt.Sprintf(format, args...)}
+}
+
+func (e *oauthError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Description)
+}
+
+func writeOAuthResponse(w http.ResponseWriter, body interface{}, status int) {
+	w.Header().Set(headerContentType, "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.WithError(err).Warnf("failed to write token endpoint response")
+	}
+}
+
+func writeOAuthError(w http.ResponseWriter, err *oauthError) {
+	writeOAuthResponse(w, err, err.status)
+}
+
+// TokenHandler is the OAuth 2.0 token endpoint, the request is handled according to its grant type
+func (a *App) TokenHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, newOAuthError(http.StatusBadRequest, "invalid_request", "invalid request body: %s", err.Error()))
+		return
+	}
+	switch grantType := r.PostForm.Get("grant_type"); grantType {
+	case grantTypeTokenExchange:
+		a.TokenExchangeHandler(w, r)
+	case grantTypeDeviceCode:
+		a.DeviceTokenHandler(w, r)
+	case grantTypeClientCredentials:
+		a.ClientCredentialsHandler(w, r)
+	default:
+		writeOAuthError(w, newOAuthError(http.StatusBadRequest, "unsupported_grant_type", "unsupported grant type %s", grantType))
+	}
+}
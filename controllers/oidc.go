@@ -0,0 +1,336 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/goidp/models"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	oidcStateCookie    = "idp_oidc_state"
+	oidcStateExpire    = 10 * time.Minute
+	oidcStateIssuer    = "idp-oidc-state"
+	oidcStateTokenType = "oidc-state"
+	oidcDiscoveryPath  = "/.well-known/openid-configuration"
+	defaultOIDCScopes  = "openid profile email"
+	defaultOIDCSubject = "preferred_username"
+)
+
+// OIDCBroker delegates the login to an upstream OpenID Connect provider using the
+// authorization code flow, the users authenticated upstream get goidp tokens in the EXTERNAL domain
+type OIDCBroker struct {
+	Issuer        string
+	ClientID      string
+	ClientSecret  string
+	RedirectURL   string
+	Scopes        string
+	UsernameClaim string
+	RoleRules     []RoleRule
+	// Provision links the upstream identity to the local user with the same username,
+	// creating it if missing
+	Provision  bool
+	HTTPClient *http.Client
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	jwks      *jwksCache
+}
+
+// oidcDiscovery holds the subset of the provider metadata used by the broker
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	IDToken     string `json:"id_token"`
+	TokenType   string `json:"token_type"`
+}
+
+// oidcStateClaims is the content of the signed state parameter, which binds the
+// callback to the login request without storing anything server side
+type oidcStateClaims struct {
+	// Typ is oidcStateTokenType, so that the state is not accepted as any other token
+	Typ   string `json:"typ"`
+	Nonce string `json:"nonce"`
+	jwt.StandardClaims
+}
+
+func (b *OIDCBroker) client() *http.Client {
+	if b.HTTPClient == nil {
+		return &http.Client{Timeout: 10 * time.Second}
+	}
+	return b.HTTPClient
+}
+
+// provider returns the provider metadata, fetched once from the discovery endpoint
+func (b *OIDCBroker) provider() (*oidcDiscovery, *jwksCache, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.discovery != nil {
+		return b.discovery, b.jwks, nil
+	}
+	res, err := b.client().Get(strings.TrimSuffix(b.Issuer, "/") + oidcDiscoveryPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("unexpected status %d from discovery endpoint", res.StatusCode)
+	}
+	var d oidcDiscovery
+	if err = json.NewDecoder(res.Body).Decode(&d); err != nil {
+		return nil, nil, err
+	}
+	if d.Issuer != b.Issuer {
+		return nil, nil, fmt.Errorf("issuer mismatch: expected %s, got %s", b.Issuer, d.Issuer)
+	}
+	b.discovery = &d
+	b.jwks = newJWKSCache(d.JWKSURI, b.client())
+	return b.discovery, b.jwks, nil
+}
+
+// exchangeCode redeems the authorization code at the provider token endpoint
+func (b *OIDCBroker) exchangeCode(tokenEndpoint, code string) (*oidcTokenResponse, error) {
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {b.RedirectURL},
+	}
+	req, err := http.NewRequest(http.MethodPost, tokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(headerContentType, "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(b.ClientID), url.QueryEscape(b.ClientSecret))
+	res, err := b.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d from token endpoint", res.StatusCode)
+	}
+	var tR oidcTokenResponse
+	if err = json.NewDecoder(res.Body).Decode(&tR); err != nil {
+		return nil, err
+	}
+	if tR.IDToken == "" {
+		return nil, errors.New("no id_token in token response")
+	}
+	return &tR, nil
+}
+
+// verifyIDToken validates the ID token signature through the provider JWKS, together with
+// its issuer, audience, expiration and nonce
+func (b *OIDCBroker) verifyIDToken(t string, d *oidcDiscovery, keys *jwksCache, nonce string) (jwt.MapClaims, error) {
+	token, err := jwt.ParseWithClaims(t, jwt.MapClaims{}, keys.keyFunc())
+	if err != nil {
+		return nil, err
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, errors.New("invalid id token")
+	}
+	if !claims.VerifyIssuer(d.Issuer, true) {
+		return nil, errors.New("invalid id token issuer")
+	}
+	if !claims.VerifyAudience(b.ClientID, true) {
+		return nil, errors.New("invalid id token audience")
+	}
+	if _, ok := claims["exp"]; !ok {
+		return nil, errors.New("id token without expiration")
+	}
+	if n, _ := claims["nonce"].(string); n != nonce {
+		return nil, errors.New("invalid id token nonce")
+	}
+	return claims, nil
+}
+
+// mapUser builds the goidp user out of the ID token claims
+func (b *OIDCBroker) mapUser(claims jwt.MapClaims) (*models.User, error) {
+	usernameClaim := b.UsernameClaim
+	if usernameClaim == "" {
+		usernameClaim = defaultOIDCSubject
+	}
+	username, _ := claims[usernameClaim].(string)
+	if username == "" {
+		username, _ = claims["sub"].(string)
+	}
+	if username == "" {
+		return nil, errors.New("no username in id token")
+	}
+	var roleNames []string
+	for _, r := range b.RoleRules {
+		if r.matches(claims) && !stringInSliceCaseInsensitive(roleNames, r.Role) {
+			roleNames = append(roleNames, r.Role)
+		}
+	}
+	if len(roleNames) == 0 {
+		return nil, fmt.Errorf("user %s is not granted any role", username)
+	}
+	roles, err := models.NewRoleList(roleNames)
+	if err != nil {
+		return nil, err
+	}
+	return &models.User{Username: username, Roles: roles}, nil
+}
+
+// OIDCLoginHandler redirects the user agent to the upstream provider authorization endpoint
+func (a *App) OIDCLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if a.OIDC == nil {
+		jsonapiError(w, http.StatusNotFound, "oidc login not configured")
+		return
+	}
+	d, _, err := a.OIDC.provider()
+	if err != nil {
+		log.WithError(err).Warnf("failed to discover oidc provider")
+		jsonapiError(w, http.StatusBadGateway, "identity provider not reachable")
+		return
+	}
+
+	nonceBytes := make([]byte, 16)
+	if _, err = rand.Read(nonceBytes); err != nil {
+		jsonapiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	nonce := base64.RawURLEncoding.EncodeToString(nonceBytes)
+	state, err := generateToken(oidcStateClaims{
+		Typ:   oidcStateTokenType,
+		Nonce: nonce,
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: time.Now().Add(oidcStateExpire).Unix(),
+			IssuedAt:  time.Now().Unix(),
+			Issuer:    oidcStateIssuer,
+		},
+	}, a.config.Secret, a.config.SignKey)
+	if err != nil {
+		jsonapiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	scopes := a.OIDC.Scopes
+	if scopes == "" {
+		scopes = defaultOIDCScopes
+	}
+	q := url.Values{
+		"response_type": {"code"},
+		"client_id":     {a.OIDC.ClientID},
+		"redirect_uri":  {a.OIDC.RedirectURL},
+		"scope":         {scopes},
+		"state":         {state},
+		"nonce":         {nonce},
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/",
+		MaxAge:   int(oidcStateExpire.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, d.AuthorizationEndpoint+sep+q.Encode(), http.StatusFound)
+}
+
+// OIDCCallbackHandler completes the upstream login: it redeems the authorization code,
+// validates the ID token and issues the goidp tokens
+func (a *App) OIDCCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if a.OIDC == nil {
+		jsonapiError(w, http.StatusNotFound, "oidc login not configured")
+		return
+	}
+	ip, _ := getIP(r)
+	queryValues := r.URL.Query()
+
+	unauthorized := func(err error, username string) {
+		log.WithError(err).Warnf("oidc login failure")
+		if err := a.Events.CreateUnsuccessfulLoginEvent(username, models.ExternalDomain, ip); err != nil {
+			log.WithError(err).Warnf("failed to store login attempt")
+		}
+		jsonapiError(w, http.StatusUnauthorized, "user not allowed")
+	}
+
+	if e := queryValues.Get("error"); e != "" {
+		unauthorized(fmt.Errorf("provider error %s: %s", e, queryValues.Get("error_description")), "unknown")
+		return
+	}
+	state := queryValues.Get("state")
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || state == "" || cookie.Value != state {
+		jsonapiError(w, http.StatusBadRequest, "invalid state")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Value: "", Path: "/", MaxAge: -1})
+
+	var sC oidcStateClaims
+	token, err := jwt.ParseWithClaims(state, &sC, getKeyFunc(a.config.Secret, a.config.VerifyKey))
+	if err != nil || !token.Valid || sC.Typ != oidcStateTokenType || sC.Issuer != oidcStateIssuer {
+		jsonapiError(w, http.StatusBadRequest, "invalid state")
+		return
+	}
+
+	d, keys, err := a.OIDC.provider()
+	if err != nil {
+		log.WithError(err).Warnf("failed to discover oidc provider")
+		jsonapiError(w, http.StatusBadGateway, "identity provider not reachable")
+		return
+	}
+	tR, err := a.OIDC.exchangeCode(d.TokenEndpoint, queryValues.Get("code"))
+	if err != nil {
+		unauthorized(err, "unknown")
+		return
+	}
+	claims, err := a.OIDC.verifyIDToken(tR.IDToken, d, keys, sC.Nonce)
+	if err != nil {
+		unauthorized(err, "unknown")
+		return
+	}
+	user, err := a.OIDC.mapUser(claims)
+	if err != nil {
+		username, _ := claims["sub"].(string)
+		unauthorized(err, username)
+		return
+	}
+
+	// the user is identified by the issuer and the subject, the usernames are picked by the users at some providers
+	subject, _ := claims["sub"].(string)
+	if a.OIDC.Provision {
+		username := user.Username
+		user, err = a.Users.ProvisionShadowUser(a.OIDC.Issuer, subject, username, user.Roles)
+		switch err.(type) {
+		case nil:
+		case *models.UserError:
+			// the username is taken by a local user or by the shadow user of another account
+			unauthorized(err, username)
+			return
+		default:
+			log.WithError(err).Warnf("failed to link upstream user")
+			jsonapiError(w, http.StatusInternalServerError, "internal error, retry later")
+			return
+		}
+	} else if err = a.recordExternalIdentity(user, a.OIDC.Issuer, subject); err != nil {
+		jsonapiError(w, http.StatusInternalServerError, "internal error, retry later")
+		return
+	}
+
+	a.createSession(w, r, user, models.ExternalDomain, false, nil, "", "")
+}
@@ -0,0 +1,251 @@
+package controllers
+
+import (
+	"crypto/rsa"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/goidp/models"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/golang-jwt/jwt"
+	"github.com/google/jsonapi"
+)
+
+// mockOIDCProvider is a local OpenID Connect provider serving the discovery document,
+// the JWKS and a token endpoint which returns the configured ID token claims
+type mockOIDCProvider struct {
+	server   *httptest.Server
+	key      *rsa.PrivateKey
+	clientID string
+	secret   string
+	claims   jwt.MapClaims
+}
+
+func newMockOIDCProvider(t *testing.T) *mockOIDCProvider {
+	key, err := ReadPrivateKey(PKCS1_Private_Key)
+	if err != nil {
+		t.Fatalf("could not read provider key: %s", err)
+	}
+	p := &mockOIDCProvider{key: key, clientID: "goidp", secret: "s3cret"}
+	mux := http.NewServeMux()
+	mux.HandleFunc(oidcDiscoveryPath, func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                p.server.URL,
+			AuthorizationEndpoint: p.server.URL + "/authorize",
+			TokenEndpoint:         p.server.URL + "/token",
+			JWKSURI:               p.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(jsonWebKeySet{Keys: []jsonWebKey{{
+			Kty: "RSA",
+			Kid: "test",
+			Use: "sig",
+			N:   base64.RawURLEncoding.EncodeToString(p.key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(p.key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, ok := r.BasicAuth()
+		if !ok || id != p.clientID || secret != p.secret || r.FormValue("code") != "valid-code" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, p.claims)
+		token.Header["kid"] = "test"
+		idToken, _ := token.SignedString(p.key)
+		_ = json.NewEncoder(w).Encode(oidcTokenResponse{IDToken: idToken, TokenType: "Bearer"})
+	})
+	p.server = httptest.NewServer(mux)
+	return p
+}
+
+func TestOIDCLogin(t *testing.T) {
+	s, err := SetupSuite()
+	if err != nil {
+		t.Fatalf("error setting up test suite: %s", err.Error())
+	}
+	provider := newMockOIDCProvider(t)
+	defer provider.server.Close()
+
+	roleRules, err := ParseRoleRules("groups:idp-admins=ADMIN;groups:idp-ops=MONITOR")
+	if err != nil {
+		t.Fatalf("could not parse role rules: %s", err)
+	}
+
+	a := NewApp(s.DB, &Config{})
+	a.config.SignKey, _ = ReadPrivateKey(PKCS1_Private_Key)
+	a.config.VerifyKey = &a.config.SignKey.PublicKey
+	a.OIDC = &OIDCBroker{
+		Issuer:       provider.server.URL,
+		ClientID:     provider.clientID,
+		ClientSecret: provider.secret,
+		RedirectURL:  "https://idp.example.org/v1.0/oidc/callback",
+		RoleRules:    roleRules,
+	}
+
+	tt := []struct {
+		name      string
+		code      string
+		audience  string
+		groups    []interface{}
+		provision bool
+		status    int
+		roles     []string
+	}{
+		{
+			name:     "valid id token",
+			code:     "valid-code",
+			audience: provider.clientID,
+			groups:   []interface{}{"idp-ops", "staff"},
+			status:   http.StatusOK,
+			roles:    []string{models.MonitorRole.String()},
+		},
+		{
+			name:     "id token for another client",
+			code:     "valid-code",
+			audience: "another-client",
+			groups:   []interface{}{"idp-admins"},
+			status:   http.StatusUnauthorized,
+		},
+		{
+			name:     "no mapped role",
+			code:     "valid-code",
+			audience: provider.clientID,
+			groups:   []interface{}{"staff"},
+			status:   http.StatusUnauthorized,
+		},
+		{
+			name:      "provisioned user named like a local user",
+			code:      "valid-code",
+			audience:  provider.clientID,
+			groups:    []interface{}{"idp-admins"},
+			provision: true,
+			status:    http.StatusUnauthorized,
+		},
+		{
+			name:     "invalid code",
+			code:     "invalid-code",
+			audience: provider.clientID,
+			status:   http.StatusUnauthorized,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			a.OIDC.Provision = tc.provision
+			// start the login, the user agent is redirected to the provider
+			req, _ := http.NewRequest(http.MethodGet, "/v1.0/oidc/login", nil)
+			rec := httptest.NewRecorder()
+			a.OIDCLoginHandler(rec, req)
+			if rec.Code != http.StatusFound {
+				t.Fatalf("expected status %d; got %d", http.StatusFound, rec.Code)
+			}
+			location, err := url.Parse(rec.Header().Get("Location"))
+			if err != nil {
+				t.Fatalf("invalid redirect location: %s", err)
+			}
+			cookies := rec.Result().Cookies()
+			if len(cookies) != 1 || cookies[0].Value != location.Query().Get("state") {
+				t.Fatalf("expected state cookie matching the state parameter")
+			}
+
+			provider.claims = jwt.MapClaims{
+				"iss":                provider.server.URL,
+				"sub":                "3f1e2c",
+				"aud":                tc.audience,
+				"exp":                time.Now().Add(time.Minute).Unix(),
+				"iat":                time.Now().Unix(),
+				"nonce":              location.Query().Get("nonce"),
+				"preferred_username": "jdoe",
+				"groups":             tc.groups,
+			}
+
+			// come back from the provider with the authorization code
+			q := url.Values{"code": {tc.code}, "state": {location.Query().Get("state")}}
+			req, _ = http.NewRequest(http.MethodGet, "/v1.0/oidc/callback?"+q.Encode(), nil)
+			req.AddCookie(cookies[0])
+			rec = httptest.NewRecorder()
+
+			if tc.status == http.StatusOK {
+				s.mock.ExpectBegin()
+				s.mock.ExpectQuery(regexp.QuoteMeta(
+					`INSERT INTO "external_identities" ("created_at","updated_at","deleted_at","username","issuer","subject","roles","last_seen","version") VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9) ON CONFLICT ("issuer","subject") DO UPDATE SET "updated_at"="excluded"."updated_at","username"="excluded"."username","roles"="excluded"."roles","last_seen"="excluded"."last_seen","version"=CASE WHEN "external_identities"."roles" = "excluded"."roles" AND "external_identities"."username" = "excluded"."username" THEN "external_identities"."version" ELSE "external_identities"."version" + 1 END RETURNING "id","version"`)).
+					WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), nil, "jdoe", provider.server.URL, "3f1e2c", `["MONITOR"]`, sqlmock.AnyArg(), 1).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "version"}).AddRow(1, 1))
+				s.mock.ExpectCommit()
+			}
+			if tc.provision {
+				// the upstream subject is not linked yet and its username is taken
+				s.mock.ExpectQuery(regexp.QuoteMeta(
+					`SELECT * FROM "users" WHERE (backend = $1 AND subject = $2) AND "users"."deleted_at" IS NULL LIMIT 1`)).
+					WithArgs(provider.server.URL, "3f1e2c").WillReturnRows(sqlmock.NewRows(nil))
+				s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "users" WHERE username = $1 OR lower(email) = lower($2)`)).
+					WithArgs("jdoe", "jdoe").WillReturnRows(sqlmock.NewRows([]string{"id", "username"}).AddRow(2, "jdoe"))
+			}
+			insertArgs := []driver.Value{sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()}
+			s.mock.ExpectBegin()
+			s.mock.ExpectQuery(regexp.QuoteMeta(
+				`INSERT INTO "events" ("created_at","updated_at","deleted_at","username","activated","description","modified","authn_domain","severity") VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9) RETURNING "id"`)).
+				WithArgs(insertArgs...).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+			s.mock.ExpectCommit()
+			if tc.status == http.StatusOK {
+				s.mock.ExpectBegin()
+				s.mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "sessions"`)).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+				s.mock.ExpectCommit()
+			}
+
+			a.OIDCCallbackHandler(rec, req)
+
+			if err := s.mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+			if rec.Code != tc.status {
+				t.Fatalf("expected status %d; got %d", tc.status, rec.Code)
+			}
+			if tc.status != http.StatusOK {
+				return
+			}
+			var sR CreateSessionHandlerResponse
+			if err = jsonapi.UnmarshalPayload(rec.Body, &sR); err != nil {
+				t.Fatalf("could not unmarshal response: %s", err)
+			}
+			claims, err := getClaimsFromAccessToken(rec.Header().Get(headerAuthorization)[len("Bearer "):], "", a.config.VerifyKey)
+			if err != nil {
+				t.Fatalf("could not decode access token: %s", err)
+			}
+			if claims.Subject != "jdoe" || claims.Azt != models.ExternalDomain {
+				t.Errorf("unexpected subject %s or domain %s", claims.Subject, claims.Azt)
+			}
+			if len(claims.Roles) != len(tc.roles) || claims.Roles[0] != tc.roles[0] {
+				t.Errorf("expected roles %v; got %v", tc.roles, claims.Roles)
+			}
+		})
+	}
+}
+
+func TestOIDCCallbackInvalidState(t *testing.T) {
+	s, err := SetupSuite()
+	if err != nil {
+		t.Fatalf("error setting up test suite: %s", err.Error())
+	}
+	a := NewApp(s.DB, &Config{})
+	a.OIDC = &OIDCBroker{}
+
+	req, _ := http.NewRequest(http.MethodGet, "/v1.0/oidc/callback?code=valid-code&state=forged", nil)
+	req.AddCookie(&http.Cookie{Name: oidcStateCookie, Value: "another"})
+	rec := httptest.NewRecorder()
+	a.OIDCCallbackHandler(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected status %d; got %d", http.StatusBadRequest, rec.Code)
+	}
+}
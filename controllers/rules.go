@@ -0,0 +1,67 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/goidp/models"
+	"strings"
+)
+
+// RoleRule grants Role to the users whose Claim (or attribute) contains Value
+// the "*" value matches any non-empty claim
+type RoleRule struct {
+	Claim string
+	Value string
+	Role  string
+}
+
+// ParseRoleRules parses claim to role rules in the form
+// "groups:idp-admins=ADMIN;groups:idp-operators=MONITOR;email_verified:true=MONITOR"
+func ParseRoleRules(rules string) ([]RoleRule, error) {
+	var rL []RoleRule
+	for _, rule := range strings.Split(rules, ";") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		i := strings.LastIndex(rule, "=")
+		if i <= 0 || i == len(rule)-1 {
+			return nil, fmt.Errorf("invalid role rule %s", rule)
+		}
+		// claim names can be URNs, so the claim ends at the last colon before the role
+		j := strings.LastIndex(rule[:i], ":")
+		if j <= 0 {
+			return nil, fmt.Errorf("invalid role rule %s", rule)
+		}
+		role := strings.TrimSpace(rule[i+1:])
+		if _, err := models.NewRoleList([]string{role}); err != nil {
+			return nil, err
+		}
+		rL = append(rL, RoleRule{
+			Claim: strings.TrimSpace(rule[:j]),
+			Value: strings.TrimSpace(rule[j+1 : i]),
+			Role:  role,
+		})
+	}
+	return rL, nil
+}
+
+// matches reports whether the claim value (string, boolean, number or list of them) satisfies the rule
+func (r *RoleRule) matches(claims map[string]interface{}) bool {
+	v, ok := claims[r.Claim]
+	if !ok {
+		return false
+	}
+	var values []interface{}
+	if l, isList := v.([]interface{}); isList {
+		values = l
+	} else {
+		values = []interface{}{v}
+	}
+	for _, value := range values {
+		s := fmt.Sprintf("%v", value)
+		if (r.Value == "*" && s != "") || strings.EqualFold(s, r.Value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,503 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/goidp/models"
+	"html/template"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/golang-jwt/jwt"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	samlSessionCookie = "idp_saml_session"
+	samlStateIssuer   = "idp-saml-state"
+	samlStateType     = "saml-state"
+	samlStateExpire   = 10 * time.Minute
+	samlMetadataType  = "application/samlmetadata+xml"
+)
+
+// SAMLConfig configures goidp as SAML 2.0 identity provider and, if IDPMetadata is set,
+// as SAML 2.0 service provider federated into an upstream identity provider
+type SAMLConfig struct {
+	// BaseURL is the externally reachable URL of goidp, e.g. https://idp.example.org
+	BaseURL string
+	// ServiceProviders holds the metadata of the service providers trusted by the identity
+	// provider, indexed by entity ID
+	ServiceProviders map[string]*saml.EntityDescriptor
+	// IDPMetadata is the metadata of the upstream identity provider
+	IDPMetadata       *saml.EntityDescriptor
+	UsernameAttribute string
+	RoleRules         []RoleRule
+	// Provision links the upstream identity to the local user with the same username,
+	// creating it if missing
+	Provision bool
+}
+
+// samlServiceProviderList implements saml.ServiceProviderProvider over the configured metadata
+type samlServiceProviderList map[string]*saml.EntityDescriptor
+
+func (l samlServiceProviderList) GetServiceProvider(r *http.Request, serviceProviderID string) (*saml.EntityDescriptor, error) {
+	sp, ok := l[serviceProviderID]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return sp, nil
+}
+
+// samlSessionProvider implements saml.SessionProvider, users are authenticated through a login
+// form and get a goidp access token stored in a cookie, which is reused for subsequent requests
+type samlSessionProvider struct {
+	a *App
+}
+
+// samlServiceProvider is the service provider federating goidp into an upstream identity provider
+type samlServiceProvider struct {
+	sp                saml.ServiceProvider
+	usernameAttribute string
+	roleRules         []RoleRule
+	provision         bool
+}
+
+// samlStateClaims is the content of the signed relay state, which binds the assertion to the
+// authentication request without storing anything server side
+type samlStateClaims struct {
+	// Typ is samlStateType, so that the relay state is not accepted as any other token
+	Typ       string `json:"typ"`
+	RequestID string `json:"request_id"`
+	jwt.StandardClaims
+}
+
+var samlLoginForm = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{.AppName}} login</title></head>
+<body>
+<form method="post" action="{{.Action}}">
+{{if .Error}}<p>{{.Error}}</p>{{end}}
+<label>Username <input type="text" name="username" autofocus></label>
+<label>Password <input type="password" name="password"></label>
+<input type="hidden" name="SAMLRequest" value="{{.SAMLRequest}}">
+<input type="hidden" name="RelayState" value="{{.RelayState}}">
+<input type="submit" value="Log in">
+</form>
+</body>
+</html>`))
+
+// ReadSAMLServiceProviders reads the metadata of the trusted service providers, one XML file
+// per service provider, from the given directory
+func ReadSAMLServiceProviders(path string) map[string]*saml.EntityDescriptor {
+	serviceProviders := make(map[string]*saml.EntityDescriptor)
+
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		log.WithError(err).Warnf("failed to read service providers dir")
+		return serviceProviders
+	}
+
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		spPath := path + "/" + file.Name()
+		log.Infoln("currently reading: ", spPath)
+
+		data, err := ioutil.ReadFile(spPath)
+		if err != nil {
+			log.WithError(err).Warnf("failed to read service provider metadata")
+			continue
+		}
+		var ed saml.EntityDescriptor
+		if err = xml.Unmarshal(data, &ed); err != nil {
+			log.WithError(err).Warnf("failed to parse service provider metadata")
+			continue
+		}
+		serviceProviders[ed.EntityID] = &ed
+	}
+
+	return serviceProviders
+}
+
+// ReadSAMLMetadata reads the metadata of the upstream identity provider, location is either
+// an URL or a file path
+func ReadSAMLMetadata(location string) (*saml.EntityDescriptor, error) {
+	var data []byte
+	var err error
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		client := &http.Client{Timeout: 10 * time.Second}
+		res, err := client.Get(location)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected status %d fetching %s", res.StatusCode, location)
+		}
+		data, err = ioutil.ReadAll(res.Body)
+		if err != nil {
+			return nil, err
+		}
+	} else if data, err = ioutil.ReadFile(location); err != nil {
+		return nil, err
+	}
+
+	var ed saml.EntityDescriptor
+	if err = xml.Unmarshal(data, &ed); err == nil {
+		return &ed, nil
+	}
+	// the metadata can also be published as a list of entities
+	var eds saml.EntitiesDescriptor
+	if err = xml.Unmarshal(data, &eds); err != nil {
+		return nil, err
+	}
+	for i := range eds.EntityDescriptors {
+		if len(eds.EntityDescriptors[i].IDPSSODescriptors) > 0 {
+			return &eds.EntityDescriptors[i], nil
+		}
+	}
+	return nil, errors.New("no identity provider found in metadata")
+}
+
+// samlCertificate returns the certificate published in the SAML metadata. If the JWT public key
+// was not provided as X509 certificate, a self-signed one is derived from the signing key: the
+// fields are fixed so that every replica and restart produces exactly the same certificate.
+func samlCertificate(c *Config) (*x509.Certificate, error) {
+	if c.SignKey == nil {
+		return nil, errors.New("SAML requires an RSA signing key")
+	}
+	if c.Certificate != nil {
+		return c.Certificate, nil
+	}
+	certTemplate := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: AppName},
+		NotBefore:             time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		NotAfter:              time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &certTemplate, &certTemplate, &c.SignKey.PublicKey, c.SignKey)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+// SetupSAML enables the SAML endpoints, assertions and requests are signed with the
+// RSA key used for the JWT tokens
+func (a *App) SetupSAML(c *SAMLConfig) error {
+	cert, err := samlCertificate(a.config)
+	if err != nil {
+		return err
+	}
+	baseURL, err := url.Parse(strings.TrimSuffix(c.BaseURL, "/") + fmt.Sprintf("/%s/saml", ApiVersion))
+	if err != nil {
+		return err
+	}
+	endpoint := func(path string) url.URL {
+		u := *baseURL
+		u.Path += path
+		return u
+	}
+	spMetadataURL := endpoint("/sp/metadata")
+
+	a.samlIdP = &saml.IdentityProvider{
+		Key:                     a.config.SignKey,
+		Logger:                  log.StandardLogger(),
+		Certificate:             cert,
+		MetadataURL:             endpoint("/idp/metadata"),
+		SSOURL:                  endpoint("/idp/sso"),
+		ServiceProviderProvider: samlServiceProviderList(c.ServiceProviders),
+		SessionProvider:         samlSessionProvider{a: a},
+	}
+
+	if c.IDPMetadata != nil {
+		a.samlSP = &samlServiceProvider{
+			sp: saml.ServiceProvider{
+				EntityID:    spMetadataURL.String(),
+				Key:         a.config.SignKey,
+				Certificate: cert,
+				MetadataURL: spMetadataURL,
+				AcsURL:      endpoint("/sp/acs"),
+				IDPMetadata: c.IDPMetadata,
+			},
+			usernameAttribute: c.UsernameAttribute,
+			roleRules:         c.RoleRules,
+			provision:         c.Provision,
+		}
+	}
+	return nil
+}
+
+// newSAMLSession converts the access token claims into the identity provider session
+// the goidp roles are released both as groups and as "roles" attribute
+func newSAMLSession(claims *customClaims) *saml.Session {
+	var roleValues []saml.AttributeValue
+	for _, r := range claims.Roles {
+		roleValues = append(roleValues, saml.AttributeValue{Type: "xs:string", Value: r})
+	}
+	return &saml.Session{
+		ID:         claims.Id,
+		CreateTime: time.Unix(claims.IssuedAt, 0),
+		ExpireTime: time.Unix(claims.ExpiresAt, 0),
+		Index:      claims.Id,
+		NameID:     claims.Subject,
+		UserName:   claims.Subject,
+		Groups:     claims.Roles,
+		CustomAttributes: []saml.Attribute{{
+			FriendlyName: "roles",
+			Name:         "roles",
+			NameFormat:   "urn:oasis:names:tc:SAML:2.0:attrname-format:basic",
+			Values:       roleValues,
+		}},
+	}
+}
+
+// GetSession returns the session of the user reaching the SSO endpoint, if the user is not
+// logged in yet the login form is written and nil is returned
+func (p samlSessionProvider) GetSession(w http.ResponseWriter, r *http.Request, req *saml.IdpAuthnRequest) *saml.Session {
+	a := p.a
+	if claims, _ := a.sessionCookieClaims(r, samlSessionCookie); claims != nil {
+		return newSAMLSession(claims)
+	}
+
+	var loginError string
+	if r.Method == http.MethodPost && r.PostForm.Get("username") != "" {
+		ip, _ := getIP(r)
+		username := r.PostForm.Get("username")
+		user, domain, ok := a.authenticate(username, r.PostForm.Get("password"))
+		if !ok {
+			domain = models.InternalDomain
+		} else if !user.Active() {
+			// the backends authenticate the shadow users whatever their state
+			log.Infof("saml login of %s user %s", user.State(), user.Username)
+			username, ok = user.Username, false
+		}
+		if ok {
+			if err := a.Events.CreateSuccessfulLoginEvent(user.Username, domain, ip); err != nil {
+				log.WithError(err).Warnf("failed to store login attempt")
+			}
+			claims := newCustomClaims(user, domain, a.config.AccessTokenExpireTime, nil, "")
+			signedToken, err := generateToken(claims, a.config.Secret, a.config.SignKey)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return nil
+			}
+			http.SetCookie(w, &http.Cookie{
+				Name:     samlSessionCookie,
+				Value:    signedToken,
+				Path:     a.samlIdP.SSOURL.Path,
+				Expires:  time.Unix(claims.ExpiresAt, 0),
+				HttpOnly: true,
+				Secure:   r.TLS != nil,
+				SameSite: http.SameSiteLaxMode,
+			})
+			return newSAMLSession(&claims)
+		}
+		if err := a.Events.CreateUnsuccessfulLoginEvent(username, domain, ip); err != nil {
+			log.WithError(err).Warnf("failed to store login attempt")
+		}
+		loginError = "user not allowed"
+	}
+
+	w.Header().Set(headerContentType, "text/html; charset=utf-8")
+	if loginError != "" {
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+	_ = samlLoginForm.Execute(w, map[string]string{
+		"AppName":     AppName,
+		"Action":      a.samlIdP.SSOURL.String(),
+		"Error":       loginError,
+		"SAMLRequest": base64.StdEncoding.EncodeToString(req.RequestBuffer),
+		"RelayState":  req.RelayState,
+	})
+	return nil
+}
+
+// SAMLIdPMetadataHandler serves the identity provider metadata
+func (a *App) SAMLIdPMetadataHandler(w http.ResponseWriter, r *http.Request) {
+	if a.samlIdP == nil {
+		jsonapiError(w, http.StatusNotFound, "saml not configured")
+		return
+	}
+	a.samlIdP.ServeMetadata(w, r)
+}
+
+// SAMLIdPSSOHandler handles the authentication requests of the service providers
+func (a *App) SAMLIdPSSOHandler(w http.ResponseWriter, r *http.Request) {
+	if a.samlIdP == nil {
+		jsonapiError(w, http.StatusNotFound, "saml not configured")
+		return
+	}
+	a.samlIdP.ServeSSO(w, r)
+}
+
+// SAMLSPMetadataHandler serves the service provider metadata to be registered at the upstream identity provider
+func (a *App) SAMLSPMetadataHandler(w http.ResponseWriter, r *http.Request) {
+	if a.samlSP == nil {
+		jsonapiError(w, http.StatusNotFound, "saml federation not configured")
+		return
+	}
+	buf, _ := xml.MarshalIndent(a.samlSP.sp.Metadata(), "", "  ")
+	w.Header().Set(headerContentType, samlMetadataType)
+	_, _ = w.Write(buf)
+}
+
+// SAMLSPLoginHandler redirects the user agent to the upstream identity provider
+func (a *App) SAMLSPLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if a.samlSP == nil {
+		jsonapiError(w, http.StatusNotFound, "saml federation not configured")
+		return
+	}
+	sp := &a.samlSP.sp
+	authnRequest, err := sp.MakeAuthenticationRequest(sp.GetSSOBindingLocation(saml.HTTPRedirectBinding),
+		saml.HTTPRedirectBinding, saml.HTTPPostBinding)
+	if err != nil {
+		jsonapiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	relayState, err := generateToken(samlStateClaims{
+		Typ:       samlStateType,
+		RequestID: authnRequest.ID,
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: time.Now().Add(samlStateExpire).Unix(),
+			IssuedAt:  time.Now().Unix(),
+			Issuer:    samlStateIssuer,
+		},
+	}, a.config.Secret, a.config.SignKey)
+	if err != nil {
+		jsonapiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	redirectURL, err := authnRequest.Redirect(relayState, sp)
+	if err != nil {
+		jsonapiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	http.Redirect(w, r, redirectURL.String(), http.StatusFound)
+}
+
+// SAMLSPACSHandler consumes the assertion of the upstream identity provider and issues the goidp tokens
+func (a *App) SAMLSPACSHandler(w http.ResponseWriter, r *http.Request) {
+	if a.samlSP == nil {
+		jsonapiError(w, http.StatusNotFound, "saml federation not configured")
+		return
+	}
+	ip, _ := getIP(r)
+	unauthorized := func(err error, username string) {
+		log.WithError(err).Warnf("saml login failure")
+		if err := a.Events.CreateUnsuccessfulLoginEvent(username, models.ExternalDomain, ip); err != nil {
+			log.WithError(err).Warnf("failed to store login attempt")
+		}
+		jsonapiError(w, http.StatusUnauthorized, "user not allowed")
+	}
+
+	if err := r.ParseForm(); err != nil {
+		jsonapiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var sC samlStateClaims
+	token, err := jwt.ParseWithClaims(r.PostForm.Get("RelayState"), &sC, getKeyFunc(a.config.Secret, a.config.VerifyKey))
+	if err != nil || !token.Valid || sC.Typ != samlStateType || sC.Issuer != samlStateIssuer {
+		jsonapiError(w, http.StatusBadRequest, "invalid relay state")
+		return
+	}
+
+	assertion, err := a.samlSP.sp.ParseResponse(r, []string{sC.RequestID})
+	if err != nil {
+		var ire *saml.InvalidResponseError
+		if errors.As(err, &ire) {
+			err = ire.PrivateErr
+		}
+		unauthorized(err, "unknown")
+		return
+	}
+	user, err := a.samlSP.mapUser(assertion)
+	if err != nil {
+		unauthorized(err, "unknown")
+		return
+	}
+
+	// the user is identified by the identity provider and the NameID, the username attributes are picked by
+	// the users at some identity providers
+	var subject string
+	if assertion.Subject != nil && assertion.Subject.NameID != nil {
+		subject = assertion.Subject.NameID.Value
+	}
+	if a.samlSP.provision {
+		username := user.Username
+		user, err = a.Users.ProvisionShadowUser(a.samlSP.sp.IDPMetadata.EntityID, subject, username, user.Roles)
+		switch err.(type) {
+		case nil:
+		case *models.UserError:
+			// the username is taken by a local user or by the shadow user of another account
+			unauthorized(err, username)
+			return
+		default:
+			log.WithError(err).Warnf("failed to link upstream user")
+			jsonapiError(w, http.StatusInternalServerError, "internal error, retry later")
+			return
+		}
+	} else if err = a.recordExternalIdentity(user, a.samlSP.sp.IDPMetadata.EntityID, subject); err != nil {
+		jsonapiError(w, http.StatusInternalServerError, "internal error, retry later")
+		return
+	}
+
+	a.createSession(w, r, user, models.ExternalDomain, false, nil, "", "")
+}
+
+// mapUser builds the goidp user out of the assertion subject and attributes, the attributes
+// can be referenced by the role rules either by name or by friendly name
+func (s *samlServiceProvider) mapUser(assertion *saml.Assertion) (*models.User, error) {
+	attributes := make(map[string]interface{})
+	for _, statement := range assertion.AttributeStatements {
+		for _, attr := range statement.Attributes {
+			var values []interface{}
+			for _, v := range attr.Values {
+				values = append(values, v.Value)
+			}
+			attributes[attr.Name] = values
+			if attr.FriendlyName != "" {
+				attributes[attr.FriendlyName] = values
+			}
+		}
+	}
+
+	var username string
+	if values, ok := attributes[s.usernameAttribute].([]interface{}); ok && len(values) > 0 {
+		username, _ = values[0].(string)
+	} else if assertion.Subject != nil && assertion.Subject.NameID != nil {
+		username = assertion.Subject.NameID.Value
+	}
+	if username == "" {
+		return nil, errors.New("no username in assertion")
+	}
+
+	var roleNames []string
+	for _, r := range s.roleRules {
+		if r.matches(attributes) && !stringInSliceCaseInsensitive(roleNames, r.Role) {
+			roleNames = append(roleNames, r.Role)
+		}
+	}
+	if len(roleNames) == 0 {
+		return nil, fmt.Errorf("user %s is not granted any role", username)
+	}
+	roles, err := models.NewRoleList(roleNames)
+	if err != nil {
+		return nil, err
+	}
+	return &models.User{Username: username, Roles: roles}, nil
+}
@@ -0,0 +1,253 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql/driver"
+	"encoding/xml"
+	"html"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/crewjam/saml"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// newTestServiceProvider returns a service provider acting as relying party of the identity provider
+func newTestServiceProvider(t *testing.T) *saml.ServiceProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("could not generate service provider key: %s", err)
+	}
+	certTemplate := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "sp.example.org"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &certTemplate, &certTemplate, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("could not generate service provider certificate: %s", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	metadataURL, _ := url.Parse("https://sp.example.org/saml/metadata")
+	acsURL, _ := url.Parse("https://sp.example.org/saml/acs")
+	return &saml.ServiceProvider{
+		EntityID:    metadataURL.String(),
+		Key:         key,
+		Certificate: cert,
+		MetadataURL: *metadataURL,
+		AcsURL:      *acsURL,
+	}
+}
+
+// formValue extracts the value of the named hidden input from an HTML form
+func formValue(t *testing.T, body, name string) string {
+	m := regexp.MustCompile(`name="` + name + `" value="([^"]*)"`).FindStringSubmatch(body)
+	if m == nil {
+		t.Fatalf("no %s input in form: %s", name, body)
+	}
+	return html.UnescapeString(m[1])
+}
+
+func TestSAMLIdentityProvider(t *testing.T) {
+	s, err := SetupSuite()
+	if err != nil {
+		t.Fatalf("error setting up test suite: %s", err.Error())
+	}
+
+	a := NewApp(s.DB, &Config{AccessTokenExpireTime: 5 * time.Minute})
+	a.config.SignKey, _ = ReadPrivateKey(PKCS1_Private_Key)
+	a.config.VerifyKey = &a.config.SignKey.PublicKey
+
+	sp := newTestServiceProvider(t)
+	if err = a.SetupSAML(&SAMLConfig{
+		BaseURL:          "https://idp.example.org",
+		ServiceProviders: map[string]*saml.EntityDescriptor{sp.EntityID: sp.Metadata()},
+	}); err != nil {
+		t.Fatalf("could not set-up saml: %s", err)
+	}
+
+	// the service provider learns the identity provider through its metadata
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/v1.0/saml/idp/metadata", nil)
+	a.SAMLIdPMetadataHandler(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d; got %d", http.StatusOK, rec.Code)
+	}
+	var idpMetadata saml.EntityDescriptor
+	if err = xml.Unmarshal(rec.Body.Bytes(), &idpMetadata); err != nil {
+		t.Fatalf("could not unmarshal metadata: %s", err)
+	}
+	if len(idpMetadata.IDPSSODescriptors) != 1 {
+		t.Fatalf("expected one IDPSSODescriptor; got %d", len(idpMetadata.IDPSSODescriptors))
+	}
+	sp.IDPMetadata = &idpMetadata
+
+	// the service provider redirects the user agent to the SSO endpoint, a login form is returned
+	authnRequest, err := sp.MakeAuthenticationRequest(sp.GetSSOBindingLocation(saml.HTTPRedirectBinding),
+		saml.HTTPRedirectBinding, saml.HTTPPostBinding)
+	if err != nil {
+		t.Fatalf("could not create authentication request: %s", err)
+	}
+	redirectURL, err := authnRequest.Redirect("relay", sp)
+	if err != nil {
+		t.Fatalf("could not create redirect: %s", err)
+	}
+	rec = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, redirectURL.String(), nil)
+	a.SAMLIdPSSOHandler(rec, req)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `name="password"`) {
+		t.Fatalf("expected login form; got status %d", rec.Code)
+	}
+
+	// the user submits the credentials
+	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("AdminUser1*"), 8)
+	s.mock.ExpectQuery(regexp.QuoteMeta(
+		`SELECT * FROM "users" WHERE username = $1 AND "users"."deleted_at" IS NULL ORDER BY "users"."id" LIMIT 1`)).
+		WithArgs("admin").
+		WillReturnRows(sqlmock.NewRows([]string{"Username", "Password", "Version"}).
+			AddRow("admin", string(hashedPassword), 1))
+	insertArgs := []driver.Value{sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()}
+	s.mock.ExpectBegin()
+	s.mock.ExpectQuery(regexp.QuoteMeta(
+		`INSERT INTO "events" ("created_at","updated_at","deleted_at","username","activated","description","modified","authn_domain","severity") VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9) RETURNING "id"`)).
+		WithArgs(insertArgs...).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	s.mock.ExpectCommit()
+
+	form := url.Values{
+		"SAMLRequest": {formValue(t, rec.Body.String(), "SAMLRequest")},
+		"RelayState":  {formValue(t, rec.Body.String(), "RelayState")},
+		"username":    {"admin"},
+		"password":    {"AdminUser1*"},
+	}
+	rec = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPost, a.samlIdP.SSOURL.String(), strings.NewReader(form.Encode()))
+	req.Header.Set(headerContentType, "application/x-www-form-urlencoded")
+	a.SAMLIdPSSOHandler(rec, req)
+	if err := s.mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d; got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != samlSessionCookie {
+		t.Fatalf("expected saml session cookie")
+	}
+
+	// the assertion is posted back to the service provider, which validates the signature
+	acsForm := url.Values{
+		"SAMLResponse": {formValue(t, rec.Body.String(), "SAMLResponse")},
+		"RelayState":   {formValue(t, rec.Body.String(), "RelayState")},
+	}
+	req, _ = http.NewRequest(http.MethodPost, sp.AcsURL.String(), strings.NewReader(acsForm.Encode()))
+	req.Header.Set(headerContentType, "application/x-www-form-urlencoded")
+	_ = req.ParseForm()
+	assertion, err := sp.ParseResponse(req, []string{authnRequest.ID})
+	if err != nil {
+		if ire, ok := err.(*saml.InvalidResponseError); ok {
+			err = ire.PrivateErr
+		}
+		t.Fatalf("invalid assertion: %s", err)
+	}
+	if assertion.Subject.NameID.Value != "admin" {
+		t.Errorf("expected subject admin; got %s", assertion.Subject.NameID.Value)
+	}
+	var uid string
+	for _, attr := range assertion.AttributeStatements[0].Attributes {
+		if attr.FriendlyName == "uid" {
+			uid = attr.Values[0].Value
+		}
+	}
+	if uid != "admin" {
+		t.Errorf("expected uid attribute admin; got %s", uid)
+	}
+	if acsForm.Get("RelayState") != "relay" {
+		t.Errorf("expected relay state to be preserved; got %s", acsForm.Get("RelayState"))
+	}
+
+	// the next authentication requests are served through the session cookie, without login form, as
+	// long as the user is active and has not changed since the login
+	tt := []struct {
+		name    string
+		status  string
+		version int
+		// reused is true if the cookie is accepted
+		reused bool
+	}{
+		{
+			name:    "unchanged user",
+			status:  "active",
+			version: 1,
+			reused:  true,
+		},
+		{
+			name:    "disabled user",
+			status:  "disabled",
+			version: 1,
+		},
+		{
+			name:    "password or roles changed",
+			status:  "active",
+			version: 2,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			s.mock.ExpectQuery(regexp.QuoteMeta(
+				`SELECT * FROM "users" WHERE username = $1 AND "users"."deleted_at" IS NULL ORDER BY "users"."id" LIMIT 1`)).
+				WithArgs("admin").
+				WillReturnRows(sqlmock.NewRows([]string{"Username", "Status", "Version"}).
+					AddRow("admin", tc.status, tc.version))
+
+			authnRequest, _ := sp.MakeAuthenticationRequest(sp.GetSSOBindingLocation(saml.HTTPRedirectBinding),
+				saml.HTTPRedirectBinding, saml.HTTPPostBinding)
+			redirectURL, _ := authnRequest.Redirect("", sp)
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodGet, redirectURL.String(), nil)
+			req.AddCookie(cookies[0])
+			a.SAMLIdPSSOHandler(rec, req)
+
+			if err := s.mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+			if rec.Code != http.StatusOK {
+				t.Fatalf("expected status %d; got %d", http.StatusOK, rec.Code)
+			}
+			if reused := strings.Contains(rec.Body.String(), "SAMLResponse"); reused != tc.reused {
+				t.Errorf("expected cookie reused %t; got %t", tc.reused, reused)
+			}
+			if !tc.reused && !strings.Contains(rec.Body.String(), `name="password"`) {
+				t.Errorf("expected login form")
+			}
+		})
+	}
+}
+
+func TestSAMLNotConfigured(t *testing.T) {
+	s, err := SetupSuite()
+	if err != nil {
+		t.Fatalf("error setting up test suite: %s", err.Error())
+	}
+	a := NewApp(s.DB, &Config{})
+	if err = a.SetupSAML(&SAMLConfig{}); err == nil {
+		t.Errorf("expected error setting up saml without signing key")
+	}
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/v1.0/saml/sp/metadata", nil)
+	a.SAMLSPMetadataHandler(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected status %d; got %d", http.StatusNotFound, rec.Code)
+	}
+}
@@ -0,0 +1,1026 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/goidp/models"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	scimBasePath       = "/scim/v2"
+	scimMediaType      = "application/scim+json"
+	scimUserSchema     = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimGroupSchema    = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	scimListSchema     = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimPatchSchema    = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	scimErrorSchema    = "urn:ietf:params:scim:api:messages:2.0:Error"
+	scimSPConfigSchema = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	scimMaxResults     = 200
+)
+
+// scimError is an error response as defined in RFC 7644 section 3.12
+type scimError struct {
+	status   int
+	scimType string
+	detail   string
+}
+
+func (e *scimError) Error() string {
+	return e.detail
+}
+
+func newSCIMError(status int, scimType, format string, args ...interface{}) *scimError {
+	return &scimError{status: status, scimType: scimType, detail: fmt.Sprintf(format, args...)}
+}
+
+type scimMeta struct {
+	ResourceType string     `json:"resourceType"`
+	Created      *time.Time `json:"created,omitempty"`
+	LastModified *time.Time `json:"lastModified,omitempty"`
+	Location     string     `json:"location"`
+	Version      string     `json:"version,omitempty"`
+}
+
+// scimValue is an element of a multi-valued attribute, e.g. a role or a group member
+type scimValue struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+	Ref     string `json:"$ref,omitempty"`
+}
+
+// scimUser is the SCIM representation of a goidp user, the groups are the roles assigned to the user
+type scimUser struct {
+	Schemas  []string    `json:"schemas"`
+	ID       string      `json:"id,omitempty"`
+	UserName string      `json:"userName"`
+	Password string      `json:"password,omitempty"`
+	Active   *bool       `json:"active,omitempty"`
+	Roles    []scimValue `json:"roles,omitempty"`
+	Groups   []scimValue `json:"groups,omitempty"`
+	Meta     *scimMeta   `json:"meta,omitempty"`
+}
+
+// scimGroup is the SCIM representation of a goidp role, the roles are fixed and only
+// the membership can be changed
+type scimGroup struct {
+	Schemas     []string    `json:"schemas"`
+	ID          string      `json:"id"`
+	DisplayName string      `json:"displayName"`
+	Members     []scimValue `json:"members"`
+	Meta        *scimMeta   `json:"meta,omitempty"`
+}
+
+type scimListResponse struct {
+	Schemas      []string      `json:"schemas"`
+	TotalResults int           `json:"totalResults"`
+	StartIndex   int           `json:"startIndex"`
+	ItemsPerPage int           `json:"itemsPerPage"`
+	Resources    []interface{} `json:"Resources"`
+}
+
+type scimPatchRequest struct {
+	Schemas    []string             `json:"schemas"`
+	Operations []scimPatchOperation `json:"Operations"`
+}
+
+type scimPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+// scimMiddleware authorizes the provisioning requests, only administrators can use the SCIM API
+func (a *App) scimMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t := parseAuthHeader(r)
+		claims, err := a.getRequestClaims(t)
+		if _, ok := err.(*models.DBError); ok {
+			writeSCIMError(w, newSCIMError(http.StatusInternalServerError, "", "internal error, retry later"))
+			return
+		} else if err != nil {
+			log.WithError(err).Info("unauthorized scim request")
+			writeSCIMError(w, newSCIMError(http.StatusUnauthorized, "", "unauthorized request"))
+			return
+		}
+		if err = a.verifyTokenBinding(r, t, claims.Cnf); err != nil {
+			log.WithError(err).Info("invalid token binding")
+			writeSCIMError(w, newSCIMError(http.StatusUnauthorized, "", "invalid token binding"))
+			return
+		}
+		if claims.Sid != "" {
+			switch _, err = a.Sessions.GetSession(claims.Sid); err.(type) {
+			case *models.NotFoundError:
+				writeSCIMError(w, newSCIMError(http.StatusUnauthorized, "", "session terminated"))
+				return
+			case *models.DBError:
+				writeSCIMError(w, newSCIMError(http.StatusInternalServerError, "", "internal error, retry later"))
+				return
+			}
+		}
+		switch err = a.verifyGeneration(claims); err.(type) {
+		case nil:
+		case *models.DBError:
+			writeSCIMError(w, newSCIMError(http.StatusInternalServerError, "", "internal error, retry later"))
+			return
+		default:
+			writeSCIMError(w, newSCIMError(http.StatusUnauthorized, "", "token revoked"))
+			return
+		}
+		if err = a.verifyAccess(claims, "scim", r.Method); err != nil {
+			log.WithError(err).Info("forbidden scim request")
+			writeSCIMError(w, newSCIMError(http.StatusForbidden, "", "forbidden request"))
+			return
+		}
+		if !stringInSliceCaseInsensitive(claims.Roles, models.AdminRole.String()) {
+			writeSCIMError(w, newSCIMError(http.StatusForbidden, "", "forbidden request"))
+			return
+		}
+		a.auditActor(r, claims)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeSCIMError(w http.ResponseWriter, e *scimError) {
+	w.Header().Set(headerContentType, scimMediaType)
+	w.WriteHeader(e.status)
+	body := map[string]interface{}{
+		"schemas": []string{scimErrorSchema},
+		"status":  strconv.Itoa(e.status),
+		"detail":  e.detail,
+	}
+	if e.scimType != "" {
+		body["scimType"] = e.scimType
+	}
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func writeSCIMResource(w http.ResponseWriter, resource interface{}, etag string, statusCode int) {
+	w.Header().Set(headerContentType, scimMediaType)
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(resource); err != nil {
+		log.WithError(err).Warnf("failed to write scim response")
+	}
+}
+
+// scimLocation returns the absolute URL of the resource
+func scimLocation(r *http.Request, resourceType, id string) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	u := url.URL{Scheme: scheme, Host: r.Host, Path: fmt.Sprintf("%s/%s/%s", scimBasePath, resourceType, id)}
+	return u.String()
+}
+
+// etagMatches compares the entity tag with the list of the If-Match or If-None-Match header,
+// using the weak comparison
+func etagMatches(header, etag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// checkIfMatch enforces the If-Match precondition of the modification requests
+func checkIfMatch(w http.ResponseWriter, r *http.Request, etag string) bool {
+	if h := r.Header.Get("If-Match"); h != "" && !etagMatches(h, etag) {
+		writeSCIMError(w, newSCIMError(http.StatusPreconditionFailed, "", "resource version mismatch, current version is %s", etag))
+		return false
+	}
+	return true
+}
+
+// scimPagination reads the 1-based startIndex and the count query parameters
+func scimPagination(q url.Values) (int, int) {
+	startIndex, err := strconv.Atoi(q.Get("startIndex"))
+	if err != nil || startIndex < 1 {
+		startIndex = 1
+	}
+	count, err := strconv.Atoi(q.Get("count"))
+	if err != nil || count > scimMaxResults {
+		count = scimMaxResults
+	}
+	if count < 0 {
+		count = 0
+	}
+	return startIndex, count
+}
+
+func writeSCIMList(w http.ResponseWriter, r *http.Request, resources []interface{}) {
+	startIndex, count := scimPagination(r.URL.Query())
+	page := make([]interface{}, 0)
+	if startIndex <= len(resources) {
+		end := startIndex - 1 + count
+		if end > len(resources) {
+			end = len(resources)
+		}
+		page = append(page, resources[startIndex-1:end]...)
+	}
+	writeSCIMResource(w, &scimListResponse{
+		Schemas:      []string{scimListSchema},
+		TotalResults: len(resources),
+		StartIndex:   startIndex,
+		ItemsPerPage: len(page),
+		Resources:    page,
+	}, "", http.StatusOK)
+}
+
+// scimFilterFromRequest parses the optional filter query parameter
+func scimFilterFromRequest(r *http.Request) (scimFilter, *scimError) {
+	f := r.URL.Query().Get("filter")
+	if f == "" {
+		return nil, nil
+	}
+	filter, err := parseSCIMFilter(f)
+	if err != nil {
+		return nil, newSCIMError(http.StatusBadRequest, "invalidFilter", "invalid filter: %s", err.Error())
+	}
+	return filter, nil
+}
+
+// scimValues decodes the value of a multi-valued attribute, either a list of objects,
+// a single object or a plain string
+func scimValues(raw json.RawMessage) ([]scimValue, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var values []scimValue
+	if err := json.Unmarshal(raw, &values); err == nil {
+		return values, nil
+	}
+	var value scimValue
+	if err := json.Unmarshal(raw, &value); err == nil {
+		return []scimValue{value}, nil
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return nil, fmt.Errorf("invalid multi-valued attribute %s", string(raw))
+	}
+	return []scimValue{{Value: s}}, nil
+}
+
+// scimBool decodes a boolean, some provisioning clients send it as string
+func scimBool(raw json.RawMessage) (bool, error) {
+	var b bool
+	if err := json.Unmarshal(raw, &b); err == nil {
+		return b, nil
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return false, fmt.Errorf("invalid boolean %s", string(raw))
+	}
+	return strconv.ParseBool(s)
+}
+
+// parseSCIMPatchPath splits a patch path as "members[value eq \"2\"]" into the attribute and the value filter
+func parseSCIMPatchPath(path string) (string, scimFilter, error) {
+	i := strings.Index(path, "[")
+	if i < 0 {
+		return scimAttributePath(path), nil, nil
+	}
+	if !strings.HasSuffix(path, "]") {
+		return "", nil, fmt.Errorf("unsupported path %s", path)
+	}
+	filter, err := parseSCIMFilter(path[i+1 : len(path)-1])
+	if err != nil {
+		return "", nil, err
+	}
+	return scimAttributePath(path[:i]), filter, nil
+}
+
+// applyMultiValuedPatch applies a patch operation to the values of a multi-valued attribute
+func applyMultiValuedPatch(current []scimValue, op string, filter scimFilter, raw json.RawMessage) ([]scimValue, error) {
+	values, err := scimValues(raw)
+	if err != nil {
+		return nil, err
+	}
+	matches := func(v scimValue) bool {
+		sA := scimAttributes{}
+		sA.add("value", v.Value)
+		sA.add("display", v.Display)
+		if filter != nil && filter.matches(sA) {
+			return true
+		}
+		for _, target := range values {
+			if strings.EqualFold(target.Value, v.Value) {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch op {
+	case "add":
+		if filter != nil {
+			return nil, fmt.Errorf("value filter not allowed in add operations")
+		}
+		for _, v := range values {
+			found := false
+			for _, c := range current {
+				found = found || strings.EqualFold(c.Value, v.Value)
+			}
+			if !found {
+				current = append(current, v)
+			}
+		}
+		return current, nil
+	case "replace":
+		if filter != nil {
+			return nil, fmt.Errorf("value filter not allowed in replace operations")
+		}
+		return values, nil
+	case "remove":
+		if filter == nil && len(values) == 0 {
+			return nil, nil
+		}
+		var kept []scimValue
+		for _, c := range current {
+			if !matches(c) {
+				kept = append(kept, c)
+			}
+		}
+		return kept, nil
+	}
+	return nil, fmt.Errorf("invalid operation %s", op)
+}
+
+// SCIMServiceProviderConfigHandler advertises the supported SCIM features
+func (a *App) SCIMServiceProviderConfigHandler(w http.ResponseWriter, r *http.Request) {
+	supported := func(s bool) map[string]bool { return map[string]bool{"supported": s} }
+	writeSCIMResource(w, map[string]interface{}{
+		"schemas":        []string{scimSPConfigSchema},
+		"patch":          supported(true),
+		"bulk":           map[string]interface{}{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":         map[string]interface{}{"supported": true, "maxResults": scimMaxResults},
+		"changePassword": supported(true),
+		"sort":           supported(false),
+		"etag":           supported(true),
+		"authenticationSchemes": []map[string]string{{
+			"type":        "oauthbearertoken",
+			"name":        "OAuth Bearer Token",
+			"description": "goidp access token of an administrator",
+		}},
+		"meta": map[string]string{"resourceType": "ServiceProviderConfig", "location": scimLocation(r, "ServiceProviderConfig", "")},
+	}, "", http.StatusOK)
+}
+
+func newSCIMUser(r *http.Request, u *models.User) *scimUser {
+	// the users in any state other than active are reported inactive
+	active := u.Active()
+	id := strconv.Itoa(int(u.ID))
+	created, modified := u.CreatedAt.UTC(), u.UpdatedAt.UTC()
+	sU := &scimUser{
+		Schemas:  []string{scimUserSchema},
+		ID:       id,
+		UserName: u.Username,
+		Active:   &active,
+		Meta: &scimMeta{
+			ResourceType: "User",
+			Created:      &created,
+			LastModified: &modified,
+			Location:     scimLocation(r, "Users", id),
+			Version:      userETag(u),
+		},
+	}
+	for _, role := range u.Roles {
+		sU.Roles = append(sU.Roles, scimValue{Value: role.Name})
+		groupID := strconv.Itoa(int(role.ID))
+		sU.Groups = append(sU.Groups, scimValue{Value: groupID, Display: role.Name, Ref: scimLocation(r, "Groups", groupID)})
+	}
+	return sU
+}
+
+// attributes returns the attributes of the user which can be used in filters
+func (sU *scimUser) attributes() scimAttributes {
+	sA := scimAttributes{}
+	sA.add("id", sU.ID)
+	sA.add("userName", sU.UserName)
+	sA.add("active", strconv.FormatBool(sU.Active == nil || *sU.Active))
+	for _, r := range sU.Roles {
+		sA.add("roles.value", r.Value)
+	}
+	for _, g := range sU.Groups {
+		sA.add("groups.value", g.Value)
+		sA.add("groups.display", g.Display)
+	}
+	if sU.Meta != nil {
+		sA.add("meta.resourceType", sU.Meta.ResourceType)
+		sA.add("meta.created", sU.Meta.Created.Format(time.RFC3339))
+		sA.add("meta.lastModified", sU.Meta.LastModified.Format(time.RFC3339))
+		sA.add("meta.version", sU.Meta.Version)
+	}
+	return sA
+}
+
+// newSCIMRoleList converts the SCIM roles into the user roles, ignoring duplicates
+func newSCIMRoleList(values []scimValue) (models.RoleList, error) {
+	var names []string
+	for _, v := range values {
+		name := strings.ToUpper(v.Value)
+		if !stringInSlice(names, name) {
+			names = append(names, name)
+		}
+	}
+	return models.NewRoleList(names)
+}
+
+// SCIMUsersHandler lists (GET) or provisions (POST) the users
+func (a *App) SCIMUsersHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		a.SCIMGetUsersHandler(w, r)
+	case http.MethodPost:
+		a.SCIMCreateUserHandler(w, r)
+	}
+}
+
+// SCIMUserHandler reads, replaces, patches or deprovisions a single user
+func (a *App) SCIMUserHandler(w http.ResponseWriter, r *http.Request) {
+	u, sErr := a.scimUserByID(mux.Vars(r)["id"])
+	if sErr != nil {
+		writeSCIMError(w, sErr)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		if h := r.Header.Get("If-None-Match"); h != "" && etagMatches(h, userETag(u)) {
+			w.Header().Set("ETag", userETag(u))
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		writeSCIMResource(w, newSCIMUser(r, u), userETag(u), http.StatusOK)
+	case http.MethodPut:
+		a.SCIMReplaceUserHandler(w, r, u)
+	case http.MethodPatch:
+		a.SCIMPatchUserHandler(w, r, u)
+	case http.MethodDelete:
+		a.SCIMDeleteUserHandler(w, r, u)
+	}
+}
+
+// scimUserByID retrieves the user, SCIM resources are addressed by ID only
+func (a *App) scimUserByID(id string) (*models.User, *scimError) {
+	if _, err := strconv.Atoi(id); err != nil {
+		return nil, newSCIMError(http.StatusNotFound, "", "user %s not found", id)
+	}
+	u, err := a.Users.GetUserByNameOrID(id)
+	switch err.(type) {
+	case nil:
+		return u, nil
+	case *models.NotFoundError:
+		return nil, newSCIMError(http.StatusNotFound, "", "user %s not found", id)
+	default:
+		return nil, newSCIMError(http.StatusInternalServerError, "", "%s", err.Error())
+	}
+}
+
+func (a *App) SCIMGetUsersHandler(w http.ResponseWriter, r *http.Request) {
+	filter, sErr := scimFilterFromRequest(r)
+	if sErr != nil {
+		writeSCIMError(w, sErr)
+		return
+	}
+	users, err := a.Users.GetUsers()
+	if err != nil {
+		writeSCIMError(w, newSCIMError(http.StatusInternalServerError, "", "%s", err.Error()))
+		return
+	}
+	var resources []interface{}
+	for _, u := range users {
+		if u == nil {
+			continue
+		}
+		sU := newSCIMUser(r, u)
+		if filter == nil || filter.matches(sU.attributes()) {
+			resources = append(resources, sU)
+		}
+	}
+	writeSCIMList(w, r, resources)
+}
+
+func (a *App) SCIMCreateUserHandler(w http.ResponseWriter, r *http.Request) {
+	var sU scimUser
+	if err := json.NewDecoder(r.Body).Decode(&sU); err != nil {
+		writeSCIMError(w, newSCIMError(http.StatusBadRequest, "invalidSyntax", "%s", err.Error()))
+		return
+	}
+	if sU.UserName == "" {
+		writeSCIMError(w, newSCIMError(http.StatusBadRequest, "invalidValue", "userName is required"))
+		return
+	}
+	roles, err := newSCIMRoleList(sU.Roles)
+	if err != nil {
+		writeSCIMError(w, newSCIMError(http.StatusBadRequest, "invalidValue", "%s", err.Error()))
+		return
+	}
+	if err = a.Users.ValidateUsername(sU.UserName); err != nil {
+		writeSCIMError(w, newSCIMError(http.StatusConflict, "uniqueness", "%s", err.Error()))
+		return
+	}
+
+	user := &models.User{
+		Username: sU.UserName,
+		Password: sU.Password,
+		Roles:    roles,
+		Version:  1,
+	}
+	if sU.Password == "" {
+		// users provisioned without password cannot log in until an administrator sets it
+		err = a.Users.CreateWithoutPassword(user)
+	} else {
+		err = a.Users.Create(user)
+	}
+	switch err.(type) {
+	case nil:
+	case *models.UserError:
+		writeSCIMError(w, newSCIMError(http.StatusBadRequest, "invalidValue", "%s", err.Error()))
+		return
+	default:
+		writeSCIMError(w, newSCIMError(http.StatusInternalServerError, "", "%s", err.Error()))
+		return
+	}
+
+	if err = a.Events.CreateUserEvent(r.Method, user.Username, ""); err != nil {
+		log.WithError(err).Warnf("failed to store user event")
+	}
+	// the users provisioned inactive are created disabled
+	if sU.Active != nil && !*sU.Active {
+		if err = a.scimSetActive(r, user, false); err != nil {
+			writeSCIMError(w, newSCIMError(http.StatusInternalServerError, "", "%s", err.Error()))
+			return
+		}
+	}
+
+	sU = *newSCIMUser(r, user)
+	w.Header().Set("Location", sU.Meta.Location)
+	writeSCIMResource(w, &sU, userETag(user), http.StatusCreated)
+}
+
+// scimUserUpdate holds the mutable attributes of the user while the request is applied
+type scimUserUpdate struct {
+	userName string
+	password string
+	active   bool
+	roles    []scimValue
+}
+
+func newSCIMUserUpdate(u *models.User) *scimUserUpdate {
+	uU := &scimUserUpdate{userName: u.Username, active: u.Active()}
+	for _, role := range u.Roles {
+		uU.roles = append(uU.roles, scimValue{Value: role.Name})
+	}
+	return uU
+}
+
+// set applies a patch operation to a single attribute
+func (uU *scimUserUpdate) set(op, attr string, filter scimFilter, raw json.RawMessage) error {
+	if attr != "roles" && (filter != nil || op == "remove") {
+		return fmt.Errorf("attribute %s cannot be removed", attr)
+	}
+	var err error
+	switch attr {
+	case "username":
+		err = json.Unmarshal(raw, &uU.userName)
+	case "password":
+		err = json.Unmarshal(raw, &uU.password)
+	case "active":
+		uU.active, err = scimBool(raw)
+	case "roles":
+		uU.roles, err = applyMultiValuedPatch(uU.roles, op, filter, raw)
+	case "id", "schemas", "meta", "groups":
+		err = fmt.Errorf("attribute %s is read-only", attr)
+	default:
+		// attributes not managed by the identity provider are ignored
+		log.Debugf("ignoring scim attribute %s", attr)
+	}
+	return err
+}
+
+// apply applies the patch operation, without path the value holds the attributes to add or replace
+func (uU *scimUserUpdate) apply(operation scimPatchOperation) error {
+	op := strings.ToLower(operation.Op)
+	if op != "add" && op != "replace" && op != "remove" {
+		return fmt.Errorf("invalid operation %s", operation.Op)
+	}
+	if operation.Path != "" {
+		attr, filter, err := parseSCIMPatchPath(operation.Path)
+		if err != nil {
+			return err
+		}
+		return uU.set(op, attr, filter, operation.Value)
+	}
+	if op == "remove" {
+		return fmt.Errorf("path is required in remove operations")
+	}
+	var attrs map[string]json.RawMessage
+	if err := json.Unmarshal(operation.Value, &attrs); err != nil {
+		return fmt.Errorf("invalid value: %s", err.Error())
+	}
+	for k, v := range attrs {
+		if err := uU.set(op, scimAttributePath(k), nil, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scimUpdateUser stores the updated user attributes and writes the new representation
+func (a *App) scimUpdateUser(w http.ResponseWriter, r *http.Request, u *models.User, uU *scimUserUpdate) {
+	if uU.userName == "" {
+		writeSCIMError(w, newSCIMError(http.StatusBadRequest, "invalidValue", "userName is required"))
+		return
+	}
+	roles, err := newSCIMRoleList(uU.roles)
+	if err != nil {
+		writeSCIMError(w, newSCIMError(http.StatusBadRequest, "invalidValue", "%s", err.Error()))
+		return
+	}
+	username := u.Username
+	if uU.userName != u.Username {
+		if err = a.Users.ValidateUsername(uU.userName); err != nil {
+			writeSCIMError(w, newSCIMError(http.StatusConflict, "uniqueness", "%s", err.Error()))
+			return
+		}
+	}
+	from := u.State()
+	status := uU.active != u.Active()
+	if status {
+		applySCIMActive(u, uU.active)
+	}
+	// the changes are stored together, provided the user has not changed since it has been read
+	err = a.Users.PatchUser(u, &models.UserPatch{
+		Username:     uU.userName,
+		Password:     uU.password,
+		Roles:        roles.String(),
+		ReplaceRoles: true,
+		Status:       status,
+	})
+	if err != nil {
+		writeSCIMError(w, scimUpdateError(err))
+		return
+	}
+
+	if err = a.Events.CreateUserEvent(r.Method, username, ""); err != nil {
+		log.WithError(err).Warnf("failed to store user event")
+	}
+	if status {
+		a.scimStatusEvent(r, u, from)
+	}
+	writeSCIMResource(w, newSCIMUser(r, u), userETag(u), http.StatusOK)
+}
+
+// scimUpdateError returns the SCIM error of the update of a user, the update of a user changed since it
+// has been read fails as the update of a stale entity tag
+func scimUpdateError(err error) *scimError {
+	switch err.(type) {
+	case *models.UserError:
+		return newSCIMError(http.StatusBadRequest, "invalidValue", "%s", err.Error())
+	case *models.ConflictError:
+		return newSCIMError(http.StatusPreconditionFailed, "", "%s", err.Error())
+	}
+	return newSCIMError(http.StatusInternalServerError, "", "%s", err.Error())
+}
+
+// applySCIMActive maps the SCIM active attribute to the lifecycle state of the user: an inactive user is
+// disabled and an active user is activated whatever its state, an expired user getting its expiration
+// time removed
+func applySCIMActive(u *models.User, active bool) {
+	to := models.UserDisabled
+	if active {
+		to = models.UserActive
+		if u.State() == models.UserExpired {
+			u.ExpiresAt = nil
+		}
+	}
+	u.Status = string(to)
+}
+
+// scimSetActive stores the lifecycle state of the user mapped from the SCIM active attribute
+func (a *App) scimSetActive(r *http.Request, u *models.User, active bool) error {
+	from := u.State()
+	applySCIMActive(u, active)
+	if err := a.Users.UpdateUserStatus(u); err != nil {
+		return err
+	}
+	a.scimStatusEvent(r, u, from)
+	return nil
+}
+
+// scimStatusEvent records the change of the lifecycle state of the user made by the SCIM client
+func (a *App) scimStatusEvent(r *http.Request, u *models.User, from models.UserStatus) {
+	var actor string
+	if claims, err := a.getRequestClaims(parseAuthHeader(r)); err == nil {
+		actor = claims.Subject
+	}
+	if err := a.Events.CreateUserStatusEvent(u.Username, string(from), u.Status, actor); err != nil {
+		log.WithError(err).Warnf("failed to store user status event")
+	}
+}
+
+func (a *App) SCIMReplaceUserHandler(w http.ResponseWriter, r *http.Request, u *models.User) {
+	if !checkIfMatch(w, r, userETag(u)) {
+		return
+	}
+	var sU scimUser
+	if err := json.NewDecoder(r.Body).Decode(&sU); err != nil {
+		writeSCIMError(w, newSCIMError(http.StatusBadRequest, "invalidSyntax", "%s", err.Error()))
+		return
+	}
+	a.scimUpdateUser(w, r, u, &scimUserUpdate{
+		userName: sU.UserName,
+		password: sU.Password,
+		active:   sU.Active == nil || *sU.Active,
+		roles:    sU.Roles,
+	})
+}
+
+func (a *App) SCIMPatchUserHandler(w http.ResponseWriter, r *http.Request, u *models.User) {
+	if !checkIfMatch(w, r, userETag(u)) {
+		return
+	}
+	var pR scimPatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&pR); err != nil || !stringInSlice(pR.Schemas, scimPatchSchema) {
+		writeSCIMError(w, newSCIMError(http.StatusBadRequest, "invalidSyntax", "invalid patch request"))
+		return
+	}
+	uU := newSCIMUserUpdate(u)
+	for _, operation := range pR.Operations {
+		if err := uU.apply(operation); err != nil {
+			writeSCIMError(w, newSCIMError(http.StatusBadRequest, "invalidValue", "%s", err.Error()))
+			return
+		}
+	}
+	a.scimUpdateUser(w, r, u, uU)
+}
+
+func (a *App) SCIMDeleteUserHandler(w http.ResponseWriter, r *http.Request, u *models.User) {
+	if !checkIfMatch(w, r, userETag(u)) {
+		return
+	}
+	switch err := a.Users.DeleteUser(u).(type) {
+	case nil:
+	case *models.NotFoundError:
+		writeSCIMError(w, newSCIMError(http.StatusNotFound, "", "%s", err.Error()))
+		return
+	case *models.UserError:
+		writeSCIMError(w, newSCIMError(http.StatusBadRequest, "", "%s", err.Error()))
+		return
+	default:
+		writeSCIMError(w, newSCIMError(http.StatusInternalServerError, "", "%s", err.Error()))
+		return
+	}
+	if err := a.Events.CreateUserEvent(r.Method, u.Username, ""); err != nil {
+		log.WithError(err).Warnf("failed to store user event")
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// newSCIMGroups builds the groups out of the roles, the members are the users the role is assigned to
+func newSCIMGroups(r *http.Request, users []*models.User) []*scimGroup {
+	var groups []*scimGroup
+	for _, role := range models.GetDefaultRoles() {
+		id := strconv.Itoa(int(role.ID))
+		g := &scimGroup{
+			Schemas:     []string{scimGroupSchema},
+			ID:          id,
+			DisplayName: role.Name,
+			Members:     []scimValue{},
+		}
+		// the group version changes whenever a member is added, removed or updated
+		h := fnv.New32a()
+		for _, u := range users {
+			if u == nil || !userHasRole(u, role.ID) {
+				continue
+			}
+			userID := strconv.Itoa(int(u.ID))
+			g.Members = append(g.Members, scimValue{Value: userID, Display: u.Username, Ref: scimLocation(r, "Users", userID)})
+			_, _ = fmt.Fprintf(h, "%d:%d;", u.ID, u.Revision)
+		}
+		g.Meta = &scimMeta{
+			ResourceType: "Group",
+			Location:     scimLocation(r, "Groups", id),
+			Version:      fmt.Sprintf(`W/"%x"`, h.Sum32()),
+		}
+		groups = append(groups, g)
+	}
+	return groups
+}
+
+func userHasRole(u *models.User, roleID uint) bool {
+	for _, r := range u.Roles {
+		if r.ID == roleID {
+			return true
+		}
+	}
+	return false
+}
+
+// attributes returns the attributes of the group which can be used in filters
+func (g *scimGroup) attributes() scimAttributes {
+	sA := scimAttributes{}
+	sA.add("id", g.ID)
+	sA.add("displayName", g.DisplayName)
+	for _, m := range g.Members {
+		sA.add("members.value", m.Value)
+		sA.add("members.display", m.Display)
+	}
+	return sA
+}
+
+// SCIMGroupsHandler lists the groups
+func (a *App) SCIMGroupsHandler(w http.ResponseWriter, r *http.Request) {
+	filter, sErr := scimFilterFromRequest(r)
+	if sErr != nil {
+		writeSCIMError(w, sErr)
+		return
+	}
+	users, err := a.Users.GetUsers()
+	if err != nil {
+		writeSCIMError(w, newSCIMError(http.StatusInternalServerError, "", "%s", err.Error()))
+		return
+	}
+	var resources []interface{}
+	for _, g := range newSCIMGroups(r, users) {
+		if filter == nil || filter.matches(g.attributes()) {
+			resources = append(resources, g)
+		}
+	}
+	writeSCIMList(w, r, resources)
+}
+
+// SCIMGroupHandler reads a group or changes its members
+func (a *App) SCIMGroupHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	users, err := a.Users.GetUsers()
+	if err != nil {
+		writeSCIMError(w, newSCIMError(http.StatusInternalServerError, "", "%s", err.Error()))
+		return
+	}
+	var group *scimGroup
+	for _, g := range newSCIMGroups(r, users) {
+		if g.ID == id {
+			group = g
+		}
+	}
+	if group == nil {
+		writeSCIMError(w, newSCIMError(http.StatusNotFound, "", "group %s not found", id))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if h := r.Header.Get("If-None-Match"); h != "" && etagMatches(h, group.Meta.Version) {
+			w.Header().Set("ETag", group.Meta.Version)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		writeSCIMResource(w, group, group.Meta.Version, http.StatusOK)
+		return
+	case http.MethodPut:
+		if !checkIfMatch(w, r, group.Meta.Version) {
+			return
+		}
+		var g scimGroup
+		if err := json.NewDecoder(r.Body).Decode(&g); err != nil {
+			writeSCIMError(w, newSCIMError(http.StatusBadRequest, "invalidSyntax", "%s", err.Error()))
+			return
+		}
+		if g.DisplayName != "" && g.DisplayName != group.DisplayName {
+			writeSCIMError(w, newSCIMError(http.StatusBadRequest, "mutability", "displayName cannot be changed"))
+			return
+		}
+		a.scimUpdateMembers(w, r, group, users, g.Members)
+	case http.MethodPatch:
+		if !checkIfMatch(w, r, group.Meta.Version) {
+			return
+		}
+		var pR scimPatchRequest
+		if err := json.NewDecoder(r.Body).Decode(&pR); err != nil || !stringInSlice(pR.Schemas, scimPatchSchema) {
+			writeSCIMError(w, newSCIMError(http.StatusBadRequest, "invalidSyntax", "invalid patch request"))
+			return
+		}
+		members := group.Members
+		for _, operation := range pR.Operations {
+			if members, err = applyGroupPatch(group, members, operation); err != nil {
+				writeSCIMError(w, newSCIMError(http.StatusBadRequest, "invalidValue", "%s", err.Error()))
+				return
+			}
+		}
+		a.scimUpdateMembers(w, r, group, users, members)
+	}
+}
+
+// applyGroupPatch applies the patch operation to the group members, the other attributes are read-only
+func applyGroupPatch(group *scimGroup, members []scimValue, operation scimPatchOperation) ([]scimValue, error) {
+	op := strings.ToLower(operation.Op)
+	if operation.Path != "" {
+		attr, filter, err := parseSCIMPatchPath(operation.Path)
+		if err != nil {
+			return nil, err
+		}
+		if attr != "members" {
+			return nil, fmt.Errorf("attribute %s cannot be changed", attr)
+		}
+		return applyMultiValuedPatch(members, op, filter, operation.Value)
+	}
+	var attrs map[string]json.RawMessage
+	if err := json.Unmarshal(operation.Value, &attrs); err != nil {
+		return nil, fmt.Errorf("invalid value: %s", err.Error())
+	}
+	for k, v := range attrs {
+		switch scimAttributePath(k) {
+		case "members":
+			var err error
+			if members, err = applyMultiValuedPatch(members, op, nil, v); err != nil {
+				return nil, err
+			}
+		case "displayname":
+			var name string
+			if err := json.Unmarshal(v, &name); err != nil || name != group.DisplayName {
+				return nil, fmt.Errorf("displayName cannot be changed")
+			}
+		default:
+			return nil, fmt.Errorf("attribute %s cannot be changed", k)
+		}
+	}
+	return members, nil
+}
+
+// scimMemberChange is a user whose membership of the group changes, with its new roles
+type scimMemberChange struct {
+	user  *models.User
+	roles models.RoleList
+}
+
+// scimUpdateMembers assigns the group role to the new members and revokes it from the removed ones
+func (a *App) scimUpdateMembers(w http.ResponseWriter, r *http.Request, group *scimGroup, users []*models.User, members []scimValue) {
+	roleID, _ := strconv.Atoi(group.ID)
+	role, _ := models.NewRoleList([]string{group.DisplayName})
+
+	wanted := make(map[string]bool)
+	for _, m := range members {
+		wanted[m.Value] = true
+	}
+	known := make(map[string]bool)
+	var changed []scimMemberChange
+	for _, u := range users {
+		if u == nil {
+			continue
+		}
+		id := strconv.Itoa(int(u.ID))
+		known[id] = true
+		isMember := userHasRole(u, uint(roleID))
+		var roles models.RoleList
+		switch {
+		case wanted[id] && !isMember:
+			roles = append(append(roles, u.Roles...), role...)
+		case !wanted[id] && isMember:
+			for _, r := range u.Roles {
+				if r.ID != uint(roleID) {
+					roles = append(roles, r)
+				}
+			}
+		default:
+			continue
+		}
+		changed = append(changed, scimMemberChange{user: u, roles: roles})
+	}
+	for id := range wanted {
+		if !known[id] {
+			writeSCIMError(w, newSCIMError(http.StatusBadRequest, "invalidValue", "user %s not found", id))
+			return
+		}
+	}
+
+	for _, c := range changed {
+		u := c.user
+		if err := a.Users.PatchUser(u, &models.UserPatch{Roles: c.roles.String(), ReplaceRoles: true}); err != nil {
+			writeSCIMError(w, scimUpdateError(err))
+			return
+		}
+		if err := a.Events.CreateUserEvent(http.MethodPatch, u.Username, ""); err != nil {
+			log.WithError(err).Warnf("failed to store user event")
+		}
+	}
+
+	for _, g := range newSCIMGroups(r, users) {
+		if g.ID == group.ID {
+			writeSCIMResource(w, g, g.Meta.Version, http.StatusOK)
+		}
+	}
+}
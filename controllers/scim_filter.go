@@ -0,0 +1,254 @@
+package controllers
+
+import (
+	"fmt"
+	"strings"
+)
+
+// scimAttributes is the flattened view of a SCIM resource used to evaluate filters,
+// it maps the lower case attribute path (e.g. "username", "roles.value") to its values
+type scimAttributes map[string][]string
+
+func (sA scimAttributes) add(path string, values ...string) {
+	path = strings.ToLower(path)
+	sA[path] = append(sA[path], values...)
+}
+
+// scimFilter is a parsed SCIM filter expression as defined in RFC 7644 section 3.4.2.2
+type scimFilter interface {
+	matches(sA scimAttributes) bool
+}
+
+type scimComparison struct {
+	attr  string
+	op    string
+	value string
+}
+
+type scimLogical struct {
+	and         bool
+	left, right scimFilter
+}
+
+type scimNot struct {
+	filter scimFilter
+}
+
+func (c *scimComparison) matches(sA scimAttributes) bool {
+	values := sA[c.attr]
+	// a complex attribute compared without sub-attribute is compared through its value
+	if _, ok := sA[c.attr+".value"]; ok && len(values) == 0 {
+		values = sA[c.attr+".value"]
+	}
+	if c.op == "pr" {
+		return len(values) > 0
+	}
+	if c.op == "ne" {
+		for _, v := range values {
+			if strings.ToLower(v) == c.value {
+				return false
+			}
+		}
+		return true
+	}
+	for _, v := range values {
+		v = strings.ToLower(v)
+		var ok bool
+		switch c.op {
+		case "eq":
+			ok = v == c.value
+		case "co":
+			ok = strings.Contains(v, c.value)
+		case "sw":
+			ok = strings.HasPrefix(v, c.value)
+		case "ew":
+			ok = strings.HasSuffix(v, c.value)
+		case "gt":
+			ok = v > c.value
+		case "ge":
+			ok = v >= c.value
+		case "lt":
+			ok = v < c.value
+		case "le":
+			ok = v <= c.value
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *scimLogical) matches(sA scimAttributes) bool {
+	if l.and {
+		return l.left.matches(sA) && l.right.matches(sA)
+	}
+	return l.left.matches(sA) || l.right.matches(sA)
+}
+
+func (n *scimNot) matches(sA scimAttributes) bool {
+	return !n.filter.matches(sA)
+}
+
+// scimFilterParser is a recursive descent parser of the filter grammar, "and" takes precedence over "or"
+type scimFilterParser struct {
+	tokens []string
+	pos    int
+}
+
+// parseSCIMFilter parses a filter expression, the comparisons are case insensitive
+func parseSCIMFilter(filter string) (scimFilter, error) {
+	tokens, err := tokenizeSCIMFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty filter")
+	}
+	p := &scimFilterParser{tokens: tokens}
+	f, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.tokens) {
+		return nil, fmt.Errorf("unexpected token %s", p.tokens[p.pos])
+	}
+	return f, nil
+}
+
+func tokenizeSCIMFilter(filter string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(filter); {
+		switch c := filter[i]; {
+		case c == ' ':
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, string(c))
+			i++
+		case c == '"':
+			// quoted string, escaped quotes are allowed
+			j := i + 1
+			for ; j < len(filter) && filter[j] != '"'; j++ {
+				if filter[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(filter) {
+				return nil, fmt.Errorf("unterminated string in filter")
+			}
+			tokens = append(tokens, filter[i:j+1])
+			i = j + 1
+		default:
+			j := i
+			for ; j < len(filter) && filter[j] != ' ' && filter[j] != '(' && filter[j] != ')'; j++ {
+			}
+			tokens = append(tokens, filter[i:j])
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+func (p *scimFilterParser) next() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	t := p.tokens[p.pos]
+	p.pos++
+	return t
+}
+
+func (p *scimFilterParser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	return strings.ToLower(p.tokens[p.pos])
+}
+
+func (p *scimFilterParser) parseOr() (scimFilter, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "or" {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &scimLogical{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *scimFilterParser) parseAnd() (scimFilter, error) {
+	left, err := p.parseFactor()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "and" {
+		p.next()
+		right, err := p.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+		left = &scimLogical{and: true, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *scimFilterParser) parseFactor() (scimFilter, error) {
+	switch p.peek() {
+	case "not":
+		p.next()
+		if p.peek() != "(" {
+			return nil, fmt.Errorf("expected ( after not")
+		}
+		f, err := p.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+		return &scimNot{filter: f}, nil
+	case "(":
+		p.next()
+		f, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		return f, nil
+	case "":
+		return nil, fmt.Errorf("unexpected end of filter")
+	}
+
+	attr := scimAttributePath(p.next())
+	op := strings.ToLower(p.next())
+	switch op {
+	case "pr":
+		return &scimComparison{attr: attr, op: op}, nil
+	case "eq", "ne", "co", "sw", "ew", "gt", "ge", "lt", "le":
+	default:
+		return nil, fmt.Errorf("invalid operator %s", op)
+	}
+	value := p.next()
+	switch {
+	case value == "":
+		return nil, fmt.Errorf("missing value for %s", attr)
+	case strings.HasPrefix(value, `"`):
+		value = strings.ReplaceAll(value[1:len(value)-1], `\"`, `"`)
+	case value == "(" || value == ")":
+		return nil, fmt.Errorf("invalid value for %s", attr)
+	}
+	return &scimComparison{attr: attr, op: op, value: strings.ToLower(value)}, nil
+}
+
+// scimAttributePath normalizes an attribute path, removing the optional schema URN prefix
+func scimAttributePath(path string) string {
+	path = strings.ToLower(path)
+	for _, schema := range []string{scimUserSchema, scimGroupSchema} {
+		path = strings.TrimPrefix(path, strings.ToLower(schema)+":")
+	}
+	return path
+}
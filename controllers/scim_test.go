@@ -0,0 +1,402 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/goidp/models"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+)
+
+func TestParseSCIMFilter(t *testing.T) {
+	sA := scimAttributes{}
+	sA.add("id", "12")
+	sA.add("userName", "Jdoe")
+	sA.add("active", "true")
+	sA.add("roles.value", "ADMIN", "MONITOR")
+	sA.add("meta.lastModified", "2021-06-01T10:00:00Z")
+
+	tt := []struct {
+		filter  string
+		matches bool
+		err     bool
+	}{
+		{filter: `userName eq "jdoe"`, matches: true},
+		{filter: `urn:ietf:params:scim:schemas:core:2.0:User:userName eq "JDOE"`, matches: true},
+		{filter: `userName ne "jdoe"`, matches: false},
+		{filter: `userName sw "jd" and active eq true`, matches: true},
+		{filter: `userName ew "x" or roles eq "monitor"`, matches: true},
+		{filter: `roles.value eq "HELPDESK"`, matches: false},
+		{filter: `not (roles.value eq "HELPDESK")`, matches: true},
+		{filter: `(userName co "oe" or id eq "1") and meta.lastModified gt "2021-01-01T00:00:00Z"`, matches: true},
+		{filter: `userName eq "jdoe" and (id eq "1" or id eq "2")`, matches: false},
+		{filter: `emails pr`, matches: false},
+		{filter: `userName pr`, matches: true},
+		{filter: `userName eq`, err: true},
+		{filter: `userName like "jdoe"`, err: true},
+		{filter: `(userName eq "jdoe"`, err: true},
+		{filter: `userName eq "jdoe`, err: true},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.filter, func(t *testing.T) {
+			f, err := parseSCIMFilter(tc.filter)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected error parsing filter")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("could not parse filter: %s", err)
+			}
+			if f.matches(sA) != tc.matches {
+				t.Errorf("expected match %t", tc.matches)
+			}
+		})
+	}
+}
+
+func TestSCIMUserPatchOperations(t *testing.T) {
+	rL, _ := models.NewRoleList([]string{models.AdminRole.String(), models.MonitorRole.String()})
+	user := &models.User{Username: "jdoe", Roles: rL}
+
+	tt := []struct {
+		name       string
+		operations string
+		username   string
+		active     bool
+		roles      []string
+		err        bool
+	}{
+		{
+			name:       "replace username",
+			operations: `[{"op":"Replace","path":"userName","value":"john.doe"}]`,
+			username:   "john.doe",
+			active:     true,
+			roles:      []string{"ADMIN", "MONITOR"},
+		},
+		{
+			name:       "remove role through value filter",
+			operations: `[{"op":"remove","path":"roles[value eq \"admin\"]"}]`,
+			username:   "jdoe",
+			active:     true,
+			roles:      []string{"MONITOR"},
+		},
+		{
+			name:       "add roles",
+			operations: `[{"op":"add","path":"roles","value":[{"value":"HELPDESK"},{"value":"ADMIN"}]}]`,
+			username:   "jdoe",
+			active:     true,
+			roles:      []string{"ADMIN", "MONITOR", "HELPDESK"},
+		},
+		{
+			name:       "replace without path",
+			operations: `[{"op":"replace","value":{"active":"False","roles":[{"value":"MONITOR"}],"displayName":"John"}}]`,
+			username:   "jdoe",
+			active:     false,
+			roles:      []string{"MONITOR"},
+		},
+		{
+			name:       "remove username",
+			operations: `[{"op":"remove","path":"userName"}]`,
+			err:        true,
+		},
+		{
+			name:       "replace read-only attribute",
+			operations: `[{"op":"replace","path":"id","value":"7"}]`,
+			err:        true,
+		},
+		{
+			name:       "invalid operation",
+			operations: `[{"op":"move","path":"userName","value":"x"}]`,
+			err:        true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			var operations []scimPatchOperation
+			if err := json.Unmarshal([]byte(tc.operations), &operations); err != nil {
+				t.Fatalf("could not unmarshal operations: %s", err)
+			}
+			uU := newSCIMUserUpdate(user)
+			var err error
+			for _, op := range operations {
+				if err = uU.apply(op); err != nil {
+					break
+				}
+			}
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected error applying operations")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("could not apply operations: %s", err)
+			}
+			if uU.userName != tc.username || uU.active != tc.active {
+				t.Errorf("expected username %s and active %t; got %s and %t", tc.username, tc.active, uU.userName, uU.active)
+			}
+			var roles []string
+			for _, r := range uU.roles {
+				roles = append(roles, r.Value)
+			}
+			if len(roles) != len(tc.roles) {
+				t.Fatalf("expected roles %v; got %v", tc.roles, roles)
+			}
+			for i := range roles {
+				if roles[i] != tc.roles[i] {
+					t.Errorf("expected roles %v; got %v", tc.roles, roles)
+				}
+			}
+		})
+	}
+}
+
+func TestSCIMUserHandler(t *testing.T) {
+	s, err := SetupSuite()
+	if err != nil {
+		t.Fatalf("error setting up test suite: %s", err.Error())
+	}
+	a := NewApp(s.DB, &Config{})
+
+	tt := []struct {
+		name    string
+		id      string
+		method  string
+		headers map[string]string
+		body    string
+		status  int
+	}{
+		{
+			name:   "get user",
+			id:     "123",
+			method: http.MethodGet,
+			status: http.StatusOK,
+		},
+		{
+			name:    "get unchanged user",
+			id:      "123",
+			method:  http.MethodGet,
+			headers: map[string]string{"If-None-Match": `W/"3"`},
+			status:  http.StatusNotModified,
+		},
+		{
+			name:    "delete stale version",
+			id:      "123",
+			method:  http.MethodDelete,
+			headers: map[string]string{"If-Match": `W/"2"`},
+			status:  http.StatusPreconditionFailed,
+		},
+		{
+			name:   "patch without patch schema",
+			id:     "123",
+			method: http.MethodPatch,
+			body:   `{"Operations":[{"op":"replace","path":"userName","value":"x"}]}`,
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "delete the user with id 1",
+			id:     "1",
+			method: http.MethodDelete,
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "user not addressed by id",
+			id:     "jdoe",
+			method: http.MethodGet,
+			status: http.StatusNotFound,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tc.method, "/scim/v2/Users/"+tc.id, bytes.NewBufferString(tc.body))
+			req = mux.SetURLVars(req, map[string]string{"id": tc.id})
+			for k, v := range tc.headers {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+
+			if id, err := strconv.Atoi(tc.id); err == nil {
+				s.mock.ExpectQuery(regexp.QuoteMeta(
+					`SELECT * FROM "users" WHERE "users"."id" = $1 AND "users"."deleted_at" IS NULL ORDER BY "users"."id" LIMIT 1`)).
+					WithArgs(int64(id)).WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at", "username", "password", "version", "revision"}).
+					AddRow(id, time.Now(), time.Now(), "jdoe", "", 1, 3))
+				s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "user_roles" WHERE "user_roles"."user_id" = $1`)).
+					WithArgs(id).WillReturnRows(sqlmock.NewRows([]string{"user_id", "role_id"}).AddRow(id, 1))
+				s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "roles" WHERE "roles"."id" = $1 AND "roles"."deleted_at" IS NULL`)).
+					WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow(1, "ADMIN"))
+			}
+
+			a.SCIMUserHandler(rec, req)
+
+			if err := s.mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+			if rec.Code != tc.status {
+				t.Fatalf("expected status %d; got %d: %s", tc.status, rec.Code, rec.Body.String())
+			}
+			if tc.status == http.StatusNotModified {
+				return
+			}
+			if rec.Header().Get(headerContentType) != scimMediaType {
+				t.Errorf("expected content type %s; got %s", scimMediaType, rec.Header().Get(headerContentType))
+			}
+			if tc.status != http.StatusOK {
+				var e map[string]interface{}
+				if err = json.NewDecoder(rec.Body).Decode(&e); err != nil {
+					t.Fatalf("could not unmarshal response: %s", err)
+				}
+				if e["status"] != strconv.Itoa(tc.status) || e["schemas"] == nil {
+					t.Errorf("unexpected error status %v", e["status"])
+				}
+				return
+			}
+			var sU scimUser
+			if err = json.NewDecoder(rec.Body).Decode(&sU); err != nil {
+				t.Fatalf("could not unmarshal response: %s", err)
+			}
+			if sU.ID != "123" || sU.UserName != "jdoe" || len(sU.Roles) != 1 || sU.Roles[0].Value != "ADMIN" {
+				t.Errorf("unexpected user %+v", sU)
+			}
+			if rec.Header().Get("ETag") != `W/"3"` || sU.Meta.Version != `W/"3"` {
+				t.Errorf("expected version W/\"3\"; got %s", rec.Header().Get("ETag"))
+			}
+		})
+	}
+}
+
+func TestSCIMPatchUserVersion(t *testing.T) {
+	s, err := SetupSuite()
+	if err != nil {
+		t.Fatalf("error setting up test suite: %s", err.Error())
+	}
+	a := NewApp(s.DB, &Config{})
+
+	tt := []struct {
+		name string
+		body string
+		// conflict is true if the user changes between its read and its update
+		conflict bool
+		version  int
+		status   int
+	}{
+		{
+			name:    "attribute not managed by the identity provider",
+			body:    `{"schemas":["urn:ietf:params:scim:api:messages:2.0:PatchOp"],"Operations":[{"op":"replace","path":"displayName","value":"John Doe"}]}`,
+			version: 1,
+			status:  http.StatusOK,
+		},
+		{
+			// the tokens issued with the previous roles are revoked
+			name:    "roles changed",
+			body:    `{"schemas":["urn:ietf:params:scim:api:messages:2.0:PatchOp"],"Operations":[{"op":"replace","path":"roles","value":[{"value":"MONITOR"}]}]}`,
+			version: 2,
+			status:  http.StatusOK,
+		},
+		{
+			name:     "user changed concurrently",
+			body:     `{"schemas":["urn:ietf:params:scim:api:messages:2.0:PatchOp"],"Operations":[{"op":"replace","path":"roles","value":[{"value":"MONITOR"}]}]}`,
+			conflict: true,
+			status:   http.StatusPreconditionFailed,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			s.mock.ExpectQuery(regexp.QuoteMeta(
+				`SELECT * FROM "users" WHERE "users"."id" = $1 AND "users"."deleted_at" IS NULL ORDER BY "users"."id" LIMIT 1`)).
+				WithArgs(int64(123)).WillReturnRows(sqlmock.NewRows([]string{"id", "username", "version", "revision"}).
+				AddRow(123, "jdoe", 1, 3))
+			s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "user_roles" WHERE "user_roles"."user_id" = $1`)).
+				WithArgs(123).WillReturnRows(sqlmock.NewRows([]string{"user_id", "role_id"}).AddRow(123, 1))
+			s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "roles" WHERE "roles"."id" = $1 AND "roles"."deleted_at" IS NULL`)).
+				WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow(1, "ADMIN"))
+			s.mock.ExpectBegin()
+			if tc.conflict {
+				expectRevision(s, 123, 3, 0)
+				s.mock.ExpectRollback()
+			} else {
+				expectRevision(s, 123, 3, 1)
+				s.mock.ExpectExec(regexp.QuoteMeta(
+					`UPDATE "users" SET "updated_at"=$1,"username"=$2,"version"=$3,"revision"=$4 WHERE "users"."deleted_at" IS NULL AND "id" = $5`)).
+					WithArgs(sqlmock.AnyArg(), "jdoe", tc.version, 4, 123).WillReturnResult(sqlmock.NewResult(0, 1))
+				s.mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "roles"`)).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+				s.mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "user_roles"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+				s.mock.ExpectExec(regexp.QuoteMeta(`UPDATE "users" SET "updated_at"=$1`)).WillReturnResult(sqlmock.NewResult(0, 1))
+				s.mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "roles"`)).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+				s.mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "user_roles"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+				s.mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "user_roles"`)).WillReturnResult(sqlmock.NewResult(0, 0))
+				s.mock.ExpectCommit()
+				expectEvent(s)
+			}
+
+			req, _ := http.NewRequest(http.MethodPatch, "/scim/v2/Users/123", bytes.NewBufferString(tc.body))
+			req = mux.SetURLVars(req, map[string]string{"id": "123"})
+			rec := httptest.NewRecorder()
+			a.SCIMUserHandler(rec, req)
+
+			if err := s.mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+			if rec.Code != tc.status {
+				t.Fatalf("expected status %d; got %d: %s", tc.status, rec.Code, rec.Body.String())
+			}
+			if tc.status == http.StatusOK && rec.Header().Get("ETag") != `W/"4"` {
+				t.Errorf("expected version W/\"4\"; got %s", rec.Header().Get("ETag"))
+			}
+		})
+	}
+}
+
+func TestSCIMMiddleware(t *testing.T) {
+	s, err := SetupSuite()
+	if err != nil {
+		t.Fatalf("error setting up test suite: %s", err.Error())
+	}
+	a := NewApp(s.DB, &Config{Secret: "s3cret", AccessTokenExpireTime: time.Minute})
+
+	adminRoles, _ := models.NewRoleList([]string{models.AdminRole.String()})
+	monitorRoles, _ := models.NewRoleList([]string{models.MonitorRole.String()})
+	token := func(roles models.RoleList) string {
+		t, _ := generateToken(newCustomClaims(&models.User{Username: "hr", Roles: roles}, models.InternalDomain, time.Minute, nil, ""), a.config.Secret, nil)
+		return t
+	}
+
+	tt := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{name: "no token", status: http.StatusUnauthorized},
+		{name: "non admin token", token: token(monitorRoles), status: http.StatusForbidden},
+		{name: "admin token", token: token(adminRoles), status: http.StatusOK},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, "/scim/v2/ServiceProviderConfig", nil)
+			if tc.token != "" {
+				req.Header.Set(headerAuthorization, "Bearer "+tc.token)
+			}
+			rec := httptest.NewRecorder()
+			a.router.ServeHTTP(rec, req)
+			if rec.Code != tc.status {
+				t.Fatalf("expected status %d; got %d", tc.status, rec.Code)
+			}
+			if rec.Header().Get(headerContentType) != scimMediaType {
+				t.Errorf("expected content type %s; got %s", scimMediaType, rec.Header().Get(headerContentType))
+			}
+		})
+	}
+}
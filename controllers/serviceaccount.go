@@ -0,0 +1,334 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/goidp/models"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/google/jsonapi"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+const clientAssertionTypeJWTBearer = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+// ServiceAccountResource is the jsonapi representation of a service account
+type ServiceAccountResource struct {
+	ID          string   `jsonapi:"primary,serviceaccount,omitempty"`
+	Name        string   `jsonapi:"attr,name"`
+	Description string   `jsonapi:"attr,description,omitempty"`
+	Owner       string   `jsonapi:"attr,owner,omitempty"`
+	Team        string   `jsonapi:"attr,team,omitempty"`
+	Roles       []string `jsonapi:"attr,roles,omitempty"`
+	PublicKeys  []string `jsonapi:"attr,public_keys,omitempty"`
+	// CertificateThumbprints are the x5t#S256 thumbprints of the client certificates of the account
+	CertificateThumbprints []string `jsonapi:"attr,certificate_thumbprints,omitempty"`
+	Disabled               *bool    `jsonapi:"attr,disabled,omitempty"`
+	HasSecret              bool     `jsonapi:"attr,has_secret"`
+	// RotateSecret requests a new client secret, which is returned only once in Secret
+	RotateSecret bool   `jsonapi:"attr,rotate_secret,omitempty"`
+	Secret       string `jsonapi:"attr,secret,omitempty"`
+}
+
+func newServiceAccountResource(s *models.ServiceAccount) *ServiceAccountResource {
+	disabled := s.Disabled
+	return &ServiceAccountResource{
+		ID:                     strconv.Itoa(int(s.ID)),
+		Name:                   s.Name,
+		Description:            s.Description,
+		Owner:                  s.Owner,
+		Team:                   s.Team,
+		Roles:                  s.Roles,
+		PublicKeys:             s.PublicKeys,
+		CertificateThumbprints: s.CertificateThumbprints,
+		Disabled:               &disabled,
+		HasSecret:              s.SecretHash != "",
+	}
+}
+
+// apply copies the provided attributes into the service account, it returns the new client secret if
+// one has been requested
+func (sR *ServiceAccountResource) apply(s *models.ServiceAccount) (string, error) {
+	if sR.Name != "" {
+		if _, err := strconv.Atoi(sR.Name); err == nil {
+			return "", errors.New("name cannot be a number")
+		}
+		s.Name = sR.Name
+	}
+	if sR.Description != "" {
+		s.Description = sR.Description
+	}
+	if sR.Owner != "" {
+		s.Owner = sR.Owner
+	}
+	if sR.Team != "" {
+		s.Team = sR.Team
+	}
+	if sR.Roles != nil {
+		rL, err := models.NewRoleList(sR.Roles)
+		if err != nil {
+			return "", err
+		}
+		s.Roles = nil
+		for _, r := range rL {
+			s.Roles = append(s.Roles, models.UserRole(r.ID).String())
+		}
+	}
+	if sR.PublicKeys != nil {
+		// make sure the keys are usable before storing them
+		for _, k := range sR.PublicKeys {
+			if _, err := parsePublicKeyPEM([]byte(k)); err != nil {
+				return "", err
+			}
+		}
+		s.PublicKeys = sR.PublicKeys
+	}
+	if sR.CertificateThumbprints != nil {
+		for _, t := range sR.CertificateThumbprints {
+			if b, err := base64.RawURLEncoding.DecodeString(t); err != nil || len(b) != sha256.Size {
+				return "", fmt.Errorf("invalid certificate thumbprint %s", t)
+			}
+		}
+		s.CertificateThumbprints = sR.CertificateThumbprints
+	}
+	if sR.Disabled != nil {
+		s.Disabled = *sR.Disabled
+	}
+	if !sR.RotateSecret {
+		return "", nil
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	secret := base64.RawURLEncoding.EncodeToString(b)
+	s.SetSecret(secret)
+	return secret, nil
+}
+
+// serviceAccountUser returns the token subject of the service account
+func serviceAccountUser(s *models.ServiceAccount) *models.User {
+	rL, _ := s.RoleList()
+	return &models.User{Username: s.Name, Roles: rL, Version: s.Version}
+}
+
+// verifyClientAssertion validates the RFC 7523 client assertion of the service account: it must be
+// signed with one of the account keys, issued by and for the account, meant for the token endpoint
+// and never seen before
+func (a *App) verifyClientAssertion(r *http.Request, s *models.ServiceAccount, assertion string) error {
+	audiences := []string{requestURL(r, r.URL.Path)}
+	if a.config.Audience != "" {
+		audiences = append(audiences, a.config.Audience)
+	}
+	tI, err := newTrustedIssuer(&models.TrustedIssuer{Issuer: s.Name, PublicKeys: s.PublicKeys, Audiences: audiences})
+	if err != nil {
+		return err
+	}
+	claims, err := tI.verify(assertion)
+	if err != nil {
+		return err
+	}
+	if sub, _ := claims["sub"].(string); sub != s.Name {
+		return errors.New("client assertion subject does not match the client")
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return errors.New("client assertion without expiration")
+	}
+	jti, _ := claims["jti"].(string)
+	if jti == "" {
+		return errors.New("client assertion without jti")
+	}
+	fresh, err := a.Nonces.Use("assertion:"+s.Name+":"+jti, time.Unix(int64(exp), 0))
+	if err != nil {
+		return err
+	}
+	if !fresh {
+		return errors.New("client assertion already used")
+	}
+	return nil
+}
+
+// authenticateClient authenticates the client of the client credentials grant, with its certificate,
+// its secret (client_secret_basic or client_secret_post) or a client assertion (private_key_jwt). The
+// clients are the service accounts, looked up by name only, a client certificate is accepted only if its
+// thumbprint is registered for the account.
+func (a *App) authenticateClient(r *http.Request, ip string) (*models.User, string, *oauthError) {
+	clientID, secret, basic := r.BasicAuth()
+	if !basic {
+		clientID = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+	assertion := r.PostForm.Get("client_assertion")
+	cert := clientCertificate(r)
+	switch {
+	case cert != nil:
+		if clientID != "" && clientID != cert.Subject.CommonName {
+			return nil, "", newOAuthError(http.StatusUnauthorized, "invalid_client", "client certificate not issued to %s", clientID)
+		}
+		clientID = cert.Subject.CommonName
+	case assertion != "":
+		if r.PostForm.Get("client_assertion_type") != clientAssertionTypeJWTBearer {
+			return nil, "", newOAuthError(http.StatusUnauthorized, "invalid_client", "unsupported client assertion type")
+		}
+		claims := jwt.MapClaims{}
+		if _, _, err := new(jwt.Parser).ParseUnverified(assertion, claims); err != nil {
+			return nil, "", newOAuthError(http.StatusUnauthorized, "invalid_client", "invalid client assertion: %s", err.Error())
+		}
+		iss, _ := claims["iss"].(string)
+		if clientID != "" && clientID != iss {
+			return nil, "", newOAuthError(http.StatusUnauthorized, "invalid_client", "client assertion not issued by %s", clientID)
+		}
+		clientID = iss
+	case clientID == "" || secret == "":
+		return nil, "", newOAuthError(http.StatusUnauthorized, "invalid_client", "client authentication required")
+	}
+
+	s, err := a.ServiceAccounts.GetServiceAccountByName(clientID)
+	switch err.(type) {
+	case *models.DBError:
+		return nil, "", newOAuthError(http.StatusInternalServerError, "server_error", "internal error, retry later")
+	case *models.NotFoundError:
+		if err := a.Events.CreateUnsuccessfulLoginEvent(clientID, models.ServiceAccountDomain, ip); err != nil {
+			log.WithError(err).Warnf("failed to store login attempt")
+		}
+		return nil, "", newOAuthError(http.StatusUnauthorized, "invalid_client", "unknown client %s", clientID)
+	}
+
+	switch {
+	case s.Disabled:
+		err = fmt.Errorf("client %s disabled", clientID)
+	case cert != nil:
+		if !s.HasCertificate(certificateThumbprint(cert)) {
+			err = fmt.Errorf("client certificate not registered for client %s", clientID)
+		}
+	case assertion != "":
+		switch err = a.verifyClientAssertion(r, s, assertion); err.(type) {
+		case nil:
+		case *models.DBError:
+			return nil, "", newOAuthError(http.StatusInternalServerError, "server_error", "internal error, retry later")
+		default:
+			err = fmt.Errorf("invalid client assertion: %s", err.Error())
+		}
+	case !s.VerifySecret(secret):
+		err = errors.New("invalid client secret")
+	}
+	if err != nil {
+		if err := a.Events.CreateUnsuccessfulLoginEvent(clientID, models.ServiceAccountDomain, ip); err != nil {
+			log.WithError(err).Warnf("failed to store login attempt")
+		}
+		return nil, "", newOAuthError(http.StatusUnauthorized, "invalid_client", "%s", err.Error())
+	}
+	return serviceAccountUser(s), models.ServiceAccountDomain, nil
+}
+
+// ServiceAccountsHandler lists (GET) or creates (POST) the service accounts
+func (a *App) ServiceAccountsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		list, err := a.ServiceAccounts.GetServiceAccounts()
+		if err != nil {
+			jsonapiError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		resources := make([]*ServiceAccountResource, 0)
+		for _, s := range list {
+			resources = append(resources, newServiceAccountResource(s))
+		}
+		jsonapiSuccess(w, resources, http.StatusOK)
+	case http.MethodPost:
+		var requestBody ServiceAccountResource
+		if err := jsonapi.UnmarshalPayload(r.Body, &requestBody); err != nil {
+			jsonapiError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		var s models.ServiceAccount
+		secret, err := requestBody.apply(&s)
+		if err != nil {
+			jsonapiError(w, http.StatusBadRequest, fmt.Sprintf("invalid service account: %s", err.Error()))
+			return
+		}
+		switch err := a.ServiceAccounts.Create(&s).(type) {
+		case *models.UserError:
+			jsonapiError(w, http.StatusBadRequest, err.Error())
+			return
+		case *models.DBError:
+			jsonapiError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err = a.Events.CreateServiceAccountEvent(r.Method, s.Name); err != nil {
+			log.WithError(err).Warnf("failed to store service account event")
+		}
+		sR := newServiceAccountResource(&s)
+		sR.Secret = secret
+		jsonapiSuccess(w, sR, http.StatusCreated)
+	}
+}
+
+// ServiceAccountHandler reads (GET), updates (PATCH) or removes (DELETE) a service account, any change
+// revokes the tokens issued to the account
+func (a *App) ServiceAccountHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	s, err := a.ServiceAccounts.GetServiceAccount(id)
+	switch err.(type) {
+	case *models.NotFoundError:
+		jsonapiError(w, http.StatusNotFound, err.Error())
+		return
+	case *models.DBError:
+		jsonapiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	var secret string
+	switch r.Method {
+	case http.MethodGet:
+		jsonapiSuccess(w, newServiceAccountResource(s), http.StatusOK)
+		return
+	case http.MethodPatch:
+		var requestBody ServiceAccountResource
+		if err = jsonapi.UnmarshalPayload(r.Body, &requestBody); err != nil {
+			jsonapiError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		// the name is the subject of the tokens and the client id, it cannot change
+		if requestBody.Name != "" && requestBody.Name != s.Name {
+			jsonapiError(w, http.StatusBadRequest, "invalid service account: name cannot be changed")
+			return
+		}
+		if secret, err = requestBody.apply(s); err != nil {
+			jsonapiError(w, http.StatusBadRequest, fmt.Sprintf("invalid service account: %s", err.Error()))
+			return
+		}
+		err = a.ServiceAccounts.UpdateServiceAccount(s)
+	case http.MethodDelete:
+		err = a.ServiceAccounts.DeleteServiceAccount(s)
+	}
+	switch err.(type) {
+	case *models.NotFoundError:
+		jsonapiError(w, http.StatusNotFound, err.Error())
+		return
+	case *models.UserError:
+		jsonapiError(w, http.StatusBadRequest, err.Error())
+		return
+	case *models.DBError:
+		jsonapiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err = a.Events.CreateServiceAccountEvent(r.Method, s.Name); err != nil {
+		log.WithError(err).Warnf("failed to store service account event")
+	}
+	if r.Method == http.MethodDelete {
+		jsonapiNoContentSuccess(w)
+		return
+	}
+	sR := newServiceAccountResource(s)
+	sR.Secret = secret
+	jsonapiSuccess(w, sR, http.StatusOK)
+}
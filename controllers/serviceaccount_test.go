@@ -0,0 +1,343 @@
+package controllers
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"github.com/goidp/models"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/golang-jwt/jwt"
+	"github.com/google/jsonapi"
+	"github.com/google/uuid"
+)
+
+var serviceAccountColumns = []string{"id", "name", "owner", "team", "roles", "secret_hash", "public_keys", "certificate_thumbprints", "disabled", "version"}
+
+func expectServiceAccount(s *Suite, name string, sa *models.ServiceAccount) {
+	rows := sqlmock.NewRows(serviceAccountColumns)
+	if sa != nil {
+		roles, _ := json.Marshal(sa.Roles)
+		keys, _ := json.Marshal(sa.PublicKeys)
+		thumbprints, _ := json.Marshal(sa.CertificateThumbprints)
+		rows.AddRow(sa.ID, sa.Name, sa.Owner, sa.Team, string(roles), sa.SecretHash, string(keys), string(thumbprints), sa.Disabled, sa.Version)
+	}
+	s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "service_accounts" WHERE name = $1 AND "service_accounts"."deleted_at" IS NULL LIMIT 1`)).
+		WithArgs(name).WillReturnRows(rows)
+}
+
+// expectEvent mocks the insertion of an event
+func expectEvent(s *Suite) {
+	insertArgs := []driver.Value{sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()}
+	s.mock.ExpectBegin()
+	s.mock.ExpectQuery(regexp.QuoteMeta(
+		`INSERT INTO "events" ("created_at","updated_at","deleted_at","username","activated","description","modified","authn_domain","severity") VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9) RETURNING "id"`)).
+		WithArgs(insertArgs...).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	s.mock.ExpectCommit()
+}
+
+func TestServiceAccountsHandler(t *testing.T) {
+	s, err := SetupSuite()
+	if err != nil {
+		t.Fatalf("error setting up test suite: %s", err.Error())
+	}
+	a := NewApp(s.DB, &Config{})
+
+	tt := []struct {
+		name      string
+		body      string
+		checked   bool
+		userCount int
+		created   bool
+		status    int
+	}{
+		{
+			name:    "create a service account with a secret",
+			body:    `{"data":{"type":"serviceaccount","attributes":{"name":"backup","owner":"jdoe","team":"storage","roles":["monitor"],"rotate_secret":true}}}`,
+			checked: true,
+			created: true,
+			status:  http.StatusCreated,
+		},
+		{
+			name:   "invalid role",
+			body:   `{"data":{"type":"serviceaccount","attributes":{"name":"backup","roles":["owner"]}}}`,
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "invalid public key",
+			body:   `{"data":{"type":"serviceaccount","attributes":{"name":"backup","public_keys":["not a key"]}}}`,
+			status: http.StatusBadRequest,
+		},
+		{
+			name:      "name of a user",
+			body:      `{"data":{"type":"serviceaccount","attributes":{"name":"admin","public_keys":["` + strings.ReplaceAll(PKIX_Public_Key, "\n", `\n`) + `"]}}}`,
+			checked:   true,
+			userCount: 1,
+			status:    http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.checked {
+				s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT count(*) FROM "service_accounts" WHERE name = $1`)).
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+				s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT count(*) FROM "users" WHERE username = $1`)).
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(tc.userCount))
+			}
+			if tc.created {
+				s.mock.ExpectBegin()
+				s.mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "service_accounts"`)).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+				s.mock.ExpectCommit()
+				expectEvent(s)
+			}
+
+			req, _ := http.NewRequest(http.MethodPost, "/v1.0/serviceaccount", bytes.NewBufferString(tc.body))
+			rec := httptest.NewRecorder()
+			a.ServiceAccountsHandler(rec, req)
+
+			if err := s.mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+			if rec.Code != tc.status {
+				t.Fatalf("expected status %d; got %d: %s", tc.status, rec.Code, rec.Body.String())
+			}
+			if tc.created {
+				var sR ServiceAccountResource
+				if err := jsonapi.UnmarshalPayload(rec.Body, &sR); err != nil {
+					t.Fatalf("could not unmarshal response: %s", err)
+				}
+				if sR.Secret == "" || !sR.HasSecret || sR.Owner != "jdoe" || sR.Team != "storage" {
+					t.Errorf("unexpected service account %+v", sR)
+				}
+				if len(sR.Roles) != 1 || sR.Roles[0] != models.MonitorRole.String() {
+					t.Errorf("unexpected roles %v", sR.Roles)
+				}
+			}
+		})
+	}
+}
+
+func TestClientCredentialsHandlerServiceAccount(t *testing.T) {
+	s, err := SetupSuite()
+	if err != nil {
+		t.Fatalf("error setting up test suite: %s", err.Error())
+	}
+	a := NewApp(s.DB, &Config{AccessTokenExpireTime: 5 * time.Minute})
+	a.config.SignKey, _ = ReadPrivateKey(PKCS1_Private_Key)
+	a.config.VerifyKey = &a.config.SignKey.PublicKey
+
+	account := &models.ServiceAccount{Name: "backup", Roles: []string{models.MonitorRole.String()}, PublicKeys: []string{PKIX_Public_Key}, Version: 3}
+	account.ID = 1
+	account.SetSecret("s3cret")
+	disabled := *account
+	disabled.Disabled = true
+
+	newAssertion := func(claims jwt.MapClaims) string {
+		assertion, _ := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(a.config.SignKey)
+		return assertion
+	}
+	replayed := newAssertion(jwt.MapClaims{"iss": "backup", "sub": "backup", "aud": "http://idp/v1.0/token", "exp": time.Now().Add(time.Minute).Unix(), "jti": uuid.New().String()})
+
+	tt := []struct {
+		name    string
+		form    url.Values
+		basic   []string
+		account *models.ServiceAccount
+		lookup  bool
+		// asserted is true if the client assertion reaches the replay check, replayed if it has been used
+		// before, possibly on another replica
+		asserted bool
+		replayed bool
+		status   int
+	}{
+		{
+			name:    "client secret basic",
+			basic:   []string{"backup", "s3cret"},
+			account: account,
+			lookup:  true,
+			status:  http.StatusOK,
+		},
+		{
+			name:    "client secret post",
+			form:    url.Values{"client_id": {"backup"}, "client_secret": {"s3cret"}},
+			account: account,
+			lookup:  true,
+			status:  http.StatusOK,
+		},
+		{
+			name:    "wrong client secret",
+			basic:   []string{"backup", "guess"},
+			account: account,
+			lookup:  true,
+			status:  http.StatusUnauthorized,
+		},
+		{
+			name:    "disabled service account",
+			basic:   []string{"backup", "s3cret"},
+			account: &disabled,
+			lookup:  true,
+			status:  http.StatusUnauthorized,
+		},
+		{
+			name:   "unknown service account",
+			basic:  []string{"restore", "s3cret"},
+			lookup: true,
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:   "no client authentication",
+			form:   url.Values{"client_id": {"backup"}},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:     "client assertion",
+			form:     url.Values{"client_assertion_type": {clientAssertionTypeJWTBearer}, "client_assertion": {replayed}},
+			account:  account,
+			lookup:   true,
+			asserted: true,
+			status:   http.StatusOK,
+		},
+		{
+			name:     "replayed client assertion",
+			form:     url.Values{"client_assertion_type": {clientAssertionTypeJWTBearer}, "client_assertion": {replayed}},
+			account:  account,
+			lookup:   true,
+			asserted: true,
+			replayed: true,
+			status:   http.StatusUnauthorized,
+		},
+		{
+			name: "client assertion for another audience",
+			form: url.Values{"client_assertion_type": {clientAssertionTypeJWTBearer}, "client_assertion": {newAssertion(jwt.MapClaims{
+				"iss": "backup", "sub": "backup", "aud": "http://another/token", "exp": time.Now().Add(time.Minute).Unix(), "jti": uuid.New().String()})}},
+			account: account,
+			lookup:  true,
+			status:  http.StatusUnauthorized,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			form := url.Values{"grant_type": {grantTypeClientCredentials}}
+			for k, v := range tc.form {
+				form[k] = v
+			}
+			req, _ := http.NewRequest(http.MethodPost, "http://idp/v1.0/token", strings.NewReader(form.Encode()))
+			req.Header.Set(headerContentType, "application/x-www-form-urlencoded")
+			if tc.basic != nil {
+				req.SetBasicAuth(tc.basic[0], tc.basic[1])
+			}
+			rec := httptest.NewRecorder()
+
+			if tc.lookup {
+				name := "backup"
+				if tc.basic != nil {
+					name = tc.basic[0]
+				}
+				expectServiceAccount(s, name, tc.account)
+				if tc.asserted {
+					expectNonce(s, tc.replayed)
+				}
+				// the successful and the failed logins are recorded alike
+				expectEvent(s)
+			}
+
+			a.TokenHandler(rec, req)
+
+			if err := s.mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+			if rec.Code != tc.status {
+				t.Fatalf("expected status %d; got %d: %s", tc.status, rec.Code, rec.Body.String())
+			}
+			if tc.status != http.StatusOK {
+				return
+			}
+			var tR tokenResponse
+			if err := json.NewDecoder(rec.Body).Decode(&tR); err != nil {
+				t.Fatalf("could not decode response: %s", err)
+			}
+			claims, err := getClaimsFromAccessToken(tR.AccessToken, "", a.config.VerifyKey)
+			if err != nil {
+				t.Fatalf("could not decode access token: %s", err)
+			}
+			if claims.Subject != "backup" || claims.Azt != models.ServiceAccountDomain || claims.Ver != 3 || tR.RefreshToken != "" {
+				t.Errorf("unexpected claims %+v", claims)
+			}
+			if len(claims.Roles) != 1 || claims.Roles[0] != models.MonitorRole.String() {
+				t.Errorf("unexpected roles %v", claims.Roles)
+			}
+		})
+	}
+}
+
+func TestJWTMiddlewareServiceAccount(t *testing.T) {
+	s, err := SetupSuite()
+	if err != nil {
+		t.Fatalf("error setting up test suite: %s", err.Error())
+	}
+	a := NewApp(s.DB, &Config{})
+	a.config.SignKey, _ = ReadPrivateKey(PKCS1_Private_Key)
+	a.config.VerifyKey = &a.config.SignKey.PublicKey
+	account := &models.ServiceAccount{Name: "backup", Roles: []string{models.MonitorRole.String()}, Version: 3}
+	token, _ := generateToken(newCustomClaims(serviceAccountUser(account), models.ServiceAccountDomain, time.Minute, nil, ""), "", a.config.SignKey)
+
+	tt := []struct {
+		name    string
+		version int
+		found   bool
+		status  int
+	}{
+		{
+			name:    "unchanged service account",
+			version: 3,
+			found:   true,
+			status:  http.StatusOK,
+		},
+		{
+			name:    "updated service account",
+			version: 4,
+			found:   true,
+			status:  http.StatusUnauthorized,
+		},
+		{
+			name:   "deleted service account",
+			status: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.found {
+				updated := *account
+				updated.Version = tc.version
+				expectServiceAccount(s, "backup", &updated)
+			} else {
+				expectServiceAccount(s, "backup", nil)
+			}
+
+			req, _ := http.NewRequest(http.MethodGet, "/v1.0/event", nil)
+			req.Header.Set(headerAuthorization, "Bearer "+token)
+			rec := httptest.NewRecorder()
+			a.jwtMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}), "event").ServeHTTP(rec, req)
+
+			if err := s.mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+			if rec.Code != tc.status {
+				t.Errorf("expected status %d; got %d: %s", tc.status, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/goidp/models"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/google/jsonapi"
 	"github.com/gorilla/mux"
@@ -30,24 +31,30 @@ func (a *App) SessionHandler(w http.ResponseWriter, r *http.Request) {
 type CreateSessionHandlerResponse struct {
 	AccessToken string
 	RenewToken  string
+	// TokenType is DPoP if the tokens are bound to the DPoP key of the client, Bearer otherwise
+	TokenType string
 }
 
 func (sessionHandlerResponse CreateSessionHandlerResponse) JSONAPIMeta() *jsonapi.Meta {
 	return &jsonapi.Meta{
 		"access_token": sessionHandlerResponse.AccessToken,
 		"renew_token":  sessionHandlerResponse.RenewToken,
+		"token_type":   sessionHandlerResponse.TokenType,
 	}
 }
 
 type CreateSessionHandlerRequest struct {
-	ID          string `jsonapi:"primary,session,omitempty"`
+	ID string `jsonapi:"primary,session,omitempty"`
+	// Username is the username or the verified email of the user
 	Username    string `jsonapi:"attr,username,omitempty"`
 	Password    string `jsonapi:"attr,password,omitempty"`
 	AccessToken string `jsonapi:"attr,access_token,omitempty"` // AccessToken is provided in case of m2m authentication
+	// Audience and Scope restrict the services and the operations the issued tokens are accepted for
+	Audience []string `jsonapi:"attr,audience,omitempty"`
+	Scope    string   `jsonapi:"attr,scope,omitempty"`
 }
 
 func (a *App) CreateSessionHandler(w http.ResponseWriter, r *http.Request) {
-	var claims customClaims
 	var user = &models.User{}
 	var domain string
 
@@ -61,6 +68,14 @@ func (a *App) CreateSessionHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// the tokens are bound to the DPoP key of the client, if it sent a proof
+	jkt, err := a.dpopBinding(r)
+	if err != nil {
+		log.WithError(err).Info("invalid DPoP proof")
+		writeDPoPError(w, err)
+		return
+	}
+
 	// we accept a JWT both if it passed as Auth header and in request body
 	var t string
 	if requestBody.AccessToken != "" {
@@ -72,7 +87,7 @@ func (a *App) CreateSessionHandler(w http.ResponseWriter, r *http.Request) {
 	ip, _ := getIP(r)
 	if t != "" {
 		// authentication with token
-		decodedClaims, err := authorizeM2MRequest(t, a.config.TrustedPublicKeys)
+		decodedClaims, err := a.issuers.authorize(t)
 		if err != nil {
 			log.WithError(err).Warnf("authorization failure")
 			jsonapiError(w, http.StatusUnauthorized, "supplied token is not valid")
@@ -91,11 +106,18 @@ func (a *App) CreateSessionHandler(w http.ResponseWriter, r *http.Request) {
 			user.Roles = roles
 		}
 		domain = models.ExternalDomain
-		a.extUsers[user.Username] = roles
+		if err := a.recordExternalIdentity(user, decodedClaims.Issuer, decodedClaims.Subject); err != nil {
+			jsonapiError(w, http.StatusInternalServerError, "internal error, retry later")
+			return
+		}
+	} else if a.isBreakGlass(requestBody.Username) {
+		// the emergency account is checked before the DB, which may be unreachable
+		a.breakGlassSession(w, r, requestBody.Password, requestBody.Audience, requestBody.Scope, jkt)
+		return
 	} else {
 		// authentication with credentials
 		var ok bool
-		user, ok = a.Users.GetAndValidateUser(requestBody.Username, requestBody.Password)
+		user, domain, ok = a.authenticate(requestBody.Username, requestBody.Password)
 		if !ok {
 			err := a.Events.CreateUnsuccessfulLoginEvent(requestBody.Username, models.InternalDomain, ip)
 			if err != nil {
@@ -104,54 +126,126 @@ func (a *App) CreateSessionHandler(w http.ResponseWriter, r *http.Request) {
 			jsonapiError(w, http.StatusUnauthorized, "user not allowed")
 			return
 		}
-		domain = models.InternalDomain
+		if domain != models.InternalDomain && user.ID == 0 {
+			// users authenticated by a backend without a local shadow copy are renewed
+			// in the same way as the external ones
+			if err := a.recordExternalIdentity(user, domain, user.Username); err != nil {
+				jsonapiError(w, http.StatusInternalServerError, "internal error, retry later")
+				return
+			}
+		}
+	}
+
+	a.createSession(w, r, user, domain, validate, requestBody.Audience, requestBody.Scope, jkt)
+}
+
+// authenticate checks the credentials against the local users first, then against the
+// configured authentication backends
+func (a *App) authenticate(username, password string) (*models.User, string, bool) {
+	if user, ok := a.Users.GetAndValidateUser(username, password); ok {
+		return user, models.InternalDomain, true
 	}
+	return a.Backends.Authenticate(username, password)
+}
 
+// createSession records the successful login and the new session of the active user, then writes the
+// access and renew tokens issued to the authenticated user, restricted to the given audience and scope and bound to
+// the DPoP key with the jkt thumbprint, if any
+func (a *App) createSession(w http.ResponseWriter, r *http.Request, user *models.User, domain string, validate bool, audience []string, scope, jkt string) {
+	ip, _ := getIP(r)
+	// the backends and the identity providers authenticate the shadow users whatever their state
+	if !user.Active() {
+		if err := a.Events.CreateUnsuccessfulLoginEvent(user.Username, domain, ip); err != nil {
+			log.WithError(err).Warnf("failed to store login attempt")
+		}
+		log.Infof("login of %s user %s", user.State(), user.Username)
+		jsonapiError(w, http.StatusUnauthorized, fmt.Sprintf("user %s", user.State()))
+		return
+	}
 	err := a.Events.CreateSuccessfulLoginEvent(user.Username, domain, ip)
 	if err != nil {
 		log.WithError(err).Warnf("failed to store login attempt")
 	}
 
+	// if validate set to true, returned jwt token expires immediately, so that it cannot be used for
+	// subsequent requests, otherwise we create the token with default expire time
+	expire := a.config.AccessTokenExpireTime
+	var sid string
 	if validate {
-		// if validate set to true, returned jwt token expires immediately, so that it cannot be used for
-		// subsequent requests
-		claims = newCustomClaims(user, domain, 0)
+		expire = 0
 	} else {
-		// if validate set to false, we create the token with default expire time
-		claims = newCustomClaims(user, domain, a.config.AccessTokenExpireTime)
+		s, err := a.startSession(r, user, domain)
+		if err == errSessionLimit {
+			jsonapiError(w, http.StatusForbidden, err.Error())
+			return
+		} else if err != nil {
+			jsonapiError(w, http.StatusInternalServerError, "internal error, retry later")
+			return
+		}
+		sid = s.SID
 	}
 
-	signedAccessToken, err := generateToken(claims, a.config.Secret, a.config.SignKey)
+	var responseBody CreateSessionHandlerResponse
+	responseBody.AccessToken, responseBody.RenewToken, err = a.issueTokens(user, domain, expire, audience, scope, jkt, sid)
 	if err != nil {
 		jsonapiError(w, http.StatusInternalServerError, err.Error())
-		err = a.Events.CreateJWTEvent(user.Username, models.InternalDomain)
-		if err != nil {
-			log.WithError(err).Warnf("failed to store JWT event")
-		}
 		return
 	}
-	w.Header().Set(headerAuthorization, fmt.Sprintf("Bearer %v", signedAccessToken))
+	responseBody.TokenType = tokenType(jkt)
+	w.Header().Set(headerAuthorization, fmt.Sprintf("%s %v", responseBody.TokenType, responseBody.AccessToken))
+	jsonapiSuccessMetaOnly(w, &responseBody, http.StatusOK)
+}
 
-	var responseBody CreateSessionHandlerResponse
-	responseBody.AccessToken = signedAccessToken
+// issueTokens signs the access token and, if the renew functionality is configured, the renew token
+// of the authenticated user for the session sid
+func (a *App) issueTokens(user *models.User, domain string, expire time.Duration, audience []string, scope, jkt, sid string) (string, string, error) {
+	a.loadElevations(user)
+	claims := newCustomClaims(user, domain, expire, audience, scope)
+	a.addProfileClaims(&claims, user)
+	claims.Cnf = newConfirmationClaim(jkt)
+	claims.Sid = sid
+	signedAccessToken, err := generateToken(claims, a.config.Secret, a.config.SignKey)
+	if err != nil {
+		if err := a.Events.CreateJWTEvent(user.Username, models.InternalDomain); err != nil {
+			log.WithError(err).Warnf("failed to store JWT event")
+		}
+		return "", "", err
+	}
 	if a.config.RenewTokenExpireTime == 0 {
 		// no renew token functionality configured
-		jsonapiSuccessMetaOnly(w, &responseBody, http.StatusOK)
-	} else {
-		rC := newStandardClaims(user, domain, a.config.RenewTokenExpireTime)
-		signedRenewToken, err := generateToken(rC, a.config.Secret, a.config.SignKey)
-		if err != nil {
-			jsonapiError(w, http.StatusInternalServerError, err.Error())
-			return
-		}
-		responseBody.RenewToken = signedRenewToken
-		jsonapiSuccessMetaOnly(w, &responseBody, http.StatusOK)
+		return signedAccessToken, "", nil
+	}
+	rC := newRenewClaims(user, domain, a.config.RenewTokenExpireTime, audience, scope)
+	rC.Cnf = newConfirmationClaim(jkt)
+	rC.Sid = sid
+	signedRenewToken, err := generateToken(rC, a.config.Secret, a.config.SignKey)
+	if err != nil {
+		return "", "", err
 	}
+	return signedAccessToken, signedRenewToken, nil
 }
 
+// DeleteSessionHandler terminates the session of the access token, the tokens issued for the session
+// are no longer accepted
 func (a *App) DeleteSessionHandler(w http.ResponseWriter, r *http.Request) {
-	// TODO: How do we handle session backend side?
-	// so far no jwt information is stored into db, fully stateless
+	t := parseAuthHeader(r)
+	claims, err := getClaimsFromAccessToken(t, a.config.Secret, a.config.VerifyKey)
+	if err != nil {
+		jsonapiError(w, http.StatusUnauthorized, "unauthorized request")
+		return
+	}
+	if err = a.verifyTokenBinding(r, t, claims.Cnf); err != nil {
+		writeTokenBindingError(w, claims.Cnf, err)
+		return
+	}
+	if claims.Sid == "" {
+		// tokens issued before the sessions were tracked, nothing to terminate
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	a.terminateSession(w, claims.Sid, func(s *models.Session) bool {
+		return s.Username == claims.Subject && s.IdentityID == claims.Eid
+	})
 }
 
 type RenewTokenHandlerRequest struct {
@@ -167,12 +261,46 @@ func (a *App) RenewTokenHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var user *models.User
+	claims, err := getClaimsFromRenewToken(renewTokenHandlerRequest.RenewToken, a.config.Secret, a.config.VerifyKey)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"token": renewTokenHandlerRequest.RenewToken,
+			"error": err,
+		}).Info("invalid renew token")
+		jsonapiError(w, http.StatusUnauthorized, "invalid renew token")
+		return
+	}
 
-	if roles, ok := a.extUsers[renewTokenHandlerRequest.UserID]; ok {
+	var user *models.User
+	var identity *models.ExternalIdentity
+	// the renew tokens of the external identities refer to them, a local user with the same username
+	// is another user
+	if claims.Eid != 0 {
+		identity, err = a.ExternalIdentities.GetExternalIdentityByID(strconv.Itoa(int(claims.Eid)))
+		switch err.(type) {
+		case *models.NotFoundError:
+			jsonapiError(w, http.StatusUnauthorized, "user revoked")
+			return
+		case *models.DBError:
+			jsonapiError(w, http.StatusInternalServerError, "internal error, retry later")
+			return
+		}
+		if identity.Username != renewTokenHandlerRequest.UserID {
+			log.Infof("renew token of %s presented for %s", identity.Username, renewTokenHandlerRequest.UserID)
+			jsonapiError(w, http.StatusUnauthorized, "invalid renew token")
+			return
+		}
+		roles, err := identity.RoleList()
+		if err != nil {
+			log.WithError(err).Warnf("unable to convert roles")
+			jsonapiError(w, http.StatusUnauthorized, "user revoked")
+			return
+		}
 		user = &models.User{
-			Username: renewTokenHandlerRequest.UserID,
-			Roles:    roles,
+			Username:   identity.Username,
+			Roles:      roles,
+			Version:    identity.Version,
+			IdentityID: identity.ID,
 		}
 	} else {
 		user, err = a.Users.GetUserByNameOrID(renewTokenHandlerRequest.UserID)
@@ -185,23 +313,73 @@ func (a *App) RenewTokenHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
-
-	claims, err := getClaimsFromRenewToken(renewTokenHandlerRequest.RenewToken, a.config.Secret, a.config.VerifyKey)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"token": renewTokenHandlerRequest.RenewToken,
-			"error": err,
-		}).Info("invalid renew token")
+	// the disabled, locked and expired users, including the users expired since the login, cannot renew
+	if !user.Active() {
+		log.Infof("renew token of %s user %s", user.State(), user.Username)
+		jsonapiError(w, http.StatusUnauthorized, fmt.Sprintf("user %s", user.State()))
+		return
+	}
+	// the renew token renews the tokens of its own subject only
+	if claims.Subject != user.Username {
+		log.Infof("renew token of %s presented for %s", claims.Subject, user.Username)
 		jsonapiError(w, http.StatusUnauthorized, "invalid renew token")
 		return
 	}
-	accessClaims := newCustomClaims(user, claims.Issuer, a.config.RenewTokenExpireTime)
+	// a bound renew token can only be used by the holder of the bound key
+	if err = a.verifyTokenBinding(r, "", claims.Cnf); err != nil {
+		log.WithError(err).Info("invalid token binding")
+		writeTokenBindingError(w, claims.Cnf, err)
+		return
+	}
+	// the renew token is revoked by the deletion of the user and by the changes of its roles or password
+	if claims.Ver != 0 && claims.Ver != user.Version {
+		log.Infof("revoked renew token of %s", user.Username)
+		jsonapiError(w, http.StatusUnauthorized, "token revoked")
+		return
+	}
+	var session *models.Session
+	if claims.Sid != "" {
+		session, err = a.Sessions.GetSession(claims.Sid)
+		switch err.(type) {
+		case *models.NotFoundError:
+			jsonapiError(w, http.StatusUnauthorized, "session terminated")
+			return
+		case *models.DBError:
+			jsonapiError(w, http.StatusInternalServerError, "internal error, retry later")
+			return
+		}
+		if a.sessionIdle(session) {
+			if err = a.Sessions.DeleteSession(session); err != nil {
+				log.WithError(err).Warnf("failed to delete idle session")
+			}
+			jsonapiError(w, http.StatusUnauthorized, "session expired for inactivity")
+			return
+		}
+	}
+	a.loadElevations(user)
+	// the renewed access token keeps the audience, scope, DPoP binding, session and generation of the
+	// renew token
+	accessClaims := newCustomClaims(user, claims.Issuer, a.config.RenewTokenExpireTime, claims.Audience, claims.Scope)
+	a.addProfileClaims(&accessClaims, user)
+	accessClaims.Cnf = claims.Cnf
+	accessClaims.Sid = claims.Sid
+	accessClaims.Ver = claims.Ver
 	signedAccessToken, err := generateToken(accessClaims, a.config.Secret, a.config.SignKey)
 	if err != nil {
 		jsonapiError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-	w.Header().Set(headerAuthorization, fmt.Sprintf("Bearer %v", signedAccessToken))
+	w.Header().Set(headerAuthorization, fmt.Sprintf("%s %v", tokenType(claims.Cnf.boundKey()), signedAccessToken))
+	if identity != nil {
+		if err = a.ExternalIdentities.TouchExternalIdentity(identity); err != nil {
+			log.WithError(err).Warnf("failed to update external identity last seen time")
+		}
+	}
+	if session != nil {
+		if err = a.Sessions.TouchSession(session); err != nil {
+			log.WithError(err).Warnf("failed to update session last renewal time")
+		}
+	}
 
 	// this is an implementation choice, we can either:
 	// - generate a new renew token at every renew request
@@ -216,6 +394,7 @@ func (a *App) RenewTokenHandler(w http.ResponseWriter, r *http.Request) {
 	var responseBody CreateSessionHandlerResponse
 	responseBody.AccessToken = signedAccessToken
 	responseBody.RenewToken = renewTokenHandlerRequest.RenewToken
+	responseBody.TokenType = tokenType(claims.Cnf.boundKey())
 
 	jsonapiSuccessMetaOnly(w, &responseBody, http.StatusOK)
 }
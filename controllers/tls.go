@@ -0,0 +1,124 @@
+package controllers
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/go-co-op/gocron"
+	log "github.com/sirupsen/logrus"
+)
+
+// TLSConfig configures the native TLS termination, TLS is disabled if CertFile is empty
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+	// ClientCAFile is the PEM bundle of the CAs the client certificates are verified against,
+	// client certificates are not requested if empty
+	ClientCAFile string
+	// RequireClientCert rejects the connections without a valid client certificate, otherwise
+	// the client certificate is only verified if given
+	RequireClientCert bool
+	// ReloadInterval is the period after which the certificate and the CA bundle are reloaded
+	ReloadInterval time.Duration
+}
+
+// tlsReloader holds the server certificate and the client CAs currently in force, so that the files
+// renewed on disk (e.g. by cert-manager) are picked up without restarting the server
+type tlsReloader struct {
+	sync.RWMutex
+	config    *TLSConfig
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+func newTLSReloader(c *TLSConfig) (*tlsReloader, error) {
+	tR := &tlsReloader{config: c}
+	if err := tR.reload(); err != nil {
+		return nil, err
+	}
+	return tR, nil
+}
+
+// reload reads the certificate, key and CA bundle, the files in force are kept on failure
+func (tR *tlsReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(tR.config.CertFile, tR.config.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load server certificate: %s", err.Error())
+	}
+	var clientCAs *x509.CertPool
+	if tR.config.ClientCAFile != "" {
+		data, err := ioutil.ReadFile(tR.config.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read client CA bundle: %s", err.Error())
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(data) {
+			return errors.New("no certificate found in client CA bundle")
+		}
+	}
+	tR.Lock()
+	defer tR.Unlock()
+	tR.cert = &cert
+	tR.clientCAs = clientCAs
+	return nil
+}
+
+// tlsConfig returns the server TLS configuration, the certificate and client CAs are resolved
+// at each handshake on a copy of the configuration so that the settings added by the http server,
+// such as the HTTP/2 protocols and cipher suites, are kept
+func (tR *tlsReloader) tlsConfig() *tls.Config {
+	base := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			tR.RLock()
+			defer tR.RUnlock()
+			return tR.cert, nil
+		},
+	}
+	base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		tR.RLock()
+		defer tR.RUnlock()
+		c := base.Clone()
+		c.GetConfigForClient = nil
+		c.GetCertificate = nil
+		c.Certificates = []tls.Certificate{*tR.cert}
+		if tR.clientCAs != nil {
+			c.ClientCAs = tR.clientCAs
+			c.ClientAuth = tls.VerifyClientCertIfGiven
+			if tR.config.RequireClientCert {
+				c.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+		}
+		return c, nil
+	}
+	return base
+}
+
+// SetupTLS enables the native TLS termination, the certificate and the client CAs are periodically reloaded
+func (a *App) SetupTLS(c *TLSConfig) error {
+	tR, err := newTLSReloader(c)
+	if err != nil {
+		return err
+	}
+	a.server.TLSConfig = tR.tlsConfig()
+	if c.ReloadInterval == 0 {
+		return nil
+	}
+	s := gocron.NewScheduler(time.UTC)
+	_, err = s.Every(c.ReloadInterval).Do(func() {
+		if err := tR.reload(); err != nil {
+			log.WithError(err).Errorf("failed to reload TLS certificates")
+		}
+	})
+	if err != nil {
+		return err
+	}
+	s.StartAsync()
+	return nil
+}
@@ -0,0 +1,237 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/goidp/models"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/jsonapi"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// personalAccessTokenPrefix tells the personal access tokens apart from the JWTs, and makes them easy
+// to spot by secret scanners
+const personalAccessTokenPrefix = "goidp_pat_"
+
+// PersonalAccessTokenResource is the jsonapi representation of a personal access token
+type PersonalAccessTokenResource struct {
+	ID         string     `jsonapi:"primary,token"`
+	Name       string     `jsonapi:"attr,name"`
+	Roles      []string   `jsonapi:"attr,roles"`
+	ExpiresAt  time.Time  `jsonapi:"attr,expires_at,iso8601"`
+	CreatedAt  time.Time  `jsonapi:"attr,created_at,iso8601"`
+	LastUsedAt *time.Time `jsonapi:"attr,last_used_at,iso8601,omitempty"`
+	// Token is the personal access token itself, it is returned only once, at creation
+	Token string `jsonapi:"attr,token,omitempty"`
+}
+
+func newPersonalAccessTokenResource(p *models.PersonalAccessToken) *PersonalAccessTokenResource {
+	pR := &PersonalAccessTokenResource{
+		ID:        strconv.Itoa(int(p.ID)),
+		Name:      p.Name,
+		Roles:     p.Roles,
+		ExpiresAt: p.ExpiresAt,
+		CreatedAt: p.CreatedAt,
+	}
+	if !p.LastUsedAt.IsZero() {
+		pR.LastUsedAt = &p.LastUsedAt
+	}
+	return pR
+}
+
+func isPersonalAccessToken(t string) bool {
+	return strings.HasPrefix(t, personalAccessTokenPrefix)
+}
+
+func newPersonalAccessToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return personalAccessTokenPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// personalAccessTokenClaims authenticates the personal access token and returns the claims of its
+// owner, restricted to the roles of the token the user still has
+func (a *App) personalAccessTokenClaims(t string) (*customClaims, error) {
+	p, err := a.PersonalAccessTokens.GetPersonalAccessToken(t)
+	if err != nil {
+		return nil, err
+	}
+	user, err := a.Users.GetUserByNameOrID(p.Username)
+	if err != nil {
+		return nil, err
+	}
+	// the tokens of the disabled, locked and expired users are rejected
+	if !user.Active() {
+		return nil, fmt.Errorf("user %s %s", user.Username, user.State())
+	}
+	var roles []string
+	for _, r := range p.Roles {
+		if stringInSliceCaseInsensitive(user.Roles.String(), r) {
+			roles = append(roles, r)
+		}
+	}
+	// the last use is recorded with a minute precision, to spare a DB write at every request
+	if time.Since(p.LastUsedAt) > time.Minute {
+		if err = a.PersonalAccessTokens.TouchPersonalAccessToken(p); err != nil {
+			log.WithError(err).Warnf("failed to update personal access token last use time")
+		}
+	}
+	claims := &customClaims{Roles: roles, Azt: models.InternalDomain}
+	if a.config.Audience != "" {
+		claims.Audience = audienceClaim{a.config.Audience}
+	}
+	claims.Subject = user.Username
+	claims.Id = uuid.New().String()
+	claims.Issuer = "idp"
+	claims.IssuedAt = p.CreatedAt.Unix()
+	claims.ExpiresAt = p.ExpiresAt.Unix()
+	return claims, nil
+}
+
+// apply validates the requested personal access token of the user
+func (pR *PersonalAccessTokenResource) apply(p *models.PersonalAccessToken, user *models.User, maxLifetime time.Duration) error {
+	if pR.Name == "" {
+		return errors.New("name cannot be empty")
+	}
+	if !pR.ExpiresAt.After(time.Now()) {
+		return errors.New("expiration time must be in the future")
+	}
+	if maxLifetime > 0 && time.Until(pR.ExpiresAt) > maxLifetime {
+		return fmt.Errorf("expiration time cannot exceed %s", maxLifetime)
+	}
+	roles := user.Roles.String()
+	if len(pR.Roles) > 0 {
+		rL, err := models.NewRoleList(pR.Roles)
+		if err != nil {
+			return err
+		}
+		roles = nil
+		for _, r := range rL {
+			role := models.UserRole(r.ID).String()
+			if !stringInSliceCaseInsensitive(user.Roles.String(), role) {
+				return fmt.Errorf("role %s not granted to %s", role, user.Username)
+			}
+			roles = append(roles, role)
+		}
+	}
+	p.Username = user.Username
+	p.Name = pR.Name
+	p.Roles = roles
+	p.ExpiresAt = pR.ExpiresAt
+	return nil
+}
+
+// tokenOwner returns the local user the personal access tokens of the {id} path parameter belong to
+func (a *App) tokenOwner(w http.ResponseWriter, r *http.Request) (*models.User, bool) {
+	user, err := a.Users.GetUserByNameOrID(mux.Vars(r)["id"])
+	switch err.(type) {
+	case *models.NotFoundError:
+		jsonapiError(w, http.StatusNotFound, err.Error())
+		return nil, false
+	case *models.DBError:
+		jsonapiError(w, http.StatusInternalServerError, err.Error())
+		return nil, false
+	}
+	return user, true
+}
+
+// PersonalAccessTokensHandler lists (GET) or creates (POST) the personal access tokens of the user, the
+// tokens are created by the user only
+func (a *App) PersonalAccessTokensHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := a.tokenOwner(w, r)
+	if !ok {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		tokens, err := a.PersonalAccessTokens.GetUserPersonalAccessTokens(user.Username)
+		if err != nil {
+			jsonapiError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		resources := make([]*PersonalAccessTokenResource, 0)
+		for _, p := range tokens {
+			resources = append(resources, newPersonalAccessTokenResource(p))
+		}
+		jsonapiSuccess(w, resources, http.StatusOK)
+	case http.MethodPost:
+		// a leaked personal access token must not be enough to get new ones
+		t := parseAuthHeader(r)
+		if isPersonalAccessToken(t) {
+			jsonapiError(w, http.StatusForbidden, "personal access tokens cannot be created with a personal access token")
+			return
+		}
+		// nor an impersonation token, which would outlive the impersonation
+		claims, err := getClaimsFromAccessToken(t, a.config.Secret, a.config.VerifyKey)
+		if err == nil && claims.Act != nil {
+			jsonapiError(w, http.StatusForbidden, "personal access tokens cannot be created on behalf of another user")
+			return
+		}
+		// the administrators list and revoke the tokens of the other users but never create them
+		// and by the local user itself, not by another principal with the same name
+		if err != nil || !claims.localUser(user.Username) {
+			jsonapiError(w, http.StatusForbidden, "personal access tokens are created by their owner only")
+			return
+		}
+		var requestBody PersonalAccessTokenResource
+		if err := jsonapi.UnmarshalPayload(r.Body, &requestBody); err != nil {
+			jsonapiError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		var p models.PersonalAccessToken
+		if err := requestBody.apply(&p, user, a.config.PersonalAccessTokenMaxLifetime); err != nil {
+			jsonapiError(w, http.StatusBadRequest, fmt.Sprintf("invalid personal access token: %s", err.Error()))
+			return
+		}
+		token, err := newPersonalAccessToken()
+		if err != nil {
+			jsonapiError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		p.Hash = models.HashPersonalAccessToken(token)
+		if err = a.PersonalAccessTokens.Create(&p); err != nil {
+			jsonapiError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err = a.Events.CreatePersonalAccessTokenEvent(r.Method, user.Username, p.Name); err != nil {
+			log.WithError(err).Warnf("failed to store personal access token event")
+		}
+		pR := newPersonalAccessTokenResource(&p)
+		pR.Token = token
+		jsonapiSuccess(w, pR, http.StatusCreated)
+	}
+}
+
+// PersonalAccessTokenHandler revokes (DELETE) a personal access token of the user
+func (a *App) PersonalAccessTokenHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := a.tokenOwner(w, r)
+	if !ok {
+		return
+	}
+	p, err := a.PersonalAccessTokens.GetUserPersonalAccessToken(user.Username, mux.Vars(r)["tid"])
+	if err == nil {
+		err = a.PersonalAccessTokens.DeletePersonalAccessToken(p)
+	}
+	switch err.(type) {
+	case *models.NotFoundError:
+		jsonapiError(w, http.StatusNotFound, err.Error())
+		return
+	case *models.DBError:
+		jsonapiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err = a.Events.CreatePersonalAccessTokenEvent(r.Method, user.Username, p.Name); err != nil {
+		log.WithError(err).Warnf("failed to store personal access token event")
+	}
+	jsonapiNoContentSuccess(w)
+}
@@ -0,0 +1,376 @@
+package controllers
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"github.com/goidp/models"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/jsonapi"
+	"github.com/gorilla/mux"
+)
+
+var personalAccessTokenColumns = []string{"id", "created_at", "username", "name", "hash", "roles", "expires_at", "last_used_at"}
+
+// expectTokenOwner mocks the lookup of the local user with its roles
+func expectTokenOwner(s *Suite, username string, roles ...models.UserRole) {
+	s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "users" WHERE username = $1 AND "users"."deleted_at" IS NULL ORDER BY "users"."id" LIMIT 1`)).
+		WithArgs(username).WillReturnRows(sqlmock.NewRows([]string{"id", "username"}).AddRow(7, username))
+	userRoles := sqlmock.NewRows([]string{"user_id", "role_id"})
+	roleRows := sqlmock.NewRows([]string{"id", "name"})
+	for _, r := range roles {
+		userRoles.AddRow(7, int(r))
+		roleRows.AddRow(int(r), r.String())
+	}
+	s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "user_roles" WHERE "user_roles"."user_id" = $1`)).
+		WithArgs(7).WillReturnRows(userRoles)
+	if len(roles) > 0 {
+		s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "roles" WHERE`)).WillReturnRows(roleRows)
+	}
+}
+
+func expectPersonalAccessTokenEvent(s *Suite) {
+	insertArgs := []driver.Value{sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()}
+	s.mock.ExpectBegin()
+	s.mock.ExpectQuery(regexp.QuoteMeta(
+		`INSERT INTO "events" ("created_at","updated_at","deleted_at","username","activated","description","modified","authn_domain","severity") VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9) RETURNING "id"`)).
+		WithArgs(insertArgs...).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	s.mock.ExpectCommit()
+}
+
+func TestPersonalAccessTokensHandler(t *testing.T) {
+	s, err := SetupSuite()
+	if err != nil {
+		t.Fatalf("error setting up test suite: %s", err.Error())
+	}
+	a := NewApp(s.DB, &Config{PersonalAccessTokenMaxLifetime: 30 * 24 * time.Hour})
+	a.config.SignKey, _ = ReadPrivateKey(PKCS1_Private_Key)
+	a.config.VerifyKey = &a.config.SignKey.PublicKey
+	expiresAt := time.Now().Add(24 * time.Hour).UTC().Format(time.RFC3339)
+	ownerToken, _ := generateToken(newCustomClaims(&models.User{Username: "jdoe"}, models.InternalDomain, time.Minute, nil, ""), "", a.config.SignKey)
+	adminRoles, _ := models.NewRoleList([]string{models.AdminRole.String()})
+	adminToken, _ := generateToken(newCustomClaims(&models.User{Username: "admin", Roles: adminRoles}, models.InternalDomain, time.Minute, nil, ""), "", a.config.SignKey)
+	// the principals named like the local user
+	externalToken, _ := generateToken(newCustomClaims(&models.User{Username: "jdoe"}, models.ExternalDomain, time.Minute, nil, ""), "", a.config.SignKey)
+	exchangedClaims := newCustomClaims(&models.User{Username: "jdoe"}, models.ExternalDomain, time.Minute, nil, "")
+	exchangedClaims.Act = &actorClaim{Subject: "svc-a"}
+	exchangedToken, _ := generateToken(exchangedClaims, "", a.config.SignKey)
+	serviceAccountToken, _ := generateToken(newCustomClaims(&models.User{Username: "jdoe"}, models.ServiceAccountDomain, time.Minute, nil, ""), "", a.config.SignKey)
+	identityToken, _ := generateToken(newCustomClaims(&models.User{Username: "jdoe", IdentityID: 3}, models.InternalDomain, time.Minute, nil, ""), "", a.config.SignKey)
+
+	tt := []struct {
+		name    string
+		body    string
+		auth    string
+		created bool
+		status  int
+	}{
+		{
+			name:    "create a token",
+			body:    `{"data":{"type":"token","attributes":{"name":"backup","roles":["monitor"],"expires_at":"` + expiresAt + `"}}}`,
+			auth:    "Bearer " + ownerToken,
+			created: true,
+			status:  http.StatusCreated,
+		},
+		{
+			name:   "role not granted",
+			body:   `{"data":{"type":"token","attributes":{"name":"backup","roles":["admin"],"expires_at":"` + expiresAt + `"}}}`,
+			auth:   "Bearer " + ownerToken,
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "expiration in the past",
+			body:   `{"data":{"type":"token","attributes":{"name":"backup","expires_at":"2020-01-01T00:00:00Z"}}}`,
+			auth:   "Bearer " + ownerToken,
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "expiration beyond the maximum lifetime",
+			body:   `{"data":{"type":"token","attributes":{"name":"backup","expires_at":"` + time.Now().Add(365*24*time.Hour).UTC().Format(time.RFC3339) + `"}}}`,
+			auth:   "Bearer " + ownerToken,
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "created with a personal access token",
+			body:   `{"data":{"type":"token","attributes":{"name":"backup","expires_at":"` + expiresAt + `"}}}`,
+			auth:   "Bearer " + personalAccessTokenPrefix + "leaked",
+			status: http.StatusForbidden,
+		},
+		{
+			name:   "created by an administrator for another user",
+			body:   `{"data":{"type":"token","attributes":{"name":"backup","expires_at":"` + expiresAt + `"}}}`,
+			auth:   "Bearer " + adminToken,
+			status: http.StatusForbidden,
+		},
+		{
+			name:   "created with the token of a trusted issuer subject",
+			body:   `{"data":{"type":"token","attributes":{"name":"backup","expires_at":"` + expiresAt + `"}}}`,
+			auth:   "Bearer " + externalToken,
+			status: http.StatusForbidden,
+		},
+		{
+			name:   "created with an exchanged token",
+			body:   `{"data":{"type":"token","attributes":{"name":"backup","expires_at":"` + expiresAt + `"}}}`,
+			auth:   "Bearer " + exchangedToken,
+			status: http.StatusForbidden,
+		},
+		{
+			name:   "created with a service account token",
+			body:   `{"data":{"type":"token","attributes":{"name":"backup","expires_at":"` + expiresAt + `"}}}`,
+			auth:   "Bearer " + serviceAccountToken,
+			status: http.StatusForbidden,
+		},
+		{
+			name:   "created with the token of an external identity",
+			body:   `{"data":{"type":"token","attributes":{"name":"backup","expires_at":"` + expiresAt + `"}}}`,
+			auth:   "Bearer " + identityToken,
+			status: http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			expectTokenOwner(s, "jdoe", models.HelpdeskRole, models.MonitorRole)
+			if tc.created {
+				s.mock.ExpectBegin()
+				s.mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "personal_access_tokens"`)).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+				s.mock.ExpectCommit()
+				expectPersonalAccessTokenEvent(s)
+			}
+
+			req, _ := http.NewRequest(http.MethodPost, "/v1.0/user/jdoe/token", bytes.NewBufferString(tc.body))
+			req.Header.Set(headerAuthorization, tc.auth)
+			req = mux.SetURLVars(req, map[string]string{"id": "jdoe"})
+			rec := httptest.NewRecorder()
+			a.PersonalAccessTokensHandler(rec, req)
+
+			if err := s.mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+			if rec.Code != tc.status {
+				t.Fatalf("expected status %d; got %d: %s", tc.status, rec.Code, rec.Body.String())
+			}
+			if tc.created {
+				var p PersonalAccessTokenResource
+				if err := jsonapi.UnmarshalPayload(rec.Body, &p); err != nil {
+					t.Fatalf("could not unmarshal response: %s", err)
+				}
+				if !strings.HasPrefix(p.Token, personalAccessTokenPrefix) {
+					t.Errorf("unexpected token %s", p.Token)
+				}
+				if len(p.Roles) != 1 || p.Roles[0] != models.MonitorRole.String() {
+					t.Errorf("unexpected roles %v", p.Roles)
+				}
+			}
+		})
+	}
+
+	t.Run("list tokens", func(t *testing.T) {
+		expectTokenOwner(s, "jdoe")
+		s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "personal_access_tokens" WHERE username = $1`)).
+			WithArgs("jdoe").
+			WillReturnRows(sqlmock.NewRows(personalAccessTokenColumns).
+				AddRow(2, time.Now(), "jdoe", "backup", "hash-2", `["MONITOR"]`, time.Now().Add(time.Hour), time.Now()).
+				AddRow(1, time.Now().Add(-time.Hour), "jdoe", "report", "hash-1", `["HELPDESK"]`, time.Now().Add(time.Hour), time.Time{}))
+
+		req, _ := http.NewRequest(http.MethodGet, "/v1.0/user/jdoe/token", nil)
+		req = mux.SetURLVars(req, map[string]string{"id": "jdoe"})
+		rec := httptest.NewRecorder()
+		a.PersonalAccessTokensHandler(rec, req)
+
+		if err := s.mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected status %d; got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+		}
+		tokens, err := jsonapi.UnmarshalManyPayload(rec.Body, reflect.TypeOf(new(PersonalAccessTokenResource)))
+		if err != nil {
+			t.Fatalf("could not unmarshal response: %s", err)
+		}
+		if len(tokens) != 2 || tokens[0].(*PersonalAccessTokenResource).Name != "backup" || tokens[0].(*PersonalAccessTokenResource).Token != "" {
+			t.Errorf("unexpected tokens %+v", tokens)
+		}
+		if tokens[1].(*PersonalAccessTokenResource).LastUsedAt != nil {
+			t.Errorf("expected a token never used")
+		}
+	})
+}
+
+func TestPersonalAccessTokenHandler(t *testing.T) {
+	s, err := SetupSuite()
+	if err != nil {
+		t.Fatalf("error setting up test suite: %s", err.Error())
+	}
+	a := NewApp(s.DB, &Config{})
+
+	tt := []struct {
+		name   string
+		tid    string
+		found  bool
+		status int
+	}{
+		{
+			name:   "revoke a token",
+			tid:    "1",
+			found:  true,
+			status: http.StatusNoContent,
+		},
+		{
+			name:   "unknown token",
+			tid:    "2",
+			status: http.StatusNotFound,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			expectTokenOwner(s, "jdoe")
+			rows := sqlmock.NewRows(personalAccessTokenColumns)
+			if tc.found {
+				rows.AddRow(1, time.Now(), "jdoe", "backup", "hash-1", `["MONITOR"]`, time.Now().Add(time.Hour), time.Time{})
+			}
+			s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "personal_access_tokens" WHERE username = $1`)).
+				WithArgs("jdoe", sqlmock.AnyArg()).WillReturnRows(rows)
+			if tc.found {
+				s.mock.ExpectBegin()
+				s.mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "personal_access_tokens" WHERE "personal_access_tokens"."id" = $1`)).
+					WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+				s.mock.ExpectCommit()
+				expectPersonalAccessTokenEvent(s)
+			}
+
+			req, _ := http.NewRequest(http.MethodDelete, "/v1.0/user/jdoe/token/"+tc.tid, nil)
+			req = mux.SetURLVars(req, map[string]string{"id": "jdoe", "tid": tc.tid})
+			rec := httptest.NewRecorder()
+			a.PersonalAccessTokenHandler(rec, req)
+
+			if err := s.mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+			if rec.Code != tc.status {
+				t.Errorf("expected status %d; got %d: %s", tc.status, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestJWTMiddlewarePersonalAccessToken(t *testing.T) {
+	s, err := SetupSuite()
+	if err != nil {
+		t.Fatalf("error setting up test suite: %s", err.Error())
+	}
+	a := NewApp(s.DB, &Config{})
+	token := personalAccessTokenPrefix + "secret"
+
+	tt := []struct {
+		name     string
+		resource string
+		method   string
+		id       string
+		found    bool
+		owner    bool
+		lastUsed time.Time
+		status   int
+	}{
+		{
+			name:     "valid token",
+			resource: "user",
+			method:   http.MethodGet,
+			found:    true,
+			owner:    true,
+			status:   http.StatusOK,
+		},
+		{
+			name:     "recently used token",
+			resource: "user",
+			method:   http.MethodGet,
+			found:    true,
+			owner:    true,
+			lastUsed: time.Now(),
+			status:   http.StatusOK,
+		},
+		{
+			name:     "unknown or expired token",
+			resource: "user",
+			method:   http.MethodGet,
+			status:   http.StatusUnauthorized,
+		},
+		{
+			name:     "owner deleted",
+			resource: "user",
+			method:   http.MethodGet,
+			found:    true,
+			status:   http.StatusUnauthorized,
+		},
+		{
+			name:     "own tokens",
+			resource: "token",
+			method:   http.MethodDelete,
+			id:       "jdoe",
+			found:    true,
+			owner:    true,
+			lastUsed: time.Now(),
+			status:   http.StatusOK,
+		},
+		{
+			name:     "tokens of another user",
+			resource: "token",
+			method:   http.MethodGet,
+			id:       "admin",
+			found:    true,
+			owner:    true,
+			lastUsed: time.Now(),
+			status:   http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			rows := sqlmock.NewRows(personalAccessTokenColumns)
+			if tc.found {
+				rows.AddRow(1, time.Now(), "jdoe", "backup", models.HashPersonalAccessToken(token), `["MONITOR","ADMIN"]`, time.Now().Add(time.Hour), tc.lastUsed)
+			}
+			s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "personal_access_tokens" WHERE (hash = $1 AND expires_at > $2)`)).
+				WithArgs(models.HashPersonalAccessToken(token), sqlmock.AnyArg()).WillReturnRows(rows)
+			if tc.found && tc.owner {
+				// the admin role of the token has been withdrawn from the user
+				expectTokenOwner(s, "jdoe", models.MonitorRole)
+			} else if tc.found {
+				s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "users" WHERE username = $1`)).
+					WithArgs("jdoe").WillReturnRows(sqlmock.NewRows([]string{"id", "username"}))
+			}
+			if tc.owner && tc.lastUsed.IsZero() {
+				s.mock.ExpectBegin()
+				s.mock.ExpectExec(regexp.QuoteMeta(`UPDATE "personal_access_tokens" SET "last_used_at"=$1`)).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				s.mock.ExpectCommit()
+			}
+
+			req, _ := http.NewRequest(tc.method, "/v1.0/user", nil)
+			req.Header.Set(headerAuthorization, "Bearer "+token)
+			if tc.id != "" {
+				req = mux.SetURLVars(req, map[string]string{"id": tc.id})
+			}
+			rec := httptest.NewRecorder()
+			a.jwtMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}), tc.resource).ServeHTTP(rec, req)
+
+			if err := s.mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+			if rec.Code != tc.status {
+				t.Errorf("expected status %d; got %d: %s", tc.status, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
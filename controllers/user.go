@@ -5,6 +5,7 @@ import (
 	"github.com/goidp/models"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -32,6 +33,42 @@ type UserResponse struct {
 	Roles    []string `jsonapi:"attr,roles" json:"roles,omitempty"`
 	Username string   `jsonapi:"attr,username" json:"username,omitempty"`
 	Version  int      `jsonapi:"attr,version" json:"version,omitempty"`
+	// Status is the lifecycle state of the account: active, pending, disabled, locked or expired
+	Status    string     `jsonapi:"attr,status" json:"status,omitempty"`
+	ExpiresAt *time.Time `jsonapi:"attr,expires_at,iso8601,omitempty" json:"expires_at,omitempty"`
+	// DisplayName, Email, Phone, Locale, Team and Attributes are the profile of the user
+	DisplayName string `jsonapi:"attr,display_name,omitempty" json:"display_name,omitempty"`
+	Email       string `jsonapi:"attr,email,omitempty" json:"email,omitempty"`
+	// EmailVerified reports whether the email has been verified, the users log in with it once verified
+	EmailVerified bool                   `jsonapi:"attr,email_verified,omitempty" json:"email_verified,omitempty"`
+	Phone         string                 `jsonapi:"attr,phone,omitempty" json:"phone,omitempty"`
+	Locale        string                 `jsonapi:"attr,locale,omitempty" json:"locale,omitempty"`
+	Team          string                 `jsonapi:"attr,team,omitempty" json:"team,omitempty"`
+	Attributes    map[string]interface{} `jsonapi:"attr,attributes,omitempty" json:"attributes,omitempty"`
+}
+
+func newUserResponse(u *models.User) *UserResponse {
+	return &UserResponse{
+		ID:            u.ID,
+		Roles:         u.Roles.String(),
+		Username:      u.Username,
+		Version:       u.Version,
+		Status:        string(u.State()),
+		ExpiresAt:     u.ExpiresAt,
+		DisplayName:   u.DisplayName,
+		Email:         u.Email,
+		EmailVerified: u.EmailVerified,
+		Phone:         u.Phone,
+		Locale:        u.Locale,
+		Team:          u.Team,
+		Attributes:    u.Attributes,
+	}
+}
+
+// userETag returns the entity tag of the user, which changes with its revision, the SCIM and the JSON:API
+// resources of the user share it
+func userETag(u *models.User) string {
+	return fmt.Sprintf(`W/"%d"`, u.Revision)
 }
 
 type SessionExpire time.Time
@@ -42,12 +79,41 @@ func (uL SessionExpire) JSONAPIMeta() *jsonapi.Meta {
 	}
 }
 
+// maxUsersPageSize bounds the page size of the users listing
+const maxUsersPageSize = 500
+
+// UsersPageMeta is the meta of the users listing, total counts the users matching the filters in all the pages
+type UsersPageMeta struct {
+	SessionExpire
+	total      int64
+	totalPages int
+}
+
+func (m UsersPageMeta) JSONAPIMeta() *jsonapi.Meta {
+	return &jsonapi.Meta{
+		"session_expires": m.SessionExpire,
+		"total":           m.total,
+		"total_pages":     m.totalPages,
+	}
+}
+
 type UserRequest struct {
 	ID       string   `jsonapi:"primary,user,omitempty"`
 	Roles    []string `jsonapi:"attr,roles"`
 	Username string   `jsonapi:"attr,username"`
 	Password string   `jsonapi:"attr,password"`
 	Version  int      `jsonapi:"attr,version"`
+	// Status and ExpiresAt change the lifecycle state of the account, they are set by administrators only
+	Status    string     `jsonapi:"attr,status,omitempty"`
+	ExpiresAt *time.Time `jsonapi:"attr,expires_at,iso8601,omitempty"`
+	// the profile fields are changed if provided, an empty string clears them
+	DisplayName *string `jsonapi:"attr,display_name,omitempty"`
+	Email       *string `jsonapi:"attr,email,omitempty"`
+	Phone       *string `jsonapi:"attr,phone,omitempty"`
+	Locale      *string `jsonapi:"attr,locale,omitempty"`
+	Team        *string `jsonapi:"attr,team,omitempty"`
+	// Attributes are the custom attributes to change, a null value removes the attribute
+	Attributes map[string]interface{} `jsonapi:"attr,attributes,omitempty"`
 }
 
 func (a *App) CreateUserHandler(w http.ResponseWriter, r *http.Request) {
@@ -64,10 +130,24 @@ func (a *App) CreateUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	user := models.User{
-		Username: requestBody.Username,
-		Password: requestBody.Password,
-		Roles:    rL,
-		Version:  1,
+		Username:  requestBody.Username,
+		Password:  requestBody.Password,
+		Roles:     rL,
+		Version:   1,
+		ExpiresAt: requestBody.ExpiresAt,
+	}
+	// the accounts are created active, pending their activation or disabled
+	if requestBody.Status != "" {
+		status, err := models.NewUserStatus(requestBody.Status)
+		if err != nil || (status != models.UserActive && status != models.UserPending && status != models.UserDisabled) {
+			jsonapiError(w, http.StatusBadRequest, fmt.Sprintf("invalid user status %s", requestBody.Status))
+			return
+		}
+		user.Status = string(status)
+	}
+	// the users are created by administrators, who set any profile field
+	if _, ok := a.applyProfile(w, &user, &requestBody, true); !ok {
+		return
 	}
 	// not really used, but we could create a user with a specific ID
 	if requestBody.ID != "" {
@@ -91,33 +171,67 @@ func (a *App) CreateUserHandler(w http.ResponseWriter, r *http.Request) {
 		log.WithError(err).Warnf("failed to store user event")
 	}
 
+	a.requestEmailVerification(r, &user)
+
 	// write http response
-	uR := UserResponse{
-		ID:       user.ID,
-		Roles:    user.Roles.String(),
-		Username: user.Username,
-		Version:  user.Version,
-	}
-	jsonapiSuccess(w, &uR, http.StatusOK)
+	jsonapiSuccess(w, newUserResponse(&user), http.StatusOK)
 }
 
+// GetUsersHandler lists the users, filtered by filter[username] and filter[role], sorted by the comma
+// separated fields of sort and paged by page[number] and page[size]
 func (a *App) GetUsersHandler(w http.ResponseWriter, r *http.Request) {
-	users, err := a.Users.GetUsers()
-	var userResponseList UserResponseList
-	for _, u := range users {
-		userResponseList = append(userResponseList, &UserResponse{
-			ID:       u.ID,
-			Roles:    u.Roles.String(),
-			Username: u.Username,
-			Version:  u.Version,
-		})
+	queryValues := r.URL.Query()
+	q := &models.UserQuery{
+		Username:   queryValues.Get("filter[username]"),
+		Role:       queryValues.Get("filter[role]"),
+		PageNumber: defaultPageNumber,
+		PageSize:   defaultPageSize,
 	}
-	if err != nil {
+	if sort := queryValues.Get("sort"); sort != "" {
+		q.Sort = strings.Split(sort, ",")
+	}
+	if v := queryValues.Get("page[number]"); v != "" {
+		pageNumber, err := strconv.Atoi(v)
+		if err != nil || pageNumber < 1 {
+			jsonapiError(w, http.StatusBadRequest, fmt.Sprintf("invalid page number %s", v))
+			return
+		}
+		q.PageNumber = pageNumber
+	}
+	if v := queryValues.Get("page[size]"); v != "" {
+		pageSize, err := strconv.Atoi(v)
+		if err != nil || pageSize < 1 || pageSize > maxUsersPageSize {
+			jsonapiError(w, http.StatusBadRequest, fmt.Sprintf("invalid page size %s", v))
+			return
+		}
+		q.PageSize = pageSize
+	}
+	if deleted, _ := strconv.ParseBool(queryValues.Get("deleted")); deleted {
+		// the deleted users are listed to administrators only
+		if !a.isAdminRequest(r) {
+			jsonapiError(w, http.StatusForbidden, "forbidden request")
+			return
+		}
+		q.Deleted = true
+	}
+	users, total, err := a.Users.FindUsers(q)
+	switch err.(type) {
+	case *models.UserError:
+		jsonapiError(w, http.StatusBadRequest, err.Error())
+		return
+	case *models.DBError:
 		jsonapiError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-	var sE SessionExpire
-	jsonapiSuccessWithMeta(w, sE, userResponseList, http.StatusOK)
+	var userResponseList UserResponseList
+	for _, u := range users {
+		userResponseList = append(userResponseList, newUserResponse(u))
+	}
+	meta := UsersPageMeta{
+		total:      total,
+		totalPages: int((total + int64(q.PageSize) - 1) / int64(q.PageSize)),
+	}
+	jsonapiSuccessWithMeta(w, meta, userResponseList, http.StatusOK)
 }
 
 // UserHandler is the function which verifies what action to take based on the request (if GET, PATCH or DELETE)
@@ -145,32 +259,58 @@ func (a *App) GetUserHandler(w http.ResponseWriter, r *http.Request, id string)
 		jsonapiError(w, http.StatusNotFound, fmt.Sprintf("user %s is not found", id))
 		return
 	}
-	uR := &UserResponse{
-		ID:       user.ID,
-		Username: user.Username,
-		Version:  user.Version,
-	}
-	if user.Roles != nil {
-		uR.Roles = user.Roles.String()
+	w.Header().Set("ETag", userETag(user))
+	if h := r.Header.Get("If-None-Match"); h != "" && etagMatches(h, userETag(user)) {
+		w.WriteHeader(http.StatusNotModified)
+		return
 	}
 	var sE SessionExpire
-	jsonapiSuccessWithMeta(w, sE, uR, http.StatusOK)
+	jsonapiSuccessWithMeta(w, sE, newUserResponse(user), http.StatusOK)
 }
 
 func (a *App) PatchUserHandler(w http.ResponseWriter, r *http.Request, id string) {
 	// the frontend is using username for PATCH
 
-	var user *models.User
+	var from, actor, email string
+	var profile bool
 
 	u, err := a.Users.GetUserByNameOrID(id)
 	if err == nil {
+		// the changes are based on the version of the user given by If-Match or by the version attribute
+		if h := r.Header.Get("If-Match"); h != "" && !etagMatches(h, userETag(u)) {
+			jsonapiError(w, http.StatusPreconditionFailed, fmt.Sprintf("user version mismatch, current version is %s", userETag(u)))
+			return
+		}
 		// read http request body
 		var requestBody UserRequest
 		if err = jsonapi.UnmarshalPayload(r.Body, &requestBody); err != nil {
 			jsonapiError(w, http.StatusBadRequest, err.Error())
 			return
 		}
-		user, err = a.Users.UpdateUserByNameOrID(id, requestBody.Username, requestBody.Password, requestBody.Roles)
+		if requestBody.Version != 0 && requestBody.Version != u.Version {
+			jsonapiError(w, http.StatusConflict, fmt.Sprintf("user %s changed since version %d, current version is %d", u.Username, requestBody.Version, u.Version))
+			return
+		}
+		if requestBody.Status != "" || requestBody.ExpiresAt != nil {
+			from = string(u.State())
+			var ok bool
+			if actor, ok = a.applyUserStatus(w, r, u, &requestBody); !ok {
+				return
+			}
+		}
+		email = u.Email
+		var ok bool
+		if profile, ok = a.applyProfile(w, u, &requestBody, a.isAdminRequest(r)); !ok {
+			return
+		}
+		// the status and the profile are applied to u, which must still be the stored version
+		err = a.Users.PatchUser(u, &models.UserPatch{
+			Username: requestBody.Username,
+			Password: requestBody.Password,
+			Roles:    requestBody.Roles,
+			Status:   actor != "",
+			Profile:  profile,
+		})
 	}
 
 	switch err.(type) {
@@ -180,6 +320,9 @@ func (a *App) PatchUserHandler(w http.ResponseWriter, r *http.Request, id string
 	case *models.UserError:
 		jsonapiError(w, http.StatusBadRequest, err.Error())
 		return
+	case *models.ConflictError:
+		jsonapiError(w, http.StatusConflict, err.Error())
+		return
 	case *models.DBError:
 		jsonapiError(w, http.StatusInternalServerError, err.Error())
 		return
@@ -190,14 +333,68 @@ func (a *App) PatchUserHandler(w http.ResponseWriter, r *http.Request, id string
 	if err != nil {
 		log.WithError(err).Warnf("failed to store user event")
 	}
+	if u.Email != email {
+		a.requestEmailVerification(r, u)
+	}
+	if to := string(u.State()); actor != "" && to != from {
+		if err = a.Events.CreateUserStatusEvent(u.Username, from, to, actor); err != nil {
+			log.WithError(err).Warnf("failed to store user status event")
+		}
+	}
 
-	userResponse := &UserResponse{
-		ID:       user.ID,
-		Roles:    user.Roles.String(),
-		Username: user.Username,
-		Version:  user.Version,
+	w.Header().Set("ETag", userETag(u))
+	jsonapiSuccess(w, newUserResponse(u), http.StatusOK)
+}
+
+// applyUserStatus moves the user to the requested lifecycle state and expiration time, it returns the
+// administrator making the change or writes the error response
+func (a *App) applyUserStatus(w http.ResponseWriter, r *http.Request, u *models.User, requestBody *UserRequest) (string, bool) {
+	claims, err := a.getRequestClaims(parseAuthHeader(r))
+	if err != nil || !stringInSliceCaseInsensitive(claims.Roles, models.AdminRole.String()) {
+		jsonapiError(w, http.StatusForbidden, "the user status is changed by administrators only")
+		return "", false
+	}
+	if claims.Subject == u.Username {
+		jsonapiError(w, http.StatusForbidden, "administrators cannot change their own status")
+		return "", false
+	}
+	if requestBody.ExpiresAt != nil {
+		u.ExpiresAt = requestBody.ExpiresAt
+	}
+	if requestBody.Status != "" {
+		status, err := models.NewUserStatus(requestBody.Status)
+		if err == nil {
+			err = u.SetStatus(status)
+		}
+		if err != nil {
+			jsonapiError(w, http.StatusBadRequest, err.Error())
+			return "", false
+		}
+	}
+	return claims.Subject, true
+}
+
+// isAdminRequest reports whether the request is made by an administrator
+func (a *App) isAdminRequest(r *http.Request) bool {
+	claims, err := a.getRequestClaims(parseAuthHeader(r))
+	return err == nil && stringInSliceCaseInsensitive(claims.Roles, models.AdminRole.String())
+}
+
+// RestoreUserHandler restores a soft deleted user, given its ID or username
+func (a *App) RestoreUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := a.Users.RestoreUserByNameOrID(mux.Vars(r)["id"])
+	switch err.(type) {
+	case *models.NotFoundError:
+		jsonapiError(w, http.StatusNotFound, err.Error())
+		return
+	case *models.DBError:
+		jsonapiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err = a.Events.CreateUserRestoreEvent(user.Username); err != nil {
+		log.WithError(err).Warnf("failed to store user event")
 	}
-	jsonapiSuccess(w, userResponse, http.StatusOK)
+	jsonapiSuccess(w, newUserResponse(user), http.StatusOK)
 }
 
 func (a *App) DeleteUserHandler(w http.ResponseWriter, r *http.Request, id string) {
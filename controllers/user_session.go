@@ -0,0 +1,341 @@
+package controllers
+
+import (
+	"errors"
+	"github.com/goidp/models"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// SessionResource is the jsonapi representation of an active session
+type SessionResource struct {
+	ID            string     `jsonapi:"primary,session"`
+	Username      string     `jsonapi:"attr,username"`
+	Domain        string     `jsonapi:"attr,domain"`
+	IP            string     `jsonapi:"attr,ip"`
+	UserAgent     string     `jsonapi:"attr,user_agent"`
+	CreatedAt     time.Time  `jsonapi:"attr,created_at,iso8601"`
+	LastRenewedAt *time.Time `jsonapi:"attr,last_renewed_at,iso8601,omitempty"`
+	ExpiresAt     time.Time  `jsonapi:"attr,expires_at,iso8601"`
+}
+
+func newSessionResource(s *models.Session) *SessionResource {
+	sR := &SessionResource{
+		ID:        s.SID,
+		Username:  s.Username,
+		Domain:    s.Domain,
+		IP:        s.IP,
+		UserAgent: s.UserAgent,
+		CreatedAt: s.CreatedAt,
+		ExpiresAt: s.ExpiresAt,
+	}
+	if !s.LastRenewedAt.IsZero() {
+		sR.LastRenewedAt = &s.LastRenewedAt
+	}
+	return sR
+}
+
+// errSessionLimit is returned when the user already has the maximum number of concurrent sessions
+var errSessionLimit = errors.New("maximum number of concurrent sessions reached")
+
+// sessionLimit returns the maximum number of concurrent sessions of the user, 0 if unlimited
+func (a *App) sessionLimit(roles models.RoleList) int {
+	limit := 0
+	for _, r := range roles {
+		for role, l := range a.config.MaxSessions {
+			if strings.EqualFold(role, r.Name) && l > 0 && (limit == 0 || l < limit) {
+				limit = l
+			}
+		}
+	}
+	return limit
+}
+
+// sessionIdle returns true if the session has not been renewed within the idle timeout
+func (a *App) sessionIdle(s *models.Session) bool {
+	return a.config.SessionIdleTimeout > 0 && time.Since(s.LastActivity()) > a.config.SessionIdleTimeout
+}
+
+// admitSession makes room for a new session within the limit: the idle sessions are terminated, then
+// the oldest ones if the user is over the limit and eviction is configured
+func (a *App) admitSession(limit int) func([]*models.Session) ([]*models.Session, error) {
+	return func(sessions []*models.Session) ([]*models.Session, error) {
+		// the sessions are sorted from the most recent, the ones beyond the limit are evicted
+		var active, evicted []*models.Session
+		for _, s := range sessions {
+			if a.sessionIdle(s) || (len(active) == limit-1 && a.config.EvictOldestSession) {
+				evicted = append(evicted, s)
+			} else {
+				active = append(active, s)
+			}
+		}
+		if len(active) >= limit {
+			return nil, errSessionLimit
+		}
+		return evicted, nil
+	}
+}
+
+// startSession records a new session of the user, within the limit of concurrent sessions of its roles
+func (a *App) startSession(r *http.Request, user *models.User, domain string) (*models.Session, error) {
+	ip, _ := getIP(r)
+	lifetime := a.config.SessionLifetime
+	if lifetime == 0 {
+		lifetime = a.config.RenewTokenExpireTime
+	}
+	if lifetime == 0 {
+		lifetime = a.config.AccessTokenExpireTime
+	}
+	s := &models.Session{
+		SID:        uuid.New().String(),
+		Username:   user.Username,
+		Domain:     domain,
+		IP:         ip,
+		UserAgent:  r.UserAgent(),
+		ExpiresAt:  time.Now().Add(lifetime),
+		UserID:     user.ID,
+		IdentityID: user.IdentityID,
+	}
+	limit := a.sessionLimit(user.Roles)
+	if limit == 0 {
+		if err := a.Sessions.Create(s); err != nil {
+			log.WithError(err).Warnf("failed to store session of %s", user.Username)
+			return nil, err
+		}
+		return s, nil
+	}
+	// the check of the limit and the creation are atomic for the owner of the session
+	evicted, err := a.Sessions.CreateWithinLimit(s, a.admitSession(limit))
+	if err != nil {
+		if err != errSessionLimit {
+			log.WithError(err).Warnf("failed to store session of %s", user.Username)
+		}
+		return nil, err
+	}
+	if evicted > 0 {
+		if err = a.Events.CreateSessionTerminatedEvent(user.Username, domain, evicted); err != nil {
+			log.WithError(err).Warnf("failed to store session termination event")
+		}
+	}
+	return s, nil
+}
+
+// verifySession rejects the tokens of terminated sessions, the tokens without session id are accepted
+func (a *App) verifySession(w http.ResponseWriter, claims *customClaims) bool {
+	if claims.Sid == "" {
+		return true
+	}
+	switch _, err := a.Sessions.GetSession(claims.Sid); err.(type) {
+	case *models.NotFoundError:
+		jsonapiError(w, http.StatusUnauthorized, "session terminated")
+		return false
+	case *models.DBError:
+		jsonapiError(w, http.StatusInternalServerError, "internal error, retry later")
+		return false
+	}
+	return true
+}
+
+// sessionCookieClaims returns the claims of the named session cookie and the user logged in, provided
+// that its session has not been terminated and that its user is still active and has not changed since
+// the login, nil otherwise
+func (a *App) sessionCookieClaims(r *http.Request, name string) (*customClaims, *models.User) {
+	c, err := r.Cookie(name)
+	if err != nil {
+		return nil, nil
+	}
+	claims, err := getClaimsFromAccessToken(c.Value, a.config.Secret, a.config.VerifyKey)
+	if err != nil {
+		return nil, nil
+	}
+	// the cookie is issued to the local and shadow users only
+	if claims.Eid != 0 || claims.Azt == models.ServiceAccountDomain {
+		return nil, nil
+	}
+	if claims.Sid != "" {
+		if _, err = a.Sessions.GetSession(claims.Sid); err != nil {
+			log.WithError(err).Infof("%s cookie of terminated session of %s", name, claims.Subject)
+			return nil, nil
+		}
+	}
+	user, err := a.Users.GetUserByNameOrID(claims.Subject)
+	if err != nil {
+		log.WithError(err).Infof("%s cookie of unknown user %s", name, claims.Subject)
+		return nil, nil
+	}
+	// the disabled, locked and expired users, including the users expired since the login, log in again
+	if !user.Active() {
+		log.Infof("%s cookie of %s user %s", name, user.State(), user.Username)
+		return nil, nil
+	}
+	// the cookie is revoked by the deletion of the user and by the changes of its roles or password
+	if claims.Ver != 0 && claims.Ver != user.Version {
+		log.Infof("revoked %s cookie of %s", name, user.Username)
+		return nil, nil
+	}
+	return claims, user
+}
+
+// sessionOwner returns the owner of the sessions of the {id} path parameter, a local or shadow user id or
+// username, with its username and domain; the external identities own other sessions, even with the
+// username of a local user, they list their own sessions with their token and the administrators reach
+// them at /identity/{id}/session
+func (a *App) sessionOwner(w http.ResponseWriter, r *http.Request) (models.SessionOwner, string, string, bool) {
+	id := mux.Vars(r)["id"]
+	if r.Method == http.MethodGet {
+		claims, err := a.getRequestClaims(parseAuthHeader(r))
+		if err == nil && claims.Eid != 0 && claims.Subject == id && !stringInSliceCaseInsensitive(claims.Roles, models.AdminRole.String()) {
+			return models.SessionOwner{IdentityID: claims.Eid}, id, models.ExternalDomain, true
+		}
+	}
+	user, err := a.Users.GetUserByNameOrID(id)
+	switch err.(type) {
+	case *models.NotFoundError:
+		jsonapiError(w, http.StatusNotFound, err.Error())
+		return models.SessionOwner{}, "", "", false
+	case *models.DBError:
+		jsonapiError(w, http.StatusInternalServerError, err.Error())
+		return models.SessionOwner{}, "", "", false
+	}
+	domain := user.Backend
+	if domain == "" {
+		domain = models.InternalDomain
+	}
+	return models.SessionOwner{UserID: user.ID}, user.Username, domain, true
+}
+
+// identitySessionOwner returns the owner of the sessions of the external identity of the {id} path parameter
+func (a *App) identitySessionOwner(w http.ResponseWriter, r *http.Request) (models.SessionOwner, string, bool) {
+	e, err := a.ExternalIdentities.GetExternalIdentityByID(mux.Vars(r)["id"])
+	switch err.(type) {
+	case *models.NotFoundError:
+		jsonapiError(w, http.StatusNotFound, err.Error())
+		return models.SessionOwner{}, "", false
+	case *models.DBError:
+		jsonapiError(w, http.StatusInternalServerError, err.Error())
+		return models.SessionOwner{}, "", false
+	}
+	return models.SessionOwner{IdentityID: e.ID}, e.Username, true
+}
+
+// UserSessionsHandler lists (GET) or terminates (DELETE) the active sessions of the user, the sessions
+// are listed to the administrators and to the user only
+func (a *App) UserSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	owner, username, domain, ok := a.sessionOwner(w, r)
+	if !ok {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		claims, err := a.getRequestClaims(parseAuthHeader(r))
+		if err != nil || (!ownsSessions(claims, owner, username) && !stringInSliceCaseInsensitive(claims.Roles, models.AdminRole.String())) {
+			jsonapiError(w, http.StatusForbidden, "forbidden request")
+			return
+		}
+		a.listSessions(w, owner)
+	case http.MethodDelete:
+		a.terminateSessions(w, owner, username, domain)
+	}
+}
+
+// ownsSessions reports whether the sessions of the owner are the sessions of the subject of the token
+func ownsSessions(claims *customClaims, owner models.SessionOwner, username string) bool {
+	if claims.Subject != username || claims.Azt == models.ServiceAccountDomain {
+		return false
+	}
+	return claims.Eid == owner.IdentityID
+}
+
+// listSessions writes the active sessions of the owner
+func (a *App) listSessions(w http.ResponseWriter, owner models.SessionOwner) {
+	sessions, err := a.Sessions.GetUserSessions(owner)
+	if err != nil {
+		jsonapiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	resources := make([]*SessionResource, 0)
+	for _, s := range sessions {
+		resources = append(resources, newSessionResource(s))
+	}
+	jsonapiSuccess(w, resources, http.StatusOK)
+}
+
+// terminateSessions removes all the sessions of the owner
+func (a *App) terminateSessions(w http.ResponseWriter, owner models.SessionOwner, username, domain string) {
+	count, err := a.Sessions.DeleteUserSessions(owner)
+	if err != nil {
+		jsonapiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err = a.Events.CreateSessionTerminatedEvent(username, domain, count); err != nil {
+		log.WithError(err).Warnf("failed to store session termination event")
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// UserSessionHandler terminates (DELETE) a session of the user
+func (a *App) UserSessionHandler(w http.ResponseWriter, r *http.Request) {
+	owner, _, _, ok := a.sessionOwner(w, r)
+	if !ok {
+		return
+	}
+	a.terminateSession(w, mux.Vars(r)["sid"], func(s *models.Session) bool { return s.Owner() == owner })
+}
+
+// ExternalIdentitySessionsHandler lists (GET) or terminates (DELETE) the active sessions of the external identity
+func (a *App) ExternalIdentitySessionsHandler(w http.ResponseWriter, r *http.Request) {
+	owner, username, ok := a.identitySessionOwner(w, r)
+	if !ok {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		a.listSessions(w, owner)
+	case http.MethodDelete:
+		a.terminateSessions(w, owner, username, models.ExternalDomain)
+	}
+}
+
+// ExternalIdentitySessionHandler terminates (DELETE) a session of the external identity
+func (a *App) ExternalIdentitySessionHandler(w http.ResponseWriter, r *http.Request) {
+	owner, _, ok := a.identitySessionOwner(w, r)
+	if !ok {
+		return
+	}
+	a.terminateSession(w, mux.Vars(r)["sid"], func(s *models.Session) bool { return s.Owner() == owner })
+}
+
+// terminateSession removes the session sid if it belongs to the expected owner, the tokens issued for it
+// are rejected afterwards
+func (a *App) terminateSession(w http.ResponseWriter, sid string, owned func(*models.Session) bool) {
+	s, err := a.Sessions.GetSession(sid)
+	switch err.(type) {
+	case *models.NotFoundError:
+		jsonapiError(w, http.StatusNotFound, err.Error())
+		return
+	case *models.DBError:
+		jsonapiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !owned(s) {
+		jsonapiError(w, http.StatusNotFound, "session not present in database")
+		return
+	}
+	switch err := a.Sessions.DeleteSession(s).(type) {
+	case *models.NotFoundError:
+		jsonapiError(w, http.StatusNotFound, err.Error())
+		return
+	case *models.DBError:
+		jsonapiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err = a.Events.CreateSessionTerminatedEvent(s.Username, s.Domain, 1); err != nil {
+		log.WithError(err).Warnf("failed to store session termination event")
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,466 @@
+package controllers
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"github.com/goidp/models"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/jsonapi"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+var sessionColumns = []string{"id", "created_at", "sid", "username", "domain", "ip", "user_agent", "last_renewed_at", "expires_at", "user_id", "identity_id"}
+
+func expectSessionTerminatedEvent(s *Suite) {
+	insertArgs := []driver.Value{sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()}
+	s.mock.ExpectBegin()
+	s.mock.ExpectQuery(regexp.QuoteMeta(
+		`INSERT INTO "events" ("created_at","updated_at","deleted_at","username","activated","description","modified","authn_domain","severity") VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9) RETURNING "id"`)).
+		WithArgs(insertArgs...).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	s.mock.ExpectCommit()
+}
+
+// expectSessionOwner expects the lookup of the local user the sessions of the {id} path parameter belong to
+func expectSessionOwner(s *Suite, username string, id int) {
+	s.mock.ExpectQuery(regexp.QuoteMeta(
+		`SELECT * FROM "users" WHERE username = $1 AND "users"."deleted_at" IS NULL ORDER BY "users"."id" LIMIT 1`)).
+		WithArgs(username).WillReturnRows(sqlmock.NewRows([]string{"id", "username"}).AddRow(id, username))
+	s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "user_roles" WHERE "user_roles"."user_id" = $1`)).
+		WithArgs(id).WillReturnRows(sqlmock.NewRows([]string{"user_id", "role_id"}))
+}
+
+func TestUserSessionsHandler(t *testing.T) {
+	s, err := SetupSuite()
+	if err != nil {
+		t.Fatalf("error setting up test suite: %s", err.Error())
+	}
+	a := NewApp(s.DB, &Config{})
+	a.config.SignKey, _ = ReadPrivateKey(PKCS1_Private_Key)
+	a.config.VerifyKey = &a.config.SignKey.PublicKey
+	token := func(username string, eid uint) string {
+		rL, _ := models.NewRoleList([]string{models.MonitorRole.String()})
+		t, _ := generateToken(newCustomClaims(&models.User{Username: username, Roles: rL, IdentityID: eid}, models.InternalDomain, time.Minute, nil, ""), "", a.config.SignKey)
+		return t
+	}
+
+	tt := []struct {
+		name  string
+		token string
+		// owner is the user id and the identity id the sessions are looked up by, nil if not looked up
+		owner  []driver.Value
+		local  bool
+		status int
+	}{
+		{
+			name:   "sessions of another user",
+			token:  token("john", 0),
+			local:  true,
+			status: http.StatusForbidden,
+		},
+		{
+			name:   "sessions of the local user",
+			token:  token("jdoe", 0),
+			owner:  []driver.Value{7, 0},
+			local:  true,
+			status: http.StatusOK,
+		},
+		{
+			// the external identity jdoe does not see the sessions of the local user jdoe
+			name:   "sessions of the external identity with the username of a local user",
+			token:  token("jdoe", 4),
+			owner:  []driver.Value{0, 4},
+			status: http.StatusOK,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.local {
+				expectSessionOwner(s, "jdoe", 7)
+			}
+			if tc.owner != nil {
+				s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "sessions" WHERE (user_id = $1 AND identity_id = $2 AND expires_at > $3)`)).
+					WithArgs(append(tc.owner, sqlmock.AnyArg())...).
+					WillReturnRows(sqlmock.NewRows(sessionColumns).
+						AddRow(2, time.Now(), "sid-2", "jdoe", models.ExternalDomain, "10.0.0.2", "curl/7.79", time.Now(), time.Now().Add(time.Hour), tc.owner[0], tc.owner[1]).
+						AddRow(1, time.Now().Add(-time.Hour), "sid-1", "jdoe", models.ExternalDomain, "10.0.0.1", "Mozilla/5.0", time.Time{}, time.Now().Add(time.Minute), tc.owner[0], tc.owner[1]))
+			}
+
+			req, _ := http.NewRequest(http.MethodGet, "/v1.0/user/jdoe/session", nil)
+			req.Header.Set(headerAuthorization, "Bearer "+tc.token)
+			req = mux.SetURLVars(req, map[string]string{"id": "jdoe"})
+			rec := httptest.NewRecorder()
+			a.UserSessionsHandler(rec, req)
+
+			if err := s.mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+			if rec.Code != tc.status {
+				t.Fatalf("expected status %d; got %d: %s", tc.status, rec.Code, rec.Body.String())
+			}
+			if tc.status != http.StatusOK {
+				return
+			}
+			sessions, err := jsonapi.UnmarshalManyPayload(rec.Body, reflect.TypeOf(new(SessionResource)))
+			if err != nil {
+				t.Fatalf("could not unmarshal response: %s", err)
+			}
+			if len(sessions) != 2 || sessions[0].(*SessionResource).ID != "sid-2" || sessions[0].(*SessionResource).IP != "10.0.0.2" {
+				t.Errorf("unexpected sessions %+v", sessions)
+			}
+			if sessions[1].(*SessionResource).LastRenewedAt != nil {
+				t.Errorf("expected a session never renewed")
+			}
+		})
+	}
+
+	t.Run("terminate all sessions", func(t *testing.T) {
+		expectSessionOwner(s, "jdoe", 7)
+		s.mock.ExpectBegin()
+		s.mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "sessions" WHERE user_id = $1 AND identity_id = $2`)).
+			WithArgs(7, 0).WillReturnResult(sqlmock.NewResult(0, 2))
+		s.mock.ExpectCommit()
+		expectSessionTerminatedEvent(s)
+
+		req, _ := http.NewRequest(http.MethodDelete, "/v1.0/user/jdoe/session", nil)
+		req = mux.SetURLVars(req, map[string]string{"id": "jdoe"})
+		rec := httptest.NewRecorder()
+		a.UserSessionsHandler(rec, req)
+
+		if err := s.mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+		if rec.Code != http.StatusNoContent {
+			t.Errorf("expected status %d; got %d", http.StatusNoContent, rec.Code)
+		}
+	})
+
+	t.Run("terminate all sessions of an external identity", func(t *testing.T) {
+		s.mock.ExpectQuery(regexp.QuoteMeta(
+			`SELECT * FROM "external_identities" WHERE "external_identities"."id" = $1 AND "external_identities"."deleted_at" IS NULL LIMIT 1`)).
+			WithArgs(4).WillReturnRows(sqlmock.NewRows([]string{"id", "username"}).AddRow(4, "jdoe"))
+		s.mock.ExpectBegin()
+		s.mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "sessions" WHERE user_id = $1 AND identity_id = $2`)).
+			WithArgs(0, 4).WillReturnResult(sqlmock.NewResult(0, 1))
+		s.mock.ExpectCommit()
+		expectSessionTerminatedEvent(s)
+
+		req, _ := http.NewRequest(http.MethodDelete, "/v1.0/identity/4/session", nil)
+		req = mux.SetURLVars(req, map[string]string{"id": "4"})
+		rec := httptest.NewRecorder()
+		a.ExternalIdentitySessionsHandler(rec, req)
+
+		if err := s.mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+		if rec.Code != http.StatusNoContent {
+			t.Errorf("expected status %d; got %d", http.StatusNoContent, rec.Code)
+		}
+	})
+}
+
+func TestUserSessionHandler(t *testing.T) {
+	s, err := SetupSuite()
+	if err != nil {
+		t.Fatalf("error setting up test suite: %s", err.Error())
+	}
+	a := NewApp(s.DB, &Config{})
+
+	tt := []struct {
+		name  string
+		sid   string
+		owner string
+		// userID and identityID identify the owner of the session
+		userID     int
+		identityID int
+		found      bool
+		deleted    bool
+		status     int
+	}{
+		{
+			name:    "terminate a session",
+			sid:     "sid-1",
+			owner:   "jdoe",
+			userID:  7,
+			found:   true,
+			deleted: true,
+			status:  http.StatusNoContent,
+		},
+		{
+			name:   "session of another user",
+			sid:    "sid-2",
+			owner:  "admin",
+			userID: 1,
+			found:  true,
+			status: http.StatusNotFound,
+		},
+		{
+			name:       "session of an external identity with the same username",
+			sid:        "sid-4",
+			owner:      "jdoe",
+			identityID: 4,
+			found:      true,
+			status:     http.StatusNotFound,
+		},
+		{
+			name:   "unknown session",
+			sid:    "sid-3",
+			status: http.StatusNotFound,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			expectSessionOwner(s, "jdoe", 7)
+			rows := sqlmock.NewRows(sessionColumns)
+			if tc.found {
+				rows.AddRow(1, time.Now(), tc.sid, tc.owner, models.InternalDomain, "10.0.0.1", "curl/7.79", time.Time{}, time.Now().Add(time.Hour), tc.userID, tc.identityID)
+			}
+			s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "sessions" WHERE (sid = $1 AND expires_at > $2)`)).
+				WithArgs(tc.sid, sqlmock.AnyArg()).WillReturnRows(rows)
+			if tc.deleted {
+				s.mock.ExpectBegin()
+				s.mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "sessions" WHERE "sessions"."id" = $1`)).
+					WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+				s.mock.ExpectCommit()
+				expectSessionTerminatedEvent(s)
+			}
+
+			req, _ := http.NewRequest(http.MethodDelete, "/v1.0/user/jdoe/session/"+tc.sid, nil)
+			req = mux.SetURLVars(req, map[string]string{"id": "jdoe", "sid": tc.sid})
+			rec := httptest.NewRecorder()
+			a.UserSessionHandler(rec, req)
+
+			if err := s.mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+			if rec.Code != tc.status {
+				t.Errorf("expected status %d; got %d: %s", tc.status, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestJWTMiddlewareSession(t *testing.T) {
+	s, err := SetupSuite()
+	if err != nil {
+		t.Fatalf("error setting up test suite: %s", err.Error())
+	}
+	a := NewApp(s.DB, &Config{})
+	a.config.SignKey, _ = ReadPrivateKey(PKCS1_Private_Key)
+	a.config.VerifyKey = &a.config.SignKey.PublicKey
+	rL, _ := models.NewRoleList([]string{models.AdminRole.String()})
+
+	claims := newCustomClaims(&models.User{Username: "admin", Roles: rL}, models.InternalDomain, time.Minute, nil, "")
+	claims.Sid = "sid-1"
+	token, _ := generateToken(claims, "", a.config.SignKey)
+
+	tt := []struct {
+		name   string
+		active bool
+		status int
+	}{
+		{
+			name:   "active session",
+			active: true,
+			status: http.StatusOK,
+		},
+		{
+			name:   "terminated session",
+			status: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			rows := sqlmock.NewRows(sessionColumns)
+			if tc.active {
+				rows.AddRow(1, time.Now(), "sid-1", "admin", models.InternalDomain, "10.0.0.1", "curl/7.79", time.Time{}, time.Now().Add(time.Hour), 1, 0)
+			}
+			s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "sessions" WHERE (sid = $1 AND expires_at > $2)`)).
+				WithArgs("sid-1", sqlmock.AnyArg()).WillReturnRows(rows)
+
+			req, _ := http.NewRequest(http.MethodGet, "/v1.0/user", nil)
+			req.Header.Set(headerAuthorization, "Bearer "+token)
+			rec := httptest.NewRecorder()
+			a.jwtMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}), "user").ServeHTTP(rec, req)
+
+			if err := s.mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+			if rec.Code != tc.status {
+				t.Errorf("expected status %d; got %d", tc.status, rec.Code)
+			}
+		})
+	}
+}
+
+func TestStartSessionLimit(t *testing.T) {
+	s, err := SetupSuite()
+	if err != nil {
+		t.Fatalf("error setting up test suite: %s", err.Error())
+	}
+	rL, _ := models.NewRoleList([]string{models.HelpdeskRole.String(), models.MonitorRole.String()})
+	operator := &models.User{Model: gorm.Model{ID: 7}, Username: "jdoe", Roles: rL}
+
+	tt := []struct {
+		name     string
+		evict    bool
+		sessions [][]interface{}
+		deleted  []int
+		err      error
+	}{
+		{
+			name: "first session",
+		},
+		{
+			name:     "limit reached",
+			sessions: [][]interface{}{{1, time.Now().Add(-time.Minute), time.Time{}}},
+			err:      errSessionLimit,
+		},
+		{
+			name:     "oldest session evicted",
+			evict:    true,
+			sessions: [][]interface{}{{2, time.Now().Add(-time.Minute), time.Time{}}, {1, time.Now().Add(-time.Hour), time.Now().Add(-time.Minute)}},
+			deleted:  []int{2, 1},
+		},
+		{
+			name:     "idle session not counted",
+			sessions: [][]interface{}{{1, time.Now().Add(-time.Hour), time.Now().Add(-20 * time.Minute)}},
+			deleted:  []int{1},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			// the lowest limit of the user roles applies
+			a := NewApp(s.DB, &Config{
+				RenewTokenExpireTime: time.Hour,
+				SessionIdleTimeout:   15 * time.Minute,
+				MaxSessions:          map[string]int{"helpdesk": 1, "MONITOR": 3},
+				EvictOldestSession:   tc.evict,
+			})
+			rows := sqlmock.NewRows(sessionColumns)
+			for _, session := range tc.sessions {
+				rows.AddRow(session[0], session[1], "sid", "jdoe", models.InternalDomain, "10.0.0.1", "curl/7.79", session[2], time.Now().Add(time.Hour), 7, 0)
+			}
+			// the logins of the user are serialized by a lock held until the session is stored, the sessions
+			// of the external identities with the same username are not counted
+			s.mock.ExpectBegin()
+			s.mock.ExpectExec(regexp.QuoteMeta(`SELECT pg_advisory_xact_lock(hashtext($1))`)).
+				WithArgs("sessions/user/7").WillReturnResult(sqlmock.NewResult(0, 0))
+			s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "sessions" WHERE (user_id = $1 AND identity_id = $2 AND expires_at > $3)`)).
+				WithArgs(7, 0, sqlmock.AnyArg()).WillReturnRows(rows)
+			if len(tc.deleted) > 0 {
+				args := make([]driver.Value, 0, len(tc.deleted))
+				for _, id := range tc.deleted {
+					args = append(args, id)
+				}
+				s.mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "sessions" WHERE id IN (`)).
+					WithArgs(args...).WillReturnResult(sqlmock.NewResult(0, int64(len(tc.deleted))))
+			}
+			if tc.err == nil {
+				s.mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "sessions"`)).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+				s.mock.ExpectCommit()
+			} else {
+				s.mock.ExpectRollback()
+			}
+			if len(tc.deleted) > 0 {
+				expectSessionTerminatedEvent(s)
+			}
+
+			req, _ := http.NewRequest(http.MethodPost, "/v1.0/session", nil)
+			session, err := a.startSession(req, operator, models.InternalDomain)
+
+			if err := s.mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+			if err != tc.err {
+				t.Fatalf("expected error %v; got %v", tc.err, err)
+			}
+			if err == nil && time.Until(session.ExpiresAt) > time.Hour {
+				t.Errorf("unexpected session expiration %s", session.ExpiresAt)
+			}
+		})
+	}
+}
+
+func TestRenewTokenHandlerIdleSession(t *testing.T) {
+	s, err := SetupSuite()
+	if err != nil {
+		t.Fatalf("error setting up test suite: %s", err.Error())
+	}
+	a := NewApp(s.DB, &Config{AccessTokenExpireTime: time.Minute, RenewTokenExpireTime: time.Hour, SessionIdleTimeout: 15 * time.Minute})
+	a.config.SignKey, _ = ReadPrivateKey(PKCS1_Private_Key)
+	a.config.VerifyKey = &a.config.SignKey.PublicKey
+	_, renewToken, err := a.issueTokens(&models.User{Username: "jdoe"}, models.InternalDomain, time.Minute, nil, "", "", "sid-1")
+	if err != nil {
+		t.Fatalf("error generating tokens: %s", err)
+	}
+
+	tt := []struct {
+		name         string
+		lastActivity time.Time
+		status       int
+	}{
+		{
+			name:         "recently renewed session",
+			lastActivity: time.Now().Add(-5 * time.Minute),
+			status:       http.StatusOK,
+		},
+		{
+			name:         "idle session",
+			lastActivity: time.Now().Add(-20 * time.Minute),
+			status:       http.StatusUnauthorized,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			requestBody := bytes.NewBuffer(nil)
+			if err := jsonapi.MarshalPayload(requestBody, &RenewTokenHandlerRequest{UserID: "jdoe", RenewToken: renewToken}); err != nil {
+				t.Fatalf("could not marshal request body %v", err)
+			}
+			req, _ := http.NewRequest(http.MethodPost, "/v1.0/renew", requestBody)
+			rec := httptest.NewRecorder()
+
+			s.mock.ExpectQuery(regexp.QuoteMeta(
+				`SELECT * FROM "users" WHERE username = $1 AND "users"."deleted_at" IS NULL ORDER BY "users"."id" LIMIT 1`)).
+				WithArgs("jdoe").
+				WillReturnRows(sqlmock.NewRows([]string{"Username", "Version"}).AddRow("jdoe", 0))
+			s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "sessions" WHERE (sid = $1 AND expires_at > $2)`)).
+				WithArgs("sid-1", sqlmock.AnyArg()).
+				WillReturnRows(sqlmock.NewRows(sessionColumns).
+					AddRow(1, time.Now().Add(-time.Hour), "sid-1", "jdoe", models.InternalDomain, "10.0.0.1", "curl/7.79", tc.lastActivity, time.Now().Add(time.Hour), 7, 0))
+			s.mock.ExpectBegin()
+			if tc.status == http.StatusOK {
+				s.mock.ExpectExec(regexp.QuoteMeta(`UPDATE "sessions" SET "last_renewed_at"=$1`)).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			} else {
+				s.mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "sessions" WHERE "sessions"."id" = $1`)).
+					WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+			s.mock.ExpectCommit()
+
+			a.RenewTokenHandler(rec, req)
+
+			if err := s.mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+			if rec.Code != tc.status {
+				t.Errorf("expected status %d; got %d: %s", tc.status, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
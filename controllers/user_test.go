@@ -11,7 +11,9 @@ import (
 	"reflect"
 	"regexp"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/google/jsonapi"
@@ -20,6 +22,14 @@ import (
 	"gorm.io/gorm"
 )
 
+// expectRevision expects the change of the user id read at revision, affected is 0 if the user changed
+// concurrently
+func expectRevision(s *Suite, id, revision int, affected int64) {
+	s.mock.ExpectExec(regexp.QuoteMeta(
+		`UPDATE "users" SET "revision"=$1 WHERE revision = $2 AND "users"."deleted_at" IS NULL AND "id" = $3`)).
+		WithArgs(revision+1, revision, id).WillReturnResult(sqlmock.NewResult(0, affected))
+}
+
 func TestCreateUsersHandler(t *testing.T) {
 	s, err := SetupSuite()
 	if err != nil {
@@ -90,17 +100,19 @@ func TestCreateUsersHandler(t *testing.T) {
 
 			if tc.status == http.StatusOK {
 				s.mock.ExpectQuery(regexp.QuoteMeta(
-					`SELECT * FROM "users" WHERE username = $1 AND "users"."deleted_at" IS NULL`)).
-					WithArgs(tc.username).WillReturnRows(sqlmock.NewRows(nil))
+					`SELECT * FROM "users" WHERE username = $1 OR lower(email) = lower($2)`)).
+					WithArgs(tc.username, tc.username).WillReturnRows(sqlmock.NewRows(nil))
+				s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT count(*) FROM "service_accounts" WHERE name = $1`)).
+					WithArgs(tc.username).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
 
 				s.mock.ExpectBegin()
 				s.EventRepo.DB.Begin()
 
-				insertArgsUsers := []driver.Value{sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()}
+				insertArgsUsers := []driver.Value{sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), 0, "active", nil, "", "", "", "", "", false, "{}", "", ""}
 				insertArgsEvents := []driver.Value{sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()}
 
 				s.mock.ExpectQuery(regexp.QuoteMeta(
-					`INSERT INTO "users" ("created_at","updated_at","deleted_at","username","password","version") VALUES ($1,$2,$3,$4,$5,$6) RETURNING "id"`)).
+					`INSERT INTO "users" ("created_at","updated_at","deleted_at","username","password","version","revision","status","expires_at","display_name","email","phone","locale","team","email_verified","attributes","backend","subject") VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15,$16,$17,$18) RETURNING "id"`)).
 					WithArgs(insertArgsUsers...).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
 				s.mock.ExpectCommit()
 
@@ -114,8 +126,10 @@ func TestCreateUsersHandler(t *testing.T) {
 				s.mock.ExpectCommit()
 			} else if tc.name == "wrong credentials" {
 				s.mock.ExpectQuery(regexp.QuoteMeta(
-					`SELECT * FROM "users" WHERE username = $1 AND "users"."deleted_at" IS NULL`)).
-					WithArgs(tc.username).WillReturnRows(sqlmock.NewRows(nil))
+					`SELECT * FROM "users" WHERE username = $1 OR lower(email) = lower($2)`)).
+					WithArgs(tc.username, tc.username).WillReturnRows(sqlmock.NewRows(nil))
+				s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT count(*) FROM "service_accounts" WHERE name = $1`)).
+					WithArgs(tc.username).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
 			}
 
 			a.UsersHandler(rec, req)
@@ -196,7 +210,10 @@ func TestGetUsersHandler(t *testing.T) {
 			s.EventRepo.DB.Begin()
 
 			s.mock.ExpectQuery(regexp.QuoteMeta(
-				`SELECT id FROM "users"`)).
+				`SELECT count(*) FROM "users" WHERE "users"."deleted_at" IS NULL`)).
+				WithArgs().WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+			s.mock.ExpectQuery(regexp.QuoteMeta(
+				`SELECT * FROM "users" WHERE "users"."deleted_at" IS NULL ORDER BY id LIMIT 25`)).
 				WithArgs().WillReturnRows(sqlmock.NewRows(nil))
 
 			a.UsersHandler(rec, req)
@@ -238,18 +255,30 @@ func TestPatchUserHandler(t *testing.T) {
 	}
 
 	tt := []struct {
-		id       string
-		name     string
-		username string
-		password string
-		status   int
-		err      string
+		id          string
+		name        string
+		username    string
+		password    string
+		roles       []string
+		displayName string
+		// email is taken by another user
+		email string
+		// taken is whether the new username is taken by another user
+		taken bool
+		// ifMatch is the entity tag the changes are based on
+		ifMatch string
+		// version is the version of the user once patched
+		version int
+		status  int
+		err     string
 	}{
 		{
 			id:       "123",
 			name:     "patch user information success",
 			username: "admin",
 			password: "AdminUser1*",
+			roles:    []string{models.AdminRole.String()},
+			version:  2,
 			status:   200,
 		},
 		{
@@ -260,20 +289,50 @@ func TestPatchUserHandler(t *testing.T) {
 			status:   400,
 			err:      "password does not meet security requirements: password must be at least 8 characters long",
 		},
+		{
+			// the profile edit made since the entity tag has been read changed the revision of the user,
+			// not its version
+			id:          "123",
+			name:        "stale entity tag after a profile edit",
+			displayName: "Administrator",
+			ifMatch:     `W/"3"`,
+			status:      412,
+			err:         `user version mismatch, current version is W/"4"`,
+		},
+		{
+			// the new username is validated before the user is stored
+			id:       "123",
+			name:     "username taken by another user",
+			username: "jdoe",
+			taken:    true,
+			status:   400,
+			err:      "user jdoe already present in database",
+		},
+		{
+			// the email is validated before the user is stored
+			id:     "123",
+			name:   "email in use",
+			email:  "jdoe@example.com",
+			status: 400,
+			err:    "email jdoe@example.com already in use",
+		},
 	}
 
-	rL, _ := models.NewRoleList([]string{models.AdminRole.String()})
 	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("admin"), 8)
 
 	adminUser := &models.User{
 		Model:    gorm.Model{ID: 123},
 		Username: "admin",
 		Version:  1,
-		Roles:    rL,
+		Revision: 4,
 	}
 	adminUser.Password = string(hashedPassword)
 
 	a := NewApp(s.DB, &Config{})
+	a.config.SignKey, _ = ReadPrivateKey(PKCS1_Private_Key)
+	a.config.VerifyKey = &a.config.SignKey.PublicKey
+	rL, _ := models.NewRoleList([]string{models.AdminRole.String()})
+	adminToken, _ := generateToken(newCustomClaims(&models.User{Username: "admin", Roles: rL}, models.InternalDomain, time.Minute, nil, ""), "", a.config.SignKey)
 
 	for _, tc := range tt {
 		t.Run(tc.name, func(t *testing.T) {
@@ -283,7 +342,13 @@ func TestPatchUserHandler(t *testing.T) {
 				ID:       tc.id,
 				Username: tc.username,
 				Password: tc.password,
-				Roles:    rL.String(),
+				Roles:    tc.roles,
+			}
+			if tc.displayName != "" {
+				p.DisplayName = &tc.displayName
+			}
+			if tc.email != "" {
+				p.Email = &tc.email
 			}
 
 			requestBody := bytes.NewBuffer(nil)
@@ -296,6 +361,10 @@ func TestPatchUserHandler(t *testing.T) {
 			if err != nil {
 				t.Fatalf("could not create request: %v", err)
 			}
+			req.Header.Set(headerAuthorization, "Bearer "+adminToken)
+			if tc.ifMatch != "" {
+				req.Header.Set("If-Match", tc.ifMatch)
+			}
 
 			vars := map[string]string{
 				"id": "123",
@@ -303,84 +372,61 @@ func TestPatchUserHandler(t *testing.T) {
 
 			req = mux.SetURLVars(req, vars)
 
-			s.mock.ExpectBegin()
-			s.EventRepo.DB.Begin()
-
 			args := []driver.Value{int64(123)}
 			queryArgs := []driver.Value{sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()}
 			twoArgs := []driver.Value{sqlmock.AnyArg(), sqlmock.AnyArg()}
 			nineArgs := []driver.Value{sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()}
 
+			s.mock.ExpectQuery(regexp.QuoteMeta(
+				`SELECT * FROM "users" WHERE "users"."id" = $1 AND "users"."deleted_at" IS NULL ORDER BY "users"."id" LIMIT 1`)).
+				WithArgs(args...).WillReturnRows(sqlmock.NewRows([]string{"id", "username", "password", "version", "revision"}).
+				AddRow(adminUser.ID, adminUser.Username, adminUser.Password, adminUser.Version, adminUser.Revision))
+			s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "user_roles" WHERE "user_roles"."user_id" = $1`)).
+				WithArgs(adminUser.ID).WillReturnRows(sqlmock.NewRows([]string{"user_id", "role_id"}))
+
+			if tc.taken {
+				s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "users" WHERE username = $1 OR lower(email) = lower($2)`)).
+					WithArgs(tc.username, tc.username).WillReturnRows(sqlmock.NewRows([]string{"id", "username"}).AddRow(7, tc.username))
+			}
+			if tc.email != "" {
+				s.mock.ExpectBegin()
+				s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "users" WHERE (lower(email) = lower($1) OR username = $2) AND id <> $3`)).
+					WithArgs(tc.email, tc.email, adminUser.ID).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(7))
+				s.mock.ExpectRollback()
+			}
 			if tc.status == http.StatusOK {
-				s.mock.ExpectQuery(regexp.QuoteMeta(
-					`SELECT * FROM "users" WHERE "users"."id" = $1 AND "users"."deleted_at" IS NULL ORDER BY "users"."id" LIMIT 1`)).
-					WithArgs(args...).WillReturnRows(sqlmock.NewRows([]string{"Username", "Password", "Version"}).
-					AddRow(adminUser.Username, adminUser.Password, adminUser.Version))
-
-				s.mock.ExpectQuery(regexp.QuoteMeta(
-					`SELECT * FROM "users" WHERE "users"."id" = $1 AND "users"."deleted_at" IS NULL ORDER BY "users"."id" LIMIT 1`)).
-					WithArgs(args...).WillReturnRows(sqlmock.NewRows([]string{"Username", "Password", "Version"}).
-					AddRow(adminUser.Username, adminUser.Password, adminUser.Version))
-
+				// the user, its roles and its profile are stored in a single transaction
 				s.mock.ExpectBegin()
-				s.EventRepo.DB.Begin()
-
+				expectRevision(s, int(adminUser.ID), adminUser.Revision, 1)
 				s.mock.ExpectExec(regexp.QuoteMeta(
-					`UPDATE "users" SET "updated_at"=$1,"username"=$2,"password"=$3,"version"=$4 WHERE "users"."deleted_at" IS NULL AND "id" = $5`)).
-					WithArgs(queryArgs...).WillReturnResult(sqlmock.NewResult(0, 1))
-
+					`UPDATE "users" SET "updated_at"=$1,"username"=$2,"password"=$3,"version"=$4,"revision"=$5 WHERE "users"."deleted_at" IS NULL AND "id" = $6`)).
+					WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), tc.version, adminUser.Revision+1, adminUser.ID).
+					WillReturnResult(sqlmock.NewResult(0, 1))
 				s.mock.ExpectQuery(regexp.QuoteMeta(
 					`INSERT INTO "roles" ("created_at","updated_at","deleted_at","name","id") VALUES ($1,$2,$3,$4,$5) ON CONFLICT DO NOTHING RETURNING "id"`)).
 					WithArgs(queryArgs...).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
-
 				s.mock.ExpectExec(regexp.QuoteMeta(
 					`INSERT INTO "user_roles" ("user_id","role_id") VALUES ($1,$2) ON CONFLICT DO NOTHING`)).
 					WithArgs(twoArgs...).WillReturnResult(sqlmock.NewResult(0, 1))
-				s.mock.ExpectCommit()
-
-				s.mock.ExpectBegin()
-				s.EventRepo.DB.Begin()
-
 				s.mock.ExpectExec(regexp.QuoteMeta(
 					`UPDATE "users" SET "updated_at"=$1 WHERE "users"."deleted_at" IS NULL AND "id" = $2`)).
 					WithArgs(twoArgs...).WillReturnResult(sqlmock.NewResult(0, 1))
-
 				s.mock.ExpectQuery(regexp.QuoteMeta(
 					`INSERT INTO "roles" ("created_at","updated_at","deleted_at","name","id") VALUES ($1,$2,$3,$4,$5) ON CONFLICT DO NOTHING RETURNING "id"`)).
 					WithArgs(queryArgs...).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
-
 				s.mock.ExpectExec(regexp.QuoteMeta(
 					`INSERT INTO "user_roles" ("user_id","role_id") VALUES ($1,$2) ON CONFLICT DO NOTHING`)).
 					WithArgs(twoArgs...).WillReturnResult(sqlmock.NewResult(0, 1))
-
-				s.mock.ExpectCommit()
-
-				s.mock.ExpectBegin()
-				s.EventRepo.DB.Begin()
-
 				s.mock.ExpectExec(regexp.QuoteMeta(
 					`DELETE FROM "user_roles" WHERE "user_roles"."user_id" = $1 AND "user_roles"."role_id" <> $2`)).
 					WithArgs(twoArgs...).WillReturnResult(sqlmock.NewResult(0, 1))
-
 				s.mock.ExpectCommit()
 
 				s.mock.ExpectBegin()
-				s.EventRepo.DB.Begin()
-
 				s.mock.ExpectQuery(regexp.QuoteMeta(
 					`INSERT INTO "events" ("created_at","updated_at","deleted_at","username","activated","description","modified","authn_domain","severity") VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9) RETURNING "id"`)).
 					WithArgs(nineArgs...).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
 				s.mock.ExpectCommit()
-			} else {
-				s.mock.ExpectQuery(regexp.QuoteMeta(
-					`SELECT * FROM "users" WHERE "users"."id" = $1 AND "users"."deleted_at" IS NULL ORDER BY "users"."id" LIMIT 1`)).
-					WithArgs(args...).WillReturnRows(sqlmock.NewRows([]string{"Username", "Password", "Version"}).
-					AddRow(adminUser.Username, adminUser.Password, adminUser.Version))
-
-				s.mock.ExpectQuery(regexp.QuoteMeta(
-					`SELECT * FROM "users" WHERE "users"."id" = $1 AND "users"."deleted_at" IS NULL ORDER BY "users"."id" LIMIT 1`)).
-					WithArgs(args...).WillReturnRows(sqlmock.NewRows([]string{"Username", "Password", "Version"}).
-					AddRow(adminUser.Username, adminUser.Password, adminUser.Version))
 			}
 
 			a.UserHandler(rec, req)
@@ -442,6 +488,14 @@ func TestDeleteUserHandler(t *testing.T) {
 			status:   404,
 			err:      "user  not found in database",
 		},
+		{
+			name:     "delete the user with id 1",
+			id:       "1",
+			username: "admin",
+			password: "AdminUser1*",
+			status:   400,
+			err:      "user with id 1 cannot be deleted",
+		},
 	}
 
 	a := NewApp(s.DB, &Config{})
@@ -503,13 +557,10 @@ func TestDeleteUserHandler(t *testing.T) {
 				s.mock.ExpectBegin()
 				s.EventRepo.DB.Begin()
 
+				// the user is soft deleted, its roles are kept for a restore
 				s.mock.ExpectExec(regexp.QuoteMeta(
-					`DELETE FROM "user_roles" WHERE "user_roles"."user_id" = $1`)).
-					WithArgs(args...).WillReturnResult(sqlmock.NewResult(0, 1))
-
-				s.mock.ExpectExec(regexp.QuoteMeta(
-					`DELETE FROM "users" WHERE "users"."id" = $1`)).
-					WithArgs(args...).WillReturnResult(sqlmock.NewResult(0, 1))
+					`UPDATE "users" SET "deleted_at"=$1 WHERE "users"."id" = $2 AND "users"."deleted_at" IS NULL`)).
+					WithArgs(sqlmock.AnyArg(), args[0]).WillReturnResult(sqlmock.NewResult(0, 1))
 
 				s.mock.ExpectCommit()
 
@@ -520,6 +571,11 @@ func TestDeleteUserHandler(t *testing.T) {
 					`INSERT INTO "events" ("created_at","updated_at","deleted_at","username","activated","description","modified","authn_domain","severity") VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9) RETURNING "id"`)).
 					WithArgs(nineArgs...).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
 				s.mock.ExpectCommit()
+			} else if tc.status == 400 {
+				s.mock.ExpectQuery(regexp.QuoteMeta(
+					`SELECT * FROM "users" WHERE "users"."id" = $1 AND "users"."deleted_at" IS NULL ORDER BY "users"."id" LIMIT 1`)).
+					WithArgs(args...).WillReturnRows(sqlmock.NewRows([]string{"id", "Username", "Password", "Version"}).
+					AddRow(adminUser.ID, adminUser.Username, adminUser.Password, adminUser.Version))
 			} else {
 				s.mock.ExpectQuery(regexp.QuoteMeta(
 					`SELECT * FROM "users" WHERE username = $1 AND "users"."deleted_at" IS NULL ORDER BY "users"."id" LIMIT 1`)).
@@ -673,3 +729,577 @@ func TestGetUserHandler(t *testing.T) {
 
 	}
 }
+
+func TestUserStatusTransitions(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+
+	tt := []struct {
+		name      string
+		status    string
+		expiresAt *time.Time
+		to        models.UserStatus
+		state     models.UserStatus
+		valid     bool
+	}{
+		{
+			name:  "disable a user stored before the states",
+			to:    models.UserDisabled,
+			state: models.UserDisabled,
+			valid: true,
+		},
+		{
+			name:   "lock an active user",
+			status: "active",
+			to:     models.UserLocked,
+			state:  models.UserLocked,
+			valid:  true,
+		},
+		{
+			name:   "unlock a locked user",
+			status: "locked",
+			to:     models.UserActive,
+			state:  models.UserActive,
+			valid:  true,
+		},
+		{
+			name:   "lock a disabled user",
+			status: "disabled",
+			to:     models.UserLocked,
+			state:  models.UserDisabled,
+		},
+		{
+			name:   "move back to pending",
+			status: "active",
+			to:     models.UserPending,
+			state:  models.UserActive,
+		},
+		{
+			name:      "active user past its expiration time",
+			status:    "active",
+			expiresAt: &past,
+			to:        models.UserActive,
+			state:     models.UserExpired,
+		},
+		{
+			name:      "expired user given a new expiration time",
+			status:    "active",
+			expiresAt: &future,
+			to:        models.UserActive,
+			state:     models.UserActive,
+			valid:     true,
+		},
+		{
+			name:   "expired user without expiration time",
+			status: "expired",
+			to:     models.UserActive,
+			state:  models.UserActive,
+			valid:  true,
+		},
+		{
+			name:      "disable a user past its expiration time",
+			status:    "active",
+			expiresAt: &past,
+			to:        models.UserDisabled,
+			state:     models.UserDisabled,
+			valid:     true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			u := &models.User{Username: "jdoe", Status: tc.status, ExpiresAt: tc.expiresAt}
+			err := u.SetStatus(tc.to)
+			if tc.valid && err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+			if !tc.valid && err == nil {
+				t.Errorf("invalid transition to %s accepted", tc.to)
+			}
+			if u.State() != tc.state || u.Active() != (tc.state == models.UserActive) {
+				t.Errorf("expected state %s; got %s", tc.state, u.State())
+			}
+			if active := *newSCIMUser(httptest.NewRequest(http.MethodGet, "/scim/v2/Users", nil), u).Active; active != u.Active() {
+				t.Errorf("expected scim active %t; got %t", u.Active(), active)
+			}
+		})
+	}
+}
+
+func TestPatchUserStatusHandler(t *testing.T) {
+	s, err := SetupSuite()
+	if err != nil {
+		t.Fatalf("error setting up test suite: %s", err.Error())
+	}
+	a := NewApp(s.DB, &Config{})
+	a.config.SignKey, _ = ReadPrivateKey(PKCS1_Private_Key)
+	a.config.VerifyKey = &a.config.SignKey.PublicKey
+	token := func(username string, role models.UserRole) string {
+		rL, _ := models.NewRoleList([]string{role.String()})
+		t, _ := generateToken(newCustomClaims(&models.User{Username: username, Roles: rL}, models.InternalDomain, time.Minute, nil, ""), "", a.config.SignKey)
+		return t
+	}
+
+	past := time.Now().Add(-time.Hour)
+
+	tt := []struct {
+		name      string
+		token     string
+		status    string
+		expiresAt *time.Time
+		code      int
+	}{
+		{
+			name:   "changed by a non administrator",
+			token:  token("jdoe", models.MonitorRole),
+			status: "disabled",
+			code:   http.StatusForbidden,
+		},
+		{
+			name:   "changed by the user itself",
+			token:  token("jdoe", models.AdminRole),
+			status: "disabled",
+			code:   http.StatusForbidden,
+		},
+		{
+			name:   "invalid status",
+			token:  token("admin", models.AdminRole),
+			status: "archived",
+			code:   http.StatusBadRequest,
+		},
+		{
+			name:   "invalid transition",
+			token:  token("admin", models.AdminRole),
+			status: "pending",
+			code:   http.StatusBadRequest,
+		},
+		{
+			name:      "activation past the expiration time",
+			token:     token("admin", models.AdminRole),
+			status:    "active",
+			expiresAt: &past,
+			code:      http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			s.mock.ExpectQuery(regexp.QuoteMeta(
+				`SELECT * FROM "users" WHERE "users"."id" = $1 AND "users"."deleted_at" IS NULL ORDER BY "users"."id" LIMIT 1`)).
+				WithArgs(int64(123)).WillReturnRows(sqlmock.NewRows([]string{"username", "version", "status", "expires_at"}).AddRow("jdoe", 2, "active", tc.expiresAt))
+
+			body := `{"data":{"type":"user","attributes":{"status":"` + tc.status + `"}}}`
+			req, _ := http.NewRequest(http.MethodPatch, "/user/123", bytes.NewBufferString(body))
+			req.Header.Set(headerAuthorization, "Bearer "+tc.token)
+			req = mux.SetURLVars(req, map[string]string{"id": "123"})
+			rec := httptest.NewRecorder()
+			a.UserHandler(rec, req)
+
+			if err := s.mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+			if rec.Code != tc.code {
+				t.Errorf("expected status %d; got %d: %s", tc.code, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestCreateSessionHandlerInactiveUser(t *testing.T) {
+	s, err := SetupSuite()
+	if err != nil {
+		t.Fatalf("error setting up test suite: %s", err.Error())
+	}
+	a := NewApp(s.DB, &Config{})
+	a.config.SignKey, _ = ReadPrivateKey(PKCS1_Private_Key)
+	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("s3cr3t"), bcrypt.MinCost)
+	past := time.Now().Add(-time.Hour)
+
+	tt := []struct {
+		name      string
+		status    string
+		expiresAt *time.Time
+	}{
+		{
+			name:   "disabled user",
+			status: "disabled",
+		},
+		{
+			name:   "locked user",
+			status: "locked",
+		},
+		{
+			name:   "pending user",
+			status: "pending",
+		},
+		{
+			name:      "expired user",
+			status:    "active",
+			expiresAt: &past,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "users" WHERE username = $1`)).
+				WithArgs("jdoe").WillReturnRows(sqlmock.NewRows([]string{"username", "password", "status", "expires_at"}).
+				AddRow("jdoe", string(hashedPassword), tc.status, tc.expiresAt))
+			expectEvent(s)
+
+			body := `{"data":{"type":"session","attributes":{"username":"jdoe","password":"s3cr3t"}}}`
+			req, _ := http.NewRequest(http.MethodPost, "/v1.0/session", bytes.NewBufferString(body))
+			rec := httptest.NewRecorder()
+			a.CreateSessionHandler(rec, req)
+
+			if err := s.mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+			if rec.Code != http.StatusUnauthorized {
+				t.Errorf("expected status %d; got %d: %s", http.StatusUnauthorized, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestRestoreUserHandler(t *testing.T) {
+	s, err := SetupSuite()
+	if err != nil {
+		t.Fatalf("error setting up test suite: %s", err.Error())
+	}
+	a := NewApp(s.DB, &Config{})
+
+	tt := []struct {
+		name   string
+		id     string
+		found  bool
+		status int
+	}{
+		{
+			name:   "restore a deleted user",
+			id:     "jdoe",
+			found:  true,
+			status: http.StatusOK,
+		},
+		{
+			name:   "restore a user not deleted",
+			id:     "123",
+			status: http.StatusNotFound,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			rows := sqlmock.NewRows([]string{"id", "username", "version", "deleted_at"})
+			if tc.found {
+				rows.AddRow(7, "jdoe", 2, time.Now())
+			}
+			s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "users" WHERE deleted_at IS NOT NULL AND`)).WillReturnRows(rows)
+			if tc.found {
+				s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "user_roles" WHERE "user_roles"."user_id" = $1`)).
+					WithArgs(7).WillReturnRows(sqlmock.NewRows([]string{"user_id", "role_id"}))
+				s.mock.ExpectBegin()
+				s.mock.ExpectExec(regexp.QuoteMeta(`UPDATE "users" SET "deleted_at"=$1,"revision"=$2,"version"=$3,"updated_at"=$4 WHERE "id" = $5`)).
+					WithArgs(nil, 1, 3, sqlmock.AnyArg(), 7).WillReturnResult(sqlmock.NewResult(0, 1))
+				// the personal access tokens issued before the deletion are not enabled again
+				s.mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "personal_access_tokens" WHERE username = $1`)).
+					WithArgs("jdoe").WillReturnResult(sqlmock.NewResult(0, 2))
+				s.mock.ExpectCommit()
+				expectEvent(s)
+			}
+
+			req, _ := http.NewRequest(http.MethodPost, "/v1.0/user/"+tc.id+"/restore", nil)
+			req = mux.SetURLVars(req, map[string]string{"id": tc.id})
+			rec := httptest.NewRecorder()
+			a.RestoreUserHandler(rec, req)
+
+			if err := s.mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+			if rec.Code != tc.status {
+				t.Fatalf("expected status %d; got %d: %s", tc.status, rec.Code, rec.Body.String())
+			}
+			if tc.status != http.StatusOK {
+				return
+			}
+			var uR UserResponse
+			if err = jsonapi.UnmarshalPayload(rec.Body, &uR); err != nil {
+				t.Fatalf("could not unmarshal response: %s", err)
+			}
+			// the tokens issued before the deletion stay revoked
+			if uR.Username != "jdoe" || uR.Version != 3 {
+				t.Errorf("unexpected user %s version %d", uR.Username, uR.Version)
+			}
+		})
+	}
+}
+
+func TestGetDeletedUsersHandler(t *testing.T) {
+	s, err := SetupSuite()
+	if err != nil {
+		t.Fatalf("error setting up test suite: %s", err.Error())
+	}
+	a := NewApp(s.DB, &Config{})
+	a.config.SignKey, _ = ReadPrivateKey(PKCS1_Private_Key)
+	a.config.VerifyKey = &a.config.SignKey.PublicKey
+
+	tt := []struct {
+		name   string
+		role   models.UserRole
+		status int
+	}{
+		{
+			name:   "listed by an administrator",
+			role:   models.AdminRole,
+			status: http.StatusOK,
+		},
+		{
+			name:   "listed by an operator",
+			role:   models.MonitorRole,
+			status: http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			rL, _ := models.NewRoleList([]string{tc.role.String()})
+			token, _ := generateToken(newCustomClaims(&models.User{Username: "admin", Roles: rL}, models.InternalDomain, time.Minute, nil, ""), "", a.config.SignKey)
+			if tc.status == http.StatusOK {
+				s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT count(*) FROM "users" WHERE deleted_at IS NOT NULL`)).
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+				s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "users" WHERE deleted_at IS NOT NULL ORDER BY id LIMIT 25`)).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "username", "version", "deleted_at"}).AddRow(7, "jdoe", 2, time.Now()))
+				s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "user_roles" WHERE "user_roles"."user_id" = $1`)).
+					WithArgs(7).WillReturnRows(sqlmock.NewRows([]string{"user_id", "role_id"}))
+			}
+
+			req, _ := http.NewRequest(http.MethodGet, "/v1.0/user?deleted=true", nil)
+			req.Header.Set(headerAuthorization, "Bearer "+token)
+			rec := httptest.NewRecorder()
+			a.UsersHandler(rec, req)
+
+			if err := s.mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+			if rec.Code != tc.status {
+				t.Fatalf("expected status %d; got %d: %s", tc.status, rec.Code, rec.Body.String())
+			}
+			if tc.status == http.StatusOK && !strings.Contains(rec.Body.String(), `"username":"jdoe"`) {
+				t.Errorf("deleted user not listed: %s", rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestFindUsersHandler(t *testing.T) {
+	s, err := SetupSuite()
+	if err != nil {
+		t.Fatalf("error setting up test suite: %s", err.Error())
+	}
+	a := NewApp(s.DB, &Config{})
+
+	tt := []struct {
+		name   string
+		query  string
+		where  string
+		args   []driver.Value
+		order  string
+		status int
+		meta   string
+	}{
+		{
+			name:   "username and role filters",
+			query:  "filter[username]=J_D&filter[role]=admin",
+			where:  `WHERE lower(username) LIKE $1 AND id IN (SELECT user_id FROM "user_roles" WHERE role_id = $2) AND "users"."deleted_at" IS NULL`,
+			args:   []driver.Value{`%j\_d%`, uint(models.AdminRole)},
+			order:  "ORDER BY id LIMIT 25",
+			status: http.StatusOK,
+			meta:   `"total":2,"total_pages":1`,
+		},
+		{
+			name:   "sorted second page",
+			query:  "sort=-created_at,username&page[number]=2&page[size]=1",
+			where:  `WHERE "users"."deleted_at" IS NULL`,
+			order:  "ORDER BY created_at desc, username, id LIMIT 1 OFFSET 1",
+			status: http.StatusOK,
+			meta:   `"total":2,"total_pages":2`,
+		},
+		{
+			name:   "invalid sort field",
+			query:  "sort=password",
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "invalid role",
+			query:  "filter[role]=root",
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "page size too large",
+			query:  "page[size]=1000",
+			status: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.status == http.StatusOK {
+				s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT count(*) FROM "users" ` + tc.where)).
+					WithArgs(tc.args...).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+				s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "users" ` + tc.where + " " + tc.order)).
+					WithArgs(tc.args...).WillReturnRows(sqlmock.NewRows([]string{"id", "username"}).AddRow(7, "j_doe"))
+				s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "user_roles" WHERE "user_roles"."user_id" = $1`)).
+					WithArgs(7).WillReturnRows(sqlmock.NewRows([]string{"user_id", "role_id"}).AddRow(7, models.AdminRole))
+				s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "roles" WHERE "roles"."id" = $1`)).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow(models.AdminRole, models.AdminRole.String()))
+			}
+
+			req, _ := http.NewRequest(http.MethodGet, "/v1.0/user?"+tc.query, nil)
+			rec := httptest.NewRecorder()
+			a.UsersHandler(rec, req)
+
+			if err := s.mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+			if rec.Code != tc.status {
+				t.Fatalf("expected status %d; got %d: %s", tc.status, rec.Code, rec.Body.String())
+			}
+			if tc.meta != "" && !strings.Contains(rec.Body.String(), tc.meta) {
+				t.Errorf("expected meta %s; got %s", tc.meta, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestCreateUserReservedUsername(t *testing.T) {
+	s, err := SetupSuite()
+	if err != nil {
+		t.Fatalf("error setting up test suite: %s", err.Error())
+	}
+	a := NewApp(s.DB, &Config{})
+	s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "users" WHERE username = $1 OR lower(email) = lower($2)`)).
+		WithArgs("jdoe", "jdoe").WillReturnRows(sqlmock.NewRows([]string{"id", "username", "deleted_at"}).AddRow(7, "jdoe", time.Now()))
+
+	body := `{"data":{"type":"user","attributes":{"username":"jdoe","password":"TestUser1*","roles":["MONITOR"]}}}`
+	req, _ := http.NewRequest(http.MethodPost, "/v1.0/user", bytes.NewBufferString(body))
+	rec := httptest.NewRecorder()
+	a.UsersHandler(rec, req)
+
+	if err := s.mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "reserved by a deleted user") {
+		t.Errorf("expected the username to be reserved; got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestCreateUserServiceAccountName(t *testing.T) {
+	s, err := SetupSuite()
+	if err != nil {
+		t.Fatalf("error setting up test suite: %s", err.Error())
+	}
+	a := NewApp(s.DB, &Config{})
+	s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT * FROM "users" WHERE username = $1 OR lower(email) = lower($2)`)).
+		WithArgs("backup", "backup").WillReturnRows(sqlmock.NewRows(nil))
+	s.mock.ExpectQuery(regexp.QuoteMeta(`SELECT count(*) FROM "service_accounts" WHERE name = $1`)).
+		WithArgs("backup").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+
+	body := `{"data":{"type":"user","attributes":{"username":"backup","password":"TestUser1*","roles":["MONITOR"]}}}`
+	req, _ := http.NewRequest(http.MethodPost, "/v1.0/user", bytes.NewBufferString(body))
+	rec := httptest.NewRecorder()
+	a.UsersHandler(rec, req)
+
+	if err := s.mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "used by a service account") {
+		t.Errorf("expected the name of the service account to be refused; got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestUserVersionHandler(t *testing.T) {
+	s, err := SetupSuite()
+	if err != nil {
+		t.Fatalf("error setting up test suite: %s", err.Error())
+	}
+	a := NewApp(s.DB, &Config{})
+	expectUser := func() {
+		s.mock.ExpectQuery(regexp.QuoteMeta(
+			`SELECT * FROM "users" WHERE "users"."id" = $1 AND "users"."deleted_at" IS NULL ORDER BY "users"."id" LIMIT 1`)).
+			WithArgs(int64(123)).WillReturnRows(sqlmock.NewRows([]string{"id", "username", "version", "revision"}).AddRow(123, "jdoe", 2, 5))
+	}
+
+	tt := []struct {
+		name       string
+		method     string
+		header     string
+		value      string
+		version    int
+		concurrent bool
+		status     int
+	}{
+		{
+			name:   "tagged read",
+			method: http.MethodGet,
+			status: http.StatusOK,
+		},
+		{
+			name:   "read of an unchanged user",
+			method: http.MethodGet,
+			header: "If-None-Match",
+			value:  `W/"5"`,
+			status: http.StatusNotModified,
+		},
+		{
+			name:   "update of an outdated revision by If-Match",
+			method: http.MethodPatch,
+			header: "If-Match",
+			value:  `W/"4"`,
+			status: http.StatusPreconditionFailed,
+		},
+		{
+			name:    "update of an outdated version by the version attribute",
+			method:  http.MethodPatch,
+			version: 1,
+			status:  http.StatusConflict,
+		},
+		{
+			name:       "update concurrent with another update",
+			method:     http.MethodPatch,
+			header:     "If-Match",
+			value:      `W/"5"`,
+			concurrent: true,
+			status:     http.StatusConflict,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			expectUser()
+			if tc.concurrent {
+				// the user is stored only if it is still at the revision the changes are based on
+				s.mock.ExpectBegin()
+				expectRevision(s, 123, 5, 0)
+				s.mock.ExpectRollback()
+			}
+
+			body := fmt.Sprintf(`{"data":{"type":"user","attributes":{"version":%d}}}`, tc.version)
+			req, _ := http.NewRequest(tc.method, "/v1.0/user/123", strings.NewReader(body))
+			if tc.header != "" {
+				req.Header.Set(tc.header, tc.value)
+			}
+			req = mux.SetURLVars(req, map[string]string{"id": "123"})
+			rec := httptest.NewRecorder()
+			a.UserHandler(rec, req)
+
+			if err := s.mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+			if rec.Code != tc.status {
+				t.Fatalf("expected status %d; got %d: %s", tc.status, rec.Code, rec.Body.String())
+			}
+			if tc.method == http.MethodGet && rec.Header().Get("ETag") != `W/"5"` {
+				t.Errorf("unexpected ETag %s", rec.Header().Get("ETag"))
+			}
+		})
+	}
+}
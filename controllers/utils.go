@@ -6,7 +6,6 @@ import (
 	"encoding/pem"
 	"errors"
 	"fmt"
-	log "github.com/sirupsen/logrus"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -81,48 +80,6 @@ func readPKIXKeyPair(rawCert, rawPvtKey []byte) (*rsa.PublicKey, *rsa.PrivateKey
 	return cert.PublicKey.(*rsa.PublicKey), pvtKey, nil
 }
 
-func ReadPublicKeys(publicKeyListPath string) []*rsa.PublicKey {
-	var publicList []*rsa.PublicKey
-
-	files, err := ioutil.ReadDir(publicKeyListPath)
-	if err != nil {
-		log.WithError(err).Warnf("failed to read keys dir")
-		return nil
-	}
-
-	for _, file := range files {
-		if file.IsDir() {
-			continue
-		}
-
-		pubKeyPath := publicKeyListPath + "/" + file.Name()
-		log.Infoln("currently reading: ", pubKeyPath)
-
-		data, err := ioutil.ReadFile(pubKeyPath)
-		if err != nil {
-			log.WithError(err).Warnf("failed to read key data from file")
-			continue
-		}
-
-		block, _ := pem.Decode(data)
-		if block == nil {
-			log.WithError(err).Warnf("invalid key")
-			continue
-		}
-
-		pKey, err := x509.ParsePKIXPublicKey(block.Bytes)
-		if err != nil {
-			log.WithError(err).Warnf("failed to parse key data")
-			continue
-		}
-		rsaPKey := pKey.(*rsa.PublicKey)
-
-		publicList = append(publicList, rsaPKey)
-	}
-
-	return publicList
-}
-
 // getIP is the utility function used to extract the ip from the request body
 func getIP(r *http.Request) (string, error) {
 	xForwardedFor := r.Header.Get("X-Forwarded-For")
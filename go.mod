@@ -4,7 +4,10 @@ go 1.15
 
 require (
 	github.com/DATA-DOG/go-sqlmock v1.5.0
+	github.com/crewjam/saml v0.4.13
+	github.com/go-asn1-ber/asn1-ber v1.5.4
 	github.com/go-co-op/gocron v1.15.1
+	github.com/go-ldap/ldap/v3 v3.4.4
 	github.com/golang-jwt/jwt v3.2.1+incompatible
 	github.com/google/jsonapi v1.0.0
 	github.com/google/uuid v1.3.0
@@ -14,8 +17,8 @@ require (
 	github.com/kelseyhightower/envconfig v1.4.0
 	github.com/robfig/cron/v3 v3.0.1
 	github.com/sirupsen/logrus v1.8.1
-	github.com/stretchr/testify v1.8.0
-	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519
+	github.com/stretchr/testify v1.8.1
+	golang.org/x/crypto v0.0.0-20220622213112-05595931fe9d
 	golang.org/x/sys v0.0.0-20210616094352-59db8d763f22 // indirect
 	gorm.io/driver/postgres v1.3.8
 	gorm.io/gorm v1.23.8
@@ -0,0 +1,174 @@
+package models
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"gorm.io/gorm"
+)
+
+// Types of the custom attributes values
+const (
+	AttributeString  = "string"
+	AttributeNumber  = "number"
+	AttributeBoolean = "boolean"
+	AttributeEnum    = "enum"
+)
+
+var attributeName = regexp.MustCompile(`^[a-z][a-z0-9_]{0,63}$`)
+
+// profileFields are the names of the core profile fields, which custom attributes cannot take
+var profileFields = []string{"username", "display_name", "email", "phone", "locale", "team"}
+
+// AttributeRepo wraps the db connection pool in a custom type
+// This approach fits nicely to perform unit tests since we can reference AttributeRepo in the application code
+// with an interface
+type AttributeRepo struct {
+	DB *gorm.DB
+}
+
+// AttributeDefinition resemble the DB attribute_definitions table schema
+// it is the schema of a custom attribute of the user profile, defined by the administrators
+type AttributeDefinition struct {
+	gorm.Model
+	Name        string `gorm:"uniqueIndex"`
+	Description string
+	// Type is the type of the values: string, number, boolean or enum
+	Type string
+	// Pattern is the regular expression the string values must match, if not empty
+	Pattern string
+	// Values are the values allowed for the enum attributes
+	Values []string `gorm:"serializer:json"`
+	// UserEditable lets the users edit the attribute of their own profile, the administrators only otherwise
+	UserEditable bool
+	// InToken maps the attribute into the attrs claim of the tokens of the user
+	InToken bool
+}
+
+// TableName returns the AttributeDefinition table name
+func (d *AttributeDefinition) TableName() string {
+	return "attribute_definitions"
+}
+
+// Validate checks the consistency of the attribute definition
+func (d *AttributeDefinition) Validate() error {
+	if !attributeName.MatchString(d.Name) {
+		return &UserError{fmt.Sprintf("invalid attribute name %s", d.Name)}
+	}
+	for _, f := range profileFields {
+		if d.Name == f {
+			return &UserError{fmt.Sprintf("attribute name %s is a profile field", d.Name)}
+		}
+	}
+	switch d.Type {
+	case AttributeString:
+		if _, err := regexp.Compile(d.Pattern); err != nil {
+			return &UserError{fmt.Sprintf("invalid attribute pattern: %s", err.Error())}
+		}
+	case AttributeEnum:
+		if len(d.Values) == 0 {
+			return &UserError{"enum attributes require their values"}
+		}
+	case AttributeNumber, AttributeBoolean:
+	default:
+		return &UserError{fmt.Sprintf("invalid attribute type %s", d.Type)}
+	}
+	return nil
+}
+
+// ValidateValue checks the value against the attribute schema
+func (d *AttributeDefinition) ValidateValue(value interface{}) error {
+	var ok bool
+	switch d.Type {
+	case AttributeString:
+		var s string
+		if s, ok = value.(string); ok && d.Pattern != "" {
+			ok = regexp.MustCompile(d.Pattern).MatchString(s)
+		}
+	case AttributeNumber:
+		_, ok = value.(float64)
+	case AttributeBoolean:
+		_, ok = value.(bool)
+	case AttributeEnum:
+		var s string
+		if s, ok = value.(string); ok {
+			ok = false
+			for _, v := range d.Values {
+				ok = ok || v == s
+			}
+		}
+	}
+	if !ok {
+		return &UserError{fmt.Sprintf("invalid value %v for attribute %s", value, d.Name)}
+	}
+	return nil
+}
+
+// Create stores a new attribute definition into the DB
+func (aR *AttributeRepo) Create(d *AttributeDefinition) error {
+	if err := d.Validate(); err != nil {
+		return err
+	}
+	var count int64
+	aR.DB.Model(&AttributeDefinition{}).Where("name = ?", d.Name).Count(&count)
+	if count > 0 {
+		return &UserError{fmt.Sprintf("attribute %s already present in database", d.Name)}
+	}
+	if res := aR.DB.Create(d); res.Error != nil {
+		return &DBError{res.Error.Error()}
+	}
+	return nil
+}
+
+// GetAttributeDefinitions returns the list of attribute definitions present in DB
+func (aR *AttributeRepo) GetAttributeDefinitions() ([]*AttributeDefinition, error) {
+	var definitions []*AttributeDefinition
+	if res := aR.DB.Order("id").Find(&definitions); res.Error != nil {
+		return nil, &DBError{res.Error.Error()}
+	}
+	return definitions, nil
+}
+
+// GetAttributeDefinition retrieves an attribute definition by ID or name
+func (aR *AttributeRepo) GetAttributeDefinition(nameOrID string) (*AttributeDefinition, error) {
+	d := &AttributeDefinition{}
+	var res *gorm.DB
+	if id, err := strconv.Atoi(nameOrID); err == nil {
+		res = aR.DB.Limit(1).Find(d, id)
+	} else {
+		res = aR.DB.Where("name = ?", nameOrID).Limit(1).Find(d)
+	}
+	if res.Error != nil {
+		return nil, &DBError{res.Error.Error()}
+	}
+	if res.RowsAffected == 0 {
+		return nil, &NotFoundError{fmt.Sprintf("attribute %s not present in database", nameOrID)}
+	}
+	return d, nil
+}
+
+// UpdateAttributeDefinition updates the attribute definition into the DB, the values already stored are
+// not validated again
+func (aR *AttributeRepo) UpdateAttributeDefinition(d *AttributeDefinition) error {
+	if err := d.Validate(); err != nil {
+		return err
+	}
+	if res := aR.DB.Save(d); res.Error != nil {
+		return &DBError{res.Error.Error()}
+	}
+	return nil
+}
+
+// DeleteAttributeDefinition removes the attribute definition from the DB, the values stored in the user
+// profiles are kept until the administrators remove them
+func (aR *AttributeRepo) DeleteAttributeDefinition(d *AttributeDefinition) error {
+	res := aR.DB.Unscoped().Delete(d)
+	if res.Error != nil {
+		return &DBError{res.Error.Error()}
+	}
+	if res.RowsAffected == 0 {
+		return &NotFoundError{fmt.Sprintf("attribute %s not present in database", d.Name)}
+	}
+	return nil
+}
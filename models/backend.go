@@ -0,0 +1,25 @@
+package models
+
+// AuthBackend is implemented by every identity source able to verify
+// username/password credentials, e.g. the local users table or an LDAP directory
+type AuthBackend interface {
+	// Domain returns the authentication domain recorded in the generated events and tokens
+	Domain() string
+	// Authenticate verifies the given credentials and returns the matching user
+	Authenticate(username, password string) (*User, bool)
+}
+
+// AuthBackendChain is an ordered list of authentication backends
+// credentials are checked against each backend until one of them accepts them
+type AuthBackendChain []AuthBackend
+
+// Authenticate runs the credentials through the chain, it returns the authenticated
+// user together with the domain of the backend which accepted the credentials
+func (c AuthBackendChain) Authenticate(username, password string) (*User, string, bool) {
+	for _, b := range c {
+		if u, ok := b.Authenticate(username, password); ok {
+			return u, b.Domain(), true
+		}
+	}
+	return nil, "", false
+}
@@ -17,9 +17,16 @@ func DBConnect(dsn string, logger logger.Interface) (*gorm.DB, error) {
 		return nil, fmt.Errorf("failed to connect to database: %s", err.Error())
 	}
 
-	if err := db.AutoMigrate(&User{}, &Role{}, &Event{}); err != nil {
+	if err := migrateExternalIdentities(db); err != nil {
 		return nil, fmt.Errorf("failed to migrate database: %s", err.Error())
 	}
+	if err := migrateSessions(db); err != nil {
+		return nil, fmt.Errorf("failed to migrate database: %s", err.Error())
+	}
+	if err := db.AutoMigrate(&User{}, &Role{}, &Event{}, &TrustedIssuer{}, &TrustedKeyImport{}, &ExternalIdentity{}, &DeviceAuthorization{}, &Session{}, &PersonalAccessToken{}, &ServiceAccount{}, &Elevation{}, &AttributeDefinition{}, &UsedNonce{}); err != nil {
+		return nil, fmt.Errorf("failed to migrate database: %s", err.Error())
+	}
+	migrateUserEmails(db)
 
 	return db, nil
 }
@@ -54,3 +61,13 @@ type UserError struct {
 func (e *UserError) Error() string {
 	return e.error
 }
+
+// ConflictError wraps the errors of the changes based on an outdated version of a record
+// this shall be normally mapped as Conflict HTTP errors
+type ConflictError struct {
+	error string
+}
+
+func (e *ConflictError) Error() string {
+	return e.error
+}
@@ -0,0 +1,118 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// DeviceAuthorizationRepo wraps the db connection pool in a custom type
+// This approach fits nicely to perform unit tests since we can reference DeviceAuthorizationRepo in the application code
+// with an interface
+type DeviceAuthorizationRepo struct {
+	DB *gorm.DB
+}
+
+// DeviceAuthorizationStatus is the state of a device authorization request
+type DeviceAuthorizationStatus string
+
+const (
+	DeviceAuthorizationPending  DeviceAuthorizationStatus = "pending"
+	DeviceAuthorizationApproved DeviceAuthorizationStatus = "approved"
+	DeviceAuthorizationDenied   DeviceAuthorizationStatus = "denied"
+)
+
+// DeviceAuthorization resemble the DB device_authorizations table schema
+// it tracks a RFC 8628 device authorization request, from its creation to the approval by the user
+type DeviceAuthorization struct {
+	gorm.Model
+	// DeviceCodeHash is the SHA-256 of the device code, the device code itself is known only to the device
+	DeviceCodeHash string   `gorm:"uniqueIndex"`
+	UserCode       string   `gorm:"uniqueIndex"`
+	Audience       []string `gorm:"serializer:json"`
+	Scope          string
+	ExpiresAt      time.Time
+	// Interval is the minimum time between two polls of the device
+	Interval     time.Duration
+	LastPolledAt time.Time
+	Status       DeviceAuthorizationStatus
+	// Username, Domain, Roles and Version describe the user who approved the request
+	Username string
+	Domain   string
+	Roles    []string `gorm:"serializer:json"`
+	Version  int
+	// UserID is the ID of the local or shadow user who approved the request, 0 for the external users
+	UserID uint
+	// IdentityID is the ID of the external identity who approved the request, 0 for the local users
+	IdentityID uint
+}
+
+// TableName returns the DeviceAuthorization table name
+func (d *DeviceAuthorization) TableName() string {
+	return "device_authorizations"
+}
+
+// Expired returns true if the request can no longer be approved nor redeemed
+func (d *DeviceAuthorization) Expired() bool {
+	return time.Now().After(d.ExpiresAt)
+}
+
+// HashDeviceCode returns the digest of the device code stored into the DB
+func HashDeviceCode(deviceCode string) string {
+	sum := sha256.Sum256([]byte(deviceCode))
+	return hex.EncodeToString(sum[:])
+}
+
+// Create stores a new device authorization request into the DB
+func (dR *DeviceAuthorizationRepo) Create(d *DeviceAuthorization) error {
+	if res := dR.DB.Create(d); res.Error != nil {
+		return &DBError{res.Error.Error()}
+	}
+	return nil
+}
+
+// GetDeviceAuthorizationByUserCode retrieves a device authorization request by the code entered by the user
+func (dR *DeviceAuthorizationRepo) GetDeviceAuthorizationByUserCode(userCode string) (*DeviceAuthorization, error) {
+	return dR.getDeviceAuthorization("user_code = ?", userCode)
+}
+
+// GetDeviceAuthorizationByDeviceCode retrieves a device authorization request by the code polled by the device
+func (dR *DeviceAuthorizationRepo) GetDeviceAuthorizationByDeviceCode(deviceCode string) (*DeviceAuthorization, error) {
+	return dR.getDeviceAuthorization("device_code_hash = ?", HashDeviceCode(deviceCode))
+}
+
+func (dR *DeviceAuthorizationRepo) getDeviceAuthorization(query string, value string) (*DeviceAuthorization, error) {
+	d := &DeviceAuthorization{}
+	res := dR.DB.Where(query, value).Limit(1).Find(d)
+	if res.Error != nil {
+		return nil, &DBError{res.Error.Error()}
+	}
+	if res.RowsAffected == 0 {
+		return nil, &NotFoundError{"device authorization request not present in database"}
+	}
+	return d, nil
+}
+
+// UpdateDeviceAuthorization updates the device authorization request into the DB
+func (dR *DeviceAuthorizationRepo) UpdateDeviceAuthorization(d *DeviceAuthorization) error {
+	if res := dR.DB.Save(d); res.Error != nil {
+		return &DBError{res.Error.Error()}
+	}
+	return nil
+}
+
+// DeleteDeviceAuthorization removes the device authorization request from the DB
+// the function returns NotFoundError if the request has already been removed, e.g. redeemed through another replica
+func (dR *DeviceAuthorizationRepo) DeleteDeviceAuthorization(d *DeviceAuthorization) error {
+	res := dR.DB.Unscoped().Delete(d)
+	if res.Error != nil {
+		return &DBError{res.Error.Error()}
+	}
+	if res.RowsAffected == 0 {
+		return &NotFoundError{fmt.Sprintf("device authorization request %s not present in database", d.UserCode)}
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package models
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// Elevation statuses, a pending request is either approved or denied by an administrator and the
+// approved and pending ones expire at the end of their window
+const (
+	ElevationPending  = "pending"
+	ElevationApproved = "approved"
+	ElevationDenied   = "denied"
+	ElevationExpired  = "expired"
+)
+
+// ElevationRepo wraps the db connection pool in a custom type
+// This approach fits nicely to perform unit tests since we can reference ElevationRepo in the application code
+// with an interface
+type ElevationRepo struct {
+	DB *gorm.DB
+}
+
+// Elevation resemble the DB elevations table schema
+// it is the request of a user for a role it does not hold, granted for a time window once approved by
+// another administrator
+type Elevation struct {
+	gorm.Model
+	Username      string `gorm:"index"`
+	Role          string
+	Justification string
+	Status        string `gorm:"index"`
+	// Approver is the administrator who approved or denied the request
+	Approver  string
+	DecidedAt time.Time
+	StartsAt  time.Time
+	ExpiresAt time.Time
+}
+
+// TableName returns the Elevation table name
+func (e *Elevation) TableName() string {
+	return "elevations"
+}
+
+// Active reports whether the elevation is approved and its window is in progress
+func (e *Elevation) Active() bool {
+	now := time.Now()
+	return e.Status == ElevationApproved && !now.Before(e.StartsAt) && now.Before(e.ExpiresAt)
+}
+
+// Create stores a new elevation request into the DB
+func (eR *ElevationRepo) Create(e *Elevation) error {
+	if res := eR.DB.Create(e); res.Error != nil {
+		return &DBError{res.Error.Error()}
+	}
+	return nil
+}
+
+// GetElevation retrieves an elevation by ID
+func (eR *ElevationRepo) GetElevation(id string) (*Elevation, error) {
+	elevationID, err := strconv.Atoi(id)
+	if err != nil {
+		return nil, &NotFoundError{fmt.Sprintf("elevation %s not present in database", id)}
+	}
+	e := &Elevation{}
+	res := eR.DB.Limit(1).Find(e, elevationID)
+	if res.Error != nil {
+		return nil, &DBError{res.Error.Error()}
+	}
+	if res.RowsAffected == 0 {
+		return nil, &NotFoundError{fmt.Sprintf("elevation %s not present in database", id)}
+	}
+	return e, nil
+}
+
+// GetElevations returns the elevations of the user, the most recent first
+func (eR *ElevationRepo) GetElevations(username string) ([]*Elevation, error) {
+	if username == "" {
+		return nil, &UserError{"the elevations are listed by username"}
+	}
+	var elevations []*Elevation
+	if res := eR.DB.Where("username = ?", username).Order("created_at desc").Find(&elevations); res.Error != nil {
+		return nil, &DBError{res.Error.Error()}
+	}
+	return elevations, nil
+}
+
+// GetAllElevations returns the elevations of all the users, the most recent first
+func (eR *ElevationRepo) GetAllElevations() ([]*Elevation, error) {
+	var elevations []*Elevation
+	if res := eR.DB.Order("created_at desc").Find(&elevations); res.Error != nil {
+		return nil, &DBError{res.Error.Error()}
+	}
+	return elevations, nil
+}
+
+// GetActiveElevations returns the approved elevations of the user whose window is in progress
+func (eR *ElevationRepo) GetActiveElevations(username string) ([]*Elevation, error) {
+	var elevations []*Elevation
+	now := time.Now()
+	res := eR.DB.Where("username = ? AND status = ? AND starts_at <= ? AND expires_at > ?", username, ElevationApproved, now, now).
+		Find(&elevations)
+	if res.Error != nil {
+		return nil, &DBError{res.Error.Error()}
+	}
+	return elevations, nil
+}
+
+// DecideElevation stores the decision on the elevation request provided it is still pending, otherwise
+// a ConflictError is returned: the concurrent decisions and the expiration are not overwritten
+func (eR *ElevationRepo) DecideElevation(e *Elevation) error {
+	res := eR.DB.Model(e).Where("status = ?", ElevationPending).
+		Updates(map[string]interface{}{"status": e.Status, "approver": e.Approver, "decided_at": e.DecidedAt})
+	if res.Error != nil {
+		return &DBError{res.Error.Error()}
+	}
+	if res.RowsAffected == 0 {
+		return &ConflictError{fmt.Sprintf("elevation %d no longer pending", e.ID)}
+	}
+	return nil
+}
+
+// expireElevations marks as expired the approved and pending elevations whose window has ended, and
+// records an event for each of them
+func expireElevations(db *gorm.DB) error {
+	var elevations []*Elevation
+	res := db.Where("status IN ? AND expires_at <= ?", []string{ElevationPending, ElevationApproved}, time.Now()).Find(&elevations)
+	if res.Error != nil {
+		return res.Error
+	}
+	events := &EventRepo{DB: db}
+	for _, e := range elevations {
+		e.Status = ElevationExpired
+		if res = db.Model(e).Update("status", e.Status); res.Error != nil {
+			return res.Error
+		}
+		if err := events.CreateElevationEvent(e, ""); err != nil {
+			log.WithError(err).Warnf("failed to store elevation event")
+		}
+	}
+	log.Debugf("expired %d elevations", len(elevations))
+	return nil
+}
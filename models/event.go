@@ -22,6 +22,8 @@ type EventRepo struct {
 const (
 	ExternalDomain string = "EXTERNAL"
 	InternalDomain string = "ORANMGR"
+	// BreakGlassDomain is the authentication domain of the emergency account, which is not stored in DB
+	BreakGlassDomain string = "BREAKGLASS"
 )
 
 // EventSeverity type reflects represent event classification
@@ -110,7 +112,7 @@ func (eR *EventRepo) CreateUserEvent(method, username, domain string) error {
 	switch method {
 	case http.MethodPost:
 		description = "Added user: " + username
-	case http.MethodPatch:
+	case http.MethodPatch, http.MethodPut:
 		description = "Updated user: " + username
 	case http.MethodDelete:
 		description = "Deleted user: " + username
@@ -129,6 +131,67 @@ func (eR *EventRepo) CreateUserEvent(method, username, domain string) error {
 	return eR.Create(e)
 }
 
+// CreateUserRestoreEvent creates a new event recording the restore of a deleted user
+func (eR *EventRepo) CreateUserRestoreEvent(username string) error {
+	e := &Event{
+		Username:    username,
+		Activated:   time.Now(),
+		Description: "Restored user: " + username,
+		Modified:    time.Now(),
+		AuthnDomain: InternalDomain,
+		Severity:    EventSeverityCleared,
+	}
+	return eR.Create(e)
+}
+
+// CreateEmailVerifiedEvent creates a new event recording the verification of the email of the user
+func (eR *EventRepo) CreateEmailVerifiedEvent(username, email string) error {
+	e := &Event{
+		Username:    username,
+		Activated:   time.Now(),
+		Description: fmt.Sprintf("Verified email of %s: %s", username, email),
+		Modified:    time.Now(),
+		AuthnDomain: InternalDomain,
+		Severity:    EventSeverityCleared,
+	}
+	return eR.Create(e)
+}
+
+// CreateUserPurgeEvent creates a new event recording the permanent removal of a deleted user
+func (eR *EventRepo) CreateUserPurgeEvent(username string) error {
+	e := &Event{
+		Username:    username,
+		Activated:   time.Now(),
+		Description: "Purged user: " + username,
+		Modified:    time.Now(),
+		AuthnDomain: InternalDomain,
+		Severity:    EventSeverityCleared,
+	}
+	return eR.Create(e)
+}
+
+// CreateUserStatusEvent creates a new event recording the transition of the user account to another
+// lifecycle state, made by the actor or, if empty, by the expiration of the account
+func (eR *EventRepo) CreateUserStatusEvent(username, from, to, actor string) error {
+	description := fmt.Sprintf("User %s moved from %s to %s", username, from, to)
+	if actor != "" {
+		description = fmt.Sprintf("%s by %s", description, actor)
+	}
+	severity := EventSeverityWarning
+	if to == string(UserActive) {
+		severity = EventSeverityCleared
+	}
+	e := &Event{
+		Username:    username,
+		Activated:   time.Now(),
+		Description: description,
+		Modified:    time.Now(),
+		AuthnDomain: InternalDomain,
+		Severity:    severity,
+	}
+	return eR.Create(e)
+}
+
 // CreateJWTEvent creates a new jwt token creation failure event
 func (eR *EventRepo) CreateJWTEvent(username, domain string) error {
 	e := &Event{
@@ -143,6 +206,188 @@ func (eR *EventRepo) CreateJWTEvent(username, domain string) error {
 	return eR.Create(e)
 }
 
+// CreateTokenExchangeEvent creates a new event recording a token issued to the actor on behalf of the user
+func (eR *EventRepo) CreateTokenExchangeEvent(username, actor, domain string) error {
+	e := &Event{
+		Username:    username,
+		Activated:   time.Now(),
+		Description: fmt.Sprintf("Token issued to %s on behalf of %s", actor, username),
+		Modified:    time.Now(),
+		AuthnDomain: domain,
+		Severity:    EventSeverityCleared,
+	}
+	return eR.Create(e)
+}
+
+// CreatePersonalAccessTokenEvent creates a new event recording the creation or the revocation of a
+// personal access token of the user
+func (eR *EventRepo) CreatePersonalAccessTokenEvent(method, username, name string) error {
+	var description string
+
+	switch method {
+	case http.MethodPost:
+		description = fmt.Sprintf("Created personal access token %s of %s", name, username)
+	case http.MethodDelete:
+		description = fmt.Sprintf("Revoked personal access token %s of %s", name, username)
+	default:
+		description = fmt.Sprintf("Unknown personal access token operation: %s of %s", name, username)
+	}
+
+	e := &Event{
+		Username:    username,
+		Activated:   time.Now(),
+		Description: description,
+		Modified:    time.Now(),
+		AuthnDomain: InternalDomain,
+		Severity:    EventSeverityCleared,
+	}
+	return eR.Create(e)
+}
+
+// CreateServiceAccountEvent creates a new service account event into the DB
+func (eR *EventRepo) CreateServiceAccountEvent(method, name string) error {
+	var description string
+
+	switch method {
+	case http.MethodPost:
+		description = "Added service account: " + name
+	case http.MethodPatch:
+		description = "Updated service account: " + name
+	case http.MethodDelete:
+		description = "Deleted service account: " + name
+	default:
+		description = "Unknown service account operation: " + name
+	}
+
+	e := &Event{
+		Username:    name,
+		Activated:   time.Now(),
+		Description: description,
+		Modified:    time.Now(),
+		AuthnDomain: ServiceAccountDomain,
+		Severity:    EventSeverityCleared,
+	}
+	return eR.Create(e)
+}
+
+// CreateAttributeDefinitionEvent creates a new custom attribute definition event into the DB
+func (eR *EventRepo) CreateAttributeDefinitionEvent(method, name, actor string) error {
+	var description string
+
+	switch method {
+	case http.MethodPost:
+		description = "Added profile attribute: " + name
+	case http.MethodPatch:
+		description = "Updated profile attribute: " + name
+	case http.MethodDelete:
+		description = "Deleted profile attribute: " + name
+	default:
+		description = "Unknown profile attribute operation: " + name
+	}
+
+	e := &Event{
+		Username:    actor,
+		Activated:   time.Now(),
+		Description: description,
+		Modified:    time.Now(),
+		AuthnDomain: InternalDomain,
+		Severity:    EventSeverityCleared,
+	}
+	return eR.Create(e)
+}
+
+// CreateImpersonationEvent creates a new event recording the start of the impersonation of the user by
+// the actor administrator
+func (eR *EventRepo) CreateImpersonationEvent(username, actor, reason string) error {
+	description := fmt.Sprintf("Impersonation of %s started by %s", username, actor)
+	if reason != "" {
+		description = fmt.Sprintf("%s: %s", description, reason)
+	}
+	e := &Event{
+		Username:    username,
+		Activated:   time.Now(),
+		Description: description,
+		Modified:    time.Now(),
+		AuthnDomain: InternalDomain,
+		Severity:    EventSeverityWarning,
+	}
+	return eR.Create(e)
+}
+
+// CreateBreakGlassEvent creates a new event recording a login with the emergency account, the event is
+// stored once the DB is reachable, so the login time is given
+func (eR *EventRepo) CreateBreakGlassEvent(username, ip string, at time.Time) error {
+	e := &Event{
+		Username:    username,
+		Activated:   at,
+		Description: fmt.Sprintf("Break-glass login of %s from %s", username, ip),
+		Modified:    time.Now(),
+		AuthnDomain: BreakGlassDomain,
+		Severity:    EventSeverityCritical,
+	}
+	return eR.Create(e)
+}
+
+// CreateImpersonatedWriteEvent creates a new event recording a write request made by the actor on behalf
+// of the user
+func (eR *EventRepo) CreateImpersonatedWriteEvent(username, actor, method, path string) error {
+	e := &Event{
+		Username:    username,
+		Activated:   time.Now(),
+		Description: fmt.Sprintf("%s %s by %s on behalf of %s", method, path, actor, username),
+		Modified:    time.Now(),
+		AuthnDomain: InternalDomain,
+		Severity:    EventSeverityWarning,
+	}
+	return eR.Create(e)
+}
+
+// CreateElevationEvent creates a new event recording a step of the elevation request: its creation, the
+// decision of the actor administrator or its expiration
+func (eR *EventRepo) CreateElevationEvent(elevation *Elevation, actor string) error {
+	var description string
+	severity := EventSeverityCleared
+
+	switch elevation.Status {
+	case ElevationPending:
+		description = fmt.Sprintf("Elevation of %s to %s requested until %s: %s", elevation.Username, elevation.Role,
+			elevation.ExpiresAt.Format(time.RFC3339), elevation.Justification)
+	case ElevationApproved:
+		description = fmt.Sprintf("Elevation of %s to %s approved by %s until %s", elevation.Username, elevation.Role,
+			actor, elevation.ExpiresAt.Format(time.RFC3339))
+		severity = EventSeverityWarning
+	case ElevationDenied:
+		description = fmt.Sprintf("Elevation of %s to %s denied by %s", elevation.Username, elevation.Role, actor)
+	case ElevationExpired:
+		description = fmt.Sprintf("Elevation of %s to %s expired", elevation.Username, elevation.Role)
+	default:
+		description = fmt.Sprintf("Unknown elevation status %s of %s", elevation.Status, elevation.Username)
+	}
+
+	e := &Event{
+		Username:    elevation.Username,
+		Activated:   time.Now(),
+		Description: description,
+		Modified:    time.Now(),
+		AuthnDomain: InternalDomain,
+		Severity:    severity,
+	}
+	return eR.Create(e)
+}
+
+// CreateSessionTerminatedEvent creates a new event recording the termination of sessions of the user
+func (eR *EventRepo) CreateSessionTerminatedEvent(username, domain string, count int64) error {
+	e := &Event{
+		Username:    username,
+		Activated:   time.Now(),
+		Description: fmt.Sprintf("Terminated %d session(s) of %s", count, username),
+		Modified:    time.Now(),
+		AuthnDomain: domain,
+		Severity:    EventSeverityCleared,
+	}
+	return eR.Create(e)
+}
+
 // GetEvents returns the list of events present in DB
 func (eR *EventRepo) GetEvents(pageNumber int, pageSize int) []*Event {
 	offset := pageSize * (pageNumber - 1)
@@ -162,10 +407,45 @@ func (eR *EventRepo) GetEventsCount(s EventSeverity) int {
 	return int(eventsCount)
 }
 
-// SetupAutomaticDeletion uses the gocron package to create a cronjob in order to delete excess events on DB
+// SetupAutomaticDeletion uses the gocron package to create a cronjob in order to delete excess events,
+// expired sessions, expired nonces, expired personal access tokens and the users deleted for longer than userRetention
+// (never if 0) on DB, and to expire the ended elevations
 // it is possible to use both cron syntax or time.Duration ("5m", "10h", ...)
-func SetupAutomaticDeletion(db *gorm.DB, schedule string, location *time.Location, maxEventsNumber int64) error {
+func SetupAutomaticDeletion(db *gorm.DB, schedule string, location *time.Location, maxEventsNumber int64, userRetention time.Duration) error {
 	s := gocron.NewScheduler(location)
+	cleanup := func() {
+		err := deleteOldestEvents(db, maxEventsNumber)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Errorf("failed to delete excess events")
+		}
+		if err = deleteExpiredSessions(db); err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Errorf("failed to delete expired sessions")
+		}
+		if err = deleteExpiredNonces(db); err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Errorf("failed to delete expired nonces")
+		}
+		if err = deleteExpiredPersonalAccessTokens(db); err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Errorf("failed to delete expired personal access tokens")
+		}
+		if err = expireElevations(db); err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Errorf("failed to expire elevations")
+		}
+		if err = purgeDeletedUsers(db, userRetention); err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Errorf("failed to purge deleted users")
+		}
+	}
 
 	_, err := cron.ParseStandard(schedule)
 	if err != nil {
@@ -173,26 +453,12 @@ func SetupAutomaticDeletion(db *gorm.DB, schedule string, location *time.Locatio
 		if err != nil {
 			return err
 		}
-		_, err = s.Every(schedule).Do(func() {
-			err := deleteOldestEvents(db, maxEventsNumber)
-			if err != nil {
-				log.WithFields(log.Fields{
-					"error": err,
-				}).Errorf("failed to delete excess events")
-			}
-		})
+		_, err = s.Every(schedule).Do(cleanup)
 		if err != nil {
 			return err
 		}
 	} else {
-		_, err = s.Cron(schedule).Do(func() {
-			err := deleteOldestEvents(db, maxEventsNumber)
-			if err != nil {
-				log.WithFields(log.Fields{
-					"error": err,
-				}).Errorf("failed to delete excess events")
-			}
-		})
+		_, err = s.Cron(schedule).Do(cleanup)
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,145 @@
+package models
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ExternalIdentityRepo wraps the db connection pool in a custom type
+// This approach fits nicely to perform unit tests since we can reference ExternalIdentityRepo in the application code
+// with an interface
+type ExternalIdentityRepo struct {
+	DB *gorm.DB
+}
+
+// ExternalIdentity resemble the DB external_identities table schema
+// it records the users authenticated by an external issuer or backend which have no local
+// user, so that their tokens can be renewed by any replica
+// the identities are keyed by issuer and subject, the same username may be given by several issuers
+type ExternalIdentity struct {
+	gorm.Model
+	Username string `gorm:"index"`
+	// Issuer is the source of the identity, e.g. the trusted issuer or the authentication backend
+	Issuer string `gorm:"uniqueIndex:idx_external_identities_issuer_subject"`
+	// Subject is the identifier of the account given by the issuer, e.g. the sub claim or the NameID
+	Subject string `gorm:"uniqueIndex:idx_external_identities_issuer_subject"`
+	// Roles are the local roles mapped at the last login
+	Roles    []string `gorm:"serializer:json"`
+	LastSeen time.Time
+	// Version is the token generation of the identity, it is increased whenever the mapped roles change
+	// so that the tokens carrying the previous roles are rejected
+	Version int
+}
+
+// TableName returns the ExternalIdentity table name
+func (e *ExternalIdentity) TableName() string {
+	return "external_identities"
+}
+
+// RoleList returns the roles mapped to the external identity
+func (e *ExternalIdentity) RoleList() (RoleList, error) {
+	return NewRoleList(e.Roles)
+}
+
+// migrateExternalIdentities prepares the identities recorded before they were keyed by issuer and subject:
+// their subject is their username, which is no longer unique
+func migrateExternalIdentities(db *gorm.DB) error {
+	m := db.Migrator()
+	if !m.HasTable(&ExternalIdentity{}) || m.HasColumn(&ExternalIdentity{}, "Subject") {
+		return nil
+	}
+	if err := m.AddColumn(&ExternalIdentity{}, "Subject"); err != nil {
+		return err
+	}
+	res := db.Unscoped().Model(&ExternalIdentity{}).Where("subject IS NULL OR subject = ''").Update("subject", gorm.Expr("username"))
+	if res.Error != nil {
+		return res.Error
+	}
+	if m.HasIndex(&ExternalIdentity{}, "idx_external_identities_username") {
+		return m.DropIndex(&ExternalIdentity{}, "idx_external_identities_username")
+	}
+	return nil
+}
+
+// Record stores the external identity of the subject of the issuer, or refreshes its username, roles and
+// last seen time if the identity is already known, the version is increased if the username or the roles
+// changed
+// the upsert is performed by the DB so that concurrent logins on different replicas do not conflict
+func (eR *ExternalIdentityRepo) Record(issuer, subject, username string, roles RoleList) (*ExternalIdentity, error) {
+	if issuer == "" || subject == "" {
+		return nil, &UserError{"the external identities require an issuer and a subject"}
+	}
+	e := &ExternalIdentity{
+		Username: username,
+		Issuer:   issuer,
+		Subject:  subject,
+		Roles:    roles.String(),
+		LastSeen: time.Now(),
+		Version:  1,
+	}
+	updates := append(clause.AssignmentColumns([]string{"updated_at", "username", "roles", "last_seen"}), clause.Assignment{
+		Column: clause.Column{Name: "version"},
+		Value: gorm.Expr(`CASE WHEN "external_identities"."roles" = "excluded"."roles" ` +
+			`AND "external_identities"."username" = "excluded"."username" ` +
+			`THEN "external_identities"."version" ELSE "external_identities"."version" + 1 END`),
+	})
+	res := eR.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "issuer"}, {Name: "subject"}},
+		DoUpdates: updates,
+	}, clause.Returning{Columns: []clause.Column{{Name: "id"}, {Name: "version"}}}).Create(e)
+	if res.Error != nil {
+		return nil, &DBError{res.Error.Error()}
+	}
+	return e, nil
+}
+
+// GetExternalIdentityByID retrieves an external identity by ID
+func (eR *ExternalIdentityRepo) GetExternalIdentityByID(id string) (*ExternalIdentity, error) {
+	identityID, err := strconv.Atoi(id)
+	if err != nil {
+		return nil, &NotFoundError{fmt.Sprintf("external identity %s not present in database", id)}
+	}
+	e := &ExternalIdentity{}
+	res := eR.DB.Limit(1).Find(e, identityID)
+	if res.Error != nil {
+		return nil, &DBError{res.Error.Error()}
+	}
+	if res.RowsAffected == 0 {
+		return nil, &NotFoundError{fmt.Sprintf("external identity %s not present in database", id)}
+	}
+	return e, nil
+}
+
+// GetExternalIdentities returns the list of external identities present in DB, most recently seen first
+func (eR *ExternalIdentityRepo) GetExternalIdentities() ([]*ExternalIdentity, error) {
+	var identities []*ExternalIdentity
+	if res := eR.DB.Order("last_seen desc").Find(&identities); res.Error != nil {
+		return nil, &DBError{res.Error.Error()}
+	}
+	return identities, nil
+}
+
+// TouchExternalIdentity updates the last seen time of the external identity
+func (eR *ExternalIdentityRepo) TouchExternalIdentity(e *ExternalIdentity) error {
+	e.LastSeen = time.Now()
+	if res := eR.DB.Model(e).Update("last_seen", e.LastSeen); res.Error != nil {
+		return &DBError{res.Error.Error()}
+	}
+	return nil
+}
+
+// DeleteExternalIdentity removes the external identity from the DB, its renew tokens are no longer accepted
+func (eR *ExternalIdentityRepo) DeleteExternalIdentity(e *ExternalIdentity) error {
+	res := eR.DB.Unscoped().Delete(e)
+	if res.Error != nil {
+		return &DBError{res.Error.Error()}
+	}
+	if res.RowsAffected == 0 {
+		return &NotFoundError{fmt.Sprintf("external identity %s not present in database", e.Username)}
+	}
+	return nil
+}
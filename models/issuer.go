@@ -0,0 +1,168 @@
+package models
+
+import (
+	"fmt"
+	"strconv"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// TrustedIssuerRepo wraps the db connection pool in a custom type
+// This approach fits nicely to perform unit tests since we can reference TrustedIssuerRepo in the application code
+// with an interface
+type TrustedIssuerRepo struct {
+	DB *gorm.DB
+}
+
+// TrustedIssuer resemble the DB trusted_issuers table schema
+// it describes an external issuer whose tokens are accepted for machine to machine authentication
+type TrustedIssuer struct {
+	gorm.Model
+	// Issuer is the expected value of the iss claim
+	Issuer string `gorm:"uniqueIndex"`
+	// JWKSURL is the location of the issuer signing keys, alternative to the static PublicKeys
+	JWKSURL string
+	// PublicKeys are the PEM encoded static signing keys of the issuer
+	PublicKeys []string `gorm:"serializer:json"`
+	// Audiences lists the accepted aud claim values, any audience is accepted if empty
+	Audiences []string `gorm:"serializer:json"`
+	// RoleMapping maps the roles asserted by the issuer to the local roles, the asserted
+	// roles are used as they are if empty
+	RoleMapping map[string]string `gorm:"serializer:json"`
+	// RoleCeiling lists the highest roles the issuer can grant, any role can be granted if empty
+	RoleCeiling []string `gorm:"serializer:json"`
+	Disabled    bool
+}
+
+// TableName returns the TrustedIssuer table name
+func (t *TrustedIssuer) TableName() string {
+	return "trusted_issuers"
+}
+
+// TrustedKeyImport records the import of a key file of the legacy keys directory, each file is imported
+// once, so that the issuers deleted or renamed afterwards are not imported again
+type TrustedKeyImport struct {
+	gorm.Model
+	Issuer string `gorm:"uniqueIndex"`
+}
+
+// TableName returns the TrustedKeyImport table name
+func (t *TrustedKeyImport) TableName() string {
+	return "trusted_key_imports"
+}
+
+// Validate checks the consistency of the trusted issuer definition
+func (t *TrustedIssuer) Validate() error {
+	if t.Issuer == "" {
+		return &UserError{"issuer cannot be empty"}
+	}
+	if t.JWKSURL == "" && len(t.PublicKeys) == 0 {
+		return &UserError{"either jwks url or public keys must be provided"}
+	}
+	if t.JWKSURL != "" && len(t.PublicKeys) > 0 {
+		return &UserError{"jwks url and public keys are mutually exclusive"}
+	}
+	var roles []string
+	for _, r := range t.RoleMapping {
+		roles = append(roles, r)
+	}
+	if _, err := NewRoleList(append(roles, t.RoleCeiling...)); err != nil {
+		return &UserError{err.Error()}
+	}
+	return nil
+}
+
+// Create stores a new trusted issuer into the DB
+func (tR *TrustedIssuerRepo) Create(t *TrustedIssuer) error {
+	if err := t.Validate(); err != nil {
+		return err
+	}
+	var count int64
+	tR.DB.Model(&TrustedIssuer{}).Where("issuer = ?", t.Issuer).Count(&count)
+	if count > 0 {
+		return &UserError{fmt.Sprintf("issuer %s already present in database", t.Issuer)}
+	}
+	if res := tR.DB.Create(t); res.Error != nil {
+		return &DBError{res.Error.Error()}
+	}
+	return nil
+}
+
+// Import stores the trusted issuer of a legacy key file unless the file has been imported before, the
+// file is recorded as imported as well if its issuer is already registered
+// it returns whether the trusted issuer has been stored
+func (tR *TrustedIssuerRepo) Import(t *TrustedIssuer) (bool, error) {
+	if err := t.Validate(); err != nil {
+		return false, err
+	}
+	imported := false
+	err := tR.DB.Transaction(func(tx *gorm.DB) error {
+		res := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&TrustedKeyImport{Issuer: t.Issuer})
+		if res.Error != nil || res.RowsAffected == 0 {
+			return res.Error
+		}
+		var count int64
+		if err := tx.Model(&TrustedIssuer{}).Where("issuer = ?", t.Issuer).Count(&count).Error; err != nil || count > 0 {
+			return err
+		}
+		if err := tx.Create(t).Error; err != nil {
+			return err
+		}
+		imported = true
+		return nil
+	})
+	if err != nil {
+		return false, &DBError{err.Error()}
+	}
+	return imported, nil
+}
+
+// GetTrustedIssuers returns the list of trusted issuers present in DB
+func (tR *TrustedIssuerRepo) GetTrustedIssuers() ([]*TrustedIssuer, error) {
+	var issuers []*TrustedIssuer
+	if res := tR.DB.Order("id").Find(&issuers); res.Error != nil {
+		return nil, &DBError{res.Error.Error()}
+	}
+	return issuers, nil
+}
+
+// GetTrustedIssuer retrieves a trusted issuer by ID
+func (tR *TrustedIssuerRepo) GetTrustedIssuer(id string) (*TrustedIssuer, error) {
+	issuerID, err := strconv.Atoi(id)
+	if err != nil {
+		return nil, &NotFoundError{fmt.Sprintf("issuer %s not present in database", id)}
+	}
+	t := &TrustedIssuer{}
+	res := tR.DB.Limit(1).Find(t, issuerID)
+	if res.Error != nil {
+		return nil, &DBError{res.Error.Error()}
+	}
+	if res.RowsAffected == 0 {
+		return nil, &NotFoundError{fmt.Sprintf("issuer %s not present in database", id)}
+	}
+	return t, nil
+}
+
+// UpdateTrustedIssuer updates the trusted issuer definition into the DB
+func (tR *TrustedIssuerRepo) UpdateTrustedIssuer(t *TrustedIssuer) error {
+	if err := t.Validate(); err != nil {
+		return err
+	}
+	if res := tR.DB.Save(t); res.Error != nil {
+		return &DBError{res.Error.Error()}
+	}
+	return nil
+}
+
+// DeleteTrustedIssuer removes the trusted issuer from the DB
+func (tR *TrustedIssuerRepo) DeleteTrustedIssuer(t *TrustedIssuer) error {
+	res := tR.DB.Unscoped().Delete(t)
+	if res.Error != nil {
+		return &DBError{res.Error.Error()}
+	}
+	if res.RowsAffected == 0 {
+		return &NotFoundError{fmt.Sprintf("issuer %s not present in database", t.Issuer)}
+	}
+	return nil
+}
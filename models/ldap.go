@@ -0,0 +1,206 @@
+package models
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+const LDAPDomain string = "LDAP"
+
+// LDAPBackend authenticates users against an LDAP / Active Directory server
+// the user entry is looked up with the service account (or anonymously), then
+// the credentials are verified binding as the user entry itself
+type LDAPBackend struct {
+	URL                string
+	StartTLS           bool
+	InsecureSkipVerify bool
+	Timeout            time.Duration
+	BindDN             string
+	BindPassword       string
+	BaseDN             string
+	// UserFilter is the search filter used to look up the user entry, %s is replaced
+	// by the escaped username, e.g. (uid=%s) or (sAMAccountName=%s)
+	UserFilter     string
+	GroupAttribute string
+	// GroupRoles maps the directory group DNs to goidp role names
+	GroupRoles map[string]string
+	// Users, if set, is used to JIT-provision a shadow local user at each successful login
+	Users ShadowUserProvisioner
+}
+
+// ShadowUserProvisioner stores the local copies of the users authenticated by an external backend
+type ShadowUserProvisioner interface {
+	ProvisionShadowUser(backend, subject, username string, roles RoleList) (*User, error)
+}
+
+// ParseLDAPGroupRoles parses a group to role mapping in the form
+// "cn=admins,ou=groups,dc=example,dc=org=ADMIN;cn=ops,ou=groups,dc=example,dc=org=MONITOR"
+func ParseLDAPGroupRoles(mapping string) (map[string]string, error) {
+	groupRoles := make(map[string]string)
+	for _, entry := range strings.Split(mapping, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		i := strings.LastIndex(entry, "=")
+		if i <= 0 || i == len(entry)-1 {
+			return nil, fmt.Errorf("invalid group role mapping %s", entry)
+		}
+		role := strings.TrimSpace(entry[i+1:])
+		if _, err := NewRoleList([]string{role}); err != nil {
+			return nil, err
+		}
+		groupRoles[strings.ToLower(strings.TrimSpace(entry[:i]))] = role
+	}
+	return groupRoles, nil
+}
+
+// Domain returns the LDAP authentication domain
+func (b *LDAPBackend) Domain() string {
+	return LDAPDomain
+}
+
+// Authenticate bind-authenticates the user against the directory and maps its groups to roles
+// users that do not belong to any mapped group are refused
+func (b *LDAPBackend) Authenticate(username, password string) (*User, bool) {
+	// an empty password would result in an unauthenticated bind, which always succeeds
+	if username == "" || password == "" {
+		return nil, false
+	}
+	conn, err := b.dial()
+	if err != nil {
+		log.WithError(err).Warnf("unable to connect to ldap server")
+		return nil, false
+	}
+	defer conn.Close()
+
+	if b.BindDN != "" {
+		if err = conn.Bind(b.BindDN, b.BindPassword); err != nil {
+			log.WithError(err).Warnf("ldap service account bind failed")
+			return nil, false
+		}
+	}
+
+	groupAttribute := b.GroupAttribute
+	if groupAttribute == "" {
+		groupAttribute = "memberOf"
+	}
+	res, err := conn.Search(ldap.NewSearchRequest(
+		b.BaseDN,
+		ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases,
+		2,
+		int(b.Timeout.Seconds()),
+		false,
+		fmt.Sprintf(b.UserFilter, ldap.EscapeFilter(username)),
+		[]string{"dn", groupAttribute},
+		nil,
+	))
+	if err != nil {
+		log.WithError(err).Warnf("ldap user search failed")
+		return nil, false
+	}
+	if len(res.Entries) != 1 {
+		log.WithField("entries", len(res.Entries)).Infof("ldap user %s not found or not unique", username)
+		return nil, false
+	}
+	entry := res.Entries[0]
+
+	if err = conn.Bind(entry.DN, password); err != nil {
+		log.WithError(err).Infof("ldap bind failed for user %s", username)
+		return nil, false
+	}
+
+	var roleNames []string
+	mapped := make(map[string]bool)
+	for _, group := range entry.GetAttributeValues(groupAttribute) {
+		if role, ok := b.GroupRoles[strings.ToLower(group)]; ok && !mapped[strings.ToUpper(role)] {
+			mapped[strings.ToUpper(role)] = true
+			roleNames = append(roleNames, role)
+		}
+	}
+	if len(roleNames) == 0 {
+		log.Infof("ldap user %s does not belong to any mapped group", username)
+		return nil, false
+	}
+	roles, err := NewRoleList(roleNames)
+	if err != nil {
+		log.WithError(err).Warnf("unable to convert ldap roles")
+		return nil, false
+	}
+
+	if b.Users == nil {
+		return &User{Username: username, Roles: roles}, true
+	}
+	u, err := b.Users.ProvisionShadowUser(b.Domain(), username, username, roles)
+	if err != nil {
+		log.WithError(err).Warnf("failed to provision shadow user %s", username)
+		return nil, false
+	}
+	return u, true
+}
+
+func (b *LDAPBackend) dial() (*ldap.Conn, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: b.InsecureSkipVerify}
+	conn, err := ldap.DialURL(b.URL, ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	if b.Timeout > 0 {
+		conn.SetTimeout(b.Timeout)
+	}
+	if b.StartTLS {
+		if err = conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// ProvisionShadowUser creates or refreshes the local copy of a user authenticated by an
+// external backend. Shadow users get a random password, so they cannot log in locally.
+// The shadow user is linked to the account of the backend by backend and subject only, a new account
+// is refused if its username is taken by a local user or by the shadow user of another account.
+func (uR *UserRepo) ProvisionShadowUser(backend, subject, username string, roles RoleList) (*User, error) {
+	if backend == "" || subject == "" {
+		return nil, &UserError{"the shadow users require a backend and a subject"}
+	}
+	u := &User{}
+	res := uR.DB.Preload("Roles").Where("backend = ? AND subject = ?", backend, subject).Limit(1).Find(u)
+	if res.Error != nil {
+		return nil, &DBError{res.Error.Error()}
+	}
+	if res.RowsAffected == 1 {
+		// the tokens issued with the previous roles are revoked
+		if !roles.equal(u.Roles) {
+			u.Version++
+		}
+		u.Roles = roles
+		if err := uR.UpdateUser(u); err != nil {
+			return nil, err
+		}
+		return u, nil
+	}
+
+	// the deleted users are not provisioned again until they are restored or purged
+	if err := uR.ValidateUsername(username); err != nil {
+		return nil, &UserError{err.Error()}
+	}
+	u = &User{
+		Username: username,
+		Roles:    roles,
+		Version:  1,
+		Backend:  backend,
+		Subject:  subject,
+	}
+	if err := uR.CreateWithoutPassword(u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
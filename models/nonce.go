@@ -0,0 +1,56 @@
+package models
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// NonceRepo wraps the db connection pool in a custom type
+// This approach fits nicely to perform unit tests since we can reference NonceRepo in the application code
+// with an interface
+type NonceRepo struct {
+	DB *gorm.DB
+}
+
+// UsedNonce resemble the DB used_nonces table schema
+// it records the identifier of a single use credential, such as a DPoP proof or a client assertion, until
+// the credential expires, the table is shared by the replicas so that a credential replayed to another
+// replica is rejected as well
+type UsedNonce struct {
+	JTI       string    `gorm:"column:jti;primaryKey"`
+	ExpiresAt time.Time `gorm:"index"`
+}
+
+// TableName returns the UsedNonce table name
+func (n *UsedNonce) TableName() string {
+	return "used_nonces"
+}
+
+// Use records the nonce until its expiration, it returns false if the nonce has already been used and
+// has not expired yet
+// the check and the record are a single statement so that concurrent requests on different replicas
+// cannot both use the same nonce
+func (nR *NonceRepo) Use(jti string, expire time.Time) (bool, error) {
+	res := nR.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "jti"}},
+		DoUpdates: clause.AssignmentColumns([]string{"expires_at"}),
+		Where:     clause.Where{Exprs: []clause.Expression{gorm.Expr(`"used_nonces"."expires_at" <= ?`, time.Now())}},
+	}).Create(&UsedNonce{JTI: jti, ExpiresAt: expire})
+	if res.Error != nil {
+		return false, &DBError{res.Error.Error()}
+	}
+	return res.RowsAffected == 1, nil
+}
+
+// deleteExpiredNonces removes the nonces whose credential has expired
+func deleteExpiredNonces(db *gorm.DB) error {
+	res := db.Where("expires_at <= ?", time.Now()).Delete(&UsedNonce{})
+	if res.Error != nil {
+		return res.Error
+	}
+	log.Debugf("deleted %d expired nonces", res.RowsAffected)
+	return nil
+}
@@ -0,0 +1,171 @@
+package models
+
+import (
+	"fmt"
+	"strconv"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// ServiceAccountDomain is the authentication domain of the service accounts
+const ServiceAccountDomain string = "SERVICE"
+
+// ServiceAccountRepo wraps the db connection pool in a custom type
+// This approach fits nicely to perform unit tests since we can reference ServiceAccountRepo in the application code
+// with an interface
+type ServiceAccountRepo struct {
+	DB *gorm.DB
+}
+
+// ServiceAccount resemble the DB service_accounts table schema
+// it describes a non-human caller, which has no password and authenticates with the client credentials
+// grant using a client certificate, a client secret or an assertion signed with one of its keys
+type ServiceAccount struct {
+	gorm.Model
+	Name        string `gorm:"uniqueIndex"`
+	Description string
+	// Owner is the person accountable for the service account, Team the one operating it
+	Owner string
+	Team  string
+	Roles []string `gorm:"serializer:json"`
+	// SecretHash is the bcrypt hash of the client secret, empty if the account has no secret
+	SecretHash string
+	// PublicKeys are the PEM encoded keys verifying the client assertions of the account
+	PublicKeys []string `gorm:"serializer:json"`
+	// CertificateThumbprints are the x5t#S256 thumbprints of the client certificates of the account,
+	// a certificate issued by a trusted CA is not accepted unless registered here
+	CertificateThumbprints []string `gorm:"serializer:json"`
+	Disabled               bool
+	// Version is incremented at each change of the account, the tokens issued before are then rejected
+	Version int
+}
+
+// TableName returns the ServiceAccount table name
+func (s *ServiceAccount) TableName() string {
+	return "service_accounts"
+}
+
+// RoleList returns the roles of the service account
+func (s *ServiceAccount) RoleList() (RoleList, error) {
+	return NewRoleList(s.Roles)
+}
+
+// SetSecret stores the hash of the client secret
+func (s *ServiceAccount) SetSecret(secret string) {
+	hashedSecret, _ := bcrypt.GenerateFromPassword([]byte(secret), 8)
+	s.SecretHash = string(hashedSecret)
+}
+
+// VerifySecret checks the client secret against the stored hash
+func (s *ServiceAccount) VerifySecret(secret string) bool {
+	return s.SecretHash != "" && bcrypt.CompareHashAndPassword([]byte(s.SecretHash), []byte(secret)) == nil
+}
+
+// Validate checks the consistency of the service account definition
+func (s *ServiceAccount) Validate() error {
+	if s.Name == "" {
+		return &UserError{"name cannot be empty"}
+	}
+	if _, err := s.RoleList(); err != nil {
+		return &UserError{err.Error()}
+	}
+	return nil
+}
+
+// Create stores a new service account into the DB, its name cannot be the one of a local user
+func (sR *ServiceAccountRepo) Create(s *ServiceAccount) error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
+	var count int64
+	sR.DB.Model(&ServiceAccount{}).Where("name = ?", s.Name).Count(&count)
+	if count > 0 {
+		return &UserError{fmt.Sprintf("service account %s already present in database", s.Name)}
+	}
+	sR.DB.Unscoped().Model(&User{}).Where("username = ?", s.Name).Count(&count)
+	if count > 0 {
+		return &UserError{fmt.Sprintf("name %s already used by a user", s.Name)}
+	}
+	s.Version = 1
+	if res := sR.DB.Create(s); res.Error != nil {
+		return &DBError{res.Error.Error()}
+	}
+	return nil
+}
+
+// GetServiceAccounts returns the list of service accounts present in DB
+func (sR *ServiceAccountRepo) GetServiceAccounts() ([]*ServiceAccount, error) {
+	var accounts []*ServiceAccount
+	if res := sR.DB.Order("id").Find(&accounts); res.Error != nil {
+		return nil, &DBError{res.Error.Error()}
+	}
+	return accounts, nil
+}
+
+// GetServiceAccount retrieves a service account by ID or name
+func (sR *ServiceAccountRepo) GetServiceAccount(nameOrID string) (*ServiceAccount, error) {
+	s := &ServiceAccount{}
+	var res *gorm.DB
+	if id, err := strconv.Atoi(nameOrID); err == nil {
+		res = sR.DB.Limit(1).Find(s, id)
+	} else {
+		res = sR.DB.Where("name = ?", nameOrID).Limit(1).Find(s)
+	}
+	if res.Error != nil {
+		return nil, &DBError{res.Error.Error()}
+	}
+	if res.RowsAffected == 0 {
+		return nil, &NotFoundError{fmt.Sprintf("service account %s not present in database", nameOrID)}
+	}
+	return s, nil
+}
+
+// GetServiceAccountByName retrieves a service account by name only, the numeric names are never
+// resolved as IDs
+func (sR *ServiceAccountRepo) GetServiceAccountByName(name string) (*ServiceAccount, error) {
+	s := &ServiceAccount{}
+	res := sR.DB.Where("name = ?", name).Limit(1).Find(s)
+	if res.Error != nil {
+		return nil, &DBError{res.Error.Error()}
+	}
+	if res.RowsAffected == 0 {
+		return nil, &NotFoundError{fmt.Sprintf("service account %s not present in database", name)}
+	}
+	return s, nil
+}
+
+// HasCertificate reports whether the client certificate with the given thumbprint is registered for the account
+func (s *ServiceAccount) HasCertificate(thumbprint string) bool {
+	for _, t := range s.CertificateThumbprints {
+		if t == thumbprint {
+			return true
+		}
+	}
+	return false
+}
+
+// UpdateServiceAccount updates the service account definition into the DB, the tokens issued before
+// are revoked
+func (sR *ServiceAccountRepo) UpdateServiceAccount(s *ServiceAccount) error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
+	s.Version = s.Version + 1
+	if res := sR.DB.Save(s); res.Error != nil {
+		return &DBError{res.Error.Error()}
+	}
+	return nil
+}
+
+// DeleteServiceAccount removes the service account from the DB
+func (sR *ServiceAccountRepo) DeleteServiceAccount(s *ServiceAccount) error {
+	res := sR.DB.Unscoped().Delete(s)
+	if res.Error != nil {
+		return &DBError{res.Error.Error()}
+	}
+	if res.RowsAffected == 0 {
+		return &NotFoundError{fmt.Sprintf("service account %s not present in database", s.Name)}
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// SessionRepo wraps the db connection pool in a custom type
+// This approach fits nicely to perform unit tests since we can reference SessionRepo in the application code
+// with an interface
+type SessionRepo struct {
+	DB *gorm.DB
+}
+
+// Session resemble the DB sessions table schema
+// it tracks a login of the user, the session id is embedded in the issued tokens which are rejected
+// once the session is terminated
+type Session struct {
+	gorm.Model
+	SID       string `gorm:"column:sid;uniqueIndex"`
+	Username  string `gorm:"index"`
+	Domain    string
+	IP        string
+	UserAgent string
+	// UserID is the local or shadow user the session belongs to, 0 for the external identities
+	UserID uint `gorm:"index"`
+	// IdentityID is the external identity the session belongs to, 0 for the local and shadow users
+	IdentityID uint `gorm:"index"`
+	// LastRenewedAt is the time of the last access token renewal, zero if never renewed
+	LastRenewedAt time.Time
+	// ExpiresAt is the end of the absolute lifetime of the session
+	ExpiresAt time.Time
+}
+
+// TableName returns the Session table name
+func (s *Session) TableName() string {
+	return "sessions"
+}
+
+// SessionOwner identifies the user the sessions belong to: the external identity for the users
+// authenticated without local copy, otherwise the local or shadow user, the local users and the
+// external identities sharing a username do not share their sessions
+type SessionOwner struct {
+	UserID     uint
+	IdentityID uint
+}
+
+// String returns the key of the owner, unique among the local users and the external identities
+func (o SessionOwner) String() string {
+	if o.IdentityID != 0 {
+		return fmt.Sprintf("identity/%d", o.IdentityID)
+	}
+	return fmt.Sprintf("user/%d", o.UserID)
+}
+
+// Owner returns the owner of the session
+func (s *Session) Owner() SessionOwner {
+	return SessionOwner{UserID: s.UserID, IdentityID: s.IdentityID}
+}
+
+// LastActivity returns the time of the last renewal of the session, or of its creation if never renewed
+func (s *Session) LastActivity() time.Time {
+	if s.LastRenewedAt.IsZero() {
+		return s.CreatedAt
+	}
+	return s.LastRenewedAt
+}
+
+// Create stores a new session into the DB
+func (sR *SessionRepo) Create(s *Session) error {
+	if res := sR.DB.Create(s); res.Error != nil {
+		return &DBError{res.Error.Error()}
+	}
+	return nil
+}
+
+// CreateWithinLimit stores a new session of the user once admit has accepted the active sessions of
+// the owner of the session, most recent first; the sessions returned by admit are terminated and counted
+// in the result. The logins of an owner are serialized by a transaction-scoped advisory lock so that concurrent logins
+// cannot both pass the limit, the error of admit is returned as is
+func (sR *SessionRepo) CreateWithinLimit(s *Session, admit func([]*Session) ([]*Session, error)) (int64, error) {
+	var evicted int64
+	var admitErr error
+	err := sR.DB.Transaction(func(tx *gorm.DB) error {
+		if res := tx.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", "sessions/"+s.Owner().String()); res.Error != nil {
+			return res.Error
+		}
+		var sessions []*Session
+		res := tx.Where("user_id = ? AND identity_id = ? AND expires_at > ?", s.UserID, s.IdentityID, time.Now()).Order("created_at desc").Find(&sessions)
+		if res.Error != nil {
+			return res.Error
+		}
+		var terminated []*Session
+		if terminated, admitErr = admit(sessions); admitErr != nil {
+			return admitErr
+		}
+		if len(terminated) > 0 {
+			ids := make([]uint, 0, len(terminated))
+			for _, t := range terminated {
+				ids = append(ids, t.ID)
+			}
+			if res = tx.Unscoped().Where("id IN ?", ids).Delete(&Session{}); res.Error != nil {
+				return res.Error
+			}
+			evicted = res.RowsAffected
+		}
+		return tx.Create(s).Error
+	})
+	if admitErr != nil {
+		return 0, admitErr
+	}
+	if err != nil {
+		return 0, &DBError{err.Error()}
+	}
+	return evicted, nil
+}
+
+// GetSession retrieves a session by session id, the expired sessions are not returned
+func (sR *SessionRepo) GetSession(sid string) (*Session, error) {
+	s := &Session{}
+	res := sR.DB.Where("sid = ? AND expires_at > ?", sid, time.Now()).Limit(1).Find(s)
+	if res.Error != nil {
+		return nil, &DBError{res.Error.Error()}
+	}
+	if res.RowsAffected == 0 {
+		return nil, &NotFoundError{fmt.Sprintf("session %s not present in database", sid)}
+	}
+	return s, nil
+}
+
+// GetUserSessions returns the active sessions of the owner, the most recent first
+func (sR *SessionRepo) GetUserSessions(o SessionOwner) ([]*Session, error) {
+	var sessions []*Session
+	res := sR.DB.Where("user_id = ? AND identity_id = ? AND expires_at > ?", o.UserID, o.IdentityID, time.Now()).Order("created_at desc").Find(&sessions)
+	if res.Error != nil {
+		return nil, &DBError{res.Error.Error()}
+	}
+	return sessions, nil
+}
+
+// TouchSession updates the last renewal time of the session
+func (sR *SessionRepo) TouchSession(s *Session) error {
+	if res := sR.DB.Model(s).Update("last_renewed_at", time.Now()); res.Error != nil {
+		return &DBError{res.Error.Error()}
+	}
+	return nil
+}
+
+// DeleteSession terminates the session
+func (sR *SessionRepo) DeleteSession(s *Session) error {
+	res := sR.DB.Unscoped().Delete(s)
+	if res.Error != nil {
+		return &DBError{res.Error.Error()}
+	}
+	if res.RowsAffected == 0 {
+		return &NotFoundError{fmt.Sprintf("session %s not present in database", s.SID)}
+	}
+	return nil
+}
+
+// DeleteUserSessions terminates all the sessions of the owner, it returns the number of sessions terminated
+func (sR *SessionRepo) DeleteUserSessions(o SessionOwner) (int64, error) {
+	res := sR.DB.Unscoped().Where("user_id = ? AND identity_id = ?", o.UserID, o.IdentityID).Delete(&Session{})
+	if res.Error != nil {
+		return 0, &DBError{res.Error.Error()}
+	}
+	return res.RowsAffected, nil
+}
+
+// migrateSessions terminates the sessions recorded before they were keyed by their owner, their username
+// may belong to a local user as well as to external identities
+func migrateSessions(db *gorm.DB) error {
+	m := db.Migrator()
+	if !m.HasTable(&Session{}) || m.HasColumn(&Session{}, "UserID") {
+		return nil
+	}
+	return db.Unscoped().Where("1 = 1").Delete(&Session{}).Error
+}
+
+// deleteExpiredSessions removes the sessions whose renew token has expired
+func deleteExpiredSessions(db *gorm.DB) error {
+	res := db.Unscoped().Where("expires_at <= ?", time.Now()).Delete(&Session{})
+	if res.Error != nil {
+		return res.Error
+	}
+	log.Debugf("deleted %d expired sessions", res.RowsAffected)
+	return nil
+}
@@ -0,0 +1,124 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// PersonalAccessTokenRepo wraps the db connection pool in a custom type
+// This approach fits nicely to perform unit tests since we can reference PersonalAccessTokenRepo in the application code
+// with an interface
+type PersonalAccessTokenRepo struct {
+	DB *gorm.DB
+}
+
+// PersonalAccessToken resemble the DB personal_access_tokens table schema
+// it is a long-lived token issued to a local user for its scripts, the token itself is shown once at
+// creation and only its hash is stored
+type PersonalAccessToken struct {
+	gorm.Model
+	Username string `gorm:"index"`
+	Name     string
+	// Hash is the SHA-256 of the token
+	Hash string `gorm:"uniqueIndex"`
+	// Roles are the roles granted by the token, a subset of the roles of the user
+	Roles     []string `gorm:"serializer:json"`
+	ExpiresAt time.Time
+	// LastUsedAt is the time the token has last been accepted, zero if never used
+	LastUsedAt time.Time
+}
+
+// TableName returns the PersonalAccessToken table name
+func (p *PersonalAccessToken) TableName() string {
+	return "personal_access_tokens"
+}
+
+// HashPersonalAccessToken returns the digest of the personal access token stored into the DB
+func HashPersonalAccessToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Create stores a new personal access token into the DB
+func (pR *PersonalAccessTokenRepo) Create(p *PersonalAccessToken) error {
+	if res := pR.DB.Create(p); res.Error != nil {
+		return &DBError{res.Error.Error()}
+	}
+	return nil
+}
+
+// GetPersonalAccessToken retrieves a personal access token by its value, the expired tokens are not returned
+func (pR *PersonalAccessTokenRepo) GetPersonalAccessToken(token string) (*PersonalAccessToken, error) {
+	p := &PersonalAccessToken{}
+	res := pR.DB.Where("hash = ? AND expires_at > ?", HashPersonalAccessToken(token), time.Now()).Limit(1).Find(p)
+	if res.Error != nil {
+		return nil, &DBError{res.Error.Error()}
+	}
+	if res.RowsAffected == 0 {
+		return nil, &NotFoundError{"personal access token not present in database"}
+	}
+	return p, nil
+}
+
+// GetUserPersonalAccessToken retrieves a personal access token of the user by ID
+func (pR *PersonalAccessTokenRepo) GetUserPersonalAccessToken(username, id string) (*PersonalAccessToken, error) {
+	tokenID, err := strconv.Atoi(id)
+	if err != nil {
+		return nil, &NotFoundError{fmt.Sprintf("personal access token %s not present in database", id)}
+	}
+	p := &PersonalAccessToken{}
+	res := pR.DB.Where("username = ?", username).Limit(1).Find(p, tokenID)
+	if res.Error != nil {
+		return nil, &DBError{res.Error.Error()}
+	}
+	if res.RowsAffected == 0 {
+		return nil, &NotFoundError{fmt.Sprintf("personal access token %s not present in database", id)}
+	}
+	return p, nil
+}
+
+// GetUserPersonalAccessTokens returns the personal access tokens of the user, the most recent first
+func (pR *PersonalAccessTokenRepo) GetUserPersonalAccessTokens(username string) ([]*PersonalAccessToken, error) {
+	var tokens []*PersonalAccessToken
+	if res := pR.DB.Where("username = ?", username).Order("created_at desc").Find(&tokens); res.Error != nil {
+		return nil, &DBError{res.Error.Error()}
+	}
+	return tokens, nil
+}
+
+// TouchPersonalAccessToken updates the last use time of the personal access token
+func (pR *PersonalAccessTokenRepo) TouchPersonalAccessToken(p *PersonalAccessToken) error {
+	p.LastUsedAt = time.Now()
+	if res := pR.DB.Model(p).Update("last_used_at", p.LastUsedAt); res.Error != nil {
+		return &DBError{res.Error.Error()}
+	}
+	return nil
+}
+
+// DeletePersonalAccessToken revokes the personal access token
+func (pR *PersonalAccessTokenRepo) DeletePersonalAccessToken(p *PersonalAccessToken) error {
+	res := pR.DB.Unscoped().Delete(p)
+	if res.Error != nil {
+		return &DBError{res.Error.Error()}
+	}
+	if res.RowsAffected == 0 {
+		return &NotFoundError{fmt.Sprintf("personal access token %d not present in database", p.ID)}
+	}
+	return nil
+}
+
+// deleteExpiredPersonalAccessTokens removes the personal access tokens past their expiration
+func deleteExpiredPersonalAccessTokens(db *gorm.DB) error {
+	res := db.Unscoped().Where("expires_at <= ?", time.Now()).Delete(&PersonalAccessToken{})
+	if res.Error != nil {
+		return res.Error
+	}
+	log.Debugf("deleted %d expired personal access tokens", res.RowsAffected)
+	return nil
+}
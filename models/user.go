@@ -1,12 +1,17 @@
 package models
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"net/mail"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
+	log "github.com/sirupsen/logrus"
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 )
@@ -16,6 +21,18 @@ import (
 // with an interface
 type UserRepo struct {
 	DB *gorm.DB
+	// reserved are the usernames of the accounts stored outside the DB, such as the break-glass account,
+	// which no user can take
+	reserved map[string]bool
+}
+
+// Reserve prevents the users from being created or renamed with the username of an account stored
+// outside the DB, it is called at start-up
+func (uR *UserRepo) Reserve(username string) {
+	if uR.reserved == nil {
+		uR.reserved = make(map[string]bool)
+	}
+	uR.reserved[username] = true
 }
 
 // RoleList defines the list of roles assigned to a DB user
@@ -42,6 +59,22 @@ func NewRoleList(roleListString []string) (RoleList, error) {
 	return rL, nil
 }
 
+// equal reports whether the two lists hold the same roles
+func (rL RoleList) equal(other RoleList) bool {
+	ids := make(map[uint]bool)
+	for _, r := range rL {
+		ids[r.ID] = true
+	}
+	otherIDs := make(map[uint]bool)
+	for _, r := range other {
+		if !ids[r.ID] {
+			return false
+		}
+		otherIDs[r.ID] = true
+	}
+	return len(ids) == len(otherIDs)
+}
+
 func (rL *RoleList) String() []string {
 	var roleListString []string
 	for _, r := range *rL {
@@ -50,6 +83,42 @@ func (rL *RoleList) String() []string {
 	return roleListString
 }
 
+// UserStatus is the lifecycle state of a user account, only the active users log in
+type UserStatus string
+
+const (
+	UserActive   UserStatus = "active"
+	UserPending  UserStatus = "pending"
+	UserDisabled UserStatus = "disabled"
+	UserLocked   UserStatus = "locked"
+	UserExpired  UserStatus = "expired"
+)
+
+// userTransitions are the states each state can move to, pending is only given at creation
+var userTransitions = map[UserStatus][]UserStatus{
+	UserActive:   {UserDisabled, UserLocked, UserExpired},
+	UserPending:  {UserActive, UserDisabled},
+	UserDisabled: {UserActive},
+	UserLocked:   {UserActive, UserDisabled},
+	UserExpired:  {UserActive, UserDisabled},
+}
+
+var (
+	// phoneNumber is the E.164 format of the phone numbers
+	phoneNumber = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+	// localeTag is a language tag with an optional region, e.g. en or en-US
+	localeTag = regexp.MustCompile(`^[a-z]{2,3}(-[A-Z]{2})?$`)
+)
+
+// NewUserStatus validates the given state name
+func NewUserStatus(s string) (UserStatus, error) {
+	status := UserStatus(strings.ToLower(s))
+	if _, ok := userTransitions[status]; !ok {
+		return "", fmt.Errorf("invalid user status %s", s)
+	}
+	return status, nil
+}
+
 // User resemble the DB users table schema
 // it has a many to many relationships with user roles
 // each user can be assigned to multiple roles
@@ -58,8 +127,38 @@ type User struct {
 	gorm.Model
 	Username string
 	Password string
-	Version  int
+	// Version is the generation of the tokens of the user, bumped by the changes which revoke them
+	Version int
+	// Revision is bumped by every change of the user, it is the entity tag of the user and settles the
+	// concurrent changes
+	Revision int      `gorm:"not null;default:0"`
 	Roles    RoleList `gorm:"many2many:user_roles"`
+	// Status is the lifecycle state of the account, the users stored before the states were introduced
+	// have an empty status and are active
+	Status string `gorm:"index"`
+	// ExpiresAt is the optional expiration time of the account, after which it is expired
+	ExpiresAt *time.Time
+	// DisplayName, Email, Phone, Locale and Team are the core profile of the user
+	DisplayName string
+	Email       string `gorm:"index"`
+	Phone       string
+	Locale      string
+	Team        string
+	// EmailVerified reports whether the user proved to own its email, which identifies the user at login
+	// once verified
+	EmailVerified bool
+	// Attributes are the custom attributes of the profile, whose schemas are the attribute definitions
+	Attributes map[string]interface{} `gorm:"serializer:json"`
+	// Backend and Subject identify the account of the shadow users in the backend which provisions them,
+	// e.g. the LDAP username or the issuer and subject of the upstream provider, they are empty for the
+	// local users, which are never linked to an external account
+	Backend string `gorm:"index:idx_users_backend_subject,unique,where:backend <> ''"`
+	Subject string `gorm:"index:idx_users_backend_subject,unique,where:backend <> ''"`
+	// Elevations are the approved elevations of the user, loaded when its tokens are issued
+	Elevations []*Elevation `gorm:"-"`
+	// IdentityID is the external identity the users without local copy are recorded as, their tokens
+	// refer to it
+	IdentityID uint `gorm:"-"`
 }
 
 // TableName returns the User table name
@@ -67,11 +166,83 @@ func (u *User) TableName() string {
 	return "users"
 }
 
+// BeforeCreate stores an empty set of custom attributes rather than a null one, the zero values of the
+// serialized fields are not serialized
+func (u *User) BeforeCreate(tx *gorm.DB) error {
+	if u.Attributes == nil {
+		u.Attributes = make(map[string]interface{})
+	}
+	return nil
+}
+
 // ToString provides a string representation of the User information
 func (u *User) ToString() string {
 	return fmt.Sprintf("id: %d\nusername: %s\nversion: %d\nroles: %s", u.ID, u.Username, u.Version, u.Roles.String())
 }
 
+// State returns the lifecycle state of the account, an active account is expired past its expiration time
+func (u *User) State() UserStatus {
+	status := UserStatus(u.Status)
+	if status == "" {
+		status = UserActive
+	}
+	if status == UserActive && u.ExpiresAt != nil && !time.Now().Before(*u.ExpiresAt) {
+		return UserExpired
+	}
+	return status
+}
+
+// Active reports whether the account can log in
+func (u *User) Active() bool {
+	return u.State() == UserActive
+}
+
+// SetStatus moves the account to the given state, if the transition is allowed, an account past its
+// expiration time is activated only once given a new expiration time or none
+func (u *User) SetStatus(status UserStatus) error {
+	current := u.State()
+	if status == current {
+		u.Status = string(status)
+		return nil
+	}
+	for _, s := range userTransitions[current] {
+		if s == status {
+			if status == UserActive && u.ExpiresAt != nil && !time.Now().Before(*u.ExpiresAt) {
+				return &UserError{fmt.Sprintf("user expired on %s, a new expiration time is required", u.ExpiresAt.Format(time.RFC3339))}
+			}
+			u.Status = string(status)
+			return nil
+		}
+	}
+	return &UserError{fmt.Sprintf("user cannot move from %s to %s", current, status)}
+}
+
+// ValidateProfile checks the format of the core profile fields, the empty fields are not set
+func (u *User) ValidateProfile() error {
+	if u.Email != "" {
+		if a, err := mail.ParseAddress(u.Email); err != nil || a.Address != u.Email {
+			return &UserError{fmt.Sprintf("invalid email %s", u.Email)}
+		}
+	}
+	if u.Phone != "" && !phoneNumber.MatchString(u.Phone) {
+		return &UserError{fmt.Sprintf("invalid phone %s, the E.164 format is required", u.Phone)}
+	}
+	if u.Locale != "" && !localeTag.MatchString(u.Locale) {
+		return &UserError{fmt.Sprintf("invalid locale %s", u.Locale)}
+	}
+	return nil
+}
+
+// SetPassword validates the given password against the security requirements and stores its hash
+func (u *User) SetPassword(password string) error {
+	if err := validatePassword(password); err != nil {
+		return &UserError{fmt.Sprintf("password does not meet security requirements: %s", err.Error())}
+	}
+	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte(password), 8)
+	u.Password = string(hashedPassword)
+	return nil
+}
+
 // Create creates a new user into the DB
 // It returns an error if:
 // - username is already present in database
@@ -87,99 +258,324 @@ func (uR *UserRepo) Create(u *User) error {
 	if err := uR.ValidateUsername(u.Username); err != nil {
 		return &UserError{err.Error()}
 	}
+	if err := uR.ValidateEmail(u.Email, 0); err != nil {
+		return err
+	}
 	if err := validatePassword(u.Password); err != nil {
 		return &UserError{fmt.Sprintf("password does not meet security requirements: %s", err.Error())}
 	}
+	if err := u.ValidateProfile(); err != nil {
+		return err
+	}
 	var res *gorm.DB
 
 	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte(u.Password), 8)
 	u.Password = string(hashedPassword)
+	if u.Status == "" {
+		u.Status = string(UserActive)
+	}
 
 	res = uR.DB.Create(&u)
 	if res.Error != nil {
+		return emailError(res.Error, u.Email)
+	}
+	return nil
+}
+
+// CreateWithoutPassword stores a user with a random password, which cannot log in with a password until
+// an administrator sets one
+func (uR *UserRepo) CreateWithoutPassword(u *User) error {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte(hex.EncodeToString(secret)), 8)
+	u.Password = string(hashedPassword)
+	if u.Status == "" {
+		u.Status = string(UserActive)
+	}
+	if res := uR.DB.Create(u); res.Error != nil {
 		return &DBError{res.Error.Error()}
 	}
 	return nil
 }
 
-// ValidateUsername validates the user username
+// ValidateUsername validates the user username, the usernames of the deleted users are reserved until
+// they are purged. The username cannot be the email of another user, both identify the users at login,
+// nor the name of a service account, both are subjects of the tokens.
 func (uR *UserRepo) ValidateUsername(u string) error {
 	var users []User
 	if u == "" {
 		return errors.New("username cannot be empty")
 	}
+	if uR.reserved[u] {
+		return fmt.Errorf("username %s reserved by the break-glass account", u)
+	}
 	var res *gorm.DB
-	res = uR.DB.Where("username = ?", u).Find(&users)
+	res = uR.DB.Unscoped().Where("username = ? OR lower(email) = lower(?)", u, u).Find(&users)
 	if res.RowsAffected > 0 {
+		if users[0].Username != u {
+			return fmt.Errorf("username %s is the email of another user", u)
+		}
+		if users[0].DeletedAt.Valid {
+			return fmt.Errorf("username %s reserved by a deleted user", u)
+		}
 		return errors.New(fmt.Sprintf("user %s already present in database", u))
 	}
+	var count int64
+	uR.DB.Model(&ServiceAccount{}).Where("name = ?", u).Count(&count)
+	if count > 0 {
+		return fmt.Errorf("username %s already used by a service account", u)
+	}
 	return nil
 }
 
-// UpdateUserByNameOrID update User information given user ID or user name
-// it is considered to be an ID, if it can be converted into integer, otherwise
-// it is considered a username
-func (uR *UserRepo) UpdateUserByNameOrID(nameOrID, username, password string, roles []string) (*User, error) {
-	targetUser := &User{}
-	if id, err := strconv.Atoi(nameOrID); err == nil {
-		targetUser.Model = gorm.Model{ID: uint(id)}
-	} else {
-		targetUser.Username = nameOrID
-	}
+// usersEmailIndex is the unique index of the emails of the users, which settles the concurrent changes
+// validated against the same email
+const usersEmailIndex = "idx_users_email_lower"
 
-	u, err := uR.GetUserByNameOrID(nameOrID)
+// migrateUserEmails creates the unique index of the emails, compared case insensitively, the index is
+// created at a later start if the stored emails are not unique yet
+func migrateUserEmails(db *gorm.DB) {
+	err := db.Exec(fmt.Sprintf("CREATE UNIQUE INDEX IF NOT EXISTS %s ON users (lower(email)) WHERE email <> ''", usersEmailIndex)).Error
 	if err != nil {
-		return nil, err
+		log.WithError(err).Warnf("failed to create the unique index of the user emails, duplicate emails must be resolved")
+	}
+}
+
+// emailError returns a UserError if err is the violation of the unique index of the emails
+func emailError(err error, email string) error {
+	if strings.Contains(err.Error(), usersEmailIndex) {
+		return &UserError{fmt.Sprintf("email %s already in use", email)}
 	}
+	return &DBError{err.Error()}
+}
+
+// ValidateEmail validates the uniqueness of the email of the user with the given ID, the emails are
+// compared case insensitively and cannot be the username of another user
+func (uR *UserRepo) ValidateEmail(email string, id uint) error {
+	return validateEmail(uR.DB, email, id)
+}
+
+func validateEmail(db *gorm.DB, email string, id uint) error {
+	if email == "" {
+		return nil
+	}
+	var users []User
+	res := db.Unscoped().Where("(lower(email) = lower(?) OR username = ?) AND id <> ?", email, email, id).Limit(1).Find(&users)
+	if res.Error != nil {
+		return &DBError{res.Error.Error()}
+	}
+	if res.RowsAffected > 0 {
+		return &UserError{fmt.Sprintf("email %s already in use", email)}
+	}
+	return nil
+}
 
-	rL, err := NewRoleList(roles)
+// UserPatch lists the changes stored together by PatchUser, the empty username, password and roles
+// are left unchanged
+type UserPatch struct {
+	Username string
+	Password string
+	Roles    []string
+	// ReplaceRoles stores the roles even if empty, removing all the roles of the user
+	ReplaceRoles bool
+	// Status and Profile report whether the lifecycle state and the expiration time, and the profile
+	// of the user have been changed
+	Status  bool
+	Profile bool
+}
+
+// PatchUser stores the changes of the user in a single transaction, provided the stored user is still
+// at the revision u has been read at, otherwise a ConflictError is returned
+// the version is bumped, revoking the tokens of the user, by the changes of the username, password,
+// roles and status only
+func (uR *UserRepo) PatchUser(u *User, p *UserPatch) error {
+	if u.ID == 0 {
+		return &UserError{"user ID is required"}
+	}
+	if p.Profile {
+		if err := u.ValidateProfile(); err != nil {
+			return err
+		}
+	}
+	rL, err := NewRoleList(p.Roles)
 	if err != nil {
-		return nil, &UserError{error: err.Error()}
+		return &UserError{error: err.Error()}
 	}
-	if len(rL) > 0 {
+	bump := p.Status
+	if len(rL) > 0 || p.ReplaceRoles {
+		bump = bump || !rL.equal(u.Roles)
 		u.Roles = rL
 	}
-	if username != "" {
-		u.Username = username
+	if p.Username != "" && p.Username != u.Username {
+		// the new username cannot be taken by another user, its email, a service account or the
+		// break-glass account
+		if err := uR.ValidateUsername(p.Username); err != nil {
+			return &UserError{err.Error()}
+		}
+		u.Username = p.Username
+		bump = true
 	}
-	if password != "" {
-		if err := validatePassword(password); err != nil {
-			return nil, &UserError{fmt.Sprintf("password does not meet security requirements: %s", err.Error())}
+	if p.Password != "" {
+		if err := u.SetPassword(p.Password); err != nil {
+			return err
 		}
-		hashedPassword, _ := bcrypt.GenerateFromPassword([]byte(password), 8)
-		u.Password = string(hashedPassword)
+		bump = true
 	}
-	u.Version = u.Version + 1
-
-	id, err := strconv.Atoi(nameOrID)
-	if err == nil {
-		u.ID = uint(id)
+	if bump {
+		u.Version++
 	}
-	if err = uR.UpdateUser(u); err != nil {
-		return nil, err
+	err = uR.DB.Transaction(func(tx *gorm.DB) error {
+		// the email is validated before any write
+		if p.Profile {
+			if err := validateEmail(tx, u.Email, u.ID); err != nil {
+				return err
+			}
+		}
+		if err := bumpRevision(tx, u); err != nil {
+			return err
+		}
+		if err := updateUser(tx, u); err != nil {
+			return err
+		}
+		if p.Status {
+			if err := updateUserStatus(tx, u); err != nil {
+				return err
+			}
+		}
+		if p.Profile {
+			return updateUserProfile(tx, u)
+		}
+		return nil
+	})
+	switch err.(type) {
+	case nil, *UserError, *ConflictError, *DBError:
+		return err
 	}
-	return u, err
+	return &DBError{err.Error()}
 }
 
-// UpdateUser updates user information into the DB
+// UpdateUser updates user information into the DB, provided the stored user is still at the revision u
+// has been read at, otherwise a ConflictError is returned
 func (uR *UserRepo) UpdateUser(u *User) error {
 	if u.ID == 0 {
 		return &UserError{"user ID is required"}
 	}
-	res := uR.DB.Updates(u)
+	err := uR.DB.Transaction(func(tx *gorm.DB) error {
+		if err := bumpRevision(tx, u); err != nil {
+			return err
+		}
+		return updateUser(tx, u)
+	})
+	switch err.(type) {
+	case nil, *UserError, *ConflictError, *DBError:
+		return err
+	}
+	return &DBError{err.Error()}
+}
+
+// bumpRevision stores the next revision of the user provided the stored user is still at the revision u
+// has been read at, so that the concurrent changes are not overwritten
+func bumpRevision(db *gorm.DB, u *User) error {
+	if u.ID == 0 {
+		return &UserError{"user ID is required"}
+	}
+	// the roles of u are stored by the update of the user only
+	res := db.Model(&User{Model: gorm.Model{ID: u.ID}}).Where("revision = ?", u.Revision).UpdateColumn("revision", u.Revision+1)
 	if res.Error != nil {
 		return &DBError{res.Error.Error()}
 	}
+	if res.RowsAffected == 0 {
+		return &ConflictError{fmt.Sprintf("user %s changed concurrently", u.Username)}
+	}
+	u.Revision++
+	return nil
+}
+
+// updateUser stores the user, whose revision has been bumped
+func updateUser(db *gorm.DB, u *User) error {
+	if u.ID == 0 {
+		return &UserError{"user ID is required"}
+	}
+	res := db.Updates(u)
+	if res.Error != nil {
+		return emailError(res.Error, u.Email)
+	}
 	var roles RoleList
 	for _, r := range u.Roles {
 		roles = append(roles, r)
 	}
-	if err := uR.DB.Model(&u).Association("Roles").Replace(&roles); err != nil {
+	if err := db.Model(&u).Association("Roles").Replace(&roles); err != nil {
+		return &DBError{err.Error()}
+	}
+	return nil
+}
+
+// UpdateUserStatus stores the lifecycle state and the expiration time of the user, provided the stored
+// user is still at the revision u has been read at, otherwise a ConflictError is returned
+func (uR *UserRepo) UpdateUserStatus(u *User) error {
+	err := uR.DB.Transaction(func(tx *gorm.DB) error {
+		if err := bumpRevision(tx, u); err != nil {
+			return err
+		}
+		return updateUserStatus(tx, u)
+	})
+	switch err.(type) {
+	case nil, *UserError, *ConflictError, *DBError:
+		return err
+	}
+	return &DBError{err.Error()}
+}
+
+func updateUserStatus(db *gorm.DB, u *User) error {
+	if u.ID == 0 {
+		return &UserError{"user ID is required"}
+	}
+	res := db.Model(u).Select("status", "expires_at").Updates(u)
+	if res.Error != nil {
 		return &DBError{res.Error.Error()}
 	}
 	return nil
 }
 
+// UpdateUserProfile stores the core profile and the custom attributes of the user, provided the stored
+// user is still at the revision u has been read at, otherwise a ConflictError is returned
+func (uR *UserRepo) UpdateUserProfile(u *User) error {
+	if err := u.ValidateProfile(); err != nil {
+		return err
+	}
+	err := uR.DB.Transaction(func(tx *gorm.DB) error {
+		if err := validateEmail(tx, u.Email, u.ID); err != nil {
+			return err
+		}
+		if err := bumpRevision(tx, u); err != nil {
+			return err
+		}
+		return updateUserProfile(tx, u)
+	})
+	switch err.(type) {
+	case nil, *UserError, *ConflictError, *DBError:
+		return err
+	}
+	return &DBError{err.Error()}
+}
+
+// updateUserProfile stores the profile of the user, whose email has been validated
+func updateUserProfile(db *gorm.DB, u *User) error {
+	if u.ID == 0 {
+		return &UserError{"user ID is required"}
+	}
+	if u.Attributes == nil {
+		u.Attributes = make(map[string]interface{})
+	}
+	res := db.Model(u).Select("display_name", "email", "email_verified", "phone", "locale", "team", "attributes").Updates(u)
+	if res.Error != nil {
+		return emailError(res.Error, u.Email)
+	}
+	return nil
+}
+
 // GetUserByNameOrID retrieves user information by ID or username
 func (uR *UserRepo) GetUserByNameOrID(nameOrID string) (*User, error) {
 	user := &User{}
@@ -199,29 +595,130 @@ func (uR *UserRepo) GetUserByNameOrID(nameOrID string) (*User, error) {
 	return user, nil
 }
 
-// GetUsers returns the list of User present in DB
+// GetUserByVerifiedEmail retrieves the user whose verified email is the given one
+func (uR *UserRepo) GetUserByVerifiedEmail(email string) (*User, error) {
+	user := &User{}
+	res := uR.DB.Preload("Roles").Where("lower(email) = lower(?) AND email_verified", email).Limit(1).Find(user)
+	if res.Error != nil {
+		return nil, &DBError{res.Error.Error()}
+	}
+	if res.RowsAffected == 0 {
+		return nil, &NotFoundError{fmt.Sprintf("user with email %s not present in database", email)}
+	}
+	return user, nil
+}
+
+// GetUsers returns the list of User present in DB, with their roles
 func (uR *UserRepo) GetUsers() ([]*User, error) {
 	var users []*User
-	// TODO: Query to all the users won't return the Roles information
-	// there for sure is a way to do that, without running a query to each user individually
-	//var user User
-	//err := GetDB().Table(user.TableName()).Preload("Roles").Find(&users).Error
-	//if err != nil {
-	//	return nil, &DBError{err.Error()}
-	//}
-	usersID := uR.GetUsersID()
-	for _, id := range usersID {
-		u, _ := uR.GetUserByNameOrID(strconv.Itoa(int(id)))
-		users = append(users, u)
+	res := uR.DB.Preload("Roles").Order("id").Find(&users)
+	if res.Error != nil {
+		return nil, &DBError{res.Error.Error()}
 	}
 	return users, nil
 }
 
+// UserQuery filters, sorts and pages the users listed by FindUsers
+type UserQuery struct {
+	// Username matches the users whose username contains it, ignoring the case
+	Username string
+	// Role matches the users having the role
+	Role string
+	// Deleted lists the soft deleted users instead of the active ones
+	Deleted bool
+	// Sort lists the sort fields, the fields prefixed by - are sorted in descending order
+	Sort []string
+	// PageNumber starts from 1, the users are not paged if PageSize is 0
+	PageNumber int
+	PageSize   int
+}
+
+// userSortFields are the fields the users are sorted by
+var userSortFields = map[string]bool{
+	"id":           true,
+	"username":     true,
+	"status":       true,
+	"created_at":   true,
+	"updated_at":   true,
+	"email":        true,
+	"display_name": true,
+	"team":         true,
+}
+
+// order returns the order clause of the query, ended by the id so that the pages are stable
+func (q *UserQuery) order() (string, error) {
+	var clauses []string
+	for _, field := range q.Sort {
+		direction := ""
+		if strings.HasPrefix(field, "-") {
+			field, direction = field[1:], " desc"
+		}
+		if !userSortFields[field] {
+			return "", &UserError{fmt.Sprintf("invalid sort field %s", field)}
+		}
+		if field == "id" {
+			return strings.Join(append(clauses, "id"+direction), ", "), nil
+		}
+		clauses = append(clauses, field+direction)
+	}
+	return strings.Join(append(clauses, "id"), ", "), nil
+}
+
+// FindUsers returns the page of users matching the query with their roles, and the number of users matching
+// the query in all the pages
+func (uR *UserRepo) FindUsers(q *UserQuery) ([]*User, int64, error) {
+	order, err := q.order()
+	if err != nil {
+		return nil, 0, err
+	}
+	var roleID uint
+	if q.Role != "" {
+		rL, err := NewRoleList([]string{q.Role})
+		if err != nil {
+			return nil, 0, &UserError{err.Error()}
+		}
+		roleID = rL[0].ID
+	}
+	filters := func(db *gorm.DB) *gorm.DB {
+		if q.Deleted {
+			db = db.Unscoped().Where("deleted_at IS NOT NULL")
+		}
+		if q.Username != "" {
+			// the wildcards of the filter are matched literally
+			pattern := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(strings.ToLower(q.Username))
+			db = db.Where("lower(username) LIKE ?", "%"+pattern+"%")
+		}
+		if roleID != 0 {
+			db = db.Where("id IN (?)", uR.DB.Table("user_roles").Select("user_id").Where("role_id = ?", roleID))
+		}
+		return db
+	}
+	var total int64
+	res := uR.DB.Model(&User{}).Scopes(filters).Count(&total)
+	if res.Error != nil {
+		return nil, 0, &DBError{res.Error.Error()}
+	}
+	var users []*User
+	tx := uR.DB.Scopes(filters).Preload("Roles").Order(order)
+	if q.PageSize > 0 {
+		pageNumber := q.PageNumber
+		if pageNumber < 1 {
+			pageNumber = 1
+		}
+		tx = tx.Offset((pageNumber - 1) * q.PageSize).Limit(q.PageSize)
+	}
+	res = tx.Find(&users)
+	if res.Error != nil {
+		return nil, 0, &DBError{res.Error.Error()}
+	}
+	return users, total, nil
+}
+
 // GetUsersID returns the list of User IDs present in DB
 func (uR *UserRepo) GetUsersID() []uint {
 	var users []*User
 	var user User
-	uR.DB.Table(user.TableName()).Select("id").Scan(&users)
+	uR.DB.Model(&user).Select("id").Scan(&users)
 	var usersID []uint
 	for _, u := range users {
 		usersID = append(usersID, u.ID)
@@ -229,9 +726,13 @@ func (uR *UserRepo) GetUsersID() []uint {
 	return usersID
 }
 
-// DeleteUser remove specified user from DB
+// DeleteUser soft deletes the specified user, which keeps its roles and its username until it is restored
+// or purged, the user with id 1 cannot be deleted
 func (uR *UserRepo) DeleteUser(user *User) error {
-	res := uR.DB.Unscoped().Select("Roles").Delete(user)
+	if user.ID == 1 {
+		return &UserError{"user with id 1 cannot be deleted"}
+	}
+	res := uR.DB.Delete(user)
 	if res.Error != nil {
 		return &DBError{res.Error.Error()}
 	}
@@ -241,11 +742,78 @@ func (uR *UserRepo) DeleteUser(user *User) error {
 	return nil
 }
 
+// RestoreUserByNameOrID restores a soft deleted user given its ID or username, the tokens issued before
+// the deletion stay revoked
+func (uR *UserRepo) RestoreUserByNameOrID(nameOrID string) (*User, error) {
+	user := &User{}
+	tx := uR.DB.Unscoped().Preload("Roles").Where("deleted_at IS NOT NULL")
+	if id, err := strconv.Atoi(nameOrID); err == nil {
+		tx = tx.Where("id = ?", id)
+	} else {
+		tx = tx.Where("username = ?", nameOrID)
+	}
+	res := tx.Limit(1).Find(user)
+	if res.Error != nil {
+		return nil, &DBError{res.Error.Error()}
+	}
+	if res.RowsAffected == 0 {
+		return nil, &NotFoundError{fmt.Sprintf("deleted user %s not present in database", nameOrID)}
+	}
+	user.Version = user.Version + 1
+	user.Revision = user.Revision + 1
+	err := uR.DB.Transaction(func(tx *gorm.DB) error {
+		if res := tx.Unscoped().Model(user).Updates(map[string]interface{}{"deleted_at": nil, "version": user.Version, "revision": user.Revision}); res.Error != nil {
+			return res.Error
+		}
+		// the personal access tokens are not versioned, they are revoked for good
+		return tx.Unscoped().Where("username = ?", user.Username).Delete(&PersonalAccessToken{}).Error
+	})
+	if err != nil {
+		return nil, &DBError{err.Error()}
+	}
+	user.DeletedAt = gorm.DeletedAt{}
+	return user, nil
+}
+
+// purgeDeletedUsers permanently removes the users deleted for longer than the retention period along
+// with their personal access tokens, sessions and elevations, and records an event for each of them
+func purgeDeletedUsers(db *gorm.DB, retention time.Duration) error {
+	if retention == 0 {
+		return nil
+	}
+	var users []*User
+	res := db.Unscoped().Where("deleted_at < ?", time.Now().Add(-retention)).Find(&users)
+	if res.Error != nil {
+		return res.Error
+	}
+	events := &EventRepo{DB: db}
+	for _, u := range users {
+		// the rows keyed by username would otherwise be inherited by a new user of the same name
+		err := db.Transaction(func(tx *gorm.DB) error {
+			for _, dependent := range []interface{}{&PersonalAccessToken{}, &Elevation{}} {
+				if err := tx.Unscoped().Where("username = ?", u.Username).Delete(dependent).Error; err != nil {
+					return err
+				}
+			}
+			// the sessions of the external identities with the same username are kept
+			if err := tx.Unscoped().Where("user_id = ? AND identity_id = 0", u.ID).Delete(&Session{}).Error; err != nil {
+				return err
+			}
+			return tx.Unscoped().Select("Roles").Delete(u).Error
+		})
+		if err != nil {
+			return err
+		}
+		if err := events.CreateUserPurgeEvent(u.Username); err != nil {
+			log.WithError(err).Warnf("failed to store user event")
+		}
+	}
+	log.Debugf("purged %d deleted users", len(users))
+	return nil
+}
+
 // DeleteUserByID remove user from DB given user ID
 func (uR *UserRepo) DeleteUserByID(id int) error {
-	if id == 1 {
-		return &UserError{"user with id 1 cannot be deleted"}
-	}
 	return uR.DeleteUser(&User{Model: gorm.Model{ID: uint(id)}})
 }
 
@@ -302,12 +870,20 @@ func (uR *UserRepo) DeleteAllUsers() error {
 
 func (uR *UserRepo) GetAndValidateUser(username string, password string) (*User, bool) {
 	storedUser, err := uR.GetUserByNameOrID(username)
+	if _, ok := err.(*NotFoundError); ok && strings.Contains(username, "@") {
+		// the users log in with their verified email as well
+		storedUser, err = uR.GetUserByVerifiedEmail(username)
+	}
 	if err != nil {
 		return nil, false
 	}
 	if err = bcrypt.CompareHashAndPassword([]byte(storedUser.Password), []byte(password)); err != nil {
 		return nil, false
 	}
+	// the disabled, locked, expired and pending accounts cannot log in
+	if !storedUser.Active() {
+		return nil, false
+	}
 	return storedUser, true
 }
 